@@ -0,0 +1,259 @@
+// The admin package provides an HTTP server for inspecting a running
+// flowpipeline process. It serves the following endpoints:
+//
+//   - `/status`: version, uptime and the state of every segment of all
+//     pipelines as JSON, including queue depths, flow counters and the
+//     segments of embedded pipelines such as branches
+//   - `/config`: the loaded configuration as YAML, with credentials redacted
+//   - `/capture`: captures the flows emitted by the segments at a position
+//     matching a flowfilter expression, streamed as JSON lines or written to
+//     a file in the capture directory, see Server.CaptureDir
+//   - `/healthz`: liveness, always succeeds while the process is serving
+//   - `/readyz`: readiness, fails if any pipeline has been closed or any of
+//     their segments implementing segments.HealthReporter reports an error
+//   - `/metrics`: the segment metrics in the Prometheus format
+//   - `/debug/pprof/`: the runtime profiles of net/http/pprof
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gopkg.in/yaml.v2"
+
+	"github.com/BelWue/flowpipeline/pipeline"
+	"github.com/BelWue/flowpipeline/pipeline/config"
+	"github.com/BelWue/flowpipeline/segments"
+)
+
+// Maximum time spent asking segments for their health on /readyz.
+const ReadinessTimeout = 5 * time.Second
+
+// A running pipeline as inspected by the Server, implemented by both
+// pipeline.Pipeline and pipeline.ReloadablePipeline.
+type Pipeline interface {
+	Status() []pipeline.SegmentStatus
+	Health(ctx context.Context) error
+	Done() <-chan struct{}
+	Attach(tap *pipeline.Tap) int
+}
+
+// The running instances of a pipeline defined in the configuration. The name
+// is empty for configurations defining a single list of segments.
+type NamedPipeline struct {
+	Name      string
+	Instances []Pipeline
+}
+
+// Serves the admin endpoints for a fixed set of pipelines. The configuration
+// can be replaced once the pipelines are reloaded.
+type Server struct {
+	CaptureDir string // directory captures may be written to, captures to files are rejected if empty
+
+	version   string
+	started   time.Time
+	pipelines []NamedPipeline
+	mutex     sync.RWMutex
+	config    []byte // redacted YAML
+}
+
+// Creates a Server for the provided pipelines, reporting the provided version
+// and its creation time as the start of the process.
+func NewServer(version string, pipelines []NamedPipeline) *Server {
+	return &Server{version: version, started: time.Now(), pipelines: pipelines}
+}
+
+// Sets the configuration served on /config.
+func (server *Server) SetConfig(pipelineReprs []config.PipelineRepr) error {
+	redacted, err := redactConfig(pipelineReprs)
+	if err != nil {
+		return err
+	}
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.config = redacted
+	return nil
+}
+
+// Returns the handler serving all admin endpoints.
+func (server *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", server.serveStatus)
+	mux.HandleFunc("/config", server.serveConfig)
+	mux.HandleFunc("/capture", server.serveCapture)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", server.serveReadiness)
+	mux.Handle("/metrics", promhttp.HandlerFor(segments.MetricsRegistry, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// The response of /status.
+type Status struct {
+	Version   string           `json:"version"`
+	Started   time.Time        `json:"started"`
+	Uptime    float64          `json:"uptime_seconds"`
+	Pipelines []PipelineStatus `json:"pipelines"`
+}
+
+// The state of all instances of a pipeline defined in the configuration.
+type PipelineStatus struct {
+	Name      string           `json:"name,omitempty"`
+	Instances []InstanceStatus `json:"instances"`
+}
+
+// The state of a single instance of a pipeline.
+type InstanceStatus struct {
+	Running  bool                     `json:"running"`
+	Segments []pipeline.SegmentStatus `json:"segments"`
+}
+
+// Collects the current state of all pipelines.
+func (server *Server) Status() Status {
+	status := Status{
+		Version: server.version,
+		Started: server.started,
+		Uptime:  time.Since(server.started).Seconds(),
+	}
+	for _, named := range server.pipelines {
+		pipelineStatus := PipelineStatus{Name: named.Name}
+		for _, instance := range named.Instances {
+			pipelineStatus.Instances = append(pipelineStatus.Instances, InstanceStatus{
+				Running:  !isClosed(instance),
+				Segments: instance.Status(),
+			})
+		}
+		status.Pipelines = append(status.Pipelines, pipelineStatus)
+	}
+	return status
+}
+
+// Checks whether all pipelines are running and all of their segments report
+// to be healthy. Returns the joined errors of all instances otherwise.
+func (server *Server) Ready(ctx context.Context) error {
+	var errs []error
+	for _, named := range server.pipelines {
+		for i, instance := range named.Instances {
+			err := instance.Health(ctx)
+			if isClosed(instance) {
+				err = errors.New("pipeline has been closed")
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", instanceName(named.Name, i), err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (server *Server) serveStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(server.Status()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (server *Server) serveConfig(w http.ResponseWriter, r *http.Request) {
+	server.mutex.RLock()
+	defer server.mutex.RUnlock()
+	if server.config == nil {
+		http.Error(w, "no configuration loaded", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(server.config)
+}
+
+func (server *Server) serveReadiness(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), ReadinessTimeout)
+	defer cancel()
+	if err := server.Ready(ctx); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+func isClosed(instance Pipeline) bool {
+	select {
+	case <-instance.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+// Returns how an instance is referred to in errors, e.g. `pipelines[0]` or
+// `enrich.pipelines[1]` for a named pipeline.
+func instanceName(name string, index int) string {
+	if name == "" {
+		return fmt.Sprintf("pipelines[%d]", index)
+	}
+	return fmt.Sprintf("%s.pipelines[%d]", name, index)
+}
+
+// Marshals the configuration to YAML, replacing the values of all parameters
+// listed in config.RedactedParameters, including those of embedded pipelines.
+// Configurations defining a single list of segments are marshalled as such.
+func redactConfig(pipelineReprs []config.PipelineRepr) ([]byte, error) {
+	if len(pipelineReprs) == 1 && pipelineReprs[0].Name == "" {
+		return yaml.Marshal(redactSegments(pipelineReprs[0].Segments))
+	}
+	redacted := make([]config.PipelineRepr, len(pipelineReprs))
+	for i, pipelineRepr := range pipelineReprs {
+		redacted[i] = pipelineRepr
+		redacted[i].Segments = redactSegments(pipelineRepr.Segments)
+	}
+	return yaml.Marshal(redacted)
+}
+
+// Returns a copy of the provided segment representations with all parameters
+// listed in config.RedactedParameters replaced.
+func redactSegments(segmentReprs []config.SegmentRepr) []config.SegmentRepr {
+	if segmentReprs == nil {
+		return nil
+	}
+	redacted := make([]config.SegmentRepr, len(segmentReprs))
+	for i, segmentRepr := range segmentReprs {
+		redacted[i] = segmentRepr
+		if segmentRepr.Config.Config != nil {
+			redacted[i].Config.Config = make(map[string]string, len(segmentRepr.Config.Config))
+			for key, value := range segmentRepr.Config.Config {
+				if slices.Contains(config.RedactedParameters, key) {
+					value = "<redacted>"
+				}
+				redacted[i].Config.Config[key] = value
+			}
+		}
+		redacted[i].If = redactSegments(segmentRepr.If)
+		redacted[i].Then = redactSegments(segmentRepr.Then)
+		redacted[i].Else = redactSegments(segmentRepr.Else)
+		redacted[i].Default = redactSegments(segmentRepr.Default)
+		redacted[i].DeadLetter = redactSegments(segmentRepr.DeadLetter)
+		redacted[i].Branches = slices.Clone(segmentRepr.Branches)
+		for j := range redacted[i].Branches {
+			redacted[i].Branches[j].Segments = redactSegments(segmentRepr.Branches[j].Segments)
+		}
+		redacted[i].Cases = slices.Clone(segmentRepr.Cases)
+		for j := range redacted[i].Cases {
+			redacted[i].Cases[j].Segments = redactSegments(segmentRepr.Cases[j].Segments)
+		}
+	}
+	return redacted
+}
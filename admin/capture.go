@@ -0,0 +1,202 @@
+package admin
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/BelWue/flowfilter/parser"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	"github.com/BelWue/flowpipeline/pb"
+	"github.com/BelWue/flowpipeline/pipeline"
+	"github.com/BelWue/flowpipeline/segments/filter/flowfilter"
+)
+
+// Limits of a capture if not requested otherwise. A capture always ends once
+// either of its limits is reached.
+const (
+	DefaultCaptureFlows    = 100
+	DefaultCaptureDuration = time.Minute
+)
+
+// A capture as requested on /capture.
+type captureRequest struct {
+	pipeline string // name of the pipeline, empty for configurations defining a single list of segments
+	file     string // name of the file in the capture directory, streamed if empty
+	options  pipeline.TapOptions
+}
+
+// Reads a capture request from the query parameters `pipeline`, `position`,
+// `filter`, `flows`, `duration` and `file`.
+func parseCaptureRequest(query url.Values) (captureRequest, error) {
+	request := captureRequest{
+		pipeline: query.Get("pipeline"),
+		file:     query.Get("file"),
+		options: pipeline.TapOptions{
+			Position:    query.Get("position"),
+			MaxFlows:    DefaultCaptureFlows,
+			MaxDuration: DefaultCaptureDuration,
+		},
+	}
+	if request.options.Position == "" {
+		return request, fmt.Errorf("the 'position' parameter is required")
+	}
+	if flows := query.Get("flows"); flows != "" {
+		maxFlows, err := strconv.Atoi(flows)
+		if err != nil || maxFlows <= 0 {
+			return request, fmt.Errorf("the 'flows' parameter must be a positive number")
+		}
+		request.options.MaxFlows = maxFlows
+	}
+	if duration := query.Get("duration"); duration != "" {
+		maxDuration, err := time.ParseDuration(duration)
+		if err != nil || maxDuration <= 0 {
+			return request, fmt.Errorf("the 'duration' parameter must be a positive duration")
+		}
+		request.options.MaxDuration = maxDuration
+	}
+	if filter := query.Get("filter"); filter != "" {
+		match, err := newMatcher(filter)
+		if err != nil {
+			return request, err
+		}
+		request.options.Match = match
+	}
+	if request.file != "" && (filepath.Base(request.file) != request.file || request.file == "." || request.file == "..") {
+		return request, fmt.Errorf("the 'file' parameter must be a file name without directories")
+	}
+	return request, nil
+}
+
+// Returns a function matching flows against a flowfilter expression. It can
+// be called concurrently, as the expression holds the evaluation state.
+func newMatcher(filter string) (func(*pb.EnrichedFlow) bool, error) {
+	expression, err := parser.Parse(filter)
+	if err != nil {
+		return nil, fmt.Errorf("syntax error in filter expression: %w", err)
+	}
+	visitor := &flowfilter.Filter{}
+	if _, err := visitor.CheckFlow(expression, &pb.EnrichedFlow{}); err != nil {
+		return nil, fmt.Errorf("semantic error in filter expression: %w", err)
+	}
+	var mutex sync.Mutex
+	return func(msg *pb.EnrichedFlow) bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		match, _ := visitor.CheckFlow(expression, msg)
+		return match
+	}, nil
+}
+
+// Attaches a tap as requested using the query parameters, see
+// parseCaptureRequest. The captured flows are either streamed as JSON lines,
+// or written to a file in the capture directory in the background.
+func (server *Server) serveCapture(w http.ResponseWriter, r *http.Request) {
+	request, err := parseCaptureRequest(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var file *os.File
+	if request.file != "" {
+		if server.CaptureDir == "" {
+			http.Error(w, "captures to files are disabled", http.StatusForbidden)
+			return
+		}
+		file, err = os.OpenFile(filepath.Join(server.CaptureDir, request.file), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+	}
+	tap, err := server.attach(request)
+	if err != nil {
+		if file != nil {
+			file.Close()
+			os.Remove(file.Name())
+		}
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if file != nil {
+		go func() {
+			defer file.Close()
+			writer := bufio.NewWriter(file)
+			writeCapture(tap, writer, writer.Flush, nil)
+			log.Info().Msgf("Admin: Captured %d flows at %s to '%s', missed %d.", tap.Delivered(), request.options.Position, file.Name(), tap.Missed())
+		}()
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, "capturing to %s\n", file.Name())
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Trailer", "Flowpipeline-Capture-Missed")
+	flush := func() error {
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+		return nil
+	}
+	writeCapture(tap, w, flush, r.Context().Done())
+	w.Header().Set("Flowpipeline-Capture-Missed", strconv.FormatInt(tap.Missed(), 10))
+}
+
+// Attaches a tap to all instances of the requested pipeline.
+func (server *Server) attach(request captureRequest) (*pipeline.Tap, error) {
+	for _, named := range server.pipelines {
+		if named.Name != request.pipeline {
+			continue
+		}
+		tap := pipeline.NewTap(request.options)
+		attached := 0
+		for _, instance := range named.Instances {
+			attached += instance.Attach(tap)
+		}
+		if attached == 0 {
+			tap.Close()
+			return nil, fmt.Errorf("no segment at position '%s'", request.options.Position)
+		}
+		return tap, nil
+	}
+	return nil, fmt.Errorf("no pipeline named '%s'", request.pipeline)
+}
+
+// Writes the flows captured by a tap as JSON lines until it is closed, or
+// until cancel is closed. Flushes whenever no further flows are waiting.
+func writeCapture(tap *pipeline.Tap, w io.Writer, flush func() error, cancel <-chan struct{}) {
+	defer tap.Close()
+	for {
+		select {
+		case msg, ok := <-tap.Flows():
+			if !ok {
+				flush()
+				return
+			}
+			data, err := protojson.Marshal(msg)
+			if err != nil {
+				log.Warn().Err(err).Msg("Admin: Skipping a captured flow, failed to recode protobuf as JSON: ")
+				continue
+			}
+			if _, err := w.Write(append(data, '\n')); err != nil {
+				return
+			}
+			if len(tap.Flows()) == 0 {
+				if err := flush(); err != nil {
+					return
+				}
+			}
+		case <-cancel:
+			return
+		}
+	}
+}
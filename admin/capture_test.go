@@ -0,0 +1,116 @@
+package admin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protojson"
+
+	"github.com/BelWue/flowpipeline/pb"
+	"github.com/BelWue/flowpipeline/pipeline"
+	"github.com/BelWue/flowpipeline/segments/pass"
+)
+
+// Starts a pipeline which is fed flows alternating between tcp and udp until
+// the returned function is called.
+func feedPipeline() (*pipeline.Pipeline, func()) {
+	p := pipeline.New(&pass.Pass{})
+	p.Start()
+	p.AutoDrain()
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			case p.In <- &pb.EnrichedFlow{Proto: uint32(6 + (i%2)*11)}:
+			}
+		}
+	}()
+	return p, func() {
+		close(stop)
+		wg.Wait()
+		p.Close()
+	}
+}
+
+func TestServerCapture(t *testing.T) {
+	p, stop := feedPipeline()
+	defer stop()
+	server := httptest.NewServer(NewServer("", []NamedPipeline{{Instances: []Pipeline{p}}}).Handler())
+	defer server.Close()
+
+	code, body := get(t, server, "/capture?position=segments[0]&filter=proto%20tcp&flows=3")
+	if code != http.StatusOK {
+		t.Fatalf("([error] Admin server responded with %d on /capture: %s", code, body)
+	}
+	lines := strings.Split(strings.TrimSpace(body), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("([error] Capture returned %d flows, should be 3: %s", len(lines), body)
+	}
+	for _, line := range lines {
+		msg := &pb.EnrichedFlow{}
+		if err := protojson.Unmarshal([]byte(line), msg); err != nil || msg.Proto != 6 {
+			t.Errorf("([error] Capture returned a flow not matching the filter: %s", line)
+		}
+	}
+}
+
+func TestServerCaptureFile(t *testing.T) {
+	p, stop := feedPipeline()
+	defer stop()
+	adminServer := NewServer("", []NamedPipeline{{Instances: []Pipeline{p}}})
+	server := httptest.NewServer(adminServer.Handler())
+	defer server.Close()
+
+	if code, _ := get(t, server, "/capture?position=segments[0]&file=capture.json"); code != http.StatusForbidden {
+		t.Errorf("([error] Admin server responded with %d on /capture to a file without a capture directory, should be 403.", code)
+	}
+	adminServer.CaptureDir = t.TempDir()
+	if code, body := get(t, server, "/capture?position=segments[0]&file=capture.json&flows=2"); code != http.StatusAccepted {
+		t.Fatalf("([error] Admin server responded with %d on /capture to a file: %s", code, body)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		written, _ := os.ReadFile(filepath.Join(adminServer.CaptureDir, "capture.json"))
+		if strings.Count(string(written), "\n") == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("([error] Capture did not write 2 flows to the file: %s", written)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if code, _ := get(t, server, "/capture?position=segments[0]&file=capture.json"); code != http.StatusConflict {
+		t.Errorf("([error] Admin server responded with %d on /capture to an existing file, should be 409.", code)
+	}
+}
+
+func TestServerCaptureErrors(t *testing.T) {
+	p := pipeline.New(&pass.Pass{})
+	server := httptest.NewServer(NewServer("", []NamedPipeline{{Instances: []Pipeline{p}}}).Handler())
+	defer server.Close()
+
+	for query, expected := range map[string]int{
+		"":                                      http.StatusBadRequest,
+		"position=segments[0]&flows=-1":         http.StatusBadRequest,
+		"position=segments[0]&duration=forever": http.StatusBadRequest,
+		"position=segments[0]&filter=proto%20tcp)": http.StatusBadRequest,
+		"position=segments[0]&file=../capture":     http.StatusBadRequest,
+		"position=segments[1]":                     http.StatusNotFound,
+		"position=segments[0]&pipeline=enrich":     http.StatusNotFound,
+	} {
+		if code, body := get(t, server, "/capture?"+query); code != expected {
+			t.Errorf("([error] Admin server responded with %d on /capture?%s, should be %d: %s", code, query, expected, body)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+// The builder package constructs pipelines from Go code, for use when
+// embedding flowpipeline in other programs. Segments are configured using the
+// typed Options provided by their packages, which share all validation with
+// configuration files:
+//
+//	p, err := builder.New().
+//		Add(flowfilter.Options{Filter: "proto tcp"}).
+//		AddWith(dropfields.Options{Policy: dropfields.PolicyDrop, Fields: []string{"SrcAddr"}}, builder.Settings{Jobs: 4}).
+//		Build(ctx)
+//	if err != nil {
+//		return err
+//	}
+//	drops := p.GetDrop()
+//	p.Start()
+//
+// Importing a segment's package registers it, so only the segments used need
+// to be imported. Segments without typed options can be added using Segment.
+package builder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/BelWue/flowpipeline/pipeline"
+	"github.com/BelWue/flowpipeline/pipeline/config"
+	"github.com/BelWue/flowpipeline/segments"
+)
+
+// Options of any registered segment given by its name and parameters, for
+// segments which do not provide typed options.
+type Segment struct {
+	Name   string
+	Config map[string]string
+}
+
+func (options Segment) SegmentName() string {
+	return options.Name
+}
+
+func (options Segment) SegmentConfig() map[string]string {
+	return options.Config
+}
+
+// Settings available to every segment regardless of its options, see the
+// README on parallel jobs and buffering.
+type Settings struct {
+	Jobs     int                    // number of parallel instances of the segment
+	ShardBy  []string               // flow fields determining the job of each flow
+	Reorder  *config.ReorderOptions // restores the order of flows after the jobs if set
+	Buffer   int                    // capacity of the segment's input channel
+	Overflow string                 // what to do if the buffer is full, see config.OverflowPolicies
+}
+
+// Collects segments to build a Pipeline from. All errors are reported by
+// Build, so calls can be chained.
+type Builder struct {
+	name         string
+	segmentReprs []config.SegmentRepr
+	batch        *config.BatchOptions
+	errs         []error
+}
+
+// Creates an empty Builder.
+func New() *Builder {
+	return &Builder{}
+}
+
+// Sets the name of the pipeline, which prefixes the positions of its
+// segments in errors and metrics. Instances of a `bus_subscribe` segment at
+// the same position of pipelines with the same name share a subscription.
+func (builder *Builder) Name(name string) *Builder {
+	builder.name = name
+	return builder
+}
+
+// Appends a segment configured by the provided options.
+func (builder *Builder) Add(options segments.Options) *Builder {
+	return builder.AddWith(options, Settings{})
+}
+
+// Appends a segment configured by the provided options and settings.
+func (builder *Builder) AddWith(options segments.Options, settings Settings) *Builder {
+	if options == nil {
+		builder.errs = append(builder.errs, fmt.Errorf("%s: no segment options given", builder.position(len(builder.segmentReprs))))
+		return builder
+	}
+	builder.segmentReprs = append(builder.segmentReprs, config.SegmentRepr{
+		Name:     options.SegmentName(),
+		Config:   config.Config{Config: options.SegmentConfig()},
+		Jobs:     settings.Jobs,
+		ShardBy:  settings.ShardBy,
+		Reorder:  settings.Reorder,
+		Buffer:   settings.Buffer,
+		Overflow: settings.Overflow,
+		Literal:  true,
+	})
+	return builder
+}
+
+// Uses the batched transport between the segments of the pipeline, see the
+// README on batched transport.
+func (builder *Builder) Batched(options config.BatchOptions) *Builder {
+	builder.batch = &options
+	return builder
+}
+
+// Builds the pipeline without starting it. All problems found are returned
+// as a joined list of errors, each one indicating the segment's position.
+// Once ctx is done, the contexts of all segments are canceled, making them
+// give up flushing just like once the deadline passed to Shutdown has passed.
+// Closing the pipeline is left to the caller, using its Close or Shutdown
+// methods, as only the caller knows when it stopped sending flows.
+func (builder *Builder) Build(ctx context.Context) (*pipeline.Pipeline, error) {
+	if len(builder.errs) > 0 {
+		return nil, errors.Join(builder.errs...)
+	}
+	var p *pipeline.Pipeline
+	var err error
+	if builder.batch == nil {
+		p, err = pipeline.NewFromRepr(builder.segmentReprs, builder.path())
+	} else if err = builder.batch.Validate(); err == nil {
+		p, err = pipeline.NewBatchedFromRepr(builder.segmentReprs, builder.path(), *builder.batch)
+	}
+	if err != nil {
+		return nil, err
+	}
+	coordinator := segments.NewShutdownCoordinator(p.Close)
+	p.SetShutdownCoordinator(coordinator)
+	go func() {
+		select {
+		case <-ctx.Done():
+			coordinator.Expire()
+		case <-p.Done():
+		}
+	}()
+	return p, nil
+}
+
+// Returns the position of the list of segments.
+func (builder *Builder) path() string {
+	if builder.name == "" {
+		return "segments"
+	}
+	return builder.name + ".segments"
+}
+
+// Returns the position of the segment at the provided index.
+func (builder *Builder) position(index int) string {
+	return fmt.Sprintf("%s[%d]", builder.path(), index)
+}
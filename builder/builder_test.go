@@ -0,0 +1,109 @@
+package builder
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BelWue/flowpipeline/pb"
+	"github.com/BelWue/flowpipeline/segments"
+	"github.com/BelWue/flowpipeline/segments/filter/flowfilter"
+	"github.com/BelWue/flowpipeline/segments/modify/dropfields"
+	"github.com/BelWue/flowpipeline/segments/output/json"
+)
+
+func TestBuilder(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "flows.json")
+	p, err := New().
+		Add(flowfilter.Options{Filter: "proto tcp"}).
+		AddWith(dropfields.Options{Policy: dropfields.PolicyDrop, Fields: []string{"InIf"}}, Settings{Jobs: 2}).
+		Add(json.Options{Filename: filename}).
+		Build(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	drops := p.GetDrop()
+	p.Start()
+
+	p.In <- &pb.EnrichedFlow{Proto: 6, InIf: 1}
+	if fmsg := <-p.Out; fmsg.InIf != 0 {
+		t.Errorf("([error] Built pipeline did not apply the segment options, InIf is %d.", fmsg.InIf)
+	}
+	p.In <- &pb.EnrichedFlow{Proto: 17, InIf: 1}
+	if fmsg := <-drops; fmsg.Proto != 17 {
+		t.Errorf("([error] Built pipeline did not drop the udp flow, got proto %d.", fmsg.Proto)
+	}
+	p.Close()
+
+	written, _ := os.ReadFile(filename)
+	if lines := strings.Count(string(written), "\n"); lines != 1 {
+		t.Errorf("([error] Built pipeline wrote %d flows, should be 1.", lines)
+	}
+}
+
+func TestBuilderErrors(t *testing.T) {
+	_, err := New().
+		Name("embedded").
+		Add(flowfilter.Options{Filter: "proto tcp )"}).
+		Add(dropfields.Options{Policy: dropfields.Policy(42)}).
+		AddWith(Segment{Name: "pass"}, Settings{Overflow: "drop-oldest"}).
+		Add(Segment{Name: "flowfliter"}).
+		Build(context.Background())
+	if err == nil {
+		t.Fatal("([error] Builder with invalid options did not fail.")
+	}
+	for _, expected := range []string{
+		"embedded.segments[0] (flowfilter): syntax error in filter expression",
+		"embedded.segments[1] (dropfields): the 'policy' parameter is required",
+		"embedded.segments[2] (pass): overflow policy 'drop-oldest' requires a buffer",
+		"embedded.segments[3] (flowfliter): could not find a segment named 'flowfliter'",
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("([error] Builder error '%s' was not reported: %s", expected, err)
+		}
+	}
+
+	_, err = New().Add(nil).Build(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "segments[0]: no segment options given") {
+		t.Errorf("([error] Builder did not reject missing options: %v", err)
+	}
+}
+
+func TestBuilderLiteralConfig(t *testing.T) {
+	t.Setenv("PROTO", "udp")
+	p, err := New().Add(flowfilter.Options{Filter: "proto $PROTO"}).Build(context.Background())
+	if err == nil {
+		p.Close()
+		t.Error("([error] Builder expanded a variable in segment options.")
+	}
+}
+
+func TestBuilderContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	p, err := New().Add(Segment{Name: "pass"}).Build(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Start()
+	p.In <- &pb.EnrichedFlow{Type: 3}
+	<-p.Out
+	cancel()
+	select {
+	case <-p.SegmentList[0].(interface{ Context() context.Context }).Context().Done():
+	case <-time.After(time.Second):
+		t.Fatal("([error] Segment context of the built pipeline was not canceled along with its context.")
+	}
+	// the input is still open until the caller closes it
+	p.In <- &pb.EnrichedFlow{Type: 3}
+	<-p.Out
+	if err := p.Shutdown(context.Background()); !errors.Is(err, segments.ErrFlushDeadline) {
+		t.Errorf("([error] Shutdown of the built pipeline did not report its canceled context: %v", err)
+	}
+	if _, ok := <-p.Out; ok {
+		t.Error("([error] Output of the closed pipeline is still open.")
+	}
+}
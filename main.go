@@ -6,8 +6,11 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
 	"plugin"
@@ -16,19 +19,30 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 
+	"github.com/BelWue/flowpipeline/admin"
 	"github.com/BelWue/flowpipeline/pipeline"
+	"github.com/BelWue/flowpipeline/pipeline/config"
+	"github.com/BelWue/flowpipeline/pipeline/graph"
+	"github.com/BelWue/flowpipeline/segments"
 
 	_ "github.com/BelWue/flowpipeline/segments/alert/http"
 
 	_ "github.com/BelWue/flowpipeline/segments/controlflow/branch"
+	_ "github.com/BelWue/flowpipeline/segments/controlflow/bus"
+	_ "github.com/BelWue/flowpipeline/segments/controlflow/switch"
+	_ "github.com/BelWue/flowpipeline/segments/controlflow/tee"
 
+	_ "github.com/BelWue/flowpipeline/segments/filter/aggregate"
+	_ "github.com/BelWue/flowpipeline/segments/filter/biflow"
 	_ "github.com/BelWue/flowpipeline/segments/filter/drop"
 	_ "github.com/BelWue/flowpipeline/segments/filter/elephant"
 
 	_ "github.com/BelWue/flowpipeline/segments/filter/flowfilter"
+	_ "github.com/BelWue/flowpipeline/segments/filter/rollup"
 
 	_ "github.com/BelWue/flowpipeline/segments/input/bpf"
 	_ "github.com/BelWue/flowpipeline/segments/input/diskbuffer"
@@ -53,6 +67,7 @@ import (
 	_ "github.com/BelWue/flowpipeline/segments/modify/remoteaddress"
 	_ "github.com/BelWue/flowpipeline/segments/modify/reversedns"
 	_ "github.com/BelWue/flowpipeline/segments/modify/snmp"
+	_ "github.com/BelWue/flowpipeline/segments/modify/split"
 	_ "github.com/BelWue/flowpipeline/segments/modify/sync_timestamps"
 
 	_ "github.com/BelWue/flowpipeline/segments/pass"
@@ -93,10 +108,21 @@ func main() {
 	var pluginPaths flagArray
 	flag.Var(&pluginPaths, "p", "Path to load segment plugins from, can be specified multiple times")
 	logLevel := flag.String("l", "warning", "Loglevel: one of 'debug', 'info', 'warning' or 'error'")
-	concurrency := flag.Uint("n", 1, "Number of concurrent pipelines to spawn. Set to 0 to enable automatic setting according to GOMAXPROCS. Only the default value 1 guarantees a stable order of the flows in and out of flowpipeline.")
+	concurrency := flag.Uint("n", 1, "Number of concurrent pipelines to spawn. Set to 0 to enable automatic setting according to GOMAXPROCS. Only the default value 1 guarantees a stable order of the flows in and out of flowpipeline, unless -ordered is set.")
+	ordered := flag.Bool("ordered", false, "Run the concurrent pipelines behind a single instance of the input segments and restore the order of the flows afterwards")
+	reorderWindow := flag.Int("reorder-window", config.DefaultReorderWindow, "Maximum number of flows held back to restore their order when using -ordered")
+	reorderTimeout := flag.Duration("reorder-timeout", config.DefaultReorderTimeout, "Maximum time to wait for a missing flow to restore the order when using -ordered")
+	batchSize := flag.Int("batch-size", 0, "Number of flows exchanged between segments at once. Set to enable the batched transport, which is disabled by default")
+	batchLatency := flag.Duration("batch-latency", config.DefaultBatchLatency, "Maximum time a flow waits for its batch to fill up when using -batch-size")
 	version := flag.Bool("v", false, "print version")
 	prettyLogging := flag.Bool("j", false, "Json log")
 	configFile := flag.String("c", "config.yml", "location of the config file in yml format")
+	checkOnly := flag.Bool("check", false, "Check the config file for errors and exit without starting any pipeline")
+	graphFormat := flag.String("graph", "", "Check the config file and print the graph of its pipelines in the given format, one of 'dot' or 'mermaid', and exit without starting any pipeline")
+	metricsAddr := flag.String("metrics", "", "Address to serve per-segment Prometheus metrics on, e.g. ':9090'. Disabled if empty")
+	adminAddr := flag.String("admin", "", "Address to serve the admin API on, e.g. 'localhost:8080', providing the status of all segments, the configuration, health checks and profiling. Disabled if empty")
+	captureDir := flag.String("capture-dir", "", "Directory the admin API may write captures to. Captures can only be streamed if empty")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 15*time.Second, "Maximum time to wait for the pipelines to flush their flows when shutting down, exits with code 5 if exceeded or if flushing failed")
 	flag.Parse()
 
 	if *version {
@@ -124,11 +150,20 @@ func main() {
 		}
 	}
 
-	config, err := os.ReadFile(*configFile)
-	if err != nil {
-		log.Error().Err(err).Msg("Reading config file: ")
-		return
+	if *checkOnly {
+		os.Exit(checkConfig(*configFile))
+	}
+
+	if *graphFormat != "" {
+		os.Exit(renderGraph(*configFile, *graphFormat))
+	}
+
+	if *metricsAddr != "" {
+		serveMetrics(*metricsAddr)
 	}
+	// the flows passing between segments are only counted and offered to
+	// captures if anyone is interested
+	pipeline.SetInstrumentation(*metricsAddr != "" || *adminAddr != "")
 
 	pipelineCount := 1
 	if *concurrency == 0 {
@@ -137,29 +172,246 @@ func main() {
 		pipelineCount = int(*concurrency)
 	}
 
-	segmentReprs := pipeline.SegmentReprsFromConfig(config)
-	for i := 0; i < pipelineCount; i++ {
-		segments := pipeline.SegmentsFromRepr(segmentReprs)
-		pipe := pipeline.New(segments...)
-		if pipe == nil {
-			log.Fatal().Msg("An error occured during pipeline initialization - Exiting")
+	pipelineReprs, err := pipeline.PipelineReprsFromFile(*configFile)
+	if err != nil {
+		log.Error().Err(err).Msg("Error reading configuration: ")
+		return
+	}
+	var batch *config.BatchOptions
+	if *batchSize > 0 {
+		batch = &config.BatchOptions{Size: *batchSize, Latency: *batchLatency}
+		if err := batch.Validate(); err != nil {
+			log.Error().Err(err).Msg("Invalid batch options: ")
 			return
 		}
-		pipe.Start()
-		pipe.AutoDrain()
-		defer pipe.Close()
 	}
+	var reorder *config.ReorderOptions
+	if *ordered {
+		reorder = &config.ReorderOptions{Window: *reorderWindow, Timeout: *reorderTimeout}
+		if err := reorder.Validate(); err != nil {
+			log.Error().Err(err).Msg("Invalid reorder options: ")
+			return
+		}
+	}
+	pipes := make([]namedPipeline, len(pipelineReprs))
+	for i, pipelineRepr := range pipelineReprs {
+		count := pipelineCount
+		if pipelineRepr.Concurrency > 0 {
+			count = pipelineRepr.Concurrency
+		}
+		options := pipeline.ReloadableOptions{Batch: batch, Path: pipelineRepr.Path}
+		if reorder != nil && count > 1 {
+			// a single pipeline running its processing segments concurrently
+			options.Concurrency = count
+			options.Reorder = reorder
+			count = 1
+		}
+		pipes[i].name = pipelineRepr.Name
+		for range count {
+			pipe, err := pipeline.NewReloadableWithOptions(pipelineRepr.Segments, options)
+			if err != nil {
+				log.Fatal().Err(err).Msg("An error occured during pipeline initialization - Exiting")
+				return
+			}
+			pipes[i].instances = append(pipes[i].instances, pipe)
+		}
+	}
+	// all pipelines are built before starting any
+	for _, named := range pipes {
+		for _, pipe := range named.instances {
+			pipe.Start()
+			pipe.AutoDrain()
+		}
+	}
+	var adminServer *admin.Server
+	if *adminAddr != "" {
+		adminServer = serveAdmin(*adminAddr, pipes, pipelineReprs, *captureDir)
+	}
+	waitForSignals(*configFile, pipes, adminServer)
+	os.Exit(shutdownPipelines(pipes, *shutdownTimeout))
+}
 
+// The running instances of a pipeline defined in the configuration. The name
+// is empty for configurations defining a single list of segments.
+type namedPipeline struct {
+	name      string
+	instances []*pipeline.ReloadablePipeline
+}
+
+// Blocks until an exit signal is received or all pipelines have been closed
+// on request of their segments, reloading the pipelines whenever SIGHUP is
+// received. The configuration served by the admin server, if any, is updated
+// once all pipelines have been reloaded successfully.
+func waitForSignals(configFile string, pipes []namedPipeline, adminServer *admin.Server) {
 	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, os.Interrupt, syscall.SIGINT)
-	signal.Notify(sigs, os.Interrupt, os.Interrupt)
-	<-sigs
-	log.Info().Msg("Received exit signal")
+	signal.Notify(sigs, os.Interrupt, syscall.SIGINT, syscall.SIGHUP)
+	closed := make(chan struct{})
+	go func() {
+		for _, named := range pipes {
+			for _, pipe := range named.instances {
+				<-pipe.Done()
+			}
+		}
+		close(closed)
+	}()
+	for {
+		select {
+		case sig := <-sigs:
+			if sig != syscall.SIGHUP {
+				log.Info().Msg("Received exit signal")
+				return
+			}
+			pipelineReprs := reloadPipelines(configFile, pipes)
+			if pipelineReprs != nil && adminServer != nil {
+				if err := adminServer.SetConfig(pipelineReprs); err != nil {
+					log.Error().Err(err).Msg("Failed to update the configuration served by the admin API: ")
+				}
+			}
+		case <-closed:
+			log.Info().Msg("All pipelines have been closed")
+			return
+		}
+	}
+}
+
+// Closes all pipelines in the order they are defined in, so that publishing
+// pipelines usually are drained before the pipelines subscribing to them. All
+// of them share the provided timeout to flush their flows. Returns the exit
+// code, which is 5 if any pipeline failed to do so.
+func shutdownPipelines(pipes []namedPipeline, timeout time.Duration) int {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	code := 0
+	for _, named := range pipes {
+		for i, pipe := range named.instances {
+			if err := pipe.Shutdown(ctx); err != nil {
+				log.Error().Err(err).Str("pipeline", named.name).Msgf("Pipeline %d failed to shut down gracefully: ", i)
+				code = 5
+			}
+		}
+	}
+	return code
+}
+
+// Serves the metrics shared by all segments on /metrics of the provided
+// address.
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(segments.MetricsRegistry, promhttp.HandlerOpts{}))
 	go func() {
-		<-time.After(time.Duration(15 * time.Second))
-		log.Fatal().Msg("Failed to shut down gracefully - force quitting")
-		os.Exit(5)
+		err := http.ListenAndServe(addr, mux)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to serve metrics: ")
+		}
 	}()
+	log.Info().Msgf("Serving segment metrics on %s/metrics", addr)
+}
+
+// Serves the admin API on the provided address, see the admin package.
+func serveAdmin(addr string, pipes []namedPipeline, pipelineReprs []config.PipelineRepr, captureDir string) *admin.Server {
+	adminPipelines := make([]admin.NamedPipeline, len(pipes))
+	for i, named := range pipes {
+		adminPipelines[i].Name = named.name
+		for _, pipe := range named.instances {
+			adminPipelines[i].Instances = append(adminPipelines[i].Instances, pipe)
+		}
+	}
+	server := admin.NewServer(Version, adminPipelines)
+	server.CaptureDir = captureDir
+	if err := server.SetConfig(pipelineReprs); err != nil {
+		log.Error().Err(err).Msg("Failed to prepare the configuration served by the admin API: ")
+	}
+	go func() {
+		err := http.ListenAndServe(addr, server.Handler())
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to serve admin API: ")
+		}
+	}()
+	log.Info().Msgf("Serving admin API on %s", addr)
+	return server
+}
+
+// Rereads the config file and replaces the processing segments of all
+// pipelines. Input segments keep running, and any errors leave the previous
+// configuration in place. Named pipelines can not be added, removed or
+// renamed. Returns the new configuration if all pipelines have been reloaded.
+func reloadPipelines(configFile string, pipes []namedPipeline) []config.PipelineRepr {
+	log.Info().Msgf("Received SIGHUP, reloading config file '%s'", configFile)
+	pipelineReprs, err := pipeline.PipelineReprsFromFile(configFile)
+	if err != nil {
+		log.Error().Err(err).Msg("Reading config file failed, keeping the previous configuration: ")
+		return nil
+	}
+	if len(pipelineReprs) != len(pipes) {
+		log.Error().Msg("Pipelines can not be added or removed at runtime, a restart is required. Keeping the previous configuration.")
+		return nil
+	}
+	for i, named := range pipes {
+		if pipelineReprs[i].Name != named.name {
+			log.Error().Msgf("Pipeline '%s' can not be renamed to '%s' at runtime, a restart is required. Keeping the previous configuration.", named.name, pipelineReprs[i].Name)
+			return nil
+		}
+	}
+	reloaded := true
+	for i, named := range pipes {
+		for j, pipe := range named.instances {
+			if err := pipe.Reload(pipelineReprs[i].Segments); err != nil {
+				log.Error().Err(err).Str("pipeline", named.name).Msgf("Reloading pipeline %d failed, keeping the previous configuration: ", j)
+				reloaded = false
+			}
+		}
+	}
+	if !reloaded {
+		return nil
+	}
+	return pipelineReprs
+}
+
+// Builds all segments from a config without running them and reports all
+// problems found. Returns the exit code to use.
+func checkConfig(configFile string) int {
+	if _, err := loadCheckedConfig(configFile); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println("Configuration is valid.")
+	return 0
+}
+
+// Renders the graph of all pipelines defined in a config in the provided
+// format, if building their segments succeeds. Returns the exit code to use.
+func renderGraph(configFile string, format string) int {
+	pipelineReprs, err := loadCheckedConfig(configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := graph.Render(os.Stdout, format, pipelineReprs); err != nil {
+		fmt.Fprintf(os.Stderr, "Error rendering graph: %s\n", err)
+		return 1
+	}
+	return 0
+}
+
+// Reads a config and builds all segments of its pipelines without running
+// them, just like they would be built for running them. All problems found
+// are returned joined.
+func loadCheckedConfig(configFile string) ([]config.PipelineRepr, error) {
+	pipelineReprs, err := pipeline.PipelineReprsFromFile(configFile)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading configuration: %w", err)
+	}
+	var errs []error
+	for _, pipelineRepr := range pipelineReprs {
+		config.SetDryRun(pipelineRepr.Segments)
+		if _, err := pipeline.SegmentsFromReprWithPath(pipelineRepr.Segments, pipelineRepr.Path); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return pipelineReprs, nil
 }
 
 func zerologLogLevel(logLevel *string) zerolog.Level {
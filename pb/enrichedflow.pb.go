@@ -484,11 +484,19 @@ type EnrichedFlow struct {
 	TimeIdleMax                uint64                    `protobuf:"varint,2155,opt,name=TimeIdleMax,proto3" json:"TimeIdleMax,omitempty"`                                                                   // new
 	TimeIdleMean               uint64                    `protobuf:"varint,2156,opt,name=TimeIdleMean,proto3" json:"TimeIdleMean,omitempty"`                                                                 // new
 	TimeIdleStdDev             uint64                    `protobuf:"varint,2157,opt,name=TimeIdleStdDev,proto3" json:"TimeIdleStdDev,omitempty"`                                                             // new
+	// filter/biflow
+	ReverseBytes   uint64 `protobuf:"varint,2190,opt,name=ReverseBytes,proto3" json:"ReverseBytes,omitempty"`
+	ReversePackets uint64 `protobuf:"varint,2191,opt,name=ReversePackets,proto3" json:"ReversePackets,omitempty"`
+	// filter/rollup
+	FlowCount uint64 `protobuf:"varint,2192,opt,name=FlowCount,proto3" json:"FlowCount,omitempty"`
+	// modify/split
+	SplitIndex uint32 `protobuf:"varint,2193,opt,name=SplitIndex,proto3" json:"SplitIndex,omitempty"`
+	SplitCount uint32 `protobuf:"varint,2194,opt,name=SplitCount,proto3" json:"SplitCount,omitempty"`
 	// modify/addcid
-	Cid                           uint32                      `protobuf:"varint,2000,opt,name=Cid,proto3" json:"Cid,omitempty"`            // TODO: deprecate and provide as helper?
-	CidString                     string                      `protobuf:"bytes,2001,opt,name=CidString,proto3" json:"CidString,omitempty"` // deprecated, delete for v1.0.0
-	SrcCid                        uint32                      `protobuf:"varint,2012,opt,name=SrcCid,proto3" json:"SrcCid,omitempty"`
-	DstCid                        uint32                      `protobuf:"varint,2013,opt,name=DstCid,proto3" json:"DstCid,omitempty"`
+	Cid       uint32 `protobuf:"varint,2000,opt,name=Cid,proto3" json:"Cid,omitempty"`            // TODO: deprecate and provide as helper?
+	CidString string `protobuf:"bytes,2001,opt,name=CidString,proto3" json:"CidString,omitempty"` // deprecated, delete for v1.0.0
+	SrcCid    uint32 `protobuf:"varint,2012,opt,name=SrcCid,proto3" json:"SrcCid,omitempty"`
+	DstCid    uint32 `protobuf:"varint,2013,opt,name=DstCid,proto3" json:"DstCid,omitempty"`
 	// modify/addnetid
 	NetId                         uint32                      `protobuf:"varint,2017,opt,name=NetId,proto3" json:"NetId,omitempty"`
 	NetIdString                   string                      `protobuf:"varint,2018,opt,name=NetIdString,proto3" json:"NetIdString,omitempty"`
@@ -1262,6 +1270,41 @@ func (x *EnrichedFlow) GetTimeIdleStdDev() uint64 {
 	return 0
 }
 
+func (x *EnrichedFlow) GetReverseBytes() uint64 {
+	if x != nil {
+		return x.ReverseBytes
+	}
+	return 0
+}
+
+func (x *EnrichedFlow) GetReversePackets() uint64 {
+	if x != nil {
+		return x.ReversePackets
+	}
+	return 0
+}
+
+func (x *EnrichedFlow) GetFlowCount() uint64 {
+	if x != nil {
+		return x.FlowCount
+	}
+	return 0
+}
+
+func (x *EnrichedFlow) GetSplitIndex() uint32 {
+	if x != nil {
+		return x.SplitIndex
+	}
+	return 0
+}
+
+func (x *EnrichedFlow) GetSplitCount() uint32 {
+	if x != nil {
+		return x.SplitCount
+	}
+	return 0
+}
+
 func (x *EnrichedFlow) GetCid() uint32 {
 	if x != nil {
 		return x.Cid
@@ -1630,7 +1673,7 @@ var File_pb_enrichedflow_proto protoreflect.FileDescriptor
 
 const file_pb_enrichedflow_proto_rawDesc = "" +
 	"\n" +
-	"\x15pb/enrichedflow.proto\x12\x06flowpb\"\xfd-\n" +
+	"\x15pb/enrichedflow.proto\x12\x06flowpb\"\xac/\n" +
 	"\fEnrichedFlow\x121\n" +
 	"\x04type\x18\x01 \x01(\x0e2\x1d.flowpb.EnrichedFlow.FlowTypeR\x04type\x12#\n" +
 	"\rtime_received\x18\x02 \x01(\x04R\ftimeReceived\x12(\n" +
@@ -1743,7 +1786,16 @@ const file_pb_enrichedflow_proto_rawDesc = "" +
 	"\vTimeIdleMin\x18\xea\x10 \x01(\x04R\vTimeIdleMin\x12!\n" +
 	"\vTimeIdleMax\x18\xeb\x10 \x01(\x04R\vTimeIdleMax\x12#\n" +
 	"\fTimeIdleMean\x18\xec\x10 \x01(\x04R\fTimeIdleMean\x12'\n" +
-	"\x0eTimeIdleStdDev\x18\xed\x10 \x01(\x04R\x0eTimeIdleStdDev\x12\x11\n" +
+	"\x0eTimeIdleStdDev\x18\xed\x10 \x01(\x04R\x0eTimeIdleStdDev\x12#\n" +
+	"\fReverseBytes\x18\x8e\x11 \x01(\x04R\fReverseBytes\x12'\n" +
+	"\x0eReversePackets\x18\x8f\x11 \x01(\x04R\x0eReversePackets\x12\x1d\n" +
+	"\tFlowCount\x18\x90\x11 \x01(\x04R\tFlowCount\x12\x1f\n" +
+	"\n" +
+	"SplitIndex\x18\x91\x11 \x01(\rR\n" +
+	"SplitIndex\x12\x1f\n" +
+	"\n" +
+	"SplitCount\x18\x92\x11 \x01(\rR\n" +
+	"SplitCount\x12\x11\n" +
 	"\x03Cid\x18\xd0\x0f \x01(\rR\x03Cid\x12\x1d\n" +
 	"\tCidString\x18\xd1\x0f \x01(\tR\tCidString\x12\x17\n" +
 	"\x06SrcCid\x18\xdc\x0f \x01(\rR\x06SrcCid\x12\x17\n" +
@@ -0,0 +1,193 @@
+package pipeline
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/BelWue/flowpipeline/pb"
+	"github.com/BelWue/flowpipeline/pipeline/config"
+	"github.com/BelWue/flowpipeline/segments"
+	_ "github.com/BelWue/flowpipeline/segments/alert/http"
+	_ "github.com/BelWue/flowpipeline/segments/filter/flowfilter"
+	_ "github.com/BelWue/flowpipeline/segments/modify/dropfields"
+	_ "github.com/BelWue/flowpipeline/segments/pass"
+)
+
+// Tracks a number of flows, counting how often each of them was done.
+type ackCounter struct {
+	flows []*pb.EnrichedFlow
+	done  []atomic.Int32
+}
+
+func newAckCounter(flows []*pb.EnrichedFlow) *ackCounter {
+	counter := &ackCounter{flows: flows, done: make([]atomic.Int32, len(flows))}
+	for i, msg := range flows {
+		segments.Track(msg, func() { counter.done[i].Add(1) })
+	}
+	return counter
+}
+
+// Waits for all flows to be done, failing if any was done more than once.
+func (counter *ackCounter) wait(t *testing.T) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for i := range counter.done {
+		for counter.done[i].Load() == 0 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if done := counter.done[i].Load(); done != 1 {
+			t.Errorf("([error] Flow %d was done %d times, should be once.", i, done)
+		}
+	}
+}
+
+func TestPipelineAck(t *testing.T) {
+	for _, batch := range []*config.BatchOptions{nil, {Size: 4}} {
+		segmentReprs, err := SegmentReprsFromConfig([]byte(`---
+- segment: flowfilter
+  jobs: 3
+  config:
+    filter: proto tcp
+- segment: pass
+  jobs: 2`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var pipeline *Pipeline
+		if batch == nil {
+			pipeline, err = NewFromRepr(segmentReprs, "ack_test")
+		} else {
+			pipeline, err = NewBatchedFromRepr(segmentReprs, "ack_test", *batch)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		var flows []*pb.EnrichedFlow
+		for i := range 20 {
+			flows = append(flows, &pb.EnrichedFlow{SequenceNum: uint32(i), Proto: uint32(6 + i%2*11)})
+		}
+		counter := newAckCounter(flows)
+
+		pipeline.Start()
+		received := make(chan []*pb.EnrichedFlow)
+		go func() {
+			var flows []*pb.EnrichedFlow
+			for msg := range pipeline.Out {
+				flows = append(flows, msg)
+			}
+			received <- flows
+		}()
+		for _, msg := range flows {
+			pipeline.In <- msg
+		}
+		pipeline.Close()
+		passed := <-received
+
+		if len(passed) != 10 {
+			t.Fatalf("([error] Pipeline emitted %d flows, should be 10.", len(passed))
+		}
+		for _, msg := range passed {
+			if done := counter.done[msg.SequenceNum].Load(); done != 0 {
+				t.Errorf("([error] Flow %d was done before it left the pipeline.", msg.SequenceNum)
+			}
+		}
+		segments.Ack(passed...)
+		segments.Ack(passed...) // further acknowledgements are ignored
+		counter.wait(t)
+	}
+}
+
+func TestPipelineAckReplaced(t *testing.T) {
+	pipeline, err := NewFromConfig([]byte(`---
+- segment: dropfields
+  jobs: 2
+  config:
+    policy: keep
+    fields: SequenceNum`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var flows []*pb.EnrichedFlow
+	for i := range 10 {
+		flows = append(flows, &pb.EnrichedFlow{SequenceNum: uint32(i), Proto: 6})
+	}
+	counter := newAckCounter(flows)
+
+	pipeline.Start()
+	received := make(chan []*pb.EnrichedFlow)
+	go func() {
+		var flows []*pb.EnrichedFlow
+		for msg := range pipeline.Out {
+			flows = append(flows, msg)
+		}
+		received <- flows
+	}()
+	for _, msg := range flows {
+		pipeline.In <- msg
+	}
+	pipeline.Close()
+	replaced := <-received
+
+	for _, msg := range replaced {
+		if msg == flows[msg.SequenceNum] {
+			t.Fatal("([error] Flow was not replaced by dropfields.")
+		}
+		if done := counter.done[msg.SequenceNum].Load(); done != 0 {
+			t.Errorf("([error] Flow %d was done before its replacement left the pipeline.", msg.SequenceNum)
+		}
+	}
+	segments.Ack(replaced...)
+	counter.wait(t)
+}
+
+func TestPipelineAckOverflow(t *testing.T) {
+	segmentrepr := config.SegmentRepr{Name: "stalled", Buffer: 2, Overflow: config.OverflowDropOldest, Path: "ack_test[0]"}
+	stalled := (&stalledSegment{}).New(nil).(*stalledSegment)
+	pipeline := newPipeline([]segments.Segment{stalled}, []config.SegmentRepr{segmentrepr}, nil)
+	var flows []*pb.EnrichedFlow
+	for i := range 5 {
+		flows = append(flows, &pb.EnrichedFlow{SequenceNum: uint32(i)})
+	}
+	counter := newAckCounter(flows)
+
+	pipeline.Start()
+	pipeline.AutoDrain()
+	for _, msg := range flows {
+		pipeline.In <- msg
+	}
+	close(stalled.release)
+	pipeline.Close()
+	counter.wait(t)
+}
+
+func TestPipelineAckDeadLetter(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	pipeline, err := NewFromConfig([]byte(`---
+- segment: http
+  config:
+    url: ` + server.URL + `
+  deadletter:
+  - segment: pass`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var flows []*pb.EnrichedFlow
+	for range 3 {
+		flows = append(flows, &pb.EnrichedFlow{Proto: 6})
+	}
+	counter := newAckCounter(flows)
+
+	pipeline.Start()
+	pipeline.AutoDrain()
+	for _, msg := range flows {
+		pipeline.In <- msg
+	}
+	pipeline.Close()
+	counter.wait(t)
+}
@@ -0,0 +1,251 @@
+package pipeline
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/BelWue/flowpipeline/pb"
+	"github.com/BelWue/flowpipeline/pipeline/config"
+	"github.com/BelWue/flowpipeline/segments"
+	"github.com/BelWue/flowpipeline/segments/pass"
+)
+
+// A section of a batched Pipeline. It consists either of a single segment
+// implementing segments.BatchSegment, or of a Pipeline of consecutive
+// segments exchanging single flows.
+type batchSection struct {
+	unit   *unit     // the batch segment, if any
+	flows  *Pipeline // the adapted segments otherwise
+	in     chan []*pb.EnrichedFlow
+	output chan []*pb.EnrichedFlow // written by the batch segment
+}
+
+// Returns the metrics of the segment receiving batches, or nil if the
+// batches are adapted for segments handling single flows.
+func (section *batchSection) receiver() *segmentMetrics {
+	if section.unit != nil {
+		return section.unit.metrics
+	}
+	return nil
+}
+
+// Initializes a new Pipeline using the batched transport. Its In and Out
+// channels accept and emit single flows, but within the Pipeline segments
+// exchange batches of flows. Segments not implementing segments.BatchSegment
+// are adapted automatically.
+func NewBatched(options config.BatchOptions, segmentList ...segments.Segment) *Pipeline {
+	if len(segmentList) == 0 {
+		segmentList = []segments.Segment{&pass.Pass{}}
+	}
+	segmentReprs := make([]config.SegmentRepr, len(segmentList))
+	for i, segment := range segmentList {
+		if segment == nil {
+			return nil
+		}
+		segmentReprs[i] = config.SegmentRepr{Name: segmentName(segment), Path: fmt.Sprintf("segments[%d]", i)}
+	}
+	return newBatchedPipeline(segmentList, segmentReprs, nil, options)
+}
+
+// Same as NewFromRepr, but the Pipeline uses the batched transport, see
+// NewBatched.
+func NewBatchedFromRepr(segmentReprs []config.SegmentRepr, path string, options config.BatchOptions) (*Pipeline, error) {
+	return newBatchedFromRepr(segmentReprs, path, 0, options)
+}
+
+func newBatchedFromRepr(segmentReprs []config.SegmentRepr, path string, offset int, options config.BatchOptions) (*Pipeline, error) {
+	if len(segmentReprs) == 0 {
+		segmentReprs = []config.SegmentRepr{{Name: "pass"}}
+	}
+	segmentReprs = withPaths(segmentReprs, path, offset)
+	segmentList, deadLetters, err := segmentsFromRepr(segmentReprs)
+	if err != nil {
+		return nil, err
+	}
+	return newBatchedPipeline(segmentList, segmentReprs, deadLetters, options), nil
+}
+
+// Checks whether a segment can be run using the batched transport natively.
+// Options which are implemented on single flows, such as multiple jobs or a
+// buffer, require the segment to be adapted.
+func runsBatches(segment segments.Segment, segmentrepr config.SegmentRepr) bool {
+	_, ok := segment.(segments.BatchSegment)
+	return ok && segmentrepr.Jobs <= 1 && segmentrepr.Buffer == 0
+}
+
+// Wires up a list of segments using the batched transport. Consecutive
+// segments without native support are grouped into sections exchanging
+// single flows, which are fed from and batched into the surrounding batches.
+func newBatchedPipeline(segmentList []segments.Segment, segmentReprs []config.SegmentRepr, deadLetters []*Pipeline, options config.BatchOptions) *Pipeline {
+	options = options.WithDefaults()
+	if deadLetters == nil {
+		deadLetters = make([]*Pipeline, len(segmentList))
+	}
+	out := make(chan *pb.EnrichedFlow)
+	pipeline := &Pipeline{In: make(chan *pb.EnrichedFlow), Out: out, wg: &sync.WaitGroup{}, SegmentList: segmentList}
+
+	var sections []*batchSection
+	for i := 0; i < len(segmentList); {
+		section := &batchSection{in: make(chan []*pb.EnrichedFlow)}
+		if runsBatches(segmentList[i], segmentReprs[i]) {
+			segment := segmentList[i]
+			section.unit = &unit{segment: segment, name: segmentReprs[i].Name, position: segmentReprs[i].Path}
+			section.unit.metrics = newSegmentMetrics(segmentReprs[i].Name, section.unit.position)
+			if filter, ok := segment.(segments.FilterSegment); ok {
+				section.unit.drops = make(chan *pb.EnrichedFlow)
+				filter.SubscribeDrops(section.unit.drops)
+			}
+			if deadLetters[i] != nil {
+				section.unit.subscribeDeadLetters(newDeadLetterRoute(deadLetters[i], 1))
+			}
+			section.output = make(chan []*pb.EnrichedFlow)
+			i += 1
+		} else {
+			end := i + 1
+			for end < len(segmentList) && !runsBatches(segmentList[end], segmentReprs[end]) {
+				end += 1
+			}
+			section.flows = newPipeline(segmentList[i:end], segmentReprs[i:end], deadLetters[i:end])
+			section.flows.parent = pipeline
+			i = end
+		}
+		sections = append(sections, section)
+	}
+	pipeline.sections = sections
+	exit := make(chan []*pb.EnrichedFlow)
+
+	pipeline.relays = append(pipeline.relays, func() {
+		batchFlows(pipeline.In, sections[0].in, options, sections[0].receiver())
+	})
+	for i, section := range sections {
+		next := exit
+		var receiver *segmentMetrics
+		if i+1 < len(sections) {
+			next = sections[i+1].in
+			receiver = sections[i+1].receiver()
+		}
+		if section.unit != nil {
+			pipeline.relays = append(pipeline.relays, section.runBatches, func() {
+				relayBatches(section.output, next, section.unit, receiver)
+			})
+			if section.unit.drops != nil {
+				pipeline.relays = append(pipeline.relays, func() {
+					pipeline.forwardDrops(section.unit, nil)
+				})
+			}
+			if section.unit.deadLetters != nil {
+				pipeline.relays = append(pipeline.relays, func() {
+					pipeline.forwardDeadLetters(section.unit)
+				})
+			}
+		} else {
+			pipeline.relays = append(pipeline.relays, func() {
+				section.runFlows(next, options, receiver)
+			})
+		}
+	}
+	pipeline.relays = append(pipeline.relays, func() {
+		defer close(out)
+		for batch := range exit {
+			for _, msg := range batch {
+				out <- msg
+			}
+		}
+	})
+	pipeline.initShutdown()
+	return pipeline
+}
+
+// Runs the batch segment of this section and cleans up its drop and dead
+// letter channels afterwards.
+func (section *batchSection) runBatches() {
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go section.unit.segment.(segments.BatchSegment).RunBatches(section.in, section.output, wg)
+	wg.Wait()
+	if section.unit.drops != nil {
+		closeQuietly(section.unit.drops)
+	}
+	if section.unit.deadLetters != nil {
+		close(section.unit.deadLetters)
+	}
+}
+
+// Runs the segments of this section exchanging single flows, feeding them
+// from the incoming batches and batching their results again.
+func (section *batchSection) runFlows(to chan<- []*pb.EnrichedFlow, options config.BatchOptions, receiver *segmentMetrics) {
+	section.flows.Start()
+	go func() {
+		for batch := range section.in {
+			for _, msg := range batch {
+				section.flows.In <- msg
+			}
+		}
+		close(section.flows.In)
+	}()
+	batchFlows(section.flows.Out, to, options, receiver)
+	section.flows.wg.Wait()
+}
+
+// Collects single flows into batches, which are handed on once they are full
+// or once their first flow has waited for the configured latency.
+func batchFlows(from <-chan *pb.EnrichedFlow, to chan<- []*pb.EnrichedFlow, options config.BatchOptions, receiver *segmentMetrics) {
+	defer close(to)
+	batch := make([]*pb.EnrichedFlow, 0, options.Size)
+	timer := time.NewTimer(options.Latency)
+	timer.Stop()
+	flush := func() {
+		timer.Stop()
+		if len(batch) == 0 {
+			return
+		}
+		to <- batch
+		if receiver != nil {
+			receiver.in.Add(float64(len(batch)))
+		}
+		batch = make([]*pb.EnrichedFlow, 0, options.Size)
+	}
+	for {
+		select {
+		case msg, ok := <-from:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, msg)
+			if len(batch) == 1 {
+				timer.Reset(options.Latency)
+			}
+			if len(batch) >= options.Size {
+				flush()
+			}
+		case <-timer.C:
+			flush()
+		}
+	}
+}
+
+// Forwards batches from one channel to another, counting their flows as
+// emitted by the sending segment and as received by the receiving one, if
+// any. The time spent waiting for the receiving side is attributed to the
+// sender.
+func relayBatches(from <-chan []*pb.EnrichedFlow, to chan<- []*pb.EnrichedFlow, sender *unit, receiver *segmentMetrics) {
+	defer close(to)
+	for batch := range from {
+		for _, msg := range batch {
+			sender.taps.offer(msg)
+		}
+		select {
+		case to <- batch:
+		default:
+			start := time.Now()
+			to <- batch
+			sender.metrics.blocked.Add(time.Since(start).Seconds())
+		}
+		sender.metrics.out.Add(float64(len(batch)))
+		if receiver != nil {
+			receiver.in.Add(float64(len(batch)))
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package pipeline
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/BelWue/flowpipeline/pb"
+	"github.com/BelWue/flowpipeline/pipeline/config"
+	_ "github.com/BelWue/flowpipeline/segments/filter/flowfilter"
+	_ "github.com/BelWue/flowpipeline/segments/modify/dropfields"
+	_ "github.com/BelWue/flowpipeline/segments/modify/normalize"
+)
+
+func TestBatchedPipeline(t *testing.T) {
+	segmentReprs, err := SegmentReprsFromConfig([]byte(`---
+- segment: flowfilter
+  config:
+    filter: proto tcp
+- segment: pass
+- segment: pass
+- segment: normalize`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline, err := NewBatchedFromRepr(segmentReprs, "batch_test", config.BatchOptions{Size: 8, Latency: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	filterIn := testutil.ToFloat64(flowsIn.WithLabelValues("flowfilter", "batch_test[0]"))
+	filterOut := testutil.ToFloat64(flowsOut.WithLabelValues("flowfilter", "batch_test[0]"))
+	passIn := testutil.ToFloat64(flowsIn.WithLabelValues("pass", "batch_test[1]"))
+
+	drops := pipeline.GetDrop()
+	pipeline.Start()
+	go func() {
+		for i := range 100 {
+			pipeline.In <- &pb.EnrichedFlow{Proto: uint32(6 + 11*(i%2)), Bytes: 1, SamplingRate: 32, SequenceNum: uint32(i)}
+		}
+		pipeline.Close()
+	}()
+	dropped := 0
+	dropsDone := make(chan struct{})
+	go func() {
+		for range drops {
+			dropped += 1
+		}
+		close(dropsDone)
+	}()
+	var received []*pb.EnrichedFlow
+	for msg := range pipeline.Out {
+		received = append(received, msg)
+	}
+	<-dropsDone
+
+	if len(received) != 50 || dropped != 50 {
+		t.Fatalf("([error] Expected 50 flows to pass and 50 to be dropped, got %d and %d.", len(received), dropped)
+	}
+	for i, msg := range received {
+		if msg.SequenceNum != uint32(2*i) || msg.Bytes != 32 {
+			t.Fatalf("([error] Batched pipeline did not process flows in order, got %v.", msg)
+		}
+	}
+	if value := testutil.ToFloat64(flowsIn.WithLabelValues("flowfilter", "batch_test[0]")) - filterIn; value != 100 {
+		t.Errorf("([error] Expected 100 flows into the batch segment, got %v.", value)
+	}
+	if value := testutil.ToFloat64(flowsOut.WithLabelValues("flowfilter", "batch_test[0]")) - filterOut; value != 50 {
+		t.Errorf("([error] Expected 50 flows out of the batch segment, got %v.", value)
+	}
+	if value := testutil.ToFloat64(flowsIn.WithLabelValues("pass", "batch_test[1]")) - passIn; value != 50 {
+		t.Errorf("([error] Expected 50 flows into the adapted segment, got %v.", value)
+	}
+}
+
+func TestBatchedPipelineLatency(t *testing.T) {
+	pipeline := NewBatched(config.BatchOptions{Size: 1000, Latency: 10 * time.Millisecond})
+	pipeline.Start()
+	pipeline.In <- &pb.EnrichedFlow{Type: 3}
+	select {
+	case msg := <-pipeline.Out:
+		if msg.Type != 3 {
+			t.Error("([error] Batched pipeline is not working.")
+		}
+	case <-time.After(time.Second):
+		t.Error("([error] Incomplete batch was not flushed.")
+	}
+	pipeline.AutoDrain()
+	pipeline.Close()
+}
+
+// Configurations for comparing the batched transport to the regular one: The
+// segments most commonly found in high-rate pipelines, and a long pipeline of
+// cheap segments exposing the cost of the transport itself.
+var benchmarkConfigs = map[string][]byte{
+	"Common": []byte(`---
+- segment: flowfilter
+  config:
+    filter: proto tcp or proto udp
+- segment: dropfields
+  config:
+    policy: drop
+    fields: SrcMac,DstMac
+- segment: normalize`),
+	"Transport": []byte(`---
+- segment: normalize
+- segment: normalize
+- segment: normalize
+- segment: normalize
+- segment: normalize
+- segment: normalize
+- segment: normalize
+- segment: normalize`),
+}
+
+func benchmarkPipeline(b *testing.B, newPipeline func([]config.SegmentRepr, string) (*Pipeline, error)) {
+	for name, rawConfig := range benchmarkConfigs {
+		b.Run(name, func(b *testing.B) {
+			segmentReprs, _ := SegmentReprsFromConfig(rawConfig)
+			pipeline, err := newPipeline(segmentReprs, "benchmark_"+name)
+			if err != nil {
+				b.Fatal(err)
+			}
+			pipeline.Start()
+			pipeline.AutoDrain()
+			b.ResetTimer()
+			for i := range b.N {
+				pipeline.In <- &pb.EnrichedFlow{Proto: 6, SamplingRate: 1, Bytes: uint64(i)}
+			}
+			pipeline.Close()
+		})
+	}
+}
+
+// The baseline, with segments connected directly as done without -metrics or
+// -admin.
+func BenchmarkPipelineDirect(b *testing.B) {
+	SetInstrumentation(false)
+	defer SetInstrumentation(true)
+	benchmarkPipeline(b, NewFromRepr)
+}
+
+func BenchmarkPipeline(b *testing.B) {
+	benchmarkPipeline(b, NewFromRepr)
+}
+
+func BenchmarkPipelineBatched(b *testing.B) {
+	benchmarkPipeline(b, func(segmentReprs []config.SegmentRepr, path string) (*Pipeline, error) {
+		return NewBatchedFromRepr(segmentReprs, path, config.BatchOptions{})
+	})
+}
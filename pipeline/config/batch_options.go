@@ -0,0 +1,40 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// Options for pipelines using the batched transport, in which segments
+// exchange batches of flows instead of single flows.
+type BatchOptions struct {
+	Size    int           // maximum number of flows in a batch, defaults to DefaultBatchSize
+	Latency time.Duration // maximum time a flow waits for its batch to fill up, defaults to DefaultBatchLatency
+}
+
+const (
+	DefaultBatchSize    = 256
+	DefaultBatchLatency = 10 * time.Millisecond
+)
+
+// Returns the options with defaults applied for any unset values.
+func (b BatchOptions) WithDefaults() BatchOptions {
+	if b.Size == 0 {
+		b.Size = DefaultBatchSize
+	}
+	if b.Latency == 0 {
+		b.Latency = DefaultBatchLatency
+	}
+	return b
+}
+
+// Checks the values of the options.
+func (b BatchOptions) Validate() error {
+	if b.Size < 0 {
+		return fmt.Errorf("batch size must not be negative, got %d", b.Size)
+	}
+	if b.Latency < 0 {
+		return fmt.Errorf("batch latency must not be negative, got %s", b.Latency)
+	}
+	return nil
+}
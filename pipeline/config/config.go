@@ -1,5 +1,9 @@
 package config
 
+// Segment parameters whose values are not shown when exposing a configuration,
+// e.g. by the admin server or in graphs, as they usually contain credentials.
+var RedactedParameters = []string{"pass", "token", "key", "community", "dsn", "mongodb_uri"}
+
 // Allows adding Config params that arnt only a simple map
 // Needs to be expanded by every Segment using it
 type Config struct {
@@ -0,0 +1,388 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// A configuration document in mapping form. Besides the segment list in
+// pipeline, or the named pipelines in pipelines, it can include other documents, define variables to be
+// substituted as `${name}` and define named segment lists which can be
+// instantiated using `- template: name`, with parameters given in `with`.
+// Configurations consisting of a plain segment list are still supported.
+type document struct {
+	Include   []string                 `yaml:"include"`
+	Vars      map[string]interface{}   `yaml:"vars"`
+	Templates map[string][]interface{} `yaml:"templates"`
+	Pipeline  []interface{}            `yaml:"pipeline"`
+	Pipelines []interface{}            `yaml:"pipelines"`
+}
+
+// Keys of a segment containing nested segment lists, which are resolved just
+// like the top level list.
+var nestedSegmentLists = []string{"if", "then", "else", "default", "deadletter"}
+
+// Keys of a segment containing lists of branches or cases, each of which has
+// a nested segment list in its segments key.
+var nestedBranchLists = []string{"branches", "cases"}
+
+// Matches variable references, but not argv references such as `${1}`.
+var variablePattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// Reads a configuration file and returns its list of segment representations,
+// see ParseSegmentReprs. Included files are looked up relative to it.
+func LoadSegmentReprs(path string) ([]SegmentRepr, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseSegmentReprs(data, filepath.Dir(path))
+}
+
+// Parses a configuration and returns its list of segment representations.
+// The configuration is either a plain list of segments, or a mapping with
+// the keys include, vars, templates and pipeline. Included files are looked
+// up relative to dir. Variables unknown to the configuration, such as
+// environment variables, are left as they are to be expanded by
+// ExpandedConfig. Configurations defining named pipelines result in an
+// error, see ParsePipelineReprs.
+func ParseSegmentReprs(data []byte, dir string) ([]SegmentRepr, error) {
+	pipelineReprs, err := ParsePipelineReprs(data, dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(pipelineReprs) != 1 || pipelineReprs[0].Name != "" {
+		return nil, fmt.Errorf("configuration defines named pipelines, expected a single list of segments")
+	}
+	return pipelineReprs[0].Segments, nil
+}
+
+// Reads a configuration file and returns its pipelines, see
+// ParsePipelineReprs. Included files are looked up relative to it.
+func LoadPipelineReprs(path string) ([]PipelineRepr, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePipelineReprs(data, filepath.Dir(path))
+}
+
+// Parses a configuration and returns its pipelines. In addition to the
+// configurations supported by ParseSegmentReprs, which result in a single
+// unnamed pipeline, the mapping may contain a list of named pipelines in
+// pipelines instead of pipeline.
+func ParsePipelineReprs(data []byte, dir string) ([]PipelineRepr, error) {
+	var raw interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	if _, ok := raw.(map[interface{}]interface{}); !ok {
+		segmentReprs := []SegmentRepr{}
+		if err := yaml.Unmarshal(data, &segmentReprs); err != nil {
+			return nil, err
+		}
+		return []PipelineRepr{{Segments: segmentReprs, Path: "segments"}}, nil
+	}
+	doc, err := parseDocument(data, dir, nil)
+	if err != nil {
+		return nil, err
+	}
+	return doc.pipelineReprs()
+}
+
+func loadDocument(path string, including []string) (*document, error) {
+	if absolute, err := filepath.Abs(path); err == nil {
+		path = absolute
+	}
+	if slices.Contains(including, path) {
+		return nil, fmt.Errorf("'%s' includes itself", path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := parseDocument(data, filepath.Dir(path), append(including, path))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return doc, nil
+}
+
+// Parses a single document and merges all documents included by it. Values
+// of the including document take precedence over included ones, and later
+// includes over earlier ones. A document without a pipeline uses the one of
+// its last include having one.
+func parseDocument(data []byte, dir string, including []string) (*document, error) {
+	var raw interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	doc := &document{}
+	switch raw := raw.(type) {
+	case nil:
+		return doc, nil
+	case []interface{}: // a plain segment list
+		doc.Pipeline = raw
+		return doc, nil
+	}
+	if err := yaml.UnmarshalStrict(data, doc); err != nil {
+		return nil, err
+	}
+	if doc.Pipeline != nil && doc.Pipelines != nil {
+		return nil, fmt.Errorf("only one of pipeline and pipelines may be given")
+	}
+	merged := &document{Vars: make(map[string]interface{}), Templates: make(map[string][]interface{})}
+	for _, include := range doc.Include {
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(dir, include)
+		}
+		included, err := loadDocument(include, including)
+		if err != nil {
+			return nil, fmt.Errorf("including '%s': %w", include, err)
+		}
+		merged.merge(included)
+	}
+	merged.merge(doc)
+	return merged, nil
+}
+
+func (doc *document) merge(other *document) {
+	for name, value := range other.Vars {
+		doc.Vars[name] = value
+	}
+	for name, template := range other.Templates {
+		doc.Templates[name] = template
+	}
+	if other.Pipeline != nil {
+		doc.Pipeline, doc.Pipelines = other.Pipeline, nil
+	}
+	if other.Pipelines != nil {
+		doc.Pipeline, doc.Pipelines = nil, other.Pipelines
+	}
+}
+
+// Instantiates all templates and substitutes all variables in the pipeline,
+// or in all named pipelines, and decodes the result.
+func (doc *document) pipelineReprs() ([]PipelineRepr, error) {
+	if doc.Pipelines == nil {
+		resolved, err := doc.resolveList(doc.Pipeline, doc.Vars, nil)
+		if err != nil {
+			return nil, err
+		}
+		segmentReprs := []SegmentRepr{}
+		if err := decode(resolved, &segmentReprs); err != nil {
+			return nil, err
+		}
+		return []PipelineRepr{{Segments: segmentReprs, Path: "segments"}}, nil
+	}
+	resolved := make([]interface{}, len(doc.Pipelines))
+	for i, item := range doc.Pipelines {
+		pipeline, ok := item.(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("pipelines[%d] must be a mapping, got '%v'", i, item)
+		}
+		resolvedPipeline, err := doc.resolveBranch(pipeline, doc.Vars, nil)
+		if err != nil {
+			return nil, fmt.Errorf("pipelines[%d]: %w", i, err)
+		}
+		resolved[i] = resolvedPipeline
+	}
+	pipelineReprs := []PipelineRepr{}
+	if err := decode(resolved, &pipelineReprs); err != nil {
+		return nil, err
+	}
+	var names []string
+	for i := range pipelineReprs {
+		name := pipelineReprs[i].Name
+		if name == "" {
+			return nil, fmt.Errorf("pipelines[%d] has no name", i)
+		} else if slices.Contains(names, name) {
+			return nil, fmt.Errorf("pipelines[%d]: pipeline name '%s' is used more than once", i, name)
+		}
+		names = append(names, name)
+		pipelineReprs[i].Path = fmt.Sprintf("pipelines[%d].segments", i)
+	}
+	return pipelineReprs, nil
+}
+
+// Decodes a resolved document tree into the provided value.
+func decode(resolved interface{}, out interface{}) error {
+	data, err := yaml.Marshal(resolved)
+	if err != nil {
+		return err
+	}
+	return yaml.Unmarshal(data, out)
+}
+
+// Resolves a segment list using the provided variables. Template instances
+// are replaced by the template's segments, using the parameters given in
+// `with` in addition to the variables. The stack contains the names of the
+// templates being instantiated.
+func (doc *document) resolveList(list []interface{}, vars map[string]interface{}, stack []string) ([]interface{}, error) {
+	var resolved []interface{}
+	for _, item := range list {
+		segment, ok := item.(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("segment must be a mapping, got '%v'", item)
+		}
+		name, ok := segment["template"]
+		if !ok {
+			resolvedSegment, err := doc.resolveSegment(segment, vars, stack)
+			if err != nil {
+				return nil, err
+			}
+			resolved = append(resolved, resolvedSegment)
+			continue
+		}
+		segments, err := doc.instantiate(name, segment, vars, stack)
+		if err != nil {
+			return nil, err
+		}
+		resolved = append(resolved, segments...)
+	}
+	return resolved, nil
+}
+
+func (doc *document) resolveSegment(segment map[interface{}]interface{}, vars map[string]interface{}, stack []string) (map[interface{}]interface{}, error) {
+	resolved := make(map[interface{}]interface{}, len(segment))
+	for key, value := range segment {
+		if list, ok := value.([]interface{}); ok && slices.Contains(nestedSegmentLists, fmt.Sprint(key)) {
+			nested, err := doc.resolveList(list, vars, stack)
+			if err != nil {
+				return nil, fmt.Errorf("%v: %w", key, err)
+			}
+			resolved[key] = nested
+			continue
+		}
+		if list, ok := value.([]interface{}); ok && slices.Contains(nestedBranchLists, fmt.Sprint(key)) {
+			branches := make([]interface{}, len(list))
+			for i, item := range list {
+				branch, ok := item.(map[interface{}]interface{})
+				if !ok {
+					return nil, fmt.Errorf("%v[%d] must be a mapping, got '%v'", key, i, item)
+				}
+				resolvedBranch, err := doc.resolveBranch(branch, vars, stack)
+				if err != nil {
+					return nil, fmt.Errorf("%v[%d]: %w", key, i, err)
+				}
+				branches[i] = resolvedBranch
+			}
+			resolved[key] = branches
+			continue
+		}
+		substituted, err := substitute(value, vars)
+		if err != nil {
+			return nil, err
+		}
+		resolved[key] = substituted
+	}
+	return resolved, nil
+}
+
+func (doc *document) resolveBranch(branch map[interface{}]interface{}, vars map[string]interface{}, stack []string) (map[interface{}]interface{}, error) {
+	resolved := make(map[interface{}]interface{}, len(branch))
+	for key, value := range branch {
+		if list, ok := value.([]interface{}); ok && key == "segments" {
+			nested, err := doc.resolveList(list, vars, stack)
+			if err != nil {
+				return nil, fmt.Errorf("segments: %w", err)
+			}
+			resolved[key] = nested
+			continue
+		}
+		substituted, err := substitute(value, vars)
+		if err != nil {
+			return nil, err
+		}
+		resolved[key] = substituted
+	}
+	return resolved, nil
+}
+
+func (doc *document) instantiate(name interface{}, instance map[interface{}]interface{}, vars map[string]interface{}, stack []string) ([]interface{}, error) {
+	for key := range instance {
+		if key != "template" && key != "with" {
+			return nil, fmt.Errorf("template instance '%v' must only specify 'template' and 'with', got '%v'", name, key)
+		}
+	}
+	template, ok := doc.Templates[fmt.Sprint(name)]
+	if !ok {
+		return nil, fmt.Errorf("template '%v' is not defined", name)
+	}
+	if slices.Contains(stack, fmt.Sprint(name)) {
+		return nil, fmt.Errorf("template '%v' instantiates itself via '%s'", name, strings.Join(stack, "' -> '"))
+	}
+	params := make(map[string]interface{}, len(vars))
+	for key, value := range vars {
+		params[key] = value
+	}
+	with, ok := instance["with"].(map[interface{}]interface{})
+	if !ok && instance["with"] != nil {
+		return nil, fmt.Errorf("parameters of template '%v' must be a mapping", name)
+	}
+	for key, value := range with {
+		substituted, err := substitute(value, vars) // parameters may refer to the caller's variables
+		if err != nil {
+			return nil, err
+		}
+		params[fmt.Sprint(key)] = substituted
+	}
+	segments, err := doc.resolveList(template, params, append(stack, fmt.Sprint(name)))
+	if err != nil {
+		return nil, fmt.Errorf("template '%v': %w", name, err)
+	}
+	return segments, nil
+}
+
+// Substitutes known variables in all strings contained in a value. A string
+// consisting of a single reference is replaced by the variable's value
+// keeping its type, references within longer strings are replaced by the
+// value's string representation.
+func substitute(value interface{}, vars map[string]interface{}) (interface{}, error) {
+	switch value := value.(type) {
+	case string:
+		if match := variablePattern.FindStringSubmatch(value); match != nil && match[0] == value {
+			if replacement, ok := vars[match[1]]; ok {
+				return replacement, nil
+			}
+		}
+		var err error
+		substituted := variablePattern.ReplaceAllStringFunc(value, func(reference string) string {
+			replacement, ok := vars[reference[2:len(reference)-1]]
+			if !ok {
+				return reference
+			}
+			switch replacement.(type) {
+			case map[interface{}]interface{}, []interface{}:
+				err = fmt.Errorf("variable '%s' can not be used within a string, it is not a scalar", reference)
+			}
+			return fmt.Sprint(replacement)
+		})
+		return substituted, err
+	case []interface{}:
+		substituted := make([]interface{}, len(value))
+		for i, item := range value {
+			var err error
+			if substituted[i], err = substitute(item, vars); err != nil {
+				return nil, err
+			}
+		}
+		return substituted, nil
+	case map[interface{}]interface{}:
+		substituted := make(map[interface{}]interface{}, len(value))
+		for key, item := range value {
+			var err error
+			if substituted[key], err = substitute(item, vars); err != nil {
+				return nil, err
+			}
+		}
+		return substituted, nil
+	}
+	return value, nil
+}
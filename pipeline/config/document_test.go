@@ -0,0 +1,308 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseSegmentReprsPlainList(t *testing.T) {
+	segmentReprs, err := ParseSegmentReprs([]byte(`---
+- segment: pass
+  config:
+    foo: ${HOME}
+`), ".")
+	if err != nil {
+		t.Fatalf("([error] Plain configuration failed to parse: %v", err)
+	}
+	if len(segmentReprs) != 1 || segmentReprs[0].Name != "pass" || segmentReprs[0].Config.Config["foo"] != "${HOME}" {
+		t.Errorf("([error] Plain configuration was not parsed as is: %+v", segmentReprs)
+	}
+}
+
+func TestParseSegmentReprsVars(t *testing.T) {
+	segmentReprs, err := ParseSegmentReprs([]byte(`---
+vars:
+  port: 2055
+  jobs: 4
+pipeline:
+  - segment: goflow
+    jobs: ${jobs}
+    config:
+      listen: "netflow://:${port}"
+      port: ${port}
+      other: ${UNKNOWN}
+`), ".")
+	if err != nil {
+		t.Fatalf("([error] Configuration with vars failed to parse: %v", err)
+	}
+	if segmentReprs[0].Jobs != 4 {
+		t.Errorf("([error] Variable was not substituted keeping its type, got %d jobs", segmentReprs[0].Jobs)
+	}
+	config := segmentReprs[0].Config.Config
+	if config["listen"] != "netflow://:2055" || config["port"] != "2055" {
+		t.Errorf("([error] Variables were not substituted: %v", config)
+	}
+	if config["other"] != "${UNKNOWN}" {
+		t.Errorf("([error] Unknown variable was not left for environment expansion: %v", config)
+	}
+}
+
+func TestParseSegmentReprsTemplates(t *testing.T) {
+	segmentReprs, err := ParseSegmentReprs([]byte(`---
+vars:
+  topic: flows
+templates:
+  enrich:
+    - segment: addnetid
+      config:
+        filename: ${netids}
+  export:
+    - template: enrich
+      with:
+        netids: ${prefix}.csv
+    - segment: kafkaproducer
+      config:
+        topic: ${topic}-${prefix}
+pipeline:
+  - segment: stdin
+  - template: export
+    with:
+      prefix: a
+  - segment: branch
+    if:
+      - segment: flowfilter
+    then:
+      - template: export
+        with:
+          prefix: b
+          topic: other
+`), ".")
+	if err != nil {
+		t.Fatalf("([error] Configuration with templates failed to parse: %v", err)
+	}
+	if len(segmentReprs) != 4 {
+		t.Fatalf("([error] Templates were not instantiated, got %d segments", len(segmentReprs))
+	}
+	if segmentReprs[1].Name != "addnetid" || segmentReprs[1].Config.Config["filename"] != "a.csv" {
+		t.Errorf("([error] Nested template was not instantiated with parameters: %+v", segmentReprs[1])
+	}
+	if segmentReprs[2].Config.Config["topic"] != "flows-a" {
+		t.Errorf("([error] Template did not use both variables and parameters: %+v", segmentReprs[2])
+	}
+	then := segmentReprs[3].Then
+	if len(then) != 2 || then[0].Config.Config["filename"] != "b.csv" || then[1].Config.Config["topic"] != "other-b" {
+		t.Errorf("([error] Template was not instantiated within branch: %+v", then)
+	}
+}
+
+func TestParseSegmentReprsTemplateErrors(t *testing.T) {
+	for config, expected := range map[string]string{
+		"pipeline: [{template: missing}]":                                                "template 'missing' is not defined",
+		"templates: {a: [{template: b}], b: [{template: a}]}\npipeline: [{template: a}]": "instantiates itself",
+		"templates: {a: [{segment: pass}]}\npipeline: [{template: a, jobs: 2}]":          "must only specify",
+		"vars: {list: [1, 2]}\npipeline: [{segment: pass, config: {a: 'x${list}'}}]":     "not a scalar",
+		"pipeline: [{segment: pass}]\nunknown: true":                                     "unknown",
+	} {
+		_, err := ParseSegmentReprs([]byte(config), ".")
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("([error] Expected error containing '%s' for '%s', got: %v", expected, config, err)
+		}
+	}
+}
+
+func TestLoadSegmentReprsInclude(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "common"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"common/base.yml": `---
+include: [templates.yml]
+vars:
+  port: 2055
+  topic: flows
+pipeline:
+  - segment: goflow
+    config:
+      listen: "netflow://:${port}"
+  - template: output
+`,
+		"common/templates.yml": `---
+templates:
+  output:
+    - segment: kafkaproducer
+      config:
+        topic: ${topic}
+`,
+		"collector.yml": `---
+include: [common/base.yml]
+vars:
+  port: 2056
+`,
+		"loop.yml": `---
+include: [loop.yml]
+`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	segmentReprs, err := LoadSegmentReprs(filepath.Join(dir, "collector.yml"))
+	if err != nil {
+		t.Fatalf("([error] Configuration with includes failed to load: %v", err)
+	}
+	if len(segmentReprs) != 2 || segmentReprs[0].Config.Config["listen"] != "netflow://:2056" || segmentReprs[1].Config.Config["topic"] != "flows" {
+		t.Errorf("([error] Included pipeline was not used with overridden vars: %+v", segmentReprs)
+	}
+
+	if _, err := LoadSegmentReprs(filepath.Join(dir, "loop.yml")); err == nil || !strings.Contains(err.Error(), "includes itself") {
+		t.Errorf("([error] Recursive include was not detected, got: %v", err)
+	}
+}
+
+func TestParseSegmentReprsTemplatesInTee(t *testing.T) {
+	segmentReprs, err := ParseSegmentReprs([]byte(`---
+templates:
+  export:
+    - segment: kafkaproducer
+      config:
+        topic: ${topic}
+pipeline:
+  - segment: tee
+    branches:
+      - name: kafka
+        buffer: ${buffer}
+        segments:
+          - template: export
+            with:
+              topic: flows
+vars:
+  buffer: 100
+`), ".")
+	if err != nil {
+		t.Fatalf("([error] Configuration with templates in tee failed to parse: %v", err)
+	}
+	branches := segmentReprs[0].Branches
+	if len(branches) != 1 || branches[0].Buffer != 100 || len(branches[0].Segments) != 1 || branches[0].Segments[0].Config.Config["topic"] != "flows" {
+		t.Errorf("([error] Template was not instantiated within tee branch: %+v", branches)
+	}
+}
+
+func TestParseSegmentReprsTemplatesInSwitch(t *testing.T) {
+	segmentReprs, err := ParseSegmentReprs([]byte(`---
+vars:
+  customer: 1
+templates:
+  export:
+    - segment: kafkaproducer
+      config:
+        topic: ${topic}
+pipeline:
+  - segment: switch
+    cases:
+      - filter: cid ${customer}
+        segments:
+          - template: export
+            with:
+              topic: customer-${customer}
+    default:
+      - template: export
+        with:
+          topic: other
+`), ".")
+	if err != nil {
+		t.Fatalf("([error] Configuration with templates in switch failed to parse: %v", err)
+	}
+	cases := segmentReprs[0].Cases
+	if len(cases) != 1 || cases[0].Filter != "cid 1" || cases[0].Segments[0].Config.Config["topic"] != "customer-1" {
+		t.Errorf("([error] Template was not instantiated within switch case: %+v", cases)
+	}
+	if defaults := segmentReprs[0].Default; len(defaults) != 1 || defaults[0].Config.Config["topic"] != "other" {
+		t.Errorf("([error] Template was not instantiated within switch default: %+v", defaults)
+	}
+}
+
+func TestParsePipelineReprs(t *testing.T) {
+	pipelineReprs, err := ParsePipelineReprs([]byte(`---
+vars:
+  topic: flows
+templates:
+  subscribe:
+    - segment: bus_subscribe
+      config:
+        topic: ${topic}
+pipelines:
+  - name: collector
+    segments:
+      - segment: goflow
+      - segment: bus_publish
+        config:
+          topic: ${topic}
+  - name: archive
+    concurrency: 4
+    segments:
+      - template: subscribe
+      - segment: clickhouse
+`), ".")
+	if err != nil {
+		t.Fatalf("([error] Configuration with named pipelines failed to parse: %v", err)
+	}
+	if len(pipelineReprs) != 2 || pipelineReprs[0].Name != "collector" || pipelineReprs[1].Concurrency != 4 {
+		t.Fatalf("([error] Named pipelines were not parsed: %+v", pipelineReprs)
+	}
+	if pipelineReprs[1].Path != "pipelines[1].segments" || pipelineReprs[1].Segments[0].Config.Config["topic"] != "flows" {
+		t.Errorf("([error] Named pipeline was not resolved: %+v", pipelineReprs[1])
+	}
+
+	pipelineReprs, err = ParsePipelineReprs([]byte(`---
+- segment: pass
+`), ".")
+	if err != nil || len(pipelineReprs) != 1 || pipelineReprs[0].Name != "" || pipelineReprs[0].Path != "segments" {
+		t.Errorf("([error] Plain configuration was not parsed as a single unnamed pipeline: %+v, %v", pipelineReprs, err)
+	}
+}
+
+func TestParsePipelineReprsErrors(t *testing.T) {
+	for config, expected := range map[string]string{
+		"pipelines: [{segments: []}]":                         "pipelines[0] has no name",
+		"pipelines: [{name: a}, {name: a}]":                   "pipeline name 'a' is used more than once",
+		"pipeline: [{segment: pass}]\npipelines: [{name: a}]": "only one of pipeline and pipelines",
+	} {
+		_, err := ParsePipelineReprs([]byte(config), ".")
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("([error] Expected error containing '%s' for '%s', got: %v", expected, config, err)
+		}
+	}
+	if _, err := ParseSegmentReprs([]byte("pipelines: [{name: a}]"), "."); err == nil || !strings.Contains(err.Error(), "named pipelines") {
+		t.Errorf("([error] Named pipelines were not rejected where a single list of segments is expected, got: %v", err)
+	}
+}
+
+func TestParseSegmentReprsTemplatesInDeadLetter(t *testing.T) {
+	segmentReprs, err := ParseSegmentReprs([]byte(`---
+vars:
+  spool: /var/spool/flowpipeline
+templates:
+  spool:
+    - segment: json
+      config:
+        filename: ${spool}/${name}.json
+pipeline:
+  - segment: clickhouse
+    deadletter:
+      - template: spool
+        with:
+          name: clickhouse
+`), ".")
+	if err != nil {
+		t.Fatalf("([error] Configuration with templates in a dead letter pipeline failed to parse: %v", err)
+	}
+	deadLetter := segmentReprs[0].DeadLetter
+	if len(deadLetter) != 1 || deadLetter[0].Config.Config["filename"] != "/var/spool/flowpipeline/clickhouse.json" {
+		t.Errorf("([error] Template was not instantiated within dead letter pipeline: %+v", deadLetter)
+	}
+}
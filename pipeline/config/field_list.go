@@ -0,0 +1,28 @@
+package config
+
+import (
+	"strings"
+)
+
+// A list of flow field names. In YAML, it can be given either as a list or as
+// a single, possibly comma-separated string, i.e. `SrcAddr,DstAddr`.
+type FieldList []string
+
+func (fields *FieldList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var list []string
+	if err := unmarshal(&list); err == nil {
+		*fields = list
+		return nil
+	}
+	var single string
+	if err := unmarshal(&single); err != nil {
+		return err
+	}
+	*fields = nil
+	for _, field := range strings.Split(single, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			*fields = append(*fields, field)
+		}
+	}
+	return nil
+}
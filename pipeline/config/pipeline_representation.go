@@ -0,0 +1,11 @@
+package config
+
+// A config representation of a named pipeline. Configurations may define
+// multiple pipelines, which are run side by side and can be connected using
+// the bus segments.
+type PipelineRepr struct {
+	Name        string        `yaml:"name"`                  // unique among all pipelines, empty for configurations defining a single segment list
+	Concurrency int           `yaml:"concurrency,omitempty"` // number of concurrent instances, overrides the `-n` flag if set
+	Segments    []SegmentRepr `yaml:"segments"`
+	Path        string        `yaml:"-"` // position of the segment list in the configuration, set during parsing
+}
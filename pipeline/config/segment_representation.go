@@ -2,38 +2,174 @@ package config
 
 import (
 	"flag"
+	"fmt"
+	"maps"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // A config representation of a segment.
 type SegmentRepr struct {
-	Name   string `yaml:"segment"`        // to be looked up with a registry
-	Config Config `yaml:"config"`         // to be expanded by our instance
-	Jobs   int    `yaml:"jobs,omitempty"` // parallel jobs running the pipeline
+	Name       string          `yaml:"segment"`              // to be looked up with a registry
+	Config     Config          `yaml:"config"`               // to be expanded by our instance
+	Jobs       int             `yaml:"jobs,omitempty"`       // parallel jobs running the pipeline
+	ShardBy    FieldList       `yaml:"shard_by,omitempty"`   // flow fields determining the job of each flow
+	Reorder    *ReorderOptions `yaml:"reorder,omitempty"`    // restore the input order of flows after parallel jobs if set
+	Buffer     int             `yaml:"buffer,omitempty"`     // capacity of the segment's input channel
+	Overflow   string          `yaml:"overflow,omitempty"`   // what to do if the input channel is full, see OverflowPolicies
+	DeadLetter []SegmentRepr   `yaml:"deadletter,omitempty"` // receives the flows the segment failed to deliver, see segments.DeadLetterSegment
+	Path       string          `yaml:"-"`                    // position in the configuration, set during pipeline construction
+	Literal    bool            `yaml:"-"`                    // use the config values as they are, for segments configured from Go code
+	DryRun     bool            `yaml:"-"`                    // build the segment only to check its configuration, see DryRunParameter
 
 	//Adds if/then/else - not part of config for backwards compability
 	BranchOptions `yaml:",inline"`
+	// Adds the sub-pipelines of the tee segment
+	TeeOptions `yaml:",inline"`
+	// Adds the cases of the switch segment
+	SwitchOptions `yaml:",inline"`
+}
+
+// Options for restoring the order of flows leaving a parallel section.
+type ReorderOptions struct {
+	Window  int           `yaml:"window,omitempty"`  // maximum number of flows held back, defaults to DefaultReorderWindow
+	Timeout time.Duration `yaml:"timeout,omitempty"` // maximum time to wait for a missing flow, defaults to DefaultReorderTimeout
+}
+
+const (
+	DefaultReorderWindow  = 10000
+	DefaultReorderTimeout = time.Second
+)
+
+// Returns the options with defaults applied for any unset values.
+func (r ReorderOptions) WithDefaults() ReorderOptions {
+	if r.Window == 0 {
+		r.Window = DefaultReorderWindow
+	}
+	if r.Timeout == 0 {
+		r.Timeout = DefaultReorderTimeout
+	}
+	return r
+}
+
+// Checks the values of the options.
+func (r ReorderOptions) Validate() error {
+	if r.Window < 0 {
+		return fmt.Errorf("reorder window must not be negative, got %d", r.Window)
+	}
+	if r.Timeout < 0 {
+		return fmt.Errorf("reorder timeout must not be negative, got %s", r.Timeout)
+	}
+	return nil
+}
+
+// Policies for flows arriving at a segment whose input channel is full.
+const (
+	OverflowBlock      = "block"       // wait for the segment, backpressuring all previous segments
+	OverflowDropNewest = "drop-newest" // discard the arriving flow
+	OverflowDropOldest = "drop-oldest" // discard the longest waiting flow in the buffer
+)
+
+// All valid values of a SegmentRepr's Overflow field.
+var OverflowPolicies = []string{OverflowBlock, OverflowDropNewest, OverflowDropOldest}
+
+// Checks the buffering options of a SegmentRepr. Policies discarding flows
+// require a buffer to have something to discard from.
+func (s *SegmentRepr) ValidateBuffering() error {
+	return ValidateBuffering(s.Buffer, s.Overflow)
+}
+
+// Checks a buffer capacity and an overflow policy, see OverflowPolicies.
+func ValidateBuffering(buffer int, overflow string) error {
+	if buffer < 0 {
+		return fmt.Errorf("buffer must not be negative, got %d", buffer)
+	}
+	switch overflow {
+	case "", OverflowBlock:
+	case OverflowDropNewest, OverflowDropOldest:
+		if buffer == 0 {
+			return fmt.Errorf("overflow policy '%s' requires a buffer", overflow)
+		}
+	default:
+		return fmt.Errorf("unknown overflow policy '%s', must be one of '%s'", overflow, strings.Join(OverflowPolicies, "', '"))
+	}
+	return nil
+}
+
+// The parameter added to the expanded config of segments which are built only
+// to check a configuration. Their New methods must not create files, connect
+// to remote services or otherwise have effects beyond reading files. It is
+// reserved and can not be set in a configuration file.
+const DryRunParameter = "-dryrun"
+
+// Marks a list of segment representations, including the segments nested in
+// them such as dead letter pipelines and the branches of control flow
+// segments, to be built only to check the configuration.
+func SetDryRun(segmentReprs []SegmentRepr) {
+	for i := range segmentReprs {
+		segmentRepr := &segmentReprs[i]
+		segmentRepr.DryRun = true
+		SetDryRun(segmentRepr.DeadLetter)
+		SetDryRun(segmentRepr.If)
+		SetDryRun(segmentRepr.Then)
+		SetDryRun(segmentRepr.Else)
+		for _, branch := range segmentRepr.Branches {
+			SetDryRun(branch.Segments)
+		}
+		for _, switchCase := range segmentRepr.Cases {
+			SetDryRun(switchCase.Segments)
+		}
+		SetDryRun(segmentRepr.Default)
+	}
 }
 
 // Returns the SegmentRepr's Config with all its variables expanded. It tries
 // to match numeric variables such as '$1' to the corresponding command line
 // argument not matched by flags, or else uses regular environment variable
-// expansion.
-func (s *SegmentRepr) ExpandedConfig() map[string]string {
-	argvMapper := func(placeholderName string) string {
-		argnum, err := strconv.Atoi(placeholderName)
+// expansion. References such as '${file:/run/secrets/pass}' are replaced by
+// the content of the file, found below the provided volume prefix, without a
+// trailing newline. Files which can not be read result in an error. Literal
+// configs are returned unchanged. DryRunParameter is set according to DryRun.
+func (s *SegmentRepr) ExpandedConfig(volumePrefix string) (map[string]string, error) {
+	if s.Literal {
+		expandedConfig := make(map[string]string, len(s.Config.Config))
+		maps.Copy(expandedConfig, s.Config.Config)
+		s.setDryRunParameter(expandedConfig)
+		return expandedConfig, nil
+	}
+	var fileErr error
+	mapper := func(placeholderName string) string {
+		if path, ok := strings.CutPrefix(placeholderName, "file:"); ok {
+			content, err := os.ReadFile(volumePrefix + path)
+			if err != nil {
+				fileErr = err
+				return ""
+			}
+			return strings.TrimSuffix(strings.TrimSuffix(string(content), "\n"), "\r")
+		}
+		argnum, err := strconv.Atoi(placeholderName) // try to convert $n and such to argv[n]
 		if err == nil && argnum < len(flag.Args()) {
 			return flag.Args()[argnum]
 		}
-		return ""
+		return os.Getenv(placeholderName) // if unsuccessful, do regular env expansion
 	}
 	expandedConfig := make(map[string]string)
 	for k, v := range s.Config.Config {
-		expandedConfig[k] = os.Expand(v, argvMapper) // try to convert $n and such to argv[n]
-		if expandedConfig[k] == "" && v != "" {      // if unsuccessful, do regular env expansion
-			expandedConfig[k] = os.ExpandEnv(v)
+		expandedConfig[k] = os.Expand(v, mapper)
+		if fileErr != nil {
+			return nil, fmt.Errorf("config parameter '%s': %w", k, fileErr)
 		}
 	}
-	return expandedConfig
+	s.setDryRunParameter(expandedConfig)
+	return expandedConfig, nil
+}
+
+func (s *SegmentRepr) setDryRunParameter(expandedConfig map[string]string) {
+	if s.DryRun {
+		expandedConfig[DryRunParameter] = "true"
+	} else {
+		delete(expandedConfig, DryRunParameter)
+	}
 }
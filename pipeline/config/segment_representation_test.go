@@ -0,0 +1,61 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExpandedConfigFileReference(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "pass"), []byte("s3cr$t\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("FLOWPIPELINE_TEST_USER", "flows")
+	segmentrepr := SegmentRepr{Config: Config{Config: map[string]string{
+		"pass":     "${file:/pass}",
+		"user":     "${FLOWPIPELINE_TEST_USER}",
+		"combined": "${FLOWPIPELINE_TEST_USER}:${file:/pass}",
+	}}}
+
+	if _, err := segmentrepr.ExpandedConfig(""); err == nil {
+		t.Fatal("([error] Reference to a file outside the volume prefix did not fail.")
+	}
+	expandedConfig, err := segmentrepr.ExpandedConfig(dir)
+	if err != nil {
+		t.Fatalf("([error] Expanding file references failed: %v", err)
+	}
+	if expandedConfig["pass"] != "s3cr$t" {
+		t.Errorf("([error] File reference was not expanded as is without trailing newline, got '%s'", expandedConfig["pass"])
+	}
+	if expandedConfig["user"] != "flows" || expandedConfig["combined"] != "flows:s3cr$t" {
+		t.Errorf("([error] File reference did not work with environment expansion: %v", expandedConfig)
+	}
+}
+
+func TestExpandedConfigDryRun(t *testing.T) {
+	segmentReprs := []SegmentRepr{{
+		Config:     Config{Config: map[string]string{DryRunParameter: "true"}},
+		DeadLetter: []SegmentRepr{{}},
+		TeeOptions: TeeOptions{Branches: []TeeBranch{{Segments: []SegmentRepr{{}}}}},
+	}}
+	expandedConfig, err := segmentReprs[0].ExpandedConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := expandedConfig[DryRunParameter]; ok {
+		t.Error("([error] Dry run parameter could be set in a configuration.")
+	}
+
+	SetDryRun(segmentReprs)
+	if !segmentReprs[0].DryRun || !segmentReprs[0].DeadLetter[0].DryRun || !segmentReprs[0].Branches[0].Segments[0].DryRun {
+		t.Error("([error] Dry run was not set for all nested segments.")
+	}
+	expandedConfig, err = segmentReprs[0].DeadLetter[0].ExpandedConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expandedConfig[DryRunParameter] != "true" {
+		t.Error("([error] Dry run parameter was not set in the expanded config.")
+	}
+}
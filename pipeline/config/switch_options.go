@@ -0,0 +1,16 @@
+package config
+
+// Extension to the segment config definition, adding the cases of the switch
+// segment.
+type SwitchOptions struct {
+	Cases   []SwitchCase  `yaml:"cases,omitempty"`
+	Default []SegmentRepr `yaml:"default,omitempty"`
+}
+
+// A case of the switch segment, consisting of a flowfilter expression and the
+// sub-pipeline receiving the flows matching it.
+type SwitchCase struct {
+	Name     string        `yaml:"name,omitempty"`
+	Filter   string        `yaml:"filter"`
+	Segments []SegmentRepr `yaml:"segments,omitempty"`
+}
@@ -0,0 +1,22 @@
+package config
+
+// Extension to the segment config definition, adding the sub-pipelines of the
+// tee segment.
+type TeeOptions struct {
+	Branches []TeeBranch `yaml:"branches,omitempty"`
+}
+
+// A named sub-pipeline of the tee segment, receiving a copy of every flow.
+// Buffer and Overflow determine how flows are handed to a slow branch, just
+// like the options of the same name of a SegmentRepr.
+type TeeBranch struct {
+	Name     string        `yaml:"name"`
+	Buffer   int           `yaml:"buffer,omitempty"`
+	Overflow string        `yaml:"overflow,omitempty"`
+	Segments []SegmentRepr `yaml:"segments,omitempty"`
+}
+
+// Checks the buffering options of a TeeBranch, see SegmentRepr.ValidateBuffering.
+func (b *TeeBranch) ValidateBuffering() error {
+	return ValidateBuffering(b.Buffer, b.Overflow)
+}
@@ -0,0 +1,82 @@
+package pipeline
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/BelWue/flowpipeline/segments"
+)
+
+// The dead letter pipeline of a segment, shared by all of its jobs. It is
+// started along with the first unit handing flows to it, and closed once all
+// of them are done.
+type deadLetterRoute struct {
+	pipeline *Pipeline
+	writers  atomic.Int32
+	starting sync.Once
+}
+
+func newDeadLetterRoute(pipeline *Pipeline, writers int) *deadLetterRoute {
+	route := &deadLetterRoute{pipeline: pipeline}
+	route.writers.Store(int32(writers))
+	return route
+}
+
+func (route *deadLetterRoute) start() {
+	route.starting.Do(func() {
+		route.pipeline.Start()
+		route.pipeline.AutoDrain()
+	})
+}
+
+func (route *deadLetterRoute) done() {
+	if route.writers.Add(-1) == 0 {
+		route.pipeline.Close()
+	}
+}
+
+// Returns the dead letter pipelines of all segments of this Pipeline,
+// including those of the sections of a batched Pipeline, but not those of
+// embedded pipelines.
+func (pipeline *Pipeline) deadLetterPipelines() []*Pipeline {
+	var deadLetters []*Pipeline
+	for _, stage := range pipeline.stages {
+		if route := stage.units[0].deadLetter; route != nil {
+			deadLetters = append(deadLetters, route.pipeline)
+		}
+	}
+	for _, section := range pipeline.sections {
+		if section.unit == nil {
+			deadLetters = append(deadLetters, section.flows.deadLetterPipelines()...)
+		} else if route := section.unit.deadLetter; route != nil {
+			deadLetters = append(deadLetters, route.pipeline)
+		}
+	}
+	return deadLetters
+}
+
+// Subscribes a unit to the dead letter pipeline, if its segment has one.
+func (unit *unit) subscribeDeadLetters(route *deadLetterRoute) {
+	if route == nil {
+		return
+	}
+	unit.deadLetter = route
+	unit.deadLetters = make(chan *segments.DeadLetter)
+	unit.segment.(segments.DeadLetterSegment).SubscribeDeadLetters(unit.deadLetters) // validated in segmentsFromRepr
+}
+
+// Counts the flows a segment failed to deliver and hands them to its dead
+// letter pipeline, with the reason stored in their Note field. Segments only
+// pass flows they own, see segments.BaseDeadLetterSegment.Keep, and
+// acknowledge them once DeadLetter returned, so they are held once more here.
+func (pipeline *Pipeline) forwardDeadLetters(unit *unit) {
+	unit.deadLetter.start()
+	defer unit.deadLetter.done()
+	for deadLetter := range unit.deadLetters {
+		unit.metrics.deadLettered.Inc()
+		msg := deadLetter.Flow
+		msg.Note = (&SegmentError{Path: unit.position, Name: unit.name, Err: deadLetter.Err}).Error()
+		segments.Hold(msg)
+		unit.deadLetter.pipeline.In <- msg
+	}
+}
@@ -0,0 +1,104 @@
+package pipeline
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/BelWue/flowpipeline/pb"
+	"github.com/BelWue/flowpipeline/pipeline/config"
+	_ "github.com/BelWue/flowpipeline/segments/alert/http"
+	_ "github.com/BelWue/flowpipeline/segments/pass"
+)
+
+func TestPipelineDeadLetter(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	segmentReprs, err := SegmentReprsFromConfig([]byte(`---
+- segment: http
+  jobs: 2
+  config:
+    url: ` + server.URL + `
+  deadletter:
+  - segment: pass`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, batch := range []*config.BatchOptions{nil, {Size: 2}} {
+		var pipeline *Pipeline
+		if batch == nil {
+			pipeline, err = NewFromRepr(segmentReprs, "deadletter_test")
+		} else {
+			pipeline, err = NewBatchedFromRepr(segmentReprs, "deadletter_test", *batch)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		initial := pipeline.Status()
+		tap := NewTap(TapOptions{Position: "deadletter_test[0].deadletter[0]"})
+		if attached := pipeline.Attach(tap); attached != 1 {
+			t.Errorf("([error] Tap was attached to %d segments of the dead letter pipeline, should be 1.", attached)
+		}
+		pipeline.Start()
+		pipeline.AutoDrain()
+		for range 3 {
+			pipeline.In <- &pb.EnrichedFlow{Proto: 6}
+		}
+		pipeline.Close()
+		tap.Close()
+
+		var deadLetters []*pb.EnrichedFlow
+		for msg := range tap.Flows() {
+			deadLetters = append(deadLetters, msg)
+		}
+		if len(deadLetters) != 3 {
+			t.Fatalf("([error] Dead letter pipeline received %d flows, should be 3.", len(deadLetters))
+		}
+		for _, msg := range deadLetters {
+			if msg.Proto != 6 || !strings.HasPrefix(msg.Note, "deadletter_test[0].jobs[") || !strings.HasSuffix(msg.Note, "(http): server endpoint responded with 503 Service Unavailable") {
+				t.Errorf("([error] Dead letter pipeline received an unexpected flow: %v", msg)
+			}
+		}
+
+		status := pipeline.Status()
+		if len(status[0].DeadLetter) != 1 || status[0].DeadLetter[0].Position != "deadletter_test[0].deadletter[0]" {
+			t.Errorf("([error] Pipeline status does not list the dead letter pipeline: %+v", status[0])
+		}
+		if deadLettered := status[0].FlowsDeadLettered - initial[0].FlowsDeadLettered; deadLettered != 3 {
+			t.Errorf("([error] Pipeline status reports %v flows dead lettered, should be 3.", deadLettered)
+		}
+		if len(status[0].Jobs) != 2 || status[0].Jobs[0].DeadLetter != nil {
+			t.Errorf("([error] Pipeline status lists the dead letter pipeline for every job: %+v", status[0])
+		}
+	}
+}
+
+func TestPipelineDeadLetterErrors(t *testing.T) {
+	segmentReprs, err := SegmentReprsFromConfig([]byte(`---
+- segment: pass
+  deadletter:
+  - segment: pass
+- segment: http
+  config:
+    url: http://localhost:8000
+  deadletter:
+  - segment: nonexistent`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewFromRepr(segmentReprs, "segments")
+	if err == nil {
+		t.Fatal("([error] Pipeline with invalid dead letter pipelines was built.")
+	}
+	for _, expected := range []string{
+		"segments[0] (pass): segment does not support a dead letter pipeline",
+		"segments[1].deadletter[0] (nonexistent): ",
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("([error] Error does not contain '%s': %s", expected, err)
+		}
+	}
+}
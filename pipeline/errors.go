@@ -0,0 +1,21 @@
+package pipeline
+
+import (
+	"fmt"
+)
+
+// Annotates an error occuring during the construction of a segment with the
+// segment's position in the configuration, for instance `segments[3].then[1]`.
+type SegmentError struct {
+	Path string // position of the segment in the configuration
+	Name string // name of the segment as configured
+	Err  error
+}
+
+func (e *SegmentError) Error() string {
+	return fmt.Sprintf("%s (%s): %s", e.Path, e.Name, e.Err)
+}
+
+func (e *SegmentError) Unwrap() error {
+	return e.Err
+}
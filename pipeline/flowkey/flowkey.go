@@ -0,0 +1,83 @@
+// This package holds the helpers shared by segments grouping flows by the
+// values of a configurable set of fields, such as aggregate and rollup, and by
+// pipelines sharding flows among the jobs of a segment.
+package flowkey
+
+import (
+	"encoding/binary"
+	"fmt"
+	"reflect"
+
+	"github.com/BelWue/flowpipeline/pb"
+)
+
+// The fields identifying a group of flows, from whose values keys are built.
+type Fields struct {
+	fields []int // indices of the fields in pb.EnrichedFlow
+}
+
+// Creates Fields using the named fields of pb.EnrichedFlow. Only fields of
+// scalar types and byte slices, such as addresses, are supported.
+func NewFields(fieldNames []string) (*Fields, error) {
+	if len(fieldNames) == 0 {
+		return nil, fmt.Errorf("no keys to group flows by")
+	}
+	flowType := reflect.TypeOf(pb.EnrichedFlow{})
+	keyFields := &Fields{}
+	for _, fieldName := range fieldNames {
+		field, ok := flowType.FieldByName(fieldName)
+		if !ok || !field.IsExported() {
+			return nil, fmt.Errorf("key '%s' does not exist", fieldName)
+		}
+		switch field.Type.Kind() {
+		case reflect.Bool, reflect.String,
+			reflect.Int, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint32, reflect.Uint64:
+		case reflect.Slice:
+			if field.Type.Elem().Kind() != reflect.Uint8 {
+				return nil, fmt.Errorf("key '%s' is not supported, it is of type %s", fieldName, field.Type)
+			}
+		default:
+			return nil, fmt.Errorf("key '%s' is not supported, it is of type %s", fieldName, field.Type)
+		}
+		keyFields.fields = append(keyFields.fields, field.Index[0])
+	}
+	return keyFields, nil
+}
+
+// Returns the key of a flow, which is equal for all flows with equal values
+// in the key fields.
+func (keyFields *Fields) Key(flow *pb.EnrichedFlow) string {
+	value := reflect.ValueOf(flow).Elem()
+	var key []byte
+	for _, index := range keyFields.fields {
+		field := value.Field(index)
+		switch field.Kind() {
+		case reflect.Bool:
+			if field.Bool() {
+				key = append(key, 1)
+			} else {
+				key = append(key, 0)
+			}
+		case reflect.String:
+			key = binary.AppendUvarint(key, uint64(field.Len()))
+			key = append(key, field.String()...)
+		case reflect.Int, reflect.Int32, reflect.Int64:
+			key = binary.AppendVarint(key, field.Int())
+		case reflect.Uint, reflect.Uint32, reflect.Uint64:
+			key = binary.AppendUvarint(key, field.Uint())
+		case reflect.Slice:
+			key = binary.AppendUvarint(key, uint64(field.Len()))
+			key = append(key, field.Bytes()...)
+		}
+	}
+	return string(key)
+}
+
+// Copies the values of the key fields from one flow to another.
+func (keyFields *Fields) Copy(dst *pb.EnrichedFlow, src *pb.EnrichedFlow) {
+	dstValue, srcValue := reflect.ValueOf(dst).Elem(), reflect.ValueOf(src).Elem()
+	for _, index := range keyFields.fields {
+		dstValue.Field(index).Set(srcValue.Field(index))
+	}
+}
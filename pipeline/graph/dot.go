@@ -0,0 +1,70 @@
+package graph
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+var dotEdgeAttributes = map[edgeKind]string{
+	edgeFlow:       "",
+	edgeDrop:       "style=dashed",
+	edgeCopy:       "style=bold",
+	edgeDeadLetter: "style=dashed, color=red",
+	edgeBus:        "style=dotted",
+}
+
+// Renders a graph in the Graphviz dot format.
+func renderDot(w io.Writer, g *graph) error {
+	var b strings.Builder
+	b.WriteString("digraph flowpipeline {\n")
+	b.WriteString("\tnode [shape=box];\n")
+	writeDotCluster(&b, &g.root, 1)
+	for _, e := range g.edges {
+		var attributes []string
+		if e.label != "" {
+			attributes = append(attributes, "label="+dotQuote(e.label))
+		}
+		if style := dotEdgeAttributes[e.kind]; style != "" {
+			attributes = append(attributes, style)
+		}
+		fmt.Fprintf(&b, "\t%s -> %s", e.from, e.to)
+		if len(attributes) > 0 {
+			fmt.Fprintf(&b, " [%s]", strings.Join(attributes, ", "))
+		}
+		b.WriteString(";\n")
+	}
+	b.WriteString("}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeDotCluster(b *strings.Builder, c *cluster, depth int) {
+	indent := strings.Repeat("\t", depth)
+	for _, n := range c.nodes {
+		attributes := []string{"label=" + dotQuote(strings.Join(n.lines, "\n"))}
+		if n.parallel {
+			attributes = append(attributes, "peripheries=2")
+		}
+		if n.topic {
+			attributes = append(attributes, "shape=ellipse")
+		}
+		fmt.Fprintf(b, "%s%s [%s];\n", indent, n.id, strings.Join(attributes, ", "))
+	}
+	for _, child := range c.clusters {
+		if child.empty() {
+			continue
+		}
+		fmt.Fprintf(b, "%ssubgraph %s {\n", indent, child.id)
+		fmt.Fprintf(b, "%s\tlabel=%s;\n", indent, dotQuote(child.label))
+		writeDotCluster(b, child, depth+1)
+		fmt.Fprintf(b, "%s}\n", indent)
+	}
+}
+
+func dotQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	return `"` + s + `"`
+}
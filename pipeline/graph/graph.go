@@ -0,0 +1,291 @@
+// Package graph renders the dataflow of pipeline configurations, such as the
+// ones returned by pipeline.PipelineReprsFromFile, as a graph in the Graphviz
+// dot or the Mermaid flowchart format.
+//
+// Every segment is a node labeled with its name, parallelism, buffering and
+// config parameters. Embedded pipelines, such as the `if`, `then` and `else`
+// lists of a `branch` segment, are drawn as nested clusters. Flows dropped by
+// filter segments are drawn as dashed edges wherever they end up, e.g. in the
+// `else` list of a `branch`. Copies made by `tee`, dead letters and flows
+// passing a bus topic are drawn as edges of their own.
+package graph
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/BelWue/flowpipeline/pipeline/config"
+	"github.com/BelWue/flowpipeline/segments"
+)
+
+// The formats supported by Render.
+const (
+	FormatDot     = "dot"
+	FormatMermaid = "mermaid"
+)
+
+// All valid formats of Render.
+var Formats = []string{FormatDot, FormatMermaid}
+
+// Config values longer than this are shortened in node labels.
+const maxValueLength = 40
+
+// Renders the dataflow graph of the provided pipelines in the provided
+// format. Config parameters listed in config.RedactedParameters are redacted.
+func Render(w io.Writer, format string, pipelineReprs []config.PipelineRepr) error {
+	var render func(io.Writer, *graph) error
+	switch format {
+	case FormatDot:
+		render = renderDot
+	case FormatMermaid:
+		render = renderMermaid
+	default:
+		return fmt.Errorf("unknown graph format '%s', must be one of '%s'", format, strings.Join(Formats, "', '"))
+	}
+	return render(w, build(pipelineReprs))
+}
+
+// The kinds of edges, determining their style.
+type edgeKind int
+
+const (
+	edgeFlow       edgeKind = iota // flows handed on
+	edgeDrop                       // flows dropped by a filter segment
+	edgeCopy                       // copies of flows made by tee
+	edgeDeadLetter                 // flows a segment failed to deliver
+	edgeBus                        // flows passing a bus topic
+)
+
+type node struct {
+	id       string
+	lines    []string // the first line being the segment name
+	parallel bool
+	topic    bool
+}
+
+type edge struct {
+	from  string
+	to    string
+	label string
+	kind  edgeKind
+}
+
+// A group of nodes, such as a named pipeline or an embedded pipeline.
+type cluster struct {
+	id       string
+	label    string
+	nodes    []*node
+	clusters []*cluster
+}
+
+type graph struct {
+	root   cluster
+	edges  []edge
+	topics map[string]*node
+}
+
+// An end of a node the next node is connected to, along with the label and
+// kind of the resulting edge.
+type port struct {
+	from  string
+	label string
+	kind  edgeKind
+}
+
+func build(pipelineReprs []config.PipelineRepr) *graph {
+	g := &graph{topics: make(map[string]*node)}
+	for _, pipelineRepr := range pipelineReprs {
+		parent := &g.root
+		if pipelineRepr.Name != "" {
+			parent = g.cluster(parent, pipelineRepr.Path, "pipeline "+pipelineRepr.Name)
+		}
+		g.segmentList(parent, pipelineRepr.Segments, pipelineRepr.Path, nil)
+	}
+	return g
+}
+
+// Adds a list of segments found at path to the parent cluster, connecting the
+// first one to the provided ports. Returns the ports of the last segment and
+// the ports of all segments whose dropped flows end up at the list's drops,
+// just like Pipeline.GetDrop does.
+func (g *graph) segmentList(parent *cluster, segmentReprs []config.SegmentRepr, path string, in []port) (out []port, drops []port) {
+	out = in
+	for i, segmentRepr := range segmentReprs {
+		var segmentDrops []port
+		out, segmentDrops = g.segment(parent, segmentRepr, fmt.Sprintf("%s[%d]", path, i), out)
+		drops = append(drops, segmentDrops...)
+	}
+	return out, drops
+}
+
+// Adds a single segment, see segmentList.
+func (g *graph) segment(parent *cluster, segmentRepr config.SegmentRepr, path string, in []port) (out []port, drops []port) {
+	name := strings.ToLower(segmentRepr.Name)
+	if name == "branch" {
+		return g.branch(parent, segmentRepr, path, in)
+	}
+
+	n := g.node(parent, path, segmentRepr)
+	g.connect(in, n.id)
+	out = []port{{from: n.id}}
+	if template, err := segments.LookupSegment(name); err == nil {
+		if _, ok := template.(segments.FilterSegment); ok {
+			drops = []port{{from: n.id, label: "drop", kind: edgeDrop}}
+		}
+	}
+	if len(segmentRepr.DeadLetter) > 0 {
+		deadLetter := g.cluster(parent, path+".deadletter", path+" deadletter")
+		g.segmentList(deadLetter, segmentRepr.DeadLetter, path+".deadletter", []port{{from: n.id, label: "deadletter", kind: edgeDeadLetter}})
+	}
+
+	switch name {
+	case "tee":
+		for i, branch := range segmentRepr.Branches {
+			branchPath := fmt.Sprintf("%s.branches[%d]", path, i)
+			label := "tee " + branch.Name
+			if branch.Buffer != 0 || branch.Overflow != "" {
+				label += " (" + buffering(branch.Buffer, branch.Overflow) + ")"
+			}
+			g.segmentList(g.cluster(parent, branchPath, label), branch.Segments, branchPath+".segments", []port{{from: n.id, label: "copy", kind: edgeCopy}})
+		}
+	case "switch":
+		out = nil
+		for i, switchCase := range segmentRepr.Cases {
+			casePath := fmt.Sprintf("%s.cases[%d]", path, i)
+			label := switchCase.Name
+			if label == "" {
+				label = strconv.Itoa(i)
+			}
+			caseOut, caseDrops := g.segmentList(g.cluster(parent, casePath, "case "+label), switchCase.Segments, casePath+".segments", []port{{from: n.id, label: switchCase.Filter}})
+			out = append(out, caseOut...)
+			drops = append(drops, caseDrops...)
+		}
+		defaultOut, defaultDrops := g.segmentList(g.cluster(parent, path+".default", "default"), segmentRepr.Default, path+".default", []port{{from: n.id, label: "default"}})
+		out = append(out, defaultOut...)
+		drops = append(drops, defaultDrops...)
+	case "bus_publish":
+		g.connect([]port{{from: n.id, kind: edgeBus}}, g.topic(segmentRepr.Config.Config["topic"]).id)
+	case "bus_subscribe":
+		g.connect([]port{{from: g.topic(segmentRepr.Config.Config["topic"]).id, kind: edgeBus}}, n.id)
+	}
+	return out, drops
+}
+
+// Adds a branch segment as a cluster of its embedded pipelines. Flows dropped
+// in the `if` list continue in the `else` list, flows dropped in the `then`
+// and `else` lists are the branch's drops, unless `bypass-messages` is set.
+func (g *graph) branch(parent *cluster, segmentRepr config.SegmentRepr, path string, in []port) (out []port, drops []port) {
+	label := path + " branch"
+	bypass, _ := strconv.ParseBool(segmentRepr.Config.Config["bypass-messages"])
+	if bypass {
+		label += " (bypass-messages)"
+	}
+	branch := g.cluster(parent, path, label)
+	conditionOut, conditionDrops := g.segmentList(g.cluster(branch, path+".if", "if"), segmentRepr.If, path+".if", in)
+	thenOut, thenDrops := g.segmentList(g.cluster(branch, path+".then", "then"), segmentRepr.Then, path+".then", relabel(conditionOut, "then", edgeFlow))
+	elseOut, elseDrops := g.segmentList(g.cluster(branch, path+".else", "else"), segmentRepr.Else, path+".else", relabel(conditionDrops, "else", edgeDrop))
+	out = slices.Concat(thenOut, elseOut)
+	drops = slices.Concat(thenDrops, elseDrops)
+	if bypass {
+		return slices.Concat(out, drops), nil
+	}
+	return out, drops
+}
+
+// Returns a copy of ports with the provided label and kind.
+func relabel(ports []port, label string, kind edgeKind) []port {
+	result := make([]port, len(ports))
+	for i, p := range ports {
+		result[i] = port{from: p.from, label: label, kind: kind}
+	}
+	return result
+}
+
+func (g *graph) connect(in []port, to string) {
+	for _, p := range in {
+		g.edges = append(g.edges, edge{from: p.from, to: to, label: p.label, kind: p.kind})
+	}
+}
+
+func (g *graph) cluster(parent *cluster, path string, label string) *cluster {
+	c := &cluster{id: "cluster_" + identifier(path), label: label}
+	parent.clusters = append(parent.clusters, c)
+	return c
+}
+
+func (g *graph) node(parent *cluster, path string, segmentRepr config.SegmentRepr) *node {
+	n := &node{id: identifier(path), lines: []string{segmentRepr.Name}}
+	if segmentRepr.Jobs > 1 {
+		n.parallel = true
+		jobs := fmt.Sprintf("jobs: %d", segmentRepr.Jobs)
+		if len(segmentRepr.ShardBy) > 0 {
+			jobs += ", shard_by: " + strings.Join(segmentRepr.ShardBy, ",")
+		}
+		if segmentRepr.Reorder != nil {
+			jobs += ", reordered"
+		}
+		n.lines = append(n.lines, jobs)
+	}
+	if segmentRepr.Buffer != 0 || segmentRepr.Overflow != "" {
+		n.lines = append(n.lines, buffering(segmentRepr.Buffer, segmentRepr.Overflow))
+	}
+	parameters := make([]string, 0, len(segmentRepr.Config.Config))
+	for key := range segmentRepr.Config.Config {
+		parameters = append(parameters, key)
+	}
+	slices.Sort(parameters)
+	for _, key := range parameters {
+		value := segmentRepr.Config.Config[key]
+		if slices.Contains(config.RedactedParameters, key) {
+			value = "<redacted>"
+		} else if utf8.RuneCountInString(value) > maxValueLength {
+			value = string([]rune(value)[:maxValueLength-1]) + "…"
+		}
+		n.lines = append(n.lines, key+": "+value)
+	}
+	parent.nodes = append(parent.nodes, n)
+	return n
+}
+
+// Returns the node of a bus topic, which is shared by all pipelines.
+func (g *graph) topic(name string) *node {
+	if n, ok := g.topics[name]; ok {
+		return n
+	}
+	n := &node{id: "topic_" + identifier(name), lines: []string{"topic " + name}, topic: true}
+	g.topics[name] = n
+	g.root.nodes = append(g.root.nodes, n)
+	return n
+}
+
+func buffering(buffer int, overflow string) string {
+	if overflow == "" {
+		overflow = config.OverflowBlock
+	}
+	return fmt.Sprintf("buffer: %d, %s", buffer, overflow)
+}
+
+var nonIdentifierChars = regexp.MustCompile(`[^A-Za-z0-9]+`)
+
+// Returns an identifier valid in both formats for a position.
+func identifier(path string) string {
+	return strings.Trim(nonIdentifierChars.ReplaceAllString(path, "_"), "_")
+}
+
+// Reports whether a cluster contains no nodes, not even in nested clusters.
+func (c *cluster) empty() bool {
+	if len(c.nodes) > 0 {
+		return false
+	}
+	for _, child := range c.clusters {
+		if !child.empty() {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,143 @@
+package graph
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/BelWue/flowpipeline/pipeline/config"
+	_ "github.com/BelWue/flowpipeline/segments/controlflow/branch"
+	_ "github.com/BelWue/flowpipeline/segments/controlflow/bus"
+	_ "github.com/BelWue/flowpipeline/segments/controlflow/switch"
+	_ "github.com/BelWue/flowpipeline/segments/filter/flowfilter"
+	_ "github.com/BelWue/flowpipeline/segments/modify/dropfields"
+	_ "github.com/BelWue/flowpipeline/segments/output/kafkaproducer"
+	_ "github.com/BelWue/flowpipeline/segments/pass"
+)
+
+func render(t *testing.T, format string, configuration string) string {
+	t.Helper()
+	pipelineReprs, err := config.ParsePipelineReprs([]byte(configuration), ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	if err := Render(&b, format, pipelineReprs); err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+const branchConfig = `---
+- segment: branch
+  if:
+  - segment: flowfilter
+    jobs: 4
+    config:
+      filter: proto tcp
+  then:
+  - segment: dropfields
+    buffer: 100
+    overflow: drop-oldest
+    config:
+      policy: drop
+      fields: InIf
+- segment: kafkaproducer
+  config:
+    topic: flows
+    pass: secret
+  deadletter:
+  - segment: pass
+`
+
+func TestRenderDot(t *testing.T) {
+	expected := `digraph flowpipeline {
+	node [shape=box];
+	segments_1 [label="kafkaproducer\npass: <redacted>\ntopic: flows"];
+	subgraph cluster_segments_0 {
+		label="segments[0] branch";
+		subgraph cluster_segments_0_if {
+			label="if";
+			segments_0_if_0 [label="flowfilter\njobs: 4\nfilter: proto tcp", peripheries=2];
+		}
+		subgraph cluster_segments_0_then {
+			label="then";
+			segments_0_then_0 [label="dropfields\nbuffer: 100, drop-oldest\nfields: InIf\npolicy: drop"];
+		}
+	}
+	subgraph cluster_segments_1_deadletter {
+		label="segments[1] deadletter";
+		segments_1_deadletter_0 [label="pass"];
+	}
+	segments_0_if_0 -> segments_0_then_0 [label="then"];
+	segments_0_then_0 -> segments_1;
+	segments_0_if_0 -> segments_1 [label="else", style=dashed];
+	segments_1 -> segments_1_deadletter_0 [label="deadletter", style=dashed, color=red];
+}
+`
+	if rendered := render(t, FormatDot, branchConfig); rendered != expected {
+		t.Errorf("([error] Rendered unexpected dot graph:\n%s", rendered)
+	}
+}
+
+func TestRenderMermaid(t *testing.T) {
+	rendered := render(t, FormatMermaid, branchConfig)
+	for _, expected := range []string{
+		"flowchart TD\n",
+		"\tsubgraph cluster_segments_0 [\"segments[0] branch\"]\n",
+		"\t\t\tsegments_0_if_0[[\"flowfilter<br/>jobs: 4<br/>filter: proto tcp\"]]\n",
+		"\tsegments_1[\"kafkaproducer<br/>pass: #lt;redacted#gt;<br/>topic: flows\"]\n",
+		"\tsegments_0_if_0 -.->|\"else\"| segments_1\n",
+		"\tsegments_0_if_0 -->|\"then\"| segments_0_then_0\n",
+	} {
+		if !strings.Contains(rendered, expected) {
+			t.Errorf("([error] Rendered mermaid graph does not contain %q:\n%s", expected, rendered)
+		}
+	}
+}
+
+func TestRenderNamedPipelines(t *testing.T) {
+	rendered := render(t, FormatDot, `---
+pipelines:
+- name: ingest
+  segments:
+  - segment: bus_publish
+    config:
+      topic: all
+- name: tcp
+  segments:
+  - segment: bus_subscribe
+    config:
+      topic: all
+  - segment: switch
+    cases:
+    - name: web
+      filter: port 443
+      segments:
+      - segment: flowfilter
+        config:
+          filter: proto tcp
+    default:
+    - segment: pass
+  - segment: pass
+`)
+	for _, expected := range []string{
+		"\tsubgraph cluster_pipelines_1_segments {\n\t\tlabel=\"pipeline tcp\";\n",
+		"\tpipelines_0_segments_0 -> topic_all [style=dotted];\n",
+		"\ttopic_all -> pipelines_1_segments_0 [style=dotted];\n",
+		"\tpipelines_1_segments_1 -> pipelines_1_segments_1_cases_0_segments_0 [label=\"port 443\"];\n",
+		"\tpipelines_1_segments_1 -> pipelines_1_segments_1_default_0 [label=\"default\"];\n",
+		"\tpipelines_1_segments_1_cases_0_segments_0 -> pipelines_1_segments_2;\n",
+		"\tpipelines_1_segments_1_default_0 -> pipelines_1_segments_2;\n",
+	} {
+		if !strings.Contains(rendered, expected) {
+			t.Errorf("([error] Rendered dot graph does not contain %q:\n%s", expected, rendered)
+		}
+	}
+}
+
+func TestRenderUnknownFormat(t *testing.T) {
+	err := Render(&strings.Builder{}, "png", nil)
+	if err == nil || !strings.Contains(err.Error(), "unknown graph format 'png'") {
+		t.Errorf("([error] Rendering an unknown format did not fail as expected: %v", err)
+	}
+}
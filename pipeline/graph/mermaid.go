@@ -0,0 +1,62 @@
+package graph
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+var mermaidArrows = map[edgeKind]string{
+	edgeFlow:       "-->",
+	edgeDrop:       "-.->",
+	edgeCopy:       "==>",
+	edgeDeadLetter: "-.->",
+	edgeBus:        "-.->",
+}
+
+var mermaidEscaper = strings.NewReplacer(
+	`"`, "#quot;",
+	"<", "#lt;",
+	">", "#gt;",
+	"|", "#124;",
+	"\n", "<br/>",
+)
+
+// Renders a graph in the Mermaid flowchart format.
+func renderMermaid(w io.Writer, g *graph) error {
+	var b strings.Builder
+	b.WriteString("flowchart TD\n")
+	writeMermaidCluster(&b, &g.root, 1)
+	for _, e := range g.edges {
+		fmt.Fprintf(&b, "\t%s %s", e.from, mermaidArrows[e.kind])
+		if e.label != "" {
+			fmt.Fprintf(&b, "|\"%s\"|", mermaidEscaper.Replace(e.label))
+		}
+		fmt.Fprintf(&b, " %s\n", e.to)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeMermaidCluster(b *strings.Builder, c *cluster, depth int) {
+	indent := strings.Repeat("\t", depth)
+	for _, n := range c.nodes {
+		label := mermaidEscaper.Replace(strings.Join(n.lines, "\n"))
+		switch {
+		case n.topic:
+			fmt.Fprintf(b, "%s%s([\"%s\"])\n", indent, n.id, label)
+		case n.parallel:
+			fmt.Fprintf(b, "%s%s[[\"%s\"]]\n", indent, n.id, label)
+		default:
+			fmt.Fprintf(b, "%s%s[\"%s\"]\n", indent, n.id, label)
+		}
+	}
+	for _, child := range c.clusters {
+		if child.empty() {
+			continue
+		}
+		fmt.Fprintf(b, "%ssubgraph %s [\"%s\"]\n", indent, child.id, mermaidEscaper.Replace(child.label))
+		writeMermaidCluster(b, child, depth+1)
+		fmt.Fprintf(b, "%send\n", indent)
+	}
+}
@@ -0,0 +1,77 @@
+package pipeline
+
+import (
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/BelWue/flowpipeline/segments"
+)
+
+var (
+	segmentLabels = []string{"segment", "position"}
+
+	flowsIn = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "flowpipeline_segment_flows_in_total",
+		Help: "Number of flows received by a segment.",
+	}, segmentLabels)
+	flowsOut = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "flowpipeline_segment_flows_out_total",
+		Help: "Number of flows emitted by a segment.",
+	}, segmentLabels)
+	flowsDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "flowpipeline_segment_flows_dropped_total",
+		Help: "Number of flows dropped by a filter segment.",
+	}, segmentLabels)
+	flowsDeadLettered = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "flowpipeline_segment_flows_dead_lettered_total",
+		Help: "Number of flows a segment failed to deliver and handed to its dead letter pipeline.",
+	}, segmentLabels)
+	flowsOverflowed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "flowpipeline_segment_flows_overflowed_total",
+		Help: "Number of flows discarded because a segment's input buffer was full.",
+	}, segmentLabels)
+	flowsReorderSkipped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "flowpipeline_segment_reorder_skipped_total",
+		Help: "Number of flows given up on while restoring the order of flows after parallel jobs.",
+	}, segmentLabels)
+	sendBlocked = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "flowpipeline_segment_send_blocked_seconds_total",
+		Help: "Time a segment spent waiting for the next segment to accept its flows.",
+	}, segmentLabels)
+)
+
+func init() {
+	segments.MetricsRegistry.MustRegister(flowsIn, flowsOut, flowsDropped, flowsDeadLettered, flowsOverflowed, flowsReorderSkipped, sendBlocked)
+}
+
+// Set if pipelines are built without relaying the flows between segments.
+var uninstrumented atomic.Bool
+
+// Sets whether pipelines built from now on relay the flows between their
+// segments, which keeps the metrics and the status of the segments up to date
+// and allows attaching taps. Otherwise, segments are connected directly
+// wherever possible, saving a hand-off per segment. Enabled by default.
+func SetInstrumentation(enabled bool) {
+	uninstrumented.Store(!enabled)
+}
+
+// The metrics kept for a single segment instance. Instances with the same
+// name and position, i.e. in concurrent pipelines, share their counters.
+type segmentMetrics struct {
+	in           prometheus.Counter
+	out          prometheus.Counter
+	dropped      prometheus.Counter
+	deadLettered prometheus.Counter
+	blocked      prometheus.Counter
+}
+
+func newSegmentMetrics(name string, position string) *segmentMetrics {
+	return &segmentMetrics{
+		in:           flowsIn.WithLabelValues(name, position),
+		out:          flowsOut.WithLabelValues(name, position),
+		dropped:      flowsDropped.WithLabelValues(name, position),
+		deadLettered: flowsDeadLettered.WithLabelValues(name, position),
+		blocked:      sendBlocked.WithLabelValues(name, position),
+	}
+}
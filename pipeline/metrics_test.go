@@ -0,0 +1,74 @@
+package pipeline
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/BelWue/flowpipeline/pb"
+	_ "github.com/BelWue/flowpipeline/segments/filter/flowfilter"
+	_ "github.com/BelWue/flowpipeline/segments/pass"
+)
+
+func TestPipelineMetrics(t *testing.T) {
+	segmentReprs, err := SegmentReprsFromConfig([]byte(`---
+- segment: pass
+- segment: flowfilter
+  jobs: 2
+  config:
+    filter: proto tcp
+- segment: pass`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline, err := NewFromRepr(segmentReprs, "metrics_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// counters are shared by all pipelines, compare against their initial values
+	counters := map[string]prometheus.Counter{
+		"first in":     flowsIn.WithLabelValues("pass", "metrics_test[0]"),
+		"first out":    flowsOut.WithLabelValues("pass", "metrics_test[0]"),
+		"job 0 in":     flowsIn.WithLabelValues("flowfilter", "metrics_test[1].jobs[0]"),
+		"job 1 in":     flowsIn.WithLabelValues("flowfilter", "metrics_test[1].jobs[1]"),
+		"job 0 out":    flowsOut.WithLabelValues("flowfilter", "metrics_test[1].jobs[0]"),
+		"job 1 out":    flowsOut.WithLabelValues("flowfilter", "metrics_test[1].jobs[1]"),
+		"job 0 drops":  flowsDropped.WithLabelValues("flowfilter", "metrics_test[1].jobs[0]"),
+		"job 1 drops":  flowsDropped.WithLabelValues("flowfilter", "metrics_test[1].jobs[1]"),
+		"last in":      flowsIn.WithLabelValues("pass", "metrics_test[2]"),
+		"last out":     flowsOut.WithLabelValues("pass", "metrics_test[2]"),
+		"last dropped": flowsDropped.WithLabelValues("pass", "metrics_test[2]"),
+	}
+	initial := make(map[string]float64)
+	for name, counter := range counters {
+		initial[name] = testutil.ToFloat64(counter)
+	}
+	delta := func(names ...string) float64 {
+		var sum float64
+		for _, name := range names {
+			sum += testutil.ToFloat64(counters[name]) - initial[name]
+		}
+		return sum
+	}
+
+	pipeline.Start()
+	pipeline.AutoDrain()
+	for range 3 {
+		pipeline.In <- &pb.EnrichedFlow{Proto: 6}
+	}
+	pipeline.In <- &pb.EnrichedFlow{Proto: 17}
+	pipeline.Close()
+
+	if in, out := delta("first in"), delta("first out"); in != 4 || out != 4 {
+		t.Errorf("([error] Expected 4 flows in and out of the first segment, got %v and %v.", in, out)
+	}
+	in, out, dropped := delta("job 0 in", "job 1 in"), delta("job 0 out", "job 1 out"), delta("job 0 drops", "job 1 drops")
+	if in != 4 || out != 3 || dropped != 1 {
+		t.Errorf("([error] Expected 4 flows in, 3 out and 1 dropped by the parallel jobs, got %v, %v and %v.", in, out, dropped)
+	}
+	if in, out, dropped := delta("last in"), delta("last out"), delta("last dropped"); in != 3 || out != 3 || dropped != 0 {
+		t.Errorf("([error] Expected 3 flows in and out of the last segment, got %v and %v with %v dropped.", in, out, dropped)
+	}
+}
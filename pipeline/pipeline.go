@@ -2,11 +2,15 @@
 package pipeline
 
 import (
+	"context"
+	"fmt"
 	"sync"
+	"sync/atomic"
 
 	"github.com/rs/zerolog/log"
 
 	"github.com/BelWue/flowpipeline/pb"
+	"github.com/BelWue/flowpipeline/pipeline/config"
 	"github.com/BelWue/flowpipeline/segments"
 	"github.com/BelWue/flowpipeline/segments/pass"
 )
@@ -20,6 +24,15 @@ type Pipeline struct {
 	Drop        chan *pb.EnrichedFlow
 	wg          *sync.WaitGroup
 	SegmentList []segments.Segment
+	stages      []*stage
+	sections    []*batchSection // used instead of stages by the batched transport
+	relays      []func()
+	dropTarget  atomic.Pointer[chan *pb.EnrichedFlow]
+	parent      *Pipeline // the batched Pipeline this one is a section of, if any
+	coordinator *segments.ShutdownCoordinator
+	closing     sync.Once
+	done        chan struct{}
+	finished    sync.Once
 }
 
 func (pipeline *Pipeline) GetInput() chan *pb.EnrichedFlow {
@@ -34,15 +47,11 @@ func (pipeline *Pipeline) GetDrop() <-chan *pb.EnrichedFlow {
 	if pipeline.Drop != nil {
 		return pipeline.Drop
 	}
-	pipeline.Drop = make(chan *pb.EnrichedFlow)
-	// Subscribe to drops from special segments, namely all based on
-	// BaseFilterSegment grouped in the filter directory.
-	for _, segment := range pipeline.SegmentList {
-		value, implementsFilter := segment.(segments.FilterSegment)
-		if implementsFilter {
-			value.SubscribeDrops(pipeline.Drop)
-		}
-	}
+	drop := make(chan *pb.EnrichedFlow)
+	pipeline.Drop = drop
+	// From now on, forward drops from special segments, namely all based
+	// on BaseFilterSegment grouped in the filter directory.
+	pipeline.dropTarget.Store(&drop)
 	// If there are no filter/* segments, this channel will never have
 	// messages available.
 	return pipeline.Drop
@@ -51,10 +60,11 @@ func (pipeline *Pipeline) GetDrop() <-chan *pb.EnrichedFlow {
 // Starts up a goroutine specific to this Pipeline which reads any message from
 // the Out channel and discards it. This is a convenience function to enable
 // having a segment at the end of the pipeline handle all results, i.e. having
-// no post-pipeline processing.
+// no post-pipeline processing. Drained flows are acknowledged.
 func (pipeline *Pipeline) AutoDrain() {
 	go func() {
-		for range pipeline.Out {
+		for msg := range pipeline.Out {
+			segments.Ack(msg)
 		}
 		log.Info().Msg("Pipeline closed, auto draining finished.")
 	}()
@@ -63,16 +73,111 @@ func (pipeline *Pipeline) AutoDrain() {
 // Closes down a Pipeline by closing its In channel and waiting for all
 // segments to propagate this close event through the full pipeline,
 // terminating all segment goroutines and thus releasing the waitgroup.
-// Blocking.
+// Blocking. This is also called when one of the segments requests a
+// shutdown, further calls only wait for the Pipeline to be closed.
 func (pipeline *Pipeline) Close() {
-	defer func() {
-		recover() // in case In is already closed
-		pipeline.wg.Wait()
-	}()
+	pipeline.closing.Do(func() {
+		defer func() {
+			recover() // in case In is already closed
+		}()
+		for _, segment := range pipeline.SegmentList {
+			segment.Close()
+		}
+		close(pipeline.In)
+	})
+	pipeline.wg.Wait()
+	if drop := pipeline.dropTarget.Swap(nil); drop != nil {
+		close(*drop)
+	}
+	pipeline.finished.Do(func() {
+		close(pipeline.done)
+	})
+}
+
+// Closes down a Pipeline just like Close, but gives up waiting once the
+// provided context is done. In that case, the contexts of all segments are
+// canceled to stop them from flushing any further, and the returned error
+// contains segments.ErrFlushDeadline. Otherwise, the errors reported by
+// segments failing to flush their flows are returned.
+func (pipeline *Pipeline) Shutdown(ctx context.Context) error {
+	return shutdown(ctx, pipeline.Close, pipeline.coordinator)
+}
+
+// Returns a channel which is closed once the Pipeline is closed, be it by
+// calling Close or on request of one of its segments.
+func (pipeline *Pipeline) Done() <-chan struct{} {
+	return pipeline.done
+}
+
+// Hands the provided ShutdownCoordinator to all segments of this Pipeline,
+// including those of its dead letter pipelines. Segments embedding further
+// pipelines use this to make them take part in the shutdown of their own
+// pipeline.
+func (pipeline *Pipeline) SetShutdownCoordinator(coordinator *segments.ShutdownCoordinator) {
+	pipeline.coordinator = coordinator
 	for _, segment := range pipeline.SegmentList {
-		segment.Close()
+		if coordinated, ok := segment.(segments.CoordinatedSegment); ok {
+			coordinated.SetShutdownCoordinator(coordinator)
+		}
+	}
+	for _, deadLetter := range pipeline.deadLetterPipelines() {
+		deadLetter.SetShutdownCoordinator(coordinator)
+	}
+}
+
+// Makes the segments of a Pipeline which is never started let go of anything
+// they hold on to since their construction, see segments.DiscardableSegment.
+// This includes the segments of its dead letter pipelines.
+func (pipeline *Pipeline) Discard() {
+	discard(pipeline.SegmentList)
+	for _, deadLetter := range pipeline.deadLetterPipelines() {
+		deadLetter.Discard()
+	}
+}
+
+func discard(segmentList []segments.Segment) {
+	for _, segment := range segmentList {
+		if discardable, ok := segment.(segments.DiscardableSegment); ok {
+			discardable.Discard()
+		}
 	}
-	close(pipeline.In)
+}
+
+// Adds a function to be called for every flow replaced by one of the segments
+// of this Pipeline, see segments.ReplacingSegment.
+func (pipeline *Pipeline) SubscribeReplacements(replaced func(msg *pb.EnrichedFlow, replacements []*pb.EnrichedFlow)) {
+	for _, segment := range pipeline.SegmentList {
+		if replacing, ok := segment.(segments.ReplacingSegment); ok {
+			replacing.SubscribeReplacements(replaced)
+		}
+	}
+}
+
+// Sets up the shutdown coordination of a newly built Pipeline, which is
+// closed once any of its segments requests a shutdown.
+func (pipeline *Pipeline) initShutdown() {
+	pipeline.done = make(chan struct{})
+	pipeline.SetShutdownCoordinator(segments.NewShutdownCoordinator(pipeline.Close))
+}
+
+// Runs closeFunc, but stops waiting for it once ctx is done and expires the
+// coordinator instead.
+func shutdown(ctx context.Context, closeFunc func(), coordinator *segments.ShutdownCoordinator) error {
+	closed := make(chan struct{}, 1) // not read anymore once ctx is done
+	go func() {
+		closeFunc()
+		closed <- struct{}{}
+	}()
+	select {
+	case <-closed:
+	case <-ctx.Done():
+		select {
+		case <-closed: // prefer a close finishing just in time
+		default:
+			coordinator.Expire()
+		}
+	}
+	return coordinator.Err()
 }
 
 // Initializes a new Pipeline object and then starts all segment goroutines
@@ -82,22 +187,45 @@ func New(segmentList ...segments.Segment) *Pipeline {
 	if len(segmentList) == 0 {
 		segmentList = []segments.Segment{&pass.Pass{}}
 	}
-	channels := make([]chan *pb.EnrichedFlow, len(segmentList)+1)
-	channels[0] = make(chan *pb.EnrichedFlow)
+	segmentReprs := make([]config.SegmentRepr, len(segmentList))
 	for i, segment := range segmentList {
 		if segment == nil {
 			return nil
 		}
-		channels[i+1] = make(chan *pb.EnrichedFlow)
-		segment.Rewire(channels[i], channels[i+1])
+		segmentReprs[i] = config.SegmentRepr{Name: segmentName(segment), Path: fmt.Sprintf("segments[%d]", i)}
 	}
-	return &Pipeline{In: channels[0], Out: channels[len(channels)-1], wg: &sync.WaitGroup{}, SegmentList: segmentList}
+	return newPipeline(segmentList, segmentReprs, nil)
 }
 
 // Starts the Pipeline by starting all segment goroutines therein.
 func (pipeline *Pipeline) Start() {
-	for _, segment := range pipeline.SegmentList {
+	for _, relay := range pipeline.relays {
 		pipeline.wg.Add(1)
-		go segment.Run(pipeline.wg)
+		go func() {
+			defer pipeline.wg.Done()
+			relay()
+		}()
+	}
+	for _, stage := range pipeline.stages {
+		for _, unit := range stage.units {
+			pipeline.wg.Add(1)
+			go pipeline.run(unit)
+		}
+	}
+}
+
+// Runs a single segment instance and cleans up its drop and dead letter
+// channels afterwards.
+func (pipeline *Pipeline) run(unit *unit) {
+	defer pipeline.wg.Done()
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go unit.segment.Run(wg)
+	wg.Wait()
+	if unit.drops != nil {
+		closeQuietly(unit.drops) // some segments close their drop channel on their own
+	}
+	if unit.deadLetters != nil {
+		close(unit.deadLetters)
 	}
 }
@@ -1,68 +1,180 @@
 package pipeline
 
 import (
+	"errors"
+	"fmt"
+
 	"github.com/BelWue/flowpipeline/pipeline/config"
 	"github.com/BelWue/flowpipeline/segments"
-	"github.com/rs/zerolog/log"
-	"gopkg.in/yaml.v2"
 )
 
 // Builds a list of Segment objects from raw configuration bytes and
-// initializes a Pipeline with them.
-func NewFromConfig(config []byte) *Pipeline {
+// initializes a Pipeline with them. All problems found in the configuration
+// are returned as a joined list of errors, see SegmentsFromRepr.
+func NewFromConfig(config []byte) (*Pipeline, error) {
 	// parse a list of SegmentReprs from yaml
-	segmentReprs := SegmentReprsFromConfig(config)
-
-	// build segments from it
-	segments := SegmentsFromRepr(segmentReprs)
+	segmentReprs, err := SegmentReprsFromConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("parsing configuration YAML: %w", err)
+	}
 
-	// we have Segments parsed and ready, instantiate them as actual pipeline
-	return New(segments...)
+	// build segments from it and instantiate them as actual pipeline
+	return NewFromRepr(segmentReprs, "segments")
 }
 
-// SegmentReprsFromConfig returns a list of segment representation objects from a config.
-func SegmentReprsFromConfig(configFile []byte) []config.SegmentRepr {
-	// parse a list of SegmentReprs from yaml
-	segmentReprs := []config.SegmentRepr{}
+// Builds a list of Segment objects from their config representations and
+// initializes a Pipeline with them. The path is used to identify the
+// position of the segments, see SegmentsFromReprWithPath.
+func NewFromRepr(segmentReprs []config.SegmentRepr, path string) (*Pipeline, error) {
+	return newFromRepr(segmentReprs, path, 0)
+}
 
-	err := yaml.Unmarshal(configFile, &segmentReprs)
+func newFromRepr(segmentReprs []config.SegmentRepr, path string, offset int) (*Pipeline, error) {
+	if len(segmentReprs) == 0 {
+		segmentReprs = []config.SegmentRepr{{Name: "pass"}}
+	}
+	segmentReprs = withPaths(segmentReprs, path, offset)
+	segmentList, deadLetters, err := segmentsFromRepr(segmentReprs)
 	if err != nil {
-		log.Fatal().Err(err).Msg("Error parsing configuration YAML: ")
+		return nil, err
 	}
+	return newPipeline(segmentList, segmentReprs, deadLetters), nil
+}
+
+// SegmentReprsFromConfig returns a list of segment representation objects from a config.
+// Files included by the config are looked up relative to the working directory.
+func SegmentReprsFromConfig(configFile []byte) ([]config.SegmentRepr, error) {
+	return config.ParseSegmentReprs(configFile, ".")
+}
 
-	return segmentReprs
+// SegmentReprsFromFile returns a list of segment representation objects from
+// a config file. Files included by the config are looked up relative to it.
+func SegmentReprsFromFile(path string) ([]config.SegmentRepr, error) {
+	return config.LoadSegmentReprs(path)
+}
+
+// PipelineReprsFromFile returns the named pipelines defined in a config file,
+// or a single unnamed one if it only contains a list of segments.
+func PipelineReprsFromFile(path string) ([]config.PipelineRepr, error) {
+	return config.LoadPipelineReprs(path)
 }
 
 // Creates a list of Segments from their config representations. Handles
-// recursive definitions found in Segments.
-func SegmentsFromRepr(segmentReprs []config.SegmentRepr) []segments.Segment {
+// recursive definitions found in Segments. Instead of stopping at the first
+// problem, all segments are tried and any errors are returned joined, each
+// one being a SegmentError indicating the segment's position.
+func SegmentsFromRepr(segmentReprs []config.SegmentRepr) ([]segments.Segment, error) {
+	return SegmentsFromReprWithPath(segmentReprs, "segments")
+}
+
+// Same as SegmentsFromRepr, but uses the provided path as a prefix for the
+// position of each segment. This is used by segments embedding further
+// pipelines, such as the `then` list of a `branch` segment found at
+// `segments[3]`, which would pass `segments[3].then` as its path.
+func SegmentsFromReprWithPath(segmentReprs []config.SegmentRepr, path string) ([]segments.Segment, error) {
+	segmentList, _, err := segmentsFromRepr(withPaths(segmentReprs, path, 0))
+	return segmentList, err
+}
+
+// Returns a copy of a list of config representations with their positions
+// set, the first of which is found at the provided offset of the list at path.
+func withPaths(segmentReprs []config.SegmentRepr, path string, offset int) []config.SegmentRepr {
+	result := make([]config.SegmentRepr, len(segmentReprs))
+	for i, segmentrepr := range segmentReprs {
+		segmentrepr.Path = fmt.Sprintf("%s[%d]", path, offset+i)
+		result[i] = segmentrepr
+	}
+	return result
+}
+
+// Creates Segments from config representations with their positions set,
+// along with the dead letter pipelines of the segments configured with one.
+func segmentsFromRepr(segmentReprs []config.SegmentRepr) ([]segments.Segment, []*Pipeline, error) {
+	var errs []error
 	segmentList := make([]segments.Segment, len(segmentReprs))
+	deadLetters := make([]*Pipeline, len(segmentReprs))
 	for i, segmentrepr := range segmentReprs {
-		segmentTemplate := segments.LookupSegment(segmentrepr.Name) // a typed nil instance
+		if err := segmentrepr.ValidateBuffering(); err != nil {
+			errs = append(errs, &SegmentError{Path: segmentrepr.Path, Name: segmentrepr.Name, Err: err})
+			continue
+		}
+		if segmentrepr.Reorder != nil {
+			if err := segmentrepr.Reorder.Validate(); err != nil {
+				errs = append(errs, &SegmentError{Path: segmentrepr.Path, Name: segmentrepr.Name, Err: err})
+				continue
+			}
+		}
+		if len(segmentrepr.ShardBy) > 0 {
+			if _, err := newSharder(segmentrepr.ShardBy); err != nil {
+				errs = append(errs, &SegmentError{Path: segmentrepr.Path, Name: segmentrepr.Name, Err: err})
+				continue
+			}
+		}
+		segmentTemplate, err := segments.LookupSegment(segmentrepr.Name) // a typed nil instance
+		if err != nil {
+			errs = append(errs, &SegmentError{Path: segmentrepr.Path, Name: segmentrepr.Name, Err: err})
+			continue
+		}
+		if len(segmentrepr.DeadLetter) > 0 {
+			if _, ok := segmentTemplate.(segments.DeadLetterSegment); !ok {
+				errs = append(errs, &SegmentError{Path: segmentrepr.Path, Name: segmentrepr.Name, Err: errors.New("segment does not support a dead letter pipeline")})
+				continue
+			}
+			deadLetters[i], err = newFromRepr(segmentrepr.DeadLetter, segmentrepr.Path+".deadletter", 0)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+		}
 
 		if segmentrepr.Jobs <= 1 {
-			segmentList[i] = segmentFromTemplate(segmentTemplate, segmentrepr)
+			segmentList[i], err = segmentFromTemplate(segmentTemplate, segmentrepr)
 		} else {
 			wrapper := &segments.ParallelizedSegment{}
 			for range segmentrepr.Jobs {
-				segment := segmentFromTemplate(segmentTemplate, segmentrepr)
-				if segment != nil {
-					wrapper.AddSegment(segment)
-				} else {
-					log.Fatal().Msgf("Configured segment '%s' could not be initialized properly, see previous messages.", segmentrepr.Name)
+				var segment segments.Segment
+				segment, err = segmentFromTemplate(segmentTemplate, segmentrepr)
+				if err != nil {
+					break
 				}
+				wrapper.AddSegment(segment)
 			}
 			segmentList[i] = wrapper
 		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		discard(segmentList)
+		for _, deadLetter := range deadLetters {
+			if deadLetter != nil {
+				deadLetter.Discard()
+			}
+		}
+		return nil, nil, errors.Join(errs...)
 	}
-	return segmentList
+	return segmentList, deadLetters, nil
 }
 
-func segmentFromTemplate(segmentTemplate segments.Segment, segmentrepr config.SegmentRepr) segments.Segment {
+func segmentFromTemplate(segmentTemplate segments.Segment, segmentrepr config.SegmentRepr) (segments.Segment, error) {
 	// the Segment's New method knows how to handle our config
-	segment := segmentTemplate.New(segmentrepr.ExpandedConfig())
-	if segment != nil {
-		segment.AddCustomConfig(segmentrepr)
+	expandedConfig, err := segmentrepr.ExpandedConfig(segments.ContainerVolumePrefix)
+	if err != nil {
+		return nil, &SegmentError{Path: segmentrepr.Path, Name: segmentrepr.Name, Err: err}
+	}
+	segment, err := segments.NewSegment(segmentTemplate, expandedConfig)
+	if err != nil {
+		return nil, &SegmentError{Path: segmentrepr.Path, Name: segmentrepr.Name, Err: err}
+	}
+	if err := segment.AddCustomConfig(segmentrepr); err != nil {
+		discard([]segments.Segment{segment})
+		// errors of nested segments already carry their own position
+		var segmentError *SegmentError
+		if errors.As(err, &segmentError) {
+			return nil, err
+		}
+		return nil, &SegmentError{Path: segmentrepr.Path, Name: segmentrepr.Name, Err: err}
 	}
-	return segment
+	return segment, nil
 }
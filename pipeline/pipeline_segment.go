@@ -0,0 +1,80 @@
+package pipeline
+
+import (
+	"context"
+	"sync"
+
+	"github.com/BelWue/flowpipeline/pb"
+	"github.com/BelWue/flowpipeline/segments"
+)
+
+// Runs a whole Pipeline as a single segment. This is used to run multiple
+// instances of a Pipeline as jobs of a ParallelizedSegment. Flows dropped
+// within the Pipeline are reported as drops of this segment.
+type pipelineSegment struct {
+	segments.BaseFilterSegment
+	pipeline *Pipeline
+}
+
+func (segment *pipelineSegment) New(config map[string]string) segments.Segment {
+	return nil // never created from a configuration
+}
+
+// Sets the ShutdownCoordinator of this segment and the wrapped Pipeline.
+func (segment *pipelineSegment) SetShutdownCoordinator(coordinator *segments.ShutdownCoordinator) {
+	segment.BaseFilterSegment.SetShutdownCoordinator(coordinator)
+	segment.pipeline.SetShutdownCoordinator(coordinator)
+}
+
+// Discards the wrapped Pipeline, which is never started.
+func (segment *pipelineSegment) Discard() {
+	segment.pipeline.Discard()
+}
+
+// Subscribes to the replacements of all segments of the wrapped Pipeline.
+func (segment *pipelineSegment) SubscribeReplacements(replaced func(msg *pb.EnrichedFlow, replacements []*pb.EnrichedFlow)) {
+	segment.pipeline.SubscribeReplacements(replaced)
+}
+
+func (segment *pipelineSegment) NestedStatus() []SegmentStatus {
+	return segment.pipeline.Status()
+}
+
+func (segment *pipelineSegment) NestedHealth(ctx context.Context) error {
+	return segment.pipeline.Health(ctx)
+}
+
+func (segment *pipelineSegment) NestedAttach(tap *Tap) int {
+	return segment.pipeline.Attach(tap)
+}
+
+func (segment *pipelineSegment) Run(wg *sync.WaitGroup) {
+	defer func() {
+		close(segment.Out)
+		wg.Done()
+	}()
+	var forwarders sync.WaitGroup
+	if segment.Drops != nil {
+		drops := segment.pipeline.GetDrop()
+		forwarders.Add(1)
+		go func() {
+			defer forwarders.Done()
+			for msg := range drops {
+				segment.Drops <- msg
+			}
+		}()
+	}
+	segment.pipeline.Start()
+	forwarders.Add(1)
+	go func() {
+		defer forwarders.Done()
+		for msg := range segment.pipeline.Out {
+			segment.Out <- msg
+		}
+	}()
+	for msg := range segment.In {
+		segment.pipeline.In <- msg
+	}
+	segment.pipeline.Close()
+	forwarders.Wait()
+}
@@ -1,7 +1,12 @@
 package pipeline
 
 import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/BelWue/flowpipeline/pb"
 	"github.com/BelWue/flowpipeline/segments"
@@ -37,11 +42,14 @@ func TestPipelineTeardown(t *testing.T) {
 }
 
 func TestPipelineConfigSuccess(t *testing.T) {
-	pipeline := NewFromConfig([]byte(`---
+	pipeline, err := NewFromConfig([]byte(`---
 - segment: pass
   config:
     foo: $baz
     bar: $0`))
+	if err != nil {
+		t.Fatal(err)
+	}
 	pipeline.Start()
 	pipeline.In <- &pb.EnrichedFlow{Type: 3}
 	fmsg := <-pipeline.Out
@@ -49,3 +57,201 @@ func TestPipelineConfigSuccess(t *testing.T) {
 		t.Error("([error] Pipeline built from config is not working.")
 	}
 }
+
+func TestPipelineConfigErrors(t *testing.T) {
+	_, err := NewFromConfig([]byte(`---
+- segment: pass
+- segment: doesnotexist
+- segment: pass
+- segment: alsodoesnotexist`))
+	if err == nil {
+		t.Fatal("([error] Pipeline built from invalid config did not fail.")
+	}
+	var segmentError *SegmentError
+	if !errors.As(err, &segmentError) || segmentError.Path != "segments[1]" {
+		t.Errorf("([error] Pipeline error is not indexed by segment: %s", err)
+	}
+	if !strings.Contains(err.Error(), "segments[3] (alsodoesnotexist)") {
+		t.Errorf("([error] Pipeline errors are not aggregated: %s", err)
+	}
+}
+
+func TestPipelineConfigBufferingErrors(t *testing.T) {
+	_, err := NewFromConfig([]byte(`---
+- segment: pass
+  buffer: 10
+  overflow: drop-oldest
+- segment: pass
+  overflow: drop-newest
+- segment: pass
+  buffer: 10
+  overflow: drop-everything`))
+	if err == nil {
+		t.Fatal("([error] Pipeline built from invalid buffering config did not fail.")
+	}
+	if !strings.Contains(err.Error(), "segments[1] (pass): overflow policy 'drop-newest' requires a buffer") {
+		t.Errorf("([error] Overflow policy without buffer was not reported: %s", err)
+	}
+	if !strings.Contains(err.Error(), "segments[2] (pass): unknown overflow policy") {
+		t.Errorf("([error] Unknown overflow policy was not reported: %s", err)
+	}
+	if strings.Contains(err.Error(), "segments[0]") {
+		t.Errorf("([error] Valid buffering config was reported: %s", err)
+	}
+}
+
+func TestPipelineConfigShardByErrors(t *testing.T) {
+	_, err := NewFromConfig([]byte(`---
+- segment: pass
+  jobs: 2
+  shard_by: [SrcAddr, DstAddr]
+- segment: pass
+  jobs: 2
+  shard_by: SrcAddr, Foo`))
+	if err == nil {
+		t.Fatal("([error] Pipeline built from invalid shard_by config did not fail.")
+	}
+	if !strings.Contains(err.Error(), "segments[1] (pass): could not parse 'shard_by': key 'Foo' does not exist") {
+		t.Errorf("([error] Invalid shard_by field was not reported: %s", err)
+	}
+	if strings.Contains(err.Error(), "segments[0]") {
+		t.Errorf("([error] Valid shard_by config was reported: %s", err)
+	}
+}
+
+func TestPipelineConfigReorderErrors(t *testing.T) {
+	_, err := NewFromConfig([]byte(`---
+- segment: pass
+  jobs: 2
+  reorder:
+    window: 100
+    timeout: 500ms
+- segment: pass
+  jobs: 2
+  reorder:
+    timeout: -1s`))
+	if err == nil {
+		t.Fatal("([error] Pipeline built from invalid reorder config did not fail.")
+	}
+	if !strings.Contains(err.Error(), "segments[1] (pass): reorder timeout must not be negative") {
+		t.Errorf("([error] Invalid reorder timeout was not reported: %s", err)
+	}
+	if strings.Contains(err.Error(), "segments[0]") {
+		t.Errorf("([error] Valid reorder config was reported: %s", err)
+	}
+}
+
+func TestPipelineConfigFileReferenceErrors(t *testing.T) {
+	_, err := NewFromConfig([]byte(`---
+- segment: pass
+- segment: flowfilter
+  config:
+    filter: ${file:/nonexistent/filter}`))
+	if err == nil {
+		t.Fatal("([error] Pipeline built from config referencing a missing file did not fail.")
+	}
+	if !strings.Contains(err.Error(), "segments[1] (flowfilter): config parameter 'filter': open /nonexistent/filter") {
+		t.Errorf("([error] Missing referenced file was not reported: %s", err)
+	}
+}
+
+// A segment which requests its pipeline to shut down after the first flow.
+type quittingSegment struct {
+	segments.BaseSegment
+}
+
+func (segment *quittingSegment) New(config map[string]string) segments.Segment {
+	return &quittingSegment{}
+}
+
+func (segment *quittingSegment) Run(wg *sync.WaitGroup) {
+	defer func() {
+		close(segment.Out)
+		wg.Done()
+	}()
+	for msg := range segment.In {
+		segment.Out <- msg
+		segment.ShutdownParentPipeline()
+	}
+}
+
+// A segment which takes the given time to flush on shutdown, reporting the
+// given error afterwards if set.
+type flushingSegment struct {
+	segments.BaseSegment
+	flush time.Duration
+	err   error
+}
+
+func (segment *flushingSegment) New(config map[string]string) segments.Segment {
+	return &flushingSegment{}
+}
+
+func (segment *flushingSegment) Run(wg *sync.WaitGroup) {
+	defer func() {
+		close(segment.Out)
+		wg.Done()
+	}()
+	for msg := range segment.In {
+		segment.Out <- msg
+	}
+	select {
+	case <-time.After(segment.flush):
+		if segment.err != nil {
+			segment.FlushFailed(segment.err)
+		}
+	case <-segment.Context().Done():
+		segment.FlushFailed(context.Cause(segment.Context()))
+	}
+}
+
+func TestPipelineShutdownRequest(t *testing.T) {
+	parallelized := &segments.ParallelizedSegment{}
+	parallelized.AddSegment(&quittingSegment{})
+	parallelized.AddSegment(&quittingSegment{})
+	quitting := New(&pass.Pass{}, parallelized)
+	other := New(&pass.Pass{})
+	quitting.Start()
+	other.Start()
+
+	quitting.In <- &pb.EnrichedFlow{Type: 3}
+	<-quitting.Out
+	select {
+	case <-quitting.Done():
+	case <-time.After(time.Second):
+		t.Fatal("([error] Pipeline was not closed on request of a nested segment.")
+	}
+	select {
+	case <-other.Done():
+		t.Error("([error] Shutdown request closed an unrelated pipeline.")
+	default:
+	}
+	other.In <- &pb.EnrichedFlow{Type: 3}
+	<-other.Out
+	other.Close()
+	quitting.Close() // closing again must not halt
+}
+
+func TestPipelineShutdownDeadline(t *testing.T) {
+	failure := errors.New("disk full")
+	for _, test := range []struct {
+		segment  *flushingSegment
+		expected error
+	}{
+		{&flushingSegment{}, nil},
+		{&flushingSegment{err: failure}, failure},
+		{&flushingSegment{flush: time.Hour}, segments.ErrFlushDeadline},
+	} {
+		pipeline := New(test.segment)
+		pipeline.Start()
+		pipeline.AutoDrain()
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		err := pipeline.Shutdown(ctx)
+		cancel()
+		if test.expected == nil && err != nil {
+			t.Errorf("([error] Pipeline flushing in time failed to shut down: %v", err)
+		} else if !errors.Is(err, test.expected) {
+			t.Errorf("([error] Pipeline shutdown returned '%v', should contain '%v'.", err, test.expected)
+		}
+	}
+}
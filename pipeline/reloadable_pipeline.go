@@ -0,0 +1,324 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/BelWue/flowpipeline/pb"
+	"github.com/BelWue/flowpipeline/pipeline/config"
+	"github.com/BelWue/flowpipeline/segments"
+)
+
+// A Pipeline whose processing part can be replaced at runtime. It consists of
+// two Pipelines: The input section contains all leading input segments (see
+// segments.InputSegment) and keeps running for the lifetime of this object,
+// while the processing section contains the remaining segments and is swapped
+// out on Reload. Flows still in flight in a replaced processing section are
+// drained by closing it. All sections share a single ShutdownCoordinator, so
+// that a shutdown requested by any segment closes the ReloadablePipeline as a
+// whole.
+type ReloadablePipeline struct {
+	inputs      *Pipeline
+	inputReprs  []config.SegmentRepr
+	processing  *Pipeline
+	options     ReloadableOptions
+	out         chan *pb.EnrichedFlow
+	mutex       sync.RWMutex   // guards processing against the forwarder
+	reloadMutex sync.Mutex     // serializes Reload and Close
+	outputs     sync.WaitGroup // tracks the Out forwarders of processing sections
+	forwardDone chan struct{}
+	started     bool
+	closed      bool
+	coordinator *segments.ShutdownCoordinator
+	done        chan struct{}
+	taps        []*Tap // attached again to new processing sections on Reload
+}
+
+// Initializes a new ReloadablePipeline from a list of segment
+// representations. Returns the errors of all segments failing to initialize.
+func NewReloadable(segmentReprs []config.SegmentRepr) (*ReloadablePipeline, error) {
+	return NewReloadableWithOptions(segmentReprs, ReloadableOptions{})
+}
+
+// Options changing how the processing section of a ReloadablePipeline is run.
+type ReloadableOptions struct {
+	Concurrency int                    // number of parallel instances of the processing section, all fed by a single input section
+	Reorder     *config.ReorderOptions // restores the order of flows after concurrent processing sections if set
+	Batch       *config.BatchOptions   // uses the batched transport within the processing section if set
+	Path        string                 // position of the segment list in the configuration, defaults to "segments"
+}
+
+// Returns the position of the segment list in the configuration.
+func (options ReloadableOptions) path() string {
+	if options.Path == "" {
+		return "segments"
+	}
+	return options.Path
+}
+
+// Same as NewReloadable, but runs the processing section as configured by the
+// provided options.
+func NewReloadableWithOptions(segmentReprs []config.SegmentRepr, options ReloadableOptions) (*ReloadablePipeline, error) {
+	pipeline := &ReloadablePipeline{
+		options:     options,
+		out:         make(chan *pb.EnrichedFlow),
+		forwardDone: make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	pipeline.coordinator = segments.NewShutdownCoordinator(pipeline.Close)
+	inputReprs, processingReprs := splitInputReprs(segmentReprs)
+	inputs, inputErr := newFromRepr(inputReprs, options.path(), 0)
+	processing, processingErr := pipeline.processingFromReprs(processingReprs, len(inputReprs))
+	if err := errors.Join(inputErr, processingErr); err != nil {
+		if inputs != nil {
+			inputs.Discard()
+		}
+		if processing != nil {
+			processing.Discard()
+		}
+		return nil, err
+	}
+	inputs.SetShutdownCoordinator(pipeline.coordinator)
+	pipeline.inputs = inputs
+	pipeline.inputReprs = inputReprs
+	pipeline.processing = processing
+	return pipeline, nil
+}
+
+func (pipeline *ReloadablePipeline) GetInput() chan *pb.EnrichedFlow {
+	return pipeline.inputs.GetInput()
+}
+
+// Returns the egress channel of this ReloadablePipeline. In contrast to the
+// processing sections it is fed from, this channel is stable across reloads.
+func (pipeline *ReloadablePipeline) GetOutput() <-chan *pb.EnrichedFlow {
+	return pipeline.out
+}
+
+// Starts the input and the processing section as well as the goroutine
+// forwarding flows between them.
+func (pipeline *ReloadablePipeline) Start() {
+	pipeline.reloadMutex.Lock()
+	defer pipeline.reloadMutex.Unlock()
+	pipeline.startProcessing(pipeline.processing)
+	pipeline.inputs.Start()
+	go pipeline.forward()
+	pipeline.started = true
+}
+
+// Starts up a goroutine which reads any message from the Out channel and
+// discards it, analogous to Pipeline.AutoDrain.
+func (pipeline *ReloadablePipeline) AutoDrain() {
+	go func() {
+		for msg := range pipeline.out {
+			segments.Ack(msg)
+		}
+		log.Info().Msg("Pipeline closed, auto draining finished.")
+	}()
+}
+
+// Replaces the processing section of this pipeline with one built from the
+// provided segment representations. The input section can not be changed at
+// runtime, a differing configuration of the leading input segments results in
+// an error. On any error, the previous processing section is kept running.
+// Blocks until the previous processing section is drained.
+func (pipeline *ReloadablePipeline) Reload(segmentReprs []config.SegmentRepr) error {
+	pipeline.reloadMutex.Lock()
+	defer pipeline.reloadMutex.Unlock()
+	if !pipeline.started || pipeline.closed {
+		return errors.New("pipeline is not running")
+	}
+
+	inputReprs, processingReprs := splitInputReprs(segmentReprs)
+	if !reflect.DeepEqual(inputReprs, pipeline.inputReprs) {
+		return errors.New("input segments can not be reconfigured at runtime, a restart is required")
+	}
+	processing, err := pipeline.processingFromReprs(processingReprs, len(inputReprs))
+	if err != nil {
+		return err
+	}
+	for _, tap := range pipeline.taps {
+		processing.Attach(tap)
+	}
+	pipeline.startProcessing(processing)
+
+	pipeline.mutex.Lock()
+	previous := pipeline.processing
+	pipeline.processing = processing
+	pipeline.mutex.Unlock()
+
+	previous.Close()
+	log.Info().Msgf("Pipeline reloaded with %d processing segments.", len(processingReprs))
+	return nil
+}
+
+// Closes the input section first and the current processing section once
+// all flows have been handed over. Blocking. This is also called when one of
+// the segments requests a shutdown, further calls do nothing.
+func (pipeline *ReloadablePipeline) Close() {
+	pipeline.reloadMutex.Lock()
+	defer pipeline.reloadMutex.Unlock()
+	if pipeline.closed {
+		return
+	}
+	pipeline.closed = true
+	defer close(pipeline.done)
+	pipeline.inputs.Close()
+	if pipeline.started {
+		<-pipeline.forwardDone
+	}
+	pipeline.processing.Close()
+	pipeline.outputs.Wait()
+	close(pipeline.out)
+}
+
+// Closes down the ReloadablePipeline just like Close, but gives up waiting
+// once the provided context is done, see Pipeline.Shutdown.
+func (pipeline *ReloadablePipeline) Shutdown(ctx context.Context) error {
+	return shutdown(ctx, pipeline.Close, pipeline.coordinator)
+}
+
+// Returns a channel which is closed once the ReloadablePipeline is closed, be
+// it by calling Close or on request of one of its segments.
+func (pipeline *ReloadablePipeline) Done() <-chan struct{} {
+	return pipeline.done
+}
+
+// Returns the status of all segments of the input and the current processing
+// section, see Pipeline.Status.
+func (pipeline *ReloadablePipeline) Status() []SegmentStatus {
+	pipeline.mutex.RLock()
+	processing := pipeline.processing
+	pipeline.mutex.RUnlock()
+	if len(pipeline.inputReprs) == 0 { // the input section only consists of a placeholder
+		return processing.Status()
+	}
+	return append(pipeline.inputs.Status(), processing.Status()...)
+}
+
+// Returns the health of all segments of the input and the current processing
+// section, see Pipeline.Health.
+func (pipeline *ReloadablePipeline) Health(ctx context.Context) error {
+	pipeline.mutex.RLock()
+	processing := pipeline.processing
+	pipeline.mutex.RUnlock()
+	return errors.Join(pipeline.inputs.Health(ctx), processing.Health(ctx))
+}
+
+// Attaches a Tap to the input and the current processing section, see
+// Pipeline.Attach. The Tap is attached to the processing sections replacing
+// the current one on Reload as well, until it is closed.
+func (pipeline *ReloadablePipeline) Attach(tap *Tap) int {
+	pipeline.reloadMutex.Lock()
+	defer pipeline.reloadMutex.Unlock()
+	attached := pipeline.processing.Attach(tap)
+	if len(pipeline.inputReprs) > 0 {
+		attached += pipeline.inputs.Attach(tap)
+	}
+	taps := []*Tap{tap}
+	for _, previous := range pipeline.taps {
+		select {
+		case <-previous.Done():
+		default:
+			taps = append(taps, previous)
+		}
+	}
+	pipeline.taps = taps
+	return attached
+}
+
+// Hands flows from the input section to the current processing section.
+func (pipeline *ReloadablePipeline) forward() {
+	for msg := range pipeline.inputs.Out {
+		pipeline.mutex.RLock()
+		pipeline.processing.In <- msg
+		pipeline.mutex.RUnlock()
+	}
+	close(pipeline.forwardDone)
+}
+
+// Starts a processing section and the goroutine merging its output into the
+// stable output channel.
+func (pipeline *ReloadablePipeline) startProcessing(processing *Pipeline) {
+	processing.SetShutdownCoordinator(pipeline.coordinator)
+	processing.Start()
+	pipeline.outputs.Add(1)
+	go func() {
+		defer pipeline.outputs.Done()
+		for msg := range processing.Out {
+			pipeline.out <- msg
+		}
+	}()
+}
+
+// Splits a list of segment representations into the leading input segments
+// and the remainder. Unknown segments are never considered inputs.
+func splitInputReprs(segmentReprs []config.SegmentRepr) ([]config.SegmentRepr, []config.SegmentRepr) {
+	for i, segmentrepr := range segmentReprs {
+		template, err := segments.LookupSegment(segmentrepr.Name)
+		if err != nil || !segments.IsInputSegment(template) {
+			return segmentReprs[:i], segmentReprs[i:]
+		}
+	}
+	return segmentReprs, nil
+}
+
+// Builds the processing section from the top level segment list starting at
+// the provided offset. Concurrent instances are run as jobs of a single
+// ParallelizedSegment, which takes care of restoring the order if requested.
+// In that case, any trailing output segments are run once behind it, so that
+// they receive the flows in order.
+func (pipeline *ReloadablePipeline) processingFromReprs(segmentReprs []config.SegmentRepr, offset int) (*Pipeline, error) {
+	if pipeline.options.Concurrency <= 1 {
+		return pipeline.sectionFromReprs(segmentReprs, offset)
+	}
+	var outputReprs []config.SegmentRepr
+	if pipeline.options.Reorder != nil {
+		segmentReprs, outputReprs = splitOutputReprs(segmentReprs)
+	}
+	parallelized := &segments.ParallelizedSegment{}
+	for range pipeline.options.Concurrency {
+		instance, err := pipeline.sectionFromReprs(segmentReprs, offset)
+		if err != nil {
+			parallelized.Discard()
+			return nil, err
+		}
+		parallelized.AddSegment(&pipelineSegment{pipeline: instance})
+	}
+	outputReprs = withPaths(outputReprs, pipeline.options.path(), offset+len(segmentReprs))
+	outputs, deadLetters, err := segmentsFromRepr(outputReprs)
+	if err != nil {
+		parallelized.Discard()
+		return nil, err
+	}
+	segmentrepr := config.SegmentRepr{Name: "pipeline", Path: "pipelines", Jobs: pipeline.options.Concurrency, Reorder: pipeline.options.Reorder}
+	if pipeline.options.path() != "segments" { // instances of a named pipeline
+		segmentrepr.Path = pipeline.options.Path + ".instances"
+	}
+	return newPipeline(append([]segments.Segment{parallelized}, outputs...), append([]config.SegmentRepr{segmentrepr}, outputReprs...), append([]*Pipeline{nil}, deadLetters...)), nil
+}
+
+// Splits a list of segment representations into the remainder and the
+// trailing output segments. Unknown segments are never considered outputs.
+func splitOutputReprs(segmentReprs []config.SegmentRepr) ([]config.SegmentRepr, []config.SegmentRepr) {
+	for i := len(segmentReprs); i > 0; i-- {
+		template, err := segments.LookupSegment(segmentReprs[i-1].Name)
+		if err != nil || !segments.IsOutputSegment(template) {
+			return segmentReprs[:i], segmentReprs[i:]
+		}
+	}
+	return nil, segmentReprs
+}
+
+// Builds a single instance of the processing section, using the batched
+// transport if configured.
+func (pipeline *ReloadablePipeline) sectionFromReprs(segmentReprs []config.SegmentRepr, offset int) (*Pipeline, error) {
+	if pipeline.options.Batch != nil {
+		return newBatchedFromRepr(segmentReprs, pipeline.options.path(), offset, *pipeline.options.Batch)
+	}
+	return newFromRepr(segmentReprs, pipeline.options.path(), offset)
+}
@@ -0,0 +1,161 @@
+package pipeline
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/BelWue/flowpipeline/pb"
+	_ "github.com/BelWue/flowpipeline/segments/input/stdin"
+	_ "github.com/BelWue/flowpipeline/segments/output/json"
+)
+
+func TestReloadablePipelineReload(t *testing.T) {
+	segmentReprs, err := SegmentReprsFromConfig([]byte(`---
+- segment: pass`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline, err := NewReloadable(segmentReprs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline.Start()
+	pipeline.GetInput() <- &pb.EnrichedFlow{Type: 3}
+	if fmsg := <-pipeline.GetOutput(); fmsg.Type != 3 {
+		t.Error("([error] Reloadable pipeline is not working.")
+	}
+
+	segmentReprs, err = SegmentReprsFromConfig([]byte(`---
+- segment: pass
+- segment: pass`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pipeline.Reload(segmentReprs); err != nil {
+		t.Errorf("([error] Reloading a valid configuration failed: %s", err)
+	}
+	pipeline.GetInput() <- &pb.EnrichedFlow{Type: 4}
+	if fmsg := <-pipeline.GetOutput(); fmsg.Type != 4 {
+		t.Error("([error] Reloaded pipeline is not working.")
+	}
+
+	pipeline.AutoDrain()
+	pipeline.Close() // fail test on halting ;)
+}
+
+func TestReloadablePipelineReloadInvalid(t *testing.T) {
+	segmentReprs, _ := SegmentReprsFromConfig([]byte(`---
+- segment: pass`))
+	pipeline, err := NewReloadable(segmentReprs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline.Start()
+
+	segmentReprs, _ = SegmentReprsFromConfig([]byte(`---
+- segment: doesnotexist`))
+	if err := pipeline.Reload(segmentReprs); err == nil {
+		t.Error("([error] Reloading an invalid configuration did not fail.")
+	}
+	pipeline.GetInput() <- &pb.EnrichedFlow{Type: 3}
+	if fmsg := <-pipeline.GetOutput(); fmsg.Type != 3 {
+		t.Error("([error] Previous pipeline did not keep running after failed reload.")
+	}
+
+	pipeline.AutoDrain()
+	pipeline.Close()
+}
+
+func TestSegmentReprsFromConfigInvalid(t *testing.T) {
+	_, err := SegmentReprsFromConfig([]byte(`---
+- segment: pass
+  config: [foo`))
+	if err == nil {
+		t.Error("([error] Parsing invalid YAML did not fail.")
+	}
+}
+
+func TestSplitOutputReprs(t *testing.T) {
+	segmentReprs, _ := SegmentReprsFromConfig([]byte(`---
+- segment: pass
+- segment: json
+- segment: pass
+- segment: json
+- segment: json`))
+	remainder, outputs := splitOutputReprs(segmentReprs)
+	if len(remainder) != 3 || len(outputs) != 2 {
+		t.Errorf("([error] Expected the last two segments to be split off as outputs, got %d and %d.", len(remainder), len(outputs))
+	}
+}
+
+func TestReloadablePipelineShutdownRequest(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "flows.json")
+	if err := os.WriteFile(filename, []byte("{\"bytes\": \"1\"}\n{\"bytes\": \"2\"}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	segmentReprs, _ := SegmentReprsFromConfig([]byte(`---
+- segment: stdin
+  config:
+    filename: ` + filename + `
+    eofcloses: true
+- segment: pass`))
+	reading, err := NewReloadable(segmentReprs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	segmentReprs, _ = SegmentReprsFromConfig([]byte(`---
+- segment: pass`))
+	other, err := NewReloadable(segmentReprs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reading.Start()
+	other.Start()
+
+	var received []uint64
+	for msg := range reading.GetOutput() {
+		received = append(received, msg.Bytes)
+	}
+	if len(received) != 2 {
+		t.Errorf("([error] Pipeline did not emit all flows before closing on EOF, got %v.", received)
+	}
+	<-reading.Done()
+	if err := reading.Reload(segmentReprs); err == nil {
+		t.Error("([error] Reloading a closed pipeline did not fail.")
+	}
+
+	other.GetInput() <- &pb.EnrichedFlow{Type: 3}
+	if fmsg := <-other.GetOutput(); fmsg.Type != 3 {
+		t.Error("([error] Unrelated pipeline did not keep running after another one closed.")
+	}
+	other.AutoDrain()
+	other.Close()
+}
+
+func TestReloadablePipelineTap(t *testing.T) {
+	segmentReprs, _ := SegmentReprsFromConfig([]byte(`---
+- segment: pass`))
+	pipeline, err := NewReloadable(segmentReprs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tap := NewTap(TapOptions{Position: "segments[0]", MaxFlows: 2})
+	if attached := pipeline.Attach(tap); attached != 1 {
+		t.Fatalf("([error] Tap was attached to %d segments, should be 1.", attached)
+	}
+	pipeline.Start()
+	pipeline.AutoDrain()
+	pipeline.GetInput() <- &pb.EnrichedFlow{Type: 3}
+
+	if err := pipeline.Reload(segmentReprs); err != nil {
+		t.Fatal(err)
+	}
+	pipeline.GetInput() <- &pb.EnrichedFlow{Type: 4}
+	pipeline.Close()
+	for _, expected := range []pb.EnrichedFlow_FlowType{3, 4} {
+		if fmsg, ok := <-tap.Flows(); !ok || fmsg.Type != expected {
+			t.Errorf("([error] Tap did not capture flow of type %d across the reload.", expected)
+		}
+	}
+}
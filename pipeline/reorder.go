@@ -0,0 +1,197 @@
+package pipeline
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/BelWue/flowpipeline/pb"
+	"github.com/BelWue/flowpipeline/pipeline/config"
+)
+
+// Restores the order of flows passing through a parallel section. Flows are
+// tagged with a sequence number on entry, and held back on exit until all
+// flows with lower sequence numbers have left the section, have been dropped
+// by a filter, or have been given up on. The latter happens if a flow has been
+// missing for longer than the timeout, or if more flows than the window
+// allows are held back waiting for it. Flows replaced by segments within the
+// section hand their sequence number on to their replacements, which are all
+// emitted in place of the original flow. Flows which do not carry a sequence
+// number, i.e. other flows created within the section or flows arriving after
+// having been given up on, are not held back.
+type reorderer struct {
+	options config.ReorderOptions
+
+	mutex     sync.Mutex
+	assigned  uint64                        // the next sequence number to be assigned
+	sequences map[*pb.EnrichedFlow]uint64   // flows in flight by pointer
+	inflight  map[uint64]*inflightFlow      // flows in flight by sequence number
+	notify    chan struct{}                 // wakes up the resequencer on drops
+	skipped   prometheus.Counter            // flows given up on
+	pending   map[uint64][]*pb.EnrichedFlow // flows held back, only used by resequence
+}
+
+// The flows in flight for a sequence number, which is the tagged flow or its
+// replacements.
+type inflightFlow struct {
+	flows     []*pb.EnrichedFlow
+	remaining int // flows which have neither left the section nor been dropped
+	tagged    time.Time
+}
+
+func newReorderer(options config.ReorderOptions, name string, position string) *reorderer {
+	return &reorderer{
+		options:   options.WithDefaults(),
+		sequences: make(map[*pb.EnrichedFlow]uint64),
+		inflight:  make(map[uint64]*inflightFlow),
+		notify:    make(chan struct{}, 1),
+		skipped:   flowsReorderSkipped.WithLabelValues(name, position),
+		pending:   make(map[uint64][]*pb.EnrichedFlow),
+	}
+}
+
+// Assigns the next sequence number to a flow entering the parallel section.
+// Must only be called from a single goroutine to preserve the input order.
+func (r *reorderer) tag(flow *pb.EnrichedFlow) {
+	r.mutex.Lock()
+	r.sequences[flow] = r.assigned
+	r.inflight[r.assigned] = &inflightFlow{flows: []*pb.EnrichedFlow{flow}, remaining: 1, tagged: time.Now()}
+	r.assigned += 1
+	r.mutex.Unlock()
+}
+
+// Hands the sequence number of a flow replaced within the parallel section
+// on to its replacements, see segments.ReplacingSegment.
+func (r *reorderer) replace(flow *pb.EnrichedFlow, replacements []*pb.EnrichedFlow) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	sequence, ok := r.sequences[flow]
+	if !ok {
+		return
+	}
+	delete(r.sequences, flow)
+	inflight := r.inflight[sequence]
+	inflight.remaining += len(replacements) - 1
+	for _, replacement := range replacements {
+		r.sequences[replacement] = sequence
+		inflight.flows = append(inflight.flows, replacement)
+	}
+	r.settle(sequence, inflight)
+}
+
+// Marks a flow as dropped within the parallel section, so that no other
+// flows are held back waiting for it.
+func (r *reorderer) drop(flow *pb.EnrichedFlow) {
+	r.mutex.Lock()
+	if sequence, ok := r.sequences[flow]; ok {
+		delete(r.sequences, flow)
+		inflight := r.inflight[sequence]
+		inflight.remaining -= 1
+		r.settle(sequence, inflight)
+	}
+	r.mutex.Unlock()
+}
+
+// Stops waiting for a sequence number once none of its flows remain in the
+// parallel section, and wakes up the resequencer. Must be called with the
+// mutex held.
+func (r *reorderer) settle(sequence uint64, inflight *inflightFlow) {
+	if inflight.remaining > 0 {
+		return
+	}
+	delete(r.inflight, sequence)
+	select {
+	case r.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Reads the flows leaving the parallel section and hands them to emit in
+// the order they were tagged in. Returns when from is closed, emitting all
+// flows still held back.
+func (r *reorderer) resequence(from <-chan *pb.EnrichedFlow, emit func(*pb.EnrichedFlow)) {
+	var head uint64 // the next sequence number to be emitted
+	timer := time.NewTimer(r.options.Timeout)
+	defer timer.Stop()
+	for {
+		var wait time.Duration
+		head, wait = r.advance(head, emit)
+		if wait > 0 {
+			timer.Reset(wait)
+		} else {
+			timer.Stop()
+		}
+		select {
+		case flow, ok := <-from:
+			if !ok {
+				r.flush(emit)
+				return
+			}
+			r.mutex.Lock()
+			sequence, tagged := r.sequences[flow]
+			if tagged {
+				delete(r.sequences, flow)
+				r.pending[sequence] = append(r.pending[sequence], flow)
+				inflight := r.inflight[sequence]
+				inflight.remaining -= 1
+				if inflight.remaining == 0 {
+					delete(r.inflight, sequence)
+				}
+			}
+			r.mutex.Unlock()
+			if !tagged {
+				emit(flow)
+			}
+		case <-r.notify:
+		case <-timer.C:
+		}
+	}
+}
+
+// Emits all flows which are due, starting at head. Returns the new head and
+// how long to wait until the flows missing at the head are given up on, or
+// zero if no flow is missing.
+func (r *reorderer) advance(head uint64, emit func(*pb.EnrichedFlow)) (uint64, time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for head < r.assigned {
+		if missing, ok := r.inflight[head]; ok {
+			age := time.Since(missing.tagged)
+			if age < r.options.Timeout && len(r.pending) <= r.options.Window {
+				return head, r.options.Timeout - age
+			}
+			r.skipped.Inc()
+			for _, flow := range missing.flows {
+				delete(r.sequences, flow)
+			}
+			delete(r.inflight, head)
+		}
+		if flows, ok := r.pending[head]; ok {
+			delete(r.pending, head)
+			r.mutex.Unlock() // do not block tagging while handing on flows
+			for _, flow := range flows {
+				emit(flow)
+			}
+			r.mutex.Lock()
+		}
+		head += 1
+	}
+	return head, 0
+}
+
+// Emits all flows held back in order of their sequence numbers.
+func (r *reorderer) flush(emit func(*pb.EnrichedFlow)) {
+	sequences := make([]uint64, 0, len(r.pending))
+	for sequence := range r.pending {
+		sequences = append(sequences, sequence)
+	}
+	slices.Sort(sequences)
+	for _, sequence := range sequences {
+		for _, flow := range r.pending[sequence] {
+			emit(flow)
+		}
+		delete(r.pending, sequence)
+	}
+}
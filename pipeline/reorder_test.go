@@ -0,0 +1,190 @@
+package pipeline
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/BelWue/flowpipeline/pb"
+	"github.com/BelWue/flowpipeline/pipeline/config"
+	"github.com/BelWue/flowpipeline/segments"
+)
+
+// A segment delaying flows depending on their sequence number, and swallowing
+// the flow with a sequence number of 13 without reporting it as dropped.
+type unevenSegment struct {
+	segments.BaseSegment
+}
+
+func (segment *unevenSegment) New(config map[string]string) segments.Segment {
+	return &unevenSegment{}
+}
+
+func (segment *unevenSegment) Run(wg *sync.WaitGroup) {
+	defer func() {
+		close(segment.Out)
+		wg.Done()
+	}()
+	for msg := range segment.In {
+		time.Sleep(time.Duration(msg.SequenceNum%3) * time.Millisecond)
+		if msg.SequenceNum == 13 {
+			continue
+		}
+		segment.Out <- msg
+	}
+}
+
+// Builds a pipeline of a segment run by four parallel jobs.
+func newParallelPipeline(t *testing.T, template segments.Segment, segmentrepr config.SegmentRepr) *Pipeline {
+	parallelized := &segments.ParallelizedSegment{}
+	for range 4 {
+		expandedConfig, err := segmentrepr.ExpandedConfig("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		segment, err := segments.NewSegment(template, expandedConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parallelized.AddSegment(segment)
+	}
+	segmentrepr.Jobs = 4
+	return newPipeline([]segments.Segment{parallelized}, []config.SegmentRepr{segmentrepr}, nil)
+}
+
+// Sends flows with sequence numbers 0 to count-1 through a pipeline and
+// returns the sequence numbers of the expected number of flows leaving it,
+// without closing the pipeline.
+func sequenceThrough(t *testing.T, pipeline *Pipeline, count int, expected int) []uint32 {
+	pipeline.Start()
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		for i := range count {
+			pipeline.In <- &pb.EnrichedFlow{SequenceNum: uint32(i), Proto: uint32(6 + 11*(i%2))}
+		}
+	}()
+	var received []uint32
+	timeout := time.After(5 * time.Second)
+	for len(received) < expected {
+		select {
+		case msg := <-pipeline.Out:
+			received = append(received, msg.SequenceNum)
+		case <-timeout:
+			t.Fatalf("([error] Expected %d flows, got %d before the timeout.", expected, len(received))
+		}
+	}
+	<-sent
+	return received
+}
+
+func TestPipelineReorderJobs(t *testing.T) {
+	segmentrepr := config.SegmentRepr{Name: "uneven", Path: "reorder_test_jobs[0]", Reorder: &config.ReorderOptions{Timeout: 200 * time.Millisecond}}
+	pipeline := newParallelPipeline(t, &unevenSegment{}, segmentrepr)
+	skipped := flowsReorderSkipped.WithLabelValues(segmentrepr.Name, segmentrepr.Path)
+	initial := testutil.ToFloat64(skipped)
+
+	received := sequenceThrough(t, pipeline, 100, 99)
+	pipeline.AutoDrain()
+	pipeline.Close()
+	for i, sequence := range received {
+		expected := uint32(i)
+		if i >= 13 {
+			expected += 1 // swallowed
+		}
+		if sequence != expected {
+			t.Fatalf("([error] Flows were not reordered, got %v.", received)
+		}
+	}
+	if value := testutil.ToFloat64(skipped) - initial; value != 1 {
+		t.Errorf("([error] Expected one flow to be given up on, got %v.", value)
+	}
+}
+
+func TestPipelineReorderDrops(t *testing.T) {
+	template, err := segments.LookupSegment("flowfilter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	segmentrepr := config.SegmentRepr{
+		Name:    "flowfilter",
+		Path:    "reorder_test_drops[0]",
+		Config:  config.Config{Config: map[string]string{"filter": "proto tcp"}},
+		Reorder: &config.ReorderOptions{Timeout: time.Hour},
+	}
+	pipeline := newParallelPipeline(t, template, segmentrepr)
+
+	// flows dropped by the filter must not be waited for
+	received := sequenceThrough(t, pipeline, 100, 50)
+	pipeline.AutoDrain()
+	pipeline.Close()
+	for i, sequence := range received {
+		if sequence != uint32(2*i) {
+			t.Fatalf("([error] Flows were not reordered, got %v.", received)
+		}
+	}
+}
+
+func TestPipelineReorderReplaced(t *testing.T) {
+	template, err := segments.LookupSegment("dropfields")
+	if err != nil {
+		t.Fatal(err)
+	}
+	segmentrepr := config.SegmentRepr{
+		Name:    "dropfields",
+		Path:    "reorder_test_replaced[0]",
+		Config:  config.Config{Config: map[string]string{"policy": "keep", "fields": "SequenceNum"}},
+		Reorder: &config.ReorderOptions{Timeout: time.Hour},
+	}
+	pipeline := newParallelPipeline(t, template, segmentrepr)
+
+	// replaced flows must not be waited for, and their replacements take their place
+	received := sequenceThrough(t, pipeline, 100, 100)
+	pipeline.AutoDrain()
+	pipeline.Close()
+	for i, sequence := range received {
+		if sequence != uint32(i) {
+			t.Fatalf("([error] Replaced flows were not reordered, got %v.", received)
+		}
+	}
+}
+
+func TestPipelineReorderShardBy(t *testing.T) {
+	segmentrepr := config.SegmentRepr{Name: "uneven", Path: "reorder_test_shard_by[0]", ShardBy: config.FieldList{"Proto"}, Reorder: &config.ReorderOptions{Timeout: 200 * time.Millisecond}}
+	pipeline := newParallelPipeline(t, &unevenSegment{}, segmentrepr)
+	received := sequenceThrough(t, pipeline, 20, 19)
+	pipeline.AutoDrain()
+	pipeline.Close()
+	for i := 1; i < len(received); i++ {
+		if received[i] <= received[i-1] {
+			t.Fatalf("([error] Sharded flows were not reordered, got %v.", received)
+		}
+	}
+}
+
+func TestConcurrentReloadableOrdered(t *testing.T) {
+	segmentReprs, err := SegmentReprsFromConfig([]byte(`---
+- segment: pass`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline, err := NewReloadableWithOptions(segmentReprs, ReloadableOptions{Concurrency: 4, Reorder: &config.ReorderOptions{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline.Start()
+	go func() {
+		for i := range 200 {
+			pipeline.GetInput() <- &pb.EnrichedFlow{SequenceNum: uint32(i)}
+		}
+	}()
+	for i := range 200 {
+		if msg := <-pipeline.GetOutput(); msg.SequenceNum != uint32(i) {
+			t.Fatalf("([error] Expected flow %d from concurrent pipelines, got %d.", i, msg.SequenceNum)
+		}
+	}
+	pipeline.AutoDrain()
+	pipeline.Close()
+}
@@ -0,0 +1,33 @@
+package pipeline
+
+import (
+	"fmt"
+	"hash/fnv"
+
+	"github.com/BelWue/flowpipeline/pb"
+	"github.com/BelWue/flowpipeline/pipeline/flowkey"
+)
+
+// Assigns flows to one of a number of jobs based on the values of a set of
+// flow fields, such that all flows with the same values end up at the same
+// job.
+type sharder struct {
+	keyFields *flowkey.Fields
+}
+
+// Creates a sharder using the named fields of pb.EnrichedFlow, see
+// flowkey.NewFields.
+func newSharder(fieldNames []string) (*sharder, error) {
+	keyFields, err := flowkey.NewFields(fieldNames)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse 'shard_by': %w", err)
+	}
+	return &sharder{keyFields: keyFields}, nil
+}
+
+// Returns the job a flow should be handled by.
+func (sharder *sharder) shard(flow *pb.EnrichedFlow, jobs int) int {
+	hash := fnv.New64a()
+	hash.Write([]byte(sharder.keyFields.Key(flow)))
+	return int(hash.Sum64() % uint64(jobs))
+}
@@ -0,0 +1,102 @@
+package pipeline
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/BelWue/flowpipeline/pb"
+	"github.com/BelWue/flowpipeline/segments"
+)
+
+// A segment remembering the flows it has seen.
+type recordingSegment struct {
+	segments.BaseSegment
+	seen []*pb.EnrichedFlow
+}
+
+func (segment *recordingSegment) New(config map[string]string) segments.Segment {
+	return &recordingSegment{}
+}
+
+func (segment *recordingSegment) Run(wg *sync.WaitGroup) {
+	defer func() {
+		close(segment.Out)
+		wg.Done()
+	}()
+	for msg := range segment.In {
+		segment.seen = append(segment.seen, msg)
+		segment.Out <- msg
+	}
+}
+
+func TestSharderConsistency(t *testing.T) {
+	sharder, err := newSharder([]string{"SrcAddr", "Proto"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	flow := &pb.EnrichedFlow{SrcAddr: []byte{192, 0, 2, 1}, DstAddr: []byte{192, 0, 2, 2}, Proto: 6}
+	other := &pb.EnrichedFlow{SrcAddr: []byte{192, 0, 2, 1}, DstAddr: []byte{198, 51, 100, 1}, Proto: 6}
+	if sharder.shard(flow, 8) != sharder.shard(other, 8) {
+		t.Error("([error] Flows with the same key were assigned to different jobs.")
+	}
+}
+
+func TestSharderInvalidFields(t *testing.T) {
+	for field, message := range map[string]string{
+		"DoesNotExist": "does not exist",
+		"state":        "does not exist",
+		"AsPath":       "not supported",
+	} {
+		if _, err := newSharder([]string{field}); err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("([error] Sharding by field '%s' did not fail with '%s': %v", field, message, err)
+		}
+	}
+}
+
+func TestPipelineShardBy(t *testing.T) {
+	segmentReprs, err := SegmentReprsFromConfig([]byte(`---
+- segment: pass
+  jobs: 4
+  shard_by: SrcAddr`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segmentReprs[0].ShardBy) != 1 || segmentReprs[0].ShardBy[0] != "SrcAddr" {
+		t.Fatalf("([error] shard_by was not parsed from a single field: %v", segmentReprs[0].ShardBy)
+	}
+
+	parallelized := &segments.ParallelizedSegment{}
+	jobs := make([]*recordingSegment, 4)
+	for i := range jobs {
+		jobs[i] = &recordingSegment{}
+		parallelized.AddSegment(jobs[i])
+	}
+	segmentReprs[0].Path = "segments[0]"
+	pipeline := newPipeline([]segments.Segment{parallelized}, segmentReprs, nil)
+	pipeline.Start()
+	pipeline.AutoDrain()
+	for i := range 400 {
+		pipeline.In <- &pb.EnrichedFlow{SrcAddr: []byte{192, 0, 2, byte(i % 16)}, SequenceNum: uint32(i)}
+	}
+	pipeline.Close()
+
+	owner := make(map[byte]int)
+	for i, job := range jobs {
+		last := make(map[byte]uint32)
+		for _, flow := range job.seen {
+			key := flow.SrcAddr[3]
+			if previous, ok := owner[key]; ok && previous != i {
+				t.Fatalf("([error] Flows of key %d were handled by jobs %d and %d.", key, previous, i)
+			}
+			owner[key] = i
+			if sequence, ok := last[key]; ok && sequence > flow.SequenceNum {
+				t.Errorf("([error] Flows of key %d were reordered.", key)
+			}
+			last[key] = flow.SequenceNum
+		}
+	}
+	if len(owner) != 16 {
+		t.Errorf("([error] Expected 16 keys to be seen, got %d.", len(owner))
+	}
+}
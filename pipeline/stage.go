@@ -0,0 +1,344 @@
+package pipeline
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/BelWue/flowpipeline/pb"
+	"github.com/BelWue/flowpipeline/pipeline/config"
+	"github.com/BelWue/flowpipeline/segments"
+)
+
+// A segment in a Pipeline as configured. Flows enter a stage through its in
+// edge, which is shared by all of its units.
+type stage struct {
+	repr      config.SegmentRepr
+	in        *edge
+	units     []*unit
+	sharder   *sharder   // distributes flows among multiple units, if set
+	reorderer *reorderer // restores the order of flows leaving multiple units, if set
+	tagged    *edge      // flows tagged by the reorderer, read by all units
+	exit      *edge      // flows leaving the units, read by the reorderer
+}
+
+// A single segment instance running within a Pipeline. Segments configured
+// with multiple jobs are represented by one unit per job.
+type unit struct {
+	segment  segments.Segment
+	name     string // as configured
+	position string
+	in       *edge                 // read by the segment
+	out      chan *pb.EnrichedFlow // written by the segment
+	relayed  bool                  // whether out is read by a relay, which counts the flows and offers them to taps
+	drops    chan *pb.EnrichedFlow // written by filter segments, nil otherwise
+	metrics  *segmentMetrics
+	taps     tapPoint // offered the flows written by the segment
+
+	deadLetters chan *segments.DeadLetter // written by segments configured with a dead letter pipeline, nil otherwise
+	deadLetter  *deadLetterRoute          // shared by all units of a stage
+}
+
+// A channel written to by a number of relays, or by a single segment directly,
+// which is closed as soon as all of them are done. If the channel is buffered, the overflow policy decides
+// what happens to flows arriving while the buffer is full.
+type edge struct {
+	ch         chan *pb.EnrichedFlow
+	writers    atomic.Int32
+	overflow   string
+	overflowed prometheus.Counter // only set for policies discarding flows
+}
+
+func newEdge(writers int, buffer int, overflow string) *edge {
+	e := &edge{ch: make(chan *pb.EnrichedFlow, buffer), overflow: overflow}
+	e.writers.Store(int32(writers))
+	return e
+}
+
+// Hands a flow to the edge according to its overflow policy. Returns whether
+// the flow was accepted, and how long the caller was blocked. Discarded flows
+// are acknowledged, as they will not be handled any further.
+func (e *edge) send(msg *pb.EnrichedFlow) (bool, time.Duration) {
+	select {
+	case e.ch <- msg:
+		return true, 0
+	default:
+	}
+	switch e.overflow {
+	case config.OverflowDropNewest:
+		e.overflowed.Inc()
+		segments.Ack(msg)
+		return false, 0
+	case config.OverflowDropOldest:
+		for {
+			select {
+			case oldest := <-e.ch:
+				e.overflowed.Inc()
+				segments.Ack(oldest)
+			default: // drained by the segment in the meantime
+			}
+			select {
+			case e.ch <- msg:
+				return true, 0
+			default: // refilled by another relay in the meantime
+			}
+		}
+	}
+	start := time.Now()
+	e.ch <- msg
+	return true, time.Since(start)
+}
+
+// Reports whether a single writer may write to the edge's channel directly
+// instead of using a relay, as it has no other writers and no overflow policy
+// to enforce.
+func (e *edge) exclusive() bool {
+	return e.writers.Load() == 1 && e.overflow != config.OverflowDropNewest && e.overflow != config.OverflowDropOldest
+}
+
+func (e *edge) done() {
+	if e.writers.Add(-1) == 0 {
+		close(e.ch)
+	}
+}
+
+// Wires up a list of segments according to their config representations.
+// Every segment instance is connected to its neighbours using relays, which
+// keep track of the flows passing through it. Without instrumentation, see
+// SetInstrumentation, relays are only used where flows of multiple segment
+// instances need to be merged or distributed. Segments wrapped in a
+// ParallelizedSegment are wired individually. The dead letter pipelines are
+// those of the segments at the same index, and may be nil if there are none.
+func newPipeline(segmentList []segments.Segment, segmentReprs []config.SegmentRepr, deadLetters []*Pipeline) *Pipeline {
+	pipeline := &Pipeline{In: make(chan *pb.EnrichedFlow), wg: &sync.WaitGroup{}, SegmentList: segmentList}
+	direct := uninstrumented.Load()
+	if deadLetters == nil {
+		deadLetters = make([]*Pipeline, len(segmentList))
+	}
+
+	writers := 1 // the entry relay
+	for i, segment := range segmentList {
+		stage := &stage{repr: segmentReprs[i], in: newEdge(writers, segmentReprs[i].Buffer, segmentReprs[i].Overflow)}
+		if stage.in.overflow == config.OverflowDropNewest || stage.in.overflow == config.OverflowDropOldest {
+			stage.in.overflowed = flowsOverflowed.WithLabelValues(stage.repr.Name, stage.repr.Path)
+		}
+		jobs := []segments.Segment{segment}
+		if parallelized, ok := segment.(*segments.ParallelizedSegment); ok && len(parallelized.Jobs()) > 0 {
+			jobs = parallelized.Jobs()
+		}
+		var deadLetter *deadLetterRoute
+		if deadLetters[i] != nil {
+			deadLetter = newDeadLetterRoute(deadLetters[i], len(jobs))
+		}
+		for j, job := range jobs {
+			unit := &unit{segment: job, name: stage.repr.Name, position: stage.repr.Path, in: stage.in}
+			if len(jobs) > 1 {
+				unit.position = fmt.Sprintf("%s.jobs[%d]", stage.repr.Path, j)
+				unit.in = newEdge(1, 0, config.OverflowBlock)
+			}
+			unit.metrics = newSegmentMetrics(stage.repr.Name, unit.position)
+			if filter, ok := job.(segments.FilterSegment); ok {
+				unit.drops = make(chan *pb.EnrichedFlow)
+				filter.SubscribeDrops(unit.drops)
+			}
+			unit.subscribeDeadLetters(deadLetter)
+			stage.units = append(stage.units, unit)
+		}
+		writers = len(jobs)
+		if len(jobs) > 1 && len(stage.repr.ShardBy) > 0 {
+			stage.sharder, _ = newSharder(stage.repr.ShardBy) // validated in segmentsFromRepr
+		}
+		if len(jobs) > 1 && stage.repr.Reorder != nil {
+			stage.reorderer = newReorderer(*stage.repr.Reorder, stage.repr.Name, stage.repr.Path)
+			if stage.sharder == nil {
+				stage.tagged = newEdge(1, 0, config.OverflowBlock)
+			}
+			stage.exit = newEdge(len(jobs), 0, config.OverflowBlock)
+			for _, unit := range stage.units {
+				if replacing, ok := unit.segment.(segments.ReplacingSegment); ok {
+					replacing.SubscribeReplacements(stage.reorderer.replace)
+				}
+			}
+			writers = 1
+		}
+		pipeline.stages = append(pipeline.stages, stage)
+	}
+	out := newEdge(writers, 0, config.OverflowBlock)
+	pipeline.Out = out.ch
+
+	// connect the pipeline's In channel to the first stage
+	first := pipeline.stages[0]
+	if direct && first.in.exclusive() {
+		pipeline.In = first.in.ch
+	} else {
+		pipeline.relays = append(pipeline.relays, func() {
+			relay(pipeline.In, first.in, nil, first.receiver())
+		})
+	}
+	for i, stage := range pipeline.stages {
+		next := out
+		var receiver *segmentMetrics
+		if i+1 < len(pipeline.stages) {
+			next = pipeline.stages[i+1].in
+			receiver = pipeline.stages[i+1].receiver()
+		}
+		distributed := stage.in
+		if stage.sharder != nil || stage.reorderer != nil {
+			pipeline.relays = append(pipeline.relays, stage.dispatch)
+			distributed = stage.tagged
+		}
+		if stage.reorderer != nil {
+			pipeline.relays = append(pipeline.relays, func() {
+				stage.resequence(next, receiver)
+			})
+		}
+		for _, unit := range stage.units {
+			if unit.in != stage.in && stage.sharder == nil { // distribute among parallel jobs
+				pipeline.relays = append(pipeline.relays, func() {
+					relay(distributed.ch, unit.in, nil, unit.metrics)
+				})
+			}
+			switch {
+			case stage.reorderer != nil:
+				unit.out, unit.relayed = make(chan *pb.EnrichedFlow), true
+				pipeline.relays = append(pipeline.relays, func() {
+					relay(unit.out, stage.exit, unit, nil)
+				})
+			case direct && next.exclusive():
+				unit.out = next.ch
+			default:
+				unit.out, unit.relayed = make(chan *pb.EnrichedFlow), true
+				pipeline.relays = append(pipeline.relays, func() {
+					relay(unit.out, next, unit, receiver)
+				})
+			}
+			unit.segment.Rewire(unit.in.ch, unit.out)
+			if unit.drops != nil {
+				pipeline.relays = append(pipeline.relays, func() {
+					pipeline.forwardDrops(unit, stage.reorderer)
+				})
+			}
+			if unit.deadLetters != nil {
+				pipeline.relays = append(pipeline.relays, func() {
+					pipeline.forwardDeadLetters(unit)
+				})
+			}
+		}
+	}
+	pipeline.initShutdown()
+	return pipeline
+}
+
+// Returns the metrics of the unit receiving flows from this stage's in edge,
+// or nil if flows are distributed among multiple units.
+func (stage *stage) receiver() *segmentMetrics {
+	if len(stage.units) == 1 {
+		return stage.units[0].metrics
+	}
+	return nil
+}
+
+// Tags the flows arriving at this stage for its reorderer and distributes
+// them among its units. Using a sharder, flows with the same key are handled
+// by the same unit, in the order they arrived. Otherwise, flows are handed on
+// to be picked up by any unit.
+func (stage *stage) dispatch() {
+	defer func() {
+		if stage.sharder == nil {
+			stage.tagged.done()
+			return
+		}
+		for _, unit := range stage.units {
+			unit.in.done()
+		}
+	}()
+	for msg := range stage.in.ch {
+		if stage.reorderer != nil {
+			stage.reorderer.tag(msg)
+		}
+		if stage.sharder == nil {
+			stage.tagged.send(msg)
+			continue
+		}
+		unit := stage.units[stage.sharder.shard(msg, len(stage.units))]
+		unit.in.send(msg)
+		unit.metrics.in.Inc()
+	}
+}
+
+// Hands the flows leaving this stage's units on in the order they arrived at
+// the stage, counting them as received by the receiving segment, if any.
+func (stage *stage) resequence(to *edge, receiver *segmentMetrics) {
+	defer to.done()
+	stage.reorderer.resequence(stage.exit.ch, func(msg *pb.EnrichedFlow) {
+		if accepted, _ := to.send(msg); accepted && receiver != nil {
+			receiver.in.Inc()
+		}
+	})
+}
+
+// Forwards flows from a channel to an edge, counting them as emitted by the
+// sending segment and as received by the receiving one, if any. The time
+// spent waiting for the receiving side is attributed to the sender. Flows are
+// offered to the sender's taps before handing them on, as the receiving side
+// may modify them.
+func relay(from <-chan *pb.EnrichedFlow, to *edge, sender *unit, receiver *segmentMetrics) {
+	defer to.done()
+	for msg := range from {
+		if sender != nil {
+			sender.taps.offer(msg)
+		}
+		accepted, blocked := to.send(msg)
+		if sender != nil {
+			sender.metrics.out.Inc()
+			if blocked > 0 {
+				sender.metrics.blocked.Add(blocked.Seconds())
+			}
+		}
+		if accepted && receiver != nil {
+			receiver.in.Inc()
+		}
+	}
+}
+
+// Counts the flows dropped by a filter segment and forwards them to the
+// pipeline's Drop channel, or the one of the batched Pipeline it is a section
+// of, if it has been requested using GetDrop. Dropped
+// flows are reported to the stage's reorderer, if any, and acknowledged if
+// nobody requested them.
+func (pipeline *Pipeline) forwardDrops(unit *unit, reorderer *reorderer) {
+	for msg := range unit.drops {
+		unit.metrics.dropped.Inc()
+		if reorderer != nil {
+			reorderer.drop(msg)
+		}
+		target := pipeline
+		if pipeline.parent != nil {
+			target = pipeline.parent
+		}
+		if drop := target.dropTarget.Load(); drop != nil {
+			*drop <- msg
+		} else {
+			segments.Ack(msg)
+		}
+	}
+}
+
+// Returns the registered name of a segment, using the jobs' name for
+// segments wrapped in a ParallelizedSegment.
+func segmentName(segment segments.Segment) string {
+	if parallelized, ok := segment.(*segments.ParallelizedSegment); ok && len(parallelized.Jobs()) > 0 {
+		return segments.SegmentName(parallelized.Jobs()[0])
+	}
+	return segments.SegmentName(segment)
+}
+
+func closeQuietly(ch chan *pb.EnrichedFlow) {
+	defer func() {
+		recover() // in case the channel is already closed
+	}()
+	close(ch)
+}
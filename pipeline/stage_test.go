@@ -0,0 +1,130 @@
+package pipeline
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/BelWue/flowpipeline/pb"
+	"github.com/BelWue/flowpipeline/pipeline/config"
+	"github.com/BelWue/flowpipeline/segments"
+)
+
+// A segment which does not read any flows until it is released.
+type stalledSegment struct {
+	segments.BaseSegment
+	release chan struct{}
+}
+
+func (segment *stalledSegment) New(config map[string]string) segments.Segment {
+	return &stalledSegment{release: make(chan struct{})}
+}
+
+func (segment *stalledSegment) Run(wg *sync.WaitGroup) {
+	defer func() {
+		close(segment.Out)
+		wg.Done()
+	}()
+	<-segment.release
+	for msg := range segment.In {
+		segment.Out <- msg
+	}
+}
+
+// Sends five flows into a stalled segment with a buffer of two and returns
+// the flows it eventually emits.
+func runOverflow(t *testing.T, overflow string) []uint32 {
+	segmentrepr := config.SegmentRepr{Name: "stalled", Buffer: 2, Overflow: overflow, Path: "overflow_test_" + overflow + "[0]"}
+	stalled := (&stalledSegment{}).New(nil).(*stalledSegment)
+	pipeline := newPipeline([]segments.Segment{stalled}, []config.SegmentRepr{segmentrepr}, nil)
+	overflowed := flowsOverflowed.WithLabelValues(segmentrepr.Name, segmentrepr.Path)
+	initial := testutil.ToFloat64(overflowed)
+
+	pipeline.Start()
+	var received []uint32
+	done := make(chan struct{})
+	go func() {
+		for msg := range pipeline.Out {
+			received = append(received, msg.SequenceNum)
+		}
+		close(done)
+	}()
+	for i := range 5 {
+		pipeline.In <- &pb.EnrichedFlow{SequenceNum: uint32(i + 1)}
+	}
+	for testutil.ToFloat64(overflowed)-initial < 3 {
+		select {
+		case <-time.After(time.Second):
+			t.Fatalf("([error] Expected 3 flows to overflow, got %v.", testutil.ToFloat64(overflowed)-initial)
+		case <-time.After(time.Millisecond):
+		}
+	}
+	close(stalled.release)
+	pipeline.Close()
+	<-done
+	return received
+}
+
+func TestPipelineOverflowDropNewest(t *testing.T) {
+	received := runOverflow(t, config.OverflowDropNewest)
+	if len(received) != 2 || received[0] != 1 || received[1] != 2 {
+		t.Errorf("([error] Expected the first two flows to be kept, got %v.", received)
+	}
+}
+
+func TestPipelineOverflowDropOldest(t *testing.T) {
+	received := runOverflow(t, config.OverflowDropOldest)
+	if len(received) != 2 || received[0] != 4 || received[1] != 5 {
+		t.Errorf("([error] Expected the last two flows to be kept, got %v.", received)
+	}
+}
+
+func TestPipelineUninstrumented(t *testing.T) {
+	SetInstrumentation(false)
+	defer SetInstrumentation(true)
+	segmentReprs, err := SegmentReprsFromConfig([]byte(`---
+- segment: pass
+- segment: pass
+  buffer: 16
+- segment: pass
+  jobs: 2
+- segment: pass
+  buffer: 16
+  overflow: drop-newest
+- segment: pass`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline, err := NewFromRepr(segmentReprs, "uninstrumented_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// distributing flows to the jobs and merging them into the buffer of the
+	// fourth segment, which enforces its overflow policy
+	if len(pipeline.relays) != 4 {
+		t.Errorf("([error] Expected 4 relays, got %d.", len(pipeline.relays))
+	}
+	if attached := pipeline.Attach(NewTap(TapOptions{Position: "uninstrumented_test[1]"})); attached != 0 {
+		t.Errorf("([error] Attached a tap to a segment which is not relayed.")
+	}
+
+	overflowed := flowsOverflowed.WithLabelValues("pass", "uninstrumented_test[3]")
+	initial := testutil.ToFloat64(overflowed)
+
+	pipeline.Start()
+	go func() {
+		for i := range 100 {
+			pipeline.In <- &pb.EnrichedFlow{SequenceNum: uint32(i)}
+		}
+		pipeline.Close()
+	}()
+	received := 0
+	for range pipeline.Out {
+		received += 1
+	}
+	if discarded := int(testutil.ToFloat64(overflowed) - initial); received+discarded != 100 {
+		t.Errorf("([error] Expected 100 flows to pass or overflow, got %d and %d.", received, discarded)
+	}
+}
@@ -0,0 +1,155 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/BelWue/flowpipeline/segments"
+)
+
+// The state of a single segment of a running Pipeline, as reported by
+// Pipeline.Status. The counters are shared by segment instances with the same
+// name and position, i.e. in concurrent pipelines.
+type SegmentStatus struct {
+	Segment           string          `json:"segment"`
+	Position          string          `json:"position"`
+	Queued            int             `json:"queued"`   // flows waiting in the segment's input channel, batches when using the batched transport
+	Capacity          int             `json:"capacity"` // capacity of the segment's input channel
+	FlowsIn           float64         `json:"flows_in"`
+	FlowsOut          float64         `json:"flows_out"`
+	FlowsDropped      float64         `json:"flows_dropped"`
+	FlowsDeadLettered float64         `json:"flows_dead_lettered"`
+	Jobs              []SegmentStatus `json:"jobs,omitempty"`       // the instances of a segment configured with multiple jobs
+	Nested            []SegmentStatus `json:"nested,omitempty"`     // the segments of embedded pipelines, such as branches
+	DeadLetter        []SegmentStatus `json:"deadletter,omitempty"` // the segments of the dead letter pipeline, if configured
+}
+
+// Segments embedding further pipelines, such as the controlflow segments,
+// implement this interface so that the segments of these pipelines are
+// included when inspecting the pipeline they are running in.
+type NestingSegment interface {
+	NestedStatus() []SegmentStatus          // the status of all segments of the embedded pipelines
+	NestedHealth(ctx context.Context) error // the joined errors of all segments of the embedded pipelines
+	NestedAttach(tap *Tap) int              // attaches the tap to the embedded pipelines, see Pipeline.Attach
+}
+
+// Returns the status of all segments of this Pipeline in order, including
+// those of embedded pipelines. It is safe to call while the Pipeline is
+// running.
+func (pipeline *Pipeline) Status() []SegmentStatus {
+	var status []SegmentStatus
+	for _, stage := range pipeline.stages {
+		status = append(status, stage.status())
+	}
+	for _, section := range pipeline.sections {
+		if section.unit == nil {
+			status = append(status, section.flows.Status()...)
+			continue
+		}
+		unitStatus := section.unit.status()
+		unitStatus.Queued = len(section.in)
+		unitStatus.Capacity = cap(section.in)
+		status = append(status, unitStatus)
+	}
+	return status
+}
+
+// Asks all segments of this Pipeline implementing segments.HealthReporter,
+// including those of embedded and dead letter pipelines, whether they are
+// ready to handle flows. Returns their joined errors, each one indicating the
+// segment's position.
+func (pipeline *Pipeline) Health(ctx context.Context) error {
+	var errs []error
+	for _, stage := range pipeline.stages {
+		for _, unit := range stage.units {
+			errs = append(errs, unit.health(ctx))
+		}
+		if route := stage.units[0].deadLetter; route != nil {
+			errs = append(errs, route.pipeline.Health(ctx))
+		}
+	}
+	for _, section := range pipeline.sections {
+		if section.unit == nil {
+			errs = append(errs, section.flows.Health(ctx))
+			continue
+		}
+		errs = append(errs, section.unit.health(ctx))
+		if route := section.unit.deadLetter; route != nil {
+			errs = append(errs, route.pipeline.Health(ctx))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Returns the status of this stage. The counters of stages with multiple
+// units are the sums of the counters of all jobs, which are listed
+// individually. Their shared dead letter pipeline is listed once for the
+// stage.
+func (stage *stage) status() SegmentStatus {
+	if len(stage.units) == 1 {
+		return stage.units[0].status()
+	}
+	status := SegmentStatus{
+		Segment:  stage.repr.Name,
+		Position: stage.repr.Path,
+		Queued:   len(stage.in.ch),
+		Capacity: cap(stage.in.ch),
+	}
+	for _, unit := range stage.units {
+		job := unit.status()
+		status.FlowsIn += job.FlowsIn
+		status.FlowsOut += job.FlowsOut
+		status.FlowsDropped += job.FlowsDropped
+		status.FlowsDeadLettered += job.FlowsDeadLettered
+		status.DeadLetter = job.DeadLetter
+		job.DeadLetter = nil
+		status.Jobs = append(status.Jobs, job)
+	}
+	return status
+}
+
+func (unit *unit) status() SegmentStatus {
+	status := SegmentStatus{
+		Segment:           unit.name,
+		Position:          unit.position,
+		FlowsIn:           counterValue(unit.metrics.in),
+		FlowsOut:          counterValue(unit.metrics.out),
+		FlowsDropped:      counterValue(unit.metrics.dropped),
+		FlowsDeadLettered: counterValue(unit.metrics.deadLettered),
+	}
+	if unit.in != nil {
+		status.Queued = len(unit.in.ch)
+		status.Capacity = cap(unit.in.ch)
+	}
+	if nesting, ok := unit.segment.(NestingSegment); ok {
+		status.Nested = nesting.NestedStatus()
+	}
+	if unit.deadLetter != nil {
+		status.DeadLetter = unit.deadLetter.pipeline.Status()
+	}
+	return status
+}
+
+func (unit *unit) health(ctx context.Context) error {
+	var errs []error
+	if reporter, ok := unit.segment.(segments.HealthReporter); ok {
+		if err := reporter.Health(ctx); err != nil {
+			errs = append(errs, &SegmentError{Path: unit.position, Name: unit.name, Err: err})
+		}
+	}
+	if nesting, ok := unit.segment.(NestingSegment); ok {
+		errs = append(errs, nesting.NestedHealth(ctx))
+	}
+	return errors.Join(errs...)
+}
+
+func counterValue(counter prometheus.Counter) float64 {
+	var metric dto.Metric
+	if err := counter.Write(&metric); err != nil {
+		return 0
+	}
+	return metric.GetCounter().GetValue()
+}
@@ -0,0 +1,94 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/BelWue/flowpipeline/pb"
+	"github.com/BelWue/flowpipeline/pipeline/config"
+	"github.com/BelWue/flowpipeline/segments"
+	"github.com/BelWue/flowpipeline/segments/pass"
+)
+
+func TestPipelineStatus(t *testing.T) {
+	segmentReprs, err := SegmentReprsFromConfig([]byte(`---
+- segment: pass
+- segment: flowfilter
+  jobs: 2
+  buffer: 5
+  config:
+    filter: proto tcp
+- segment: pass`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, batch := range []*config.BatchOptions{nil, {Size: 2}} {
+		var pipeline *Pipeline
+		if batch == nil {
+			pipeline, err = NewFromRepr(segmentReprs, "status_test")
+		} else {
+			pipeline, err = NewBatchedFromRepr(segmentReprs, "status_test", *batch)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		// counters are shared by all pipelines, compare against their initial values
+		initial := pipeline.Status()
+		pipeline.Start()
+		pipeline.AutoDrain()
+		for _, proto := range []uint32{6, 6, 17, 6} {
+			pipeline.In <- &pb.EnrichedFlow{Proto: proto}
+		}
+		pipeline.Close()
+
+		status := pipeline.Status()
+		if len(status) != 3 {
+			t.Fatalf("([error] Pipeline status lists %d segments, should be 3.", len(status))
+		}
+		filter := status[1]
+		if filter.Segment != "flowfilter" || filter.Position != "status_test[1]" {
+			t.Errorf("([error] Pipeline status lists segment '%s' at '%s', should be 'flowfilter' at 'status_test[1]'.", filter.Segment, filter.Position)
+		}
+		if filter.Capacity != 5 || len(filter.Jobs) != 2 {
+			t.Errorf("([error] Pipeline status reports capacity %d and %d jobs, should be 5 and 2.", filter.Capacity, len(filter.Jobs))
+		}
+		if in := filter.FlowsIn - initial[1].FlowsIn; in != 4 {
+			t.Errorf("([error] Pipeline status reports %v flows in, should be 4.", in)
+		}
+		if out := filter.FlowsOut - initial[1].FlowsOut; out != 3 {
+			t.Errorf("([error] Pipeline status reports %v flows out, should be 3.", out)
+		}
+		if dropped := filter.FlowsDropped - initial[1].FlowsDropped; dropped != 1 {
+			t.Errorf("([error] Pipeline status reports %v flows dropped, should be 1.", dropped)
+		}
+	}
+}
+
+// A segment reporting the given error as its health.
+type unhealthySegment struct {
+	pass.Pass
+	err error
+}
+
+func (segment *unhealthySegment) Health(ctx context.Context) error {
+	return segment.err
+}
+
+func TestPipelineHealth(t *testing.T) {
+	parallelized := &segments.ParallelizedSegment{}
+	parallelized.AddSegment(&pipelineSegment{pipeline: New(&unhealthySegment{err: errors.New("not connected")})})
+	parallelized.AddSegment(&pipelineSegment{pipeline: New(&unhealthySegment{})})
+	pipeline := New(&unhealthySegment{}, parallelized)
+	err := pipeline.Health(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "segments[0] (unhealthysegment): not connected") {
+		t.Fatalf("([error] Pipeline did not report the nested segment's health: %v", err)
+	}
+	if strings.Count(err.Error(), "not connected") != 1 {
+		t.Errorf("([error] Pipeline reported healthy segments: %v", err)
+	}
+	if status := pipeline.Status(); len(status[1].Jobs) != 2 || len(status[1].Jobs[0].Nested) != 1 {
+		t.Errorf("([error] Pipeline status does not include the nested pipelines: %+v", status)
+	}
+}
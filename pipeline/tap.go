@@ -0,0 +1,233 @@
+package pipeline
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/BelWue/flowpipeline/pb"
+)
+
+// The number of flows a Tap holds for its reader if not configured otherwise.
+const DefaultTapBuffer = 1024
+
+// Options of a Tap.
+type TapOptions struct {
+	Position    string                      // position of the segments whose emitted flows are captured, including all of their jobs
+	Match       func(*pb.EnrichedFlow) bool // selects the flows to capture, all if nil; called concurrently by all segments tapped
+	MaxFlows    int                         // closes the tap once this many flows have been captured, unlimited if 0
+	MaxDuration time.Duration               // closes the tap after this time, unlimited if 0
+	Buffer      int                         // number of flows held for a slow reader, defaults to DefaultTapBuffer
+}
+
+// A temporary tap capturing copies of the flows emitted by the segments at a
+// position of running pipelines, see Pipeline.Attach. Flows are handed to the
+// tap without ever blocking a pipeline: flows arriving while its buffer is
+// full are counted as missed instead. Once closed, the tap detaches itself
+// from all pipelines and closes its Flows channel.
+type Tap struct {
+	options   TapOptions
+	flows     chan *pb.EnrichedFlow
+	done      chan struct{}
+	timer     *time.Timer
+	mutex     sync.RWMutex // guards flows against being closed while sending
+	closed    bool
+	points    []*tapPoint
+	delivered atomic.Int64
+	missed    atomic.Int64
+}
+
+// Creates a Tap, which starts capturing once attached to a pipeline. The
+// MaxDuration starts running immediately.
+func NewTap(options TapOptions) *Tap {
+	if options.Buffer <= 0 {
+		options.Buffer = DefaultTapBuffer
+	}
+	tap := &Tap{
+		options: options,
+		flows:   make(chan *pb.EnrichedFlow, options.Buffer),
+		done:    make(chan struct{}),
+	}
+	if options.MaxDuration > 0 {
+		tap.timer = time.AfterFunc(options.MaxDuration, tap.Close)
+	}
+	return tap
+}
+
+// Returns the channel the captured flows are delivered to, which is closed
+// once the tap is closed.
+func (tap *Tap) Flows() <-chan *pb.EnrichedFlow {
+	return tap.flows
+}
+
+// Returns a channel which is closed once the tap is closed, be it by calling
+// Close or by reaching one of its limits.
+func (tap *Tap) Done() <-chan struct{} {
+	return tap.done
+}
+
+// Returns the number of flows captured so far.
+func (tap *Tap) Delivered() int64 {
+	return tap.delivered.Load()
+}
+
+// Returns the number of matching flows which have not been captured because
+// the reader was too slow.
+func (tap *Tap) Missed() int64 {
+	return tap.missed.Load()
+}
+
+// Detaches the tap from all pipelines and closes its Flows channel once all
+// flows captured have been read. Further calls do nothing.
+func (tap *Tap) Close() {
+	tap.mutex.Lock()
+	if tap.closed {
+		tap.mutex.Unlock()
+		return
+	}
+	tap.closed = true
+	points := tap.points
+	tap.points = nil
+	close(tap.flows)
+	close(tap.done)
+	tap.mutex.Unlock()
+
+	if tap.timer != nil {
+		tap.timer.Stop()
+	}
+	for _, point := range points {
+		point.detach(tap)
+	}
+}
+
+// Checks whether the segment at the provided position is tapped, which
+// includes all jobs of the segment at the tap's position.
+func (tap *Tap) covers(position string) bool {
+	return position == tap.options.Position || strings.HasPrefix(position, tap.options.Position+".jobs[")
+}
+
+// Attaches the tap to the provided tap point. Returns false if the tap has
+// been closed already.
+func (tap *Tap) register(point *tapPoint) bool {
+	tap.mutex.Lock()
+	defer tap.mutex.Unlock()
+	if tap.closed {
+		return false
+	}
+	tap.points = append(tap.points, point)
+	point.attach(tap)
+	return true
+}
+
+// Hands a copy of a matching flow to the reader if there is room for it.
+func (tap *Tap) offer(msg *pb.EnrichedFlow) {
+	tap.mutex.RLock()
+	defer tap.mutex.RUnlock()
+	if tap.closed || (tap.options.Match != nil && !tap.options.Match(msg)) {
+		return
+	}
+	limit := int64(tap.options.MaxFlows)
+	reserved := tap.delivered.Add(1)
+	if limit > 0 && reserved > limit {
+		tap.delivered.Add(-1)
+		return
+	}
+	select {
+	case tap.flows <- proto.Clone(msg).(*pb.EnrichedFlow):
+		if reserved == limit {
+			go tap.Close() // can not close while holding the read lock
+		}
+	default:
+		tap.delivered.Add(-1)
+		tap.missed.Add(1)
+	}
+}
+
+// The taps attached to a segment instance, offered every flow it emits. The
+// list is replaced on every change, so that relays only need a single atomic
+// load per flow to find out it is empty.
+type tapPoint struct {
+	mutex sync.Mutex
+	taps  atomic.Pointer[[]*Tap]
+}
+
+func (point *tapPoint) attach(tap *Tap) {
+	point.mutex.Lock()
+	defer point.mutex.Unlock()
+	var taps []*Tap
+	if current := point.taps.Load(); current != nil {
+		taps = append(taps, *current...)
+	}
+	taps = append(taps, tap)
+	point.taps.Store(&taps)
+}
+
+func (point *tapPoint) detach(tap *Tap) {
+	point.mutex.Lock()
+	defer point.mutex.Unlock()
+	current := point.taps.Load()
+	if current == nil {
+		return
+	}
+	var taps []*Tap
+	for _, attached := range *current {
+		if attached != tap {
+			taps = append(taps, attached)
+		}
+	}
+	if len(taps) == 0 {
+		point.taps.Store(nil)
+		return
+	}
+	point.taps.Store(&taps)
+}
+
+// Offers a flow to all attached taps.
+func (point *tapPoint) offer(msg *pb.EnrichedFlow) {
+	if taps := point.taps.Load(); taps != nil {
+		for _, tap := range *taps {
+			tap.offer(msg)
+		}
+	}
+}
+
+// Attaches a Tap to all segments at its position, including those of
+// embedded and dead letter pipelines. Returns the number of segment instances tapped, which
+// is zero if there is no segment at the position. The Tap detaches itself
+// once closed.
+func (pipeline *Pipeline) Attach(tap *Tap) int {
+	attached := 0
+	for _, stage := range pipeline.stages {
+		for _, unit := range stage.units {
+			attached += unit.attach(tap)
+		}
+		if route := stage.units[0].deadLetter; route != nil {
+			attached += route.pipeline.Attach(tap)
+		}
+	}
+	for _, section := range pipeline.sections {
+		if section.unit == nil {
+			attached += section.flows.Attach(tap)
+			continue
+		}
+		attached += section.unit.attach(tap)
+		if route := section.unit.deadLetter; route != nil {
+			attached += route.pipeline.Attach(tap)
+		}
+	}
+	return attached
+}
+
+func (unit *unit) attach(tap *Tap) int {
+	attached := 0
+	if unit.relayed && tap.covers(unit.position) && tap.register(&unit.taps) {
+		attached += 1
+	}
+	if nesting, ok := unit.segment.(NestingSegment); ok {
+		attached += nesting.NestedAttach(tap)
+	}
+	return attached
+}
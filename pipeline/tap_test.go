@@ -0,0 +1,90 @@
+package pipeline
+
+import (
+	"testing"
+	"time"
+
+	"github.com/BelWue/flowpipeline/pb"
+	"github.com/BelWue/flowpipeline/pipeline/config"
+)
+
+func TestTap(t *testing.T) {
+	segmentReprs, err := SegmentReprsFromConfig([]byte(`---
+- segment: pass
+- segment: dropfields
+  jobs: 2
+  config:
+    policy: drop
+    fields: InIf
+- segment: dropfields
+  config:
+    policy: drop
+    fields: OutIf`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, batch := range []*config.BatchOptions{nil, {Size: 2}} {
+		var pipeline *Pipeline
+		if batch == nil {
+			pipeline, err = NewFromRepr(segmentReprs, "segments")
+		} else {
+			pipeline, err = NewBatchedFromRepr(segmentReprs, "segments", *batch)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		tap := NewTap(TapOptions{
+			Position: "segments[1]",
+			Match:    func(msg *pb.EnrichedFlow) bool { return msg.Proto == 6 },
+			MaxFlows: 2,
+		})
+		if attached := pipeline.Attach(tap); attached != 2 {
+			t.Errorf("([error] Tap was attached to %d segments, should be 2.", attached)
+		}
+		pipeline.Start()
+		pipeline.AutoDrain()
+		for _, proto := range []uint32{17, 6, 6, 6} {
+			pipeline.In <- &pb.EnrichedFlow{Proto: proto, InIf: 1, OutIf: 2}
+		}
+		pipeline.Close()
+
+		var captured []*pb.EnrichedFlow
+		for msg := range tap.Flows() {
+			captured = append(captured, msg)
+		}
+		if len(captured) != 2 {
+			t.Fatalf("([error] Tap captured %d flows, should be 2.", len(captured))
+		}
+		for _, msg := range captured {
+			if msg.Proto != 6 || msg.InIf != 0 || msg.OutIf != 2 {
+				t.Errorf("([error] Tap captured a flow not as emitted by the tapped segment: %v", msg)
+			}
+		}
+	}
+}
+
+func TestTapLimits(t *testing.T) {
+	pipeline := New()
+	tap := NewTap(TapOptions{Position: "segments[0]", MaxDuration: 50 * time.Millisecond, Buffer: 1})
+	if attached := pipeline.Attach(tap); attached != 1 {
+		t.Fatalf("([error] Tap was attached to %d segments, should be 1.", attached)
+	}
+	pipeline.Start()
+	pipeline.AutoDrain()
+	for range 3 {
+		pipeline.In <- &pb.EnrichedFlow{Proto: 6} // must not block on the full tap
+	}
+	select {
+	case <-tap.Done():
+	case <-time.After(time.Second):
+		t.Fatal("([error] Tap was not closed after its maximum duration.")
+	}
+	pipeline.In <- &pb.EnrichedFlow{Proto: 6}
+	pipeline.Close()
+	if tap.Delivered() != 1 || tap.Missed() != 2 {
+		t.Errorf("([error] Tap delivered %d and missed %d flows, should be 1 and 2.", tap.Delivered(), tap.Missed())
+	}
+	if attached := pipeline.Attach(NewTap(TapOptions{Position: "segments[1]"})); attached != 0 {
+		t.Errorf("([error] Tap was attached to %d segments at an unknown position.", attached)
+	}
+}
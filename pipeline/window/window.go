@@ -0,0 +1,208 @@
+// Package window provides time buckets for segments which calculate traffic
+// statistics over sliding windows, such as `toptalkers_metrics` or `elephant`.
+//
+// Flows can be accounted either in processing time, i.e. in the bucket of the
+// wall-clock time they arrive at a segment, or in event time, i.e. in the
+// bucket of their own timestamps. The latter yields correct rates for delayed
+// exporters and for replays of recorded flows. In event time, a watermark
+// tracks the latest flow time seen, and a bucket is considered complete once
+// the watermark has passed its end by the allowed lateness. Flows arriving
+// even later than that are reported as late and should not be accounted.
+package window
+
+import (
+	"fmt"
+	"iter"
+	"sync/atomic"
+	"time"
+
+	"github.com/BelWue/flowpipeline/pb"
+)
+
+// Determines which time flows are accounted at.
+type Mode int
+
+const (
+	ProcessingTime Mode = iota // the time flows arrive at a segment
+	EventTime                  // the time flows have been observed at
+)
+
+// Parses the values of the `time` parameter of segments, which are
+// `processing` and `event`. An empty value defaults to processing time.
+func ParseMode(mode string) (Mode, error) {
+	switch mode {
+	case "", "processing":
+		return ProcessingTime, nil
+	case "event":
+		return EventTime, nil
+	}
+	return ProcessingTime, fmt.Errorf("unknown time mode '%s', use one of 'processing' or 'event'", mode)
+}
+
+func (mode Mode) String() string {
+	if mode == EventTime {
+		return "event"
+	}
+	return "processing"
+}
+
+// Returns the event time of a flow, which is its end, or its start if the end
+// is not set. Flows without either are timed by their reception at the
+// collector, and by the current time as a last resort.
+func FlowTime(msg *pb.EnrichedFlow, now time.Time) time.Time {
+	switch {
+	case msg.TimeFlowEndNs != 0:
+		return time.Unix(0, int64(msg.TimeFlowEndNs))
+	case msg.TimeFlowEndMs != 0:
+		return time.UnixMilli(int64(msg.TimeFlowEndMs))
+	case msg.TimeFlowEnd != 0:
+		return time.Unix(int64(msg.TimeFlowEnd), 0)
+	case msg.TimeFlowStartNs != 0:
+		return time.Unix(0, int64(msg.TimeFlowStartNs))
+	case msg.TimeFlowStartMs != 0:
+		return time.UnixMilli(int64(msg.TimeFlowStartMs))
+	case msg.TimeFlowStart != 0:
+		return time.Unix(int64(msg.TimeFlowStart), 0)
+	case msg.TimeReceivedNs != 0:
+		return time.Unix(0, int64(msg.TimeReceivedNs))
+	case msg.TimeReceived != 0:
+		return time.Unix(int64(msg.TimeReceived), 0)
+	}
+	return now
+}
+
+// Assigns flows to buckets of a fixed duration, numbered by the Unix time of
+// their start divided by their duration. A Clock may be used concurrently.
+type Clock struct {
+	Mode     Mode
+	Duration time.Duration // the duration of a bucket
+	Lateness time.Duration // the time flows are waited for in event time
+
+	watermark atomic.Int64 // the latest flow time seen in nanoseconds
+}
+
+func NewClock(mode Mode, duration time.Duration, lateness time.Duration) *Clock {
+	return &Clock{Mode: mode, Duration: duration, Lateness: lateness}
+}
+
+// Returns the bucket a flow is to be accounted in, and whether this bucket is
+// still open. In event time, this advances the watermark.
+func (clock *Clock) Bucket(msg *pb.EnrichedFlow) (int64, bool) {
+	if clock.Mode == ProcessingTime {
+		return clock.bucket(time.Now().UnixNano()), true
+	}
+	bucket := clock.bucket(clock.Advance(msg))
+	return bucket, bucket >= clock.Completed()
+}
+
+// Advances the watermark to the event time of a flow, if it is later, and
+// returns this time in nanoseconds. This is useful for flows which are not
+// accounted, but should still move time forward.
+func (clock *Clock) Advance(msg *pb.EnrichedFlow) int64 {
+	flowTime := FlowTime(msg, time.Now()).UnixNano()
+	for {
+		watermark := clock.watermark.Load()
+		if flowTime <= watermark || clock.watermark.CompareAndSwap(watermark, flowTime) {
+			return flowTime
+		}
+	}
+}
+
+// Returns the newest bucket, i.e. the one of the current time or of the
+// watermark in event time.
+func (clock *Clock) Current() int64 {
+	if clock.Mode == ProcessingTime {
+		return clock.bucket(time.Now().UnixNano())
+	}
+	return clock.bucket(clock.watermark.Load())
+}
+
+// Returns the first bucket which is not complete yet. All buckets before it
+// will not receive any more flows.
+func (clock *Clock) Completed() int64 {
+	if clock.Mode == ProcessingTime {
+		return clock.bucket(time.Now().UnixNano())
+	}
+	return clock.bucket(clock.watermark.Load() - int64(clock.Lateness))
+}
+
+// Returns the number of buckets which may receive flows at the same time. Rings
+// need to be this much larger than the number of complete buckets they keep.
+func (clock *Clock) Open() int {
+	if clock.Mode == ProcessingTime {
+		return 1
+	}
+	return int((clock.Lateness+clock.Duration-1)/clock.Duration) + 1
+}
+
+func (clock *Clock) bucket(nanoseconds int64) int64 {
+	bucket := nanoseconds / int64(clock.Duration)
+	if nanoseconds < 0 && nanoseconds%int64(clock.Duration) != 0 {
+		bucket -= 1
+	}
+	return bucket
+}
+
+// Keeps the values of a fixed number of consecutive buckets, the latest of
+// which is the newest bucket accessed. A Ring is not safe for concurrent use.
+type Ring[T any] struct {
+	buckets []T
+	latest  int64
+	started bool
+}
+
+func NewRing[T any](size int) *Ring[T] {
+	return &Ring[T]{buckets: make([]T, size)}
+}
+
+// Returns the value of a bucket. Accessing a newer bucket than the latest one
+// advances the ring, resetting the values of the buckets skipped. Buckets
+// which are too old to be kept anymore return nil.
+func (ring *Ring[T]) At(bucket int64) *T {
+	size := int64(len(ring.buckets))
+	if size == 0 {
+		return nil
+	}
+	if !ring.started || bucket > ring.latest {
+		from := bucket - size + 1
+		if ring.started {
+			from = max(from, ring.latest+1)
+		}
+		var zero T
+		for b := from; b <= bucket; b++ {
+			ring.buckets[ring.index(b)] = zero
+		}
+		ring.latest = bucket
+		ring.started = true
+	} else if ring.latest-bucket >= size {
+		return nil
+	}
+	return &ring.buckets[ring.index(bucket)]
+}
+
+// Iterates over the values of the buckets from the first up to but excluding
+// the last one provided, skipping those which are not kept in the ring.
+func (ring *Ring[T]) Range(from int64, to int64) iter.Seq[*T] {
+	return func(yield func(*T) bool) {
+		if !ring.started {
+			return
+		}
+		first := max(from, ring.latest-int64(len(ring.buckets))+1)
+		last := min(to, ring.latest+1)
+		for b := first; b < last; b++ {
+			if !yield(&ring.buckets[ring.index(b)]) {
+				return
+			}
+		}
+	}
+}
+
+// Iterates over the values of all buckets kept in the ring.
+func (ring *Ring[T]) All() iter.Seq[*T] {
+	return ring.Range(ring.latest-int64(len(ring.buckets))+1, ring.latest+1)
+}
+
+func (ring *Ring[T]) index(bucket int64) int {
+	size := int64(len(ring.buckets))
+	return int((bucket%size + size) % size)
+}
@@ -0,0 +1,120 @@
+package window
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/BelWue/flowpipeline/pb"
+)
+
+func TestParseMode(t *testing.T) {
+	for value, expected := range map[string]Mode{"": ProcessingTime, "processing": ProcessingTime, "event": EventTime} {
+		if mode, err := ParseMode(value); err != nil || mode != expected {
+			t.Errorf("ParseMode(%q) returned %s, %v", value, mode, err)
+		}
+	}
+	if _, err := ParseMode("wallclock"); err == nil {
+		t.Error("ParseMode accepted an unknown mode")
+	}
+}
+
+func TestFlowTime(t *testing.T) {
+	now := time.Unix(1000, 0)
+	for _, test := range []struct {
+		flow     *pb.EnrichedFlow
+		expected time.Time
+	}{
+		{&pb.EnrichedFlow{TimeFlowStart: 10, TimeFlowEnd: 20, TimeReceived: 30}, time.Unix(20, 0)},
+		{&pb.EnrichedFlow{TimeFlowStartMs: 10500, TimeFlowEndMs: 20500}, time.UnixMilli(20500)},
+		{&pb.EnrichedFlow{TimeFlowStart: 10, TimeReceived: 30}, time.Unix(10, 0)},
+		{&pb.EnrichedFlow{TimeReceivedNs: 30000000001}, time.Unix(30, 1)},
+		{&pb.EnrichedFlow{}, now},
+	} {
+		if flowTime := FlowTime(test.flow, now); !flowTime.Equal(test.expected) {
+			t.Errorf("FlowTime returned %s, should be %s", flowTime, test.expected)
+		}
+	}
+}
+
+func TestClock_eventTime(t *testing.T) {
+	clock := NewClock(EventTime, 10*time.Second, 30*time.Second)
+	if open := clock.Open(); open != 4 {
+		t.Errorf("Clock has %d open buckets, should be 4", open)
+	}
+	if bucket, open := clock.Bucket(&pb.EnrichedFlow{TimeFlowEnd: 1005}); bucket != 100 || !open {
+		t.Errorf("Clock put a flow in bucket %d (open %t), should be 100", bucket, open)
+	}
+	if bucket, open := clock.Bucket(&pb.EnrichedFlow{TimeFlowEnd: 1042}); bucket != 104 || !open {
+		t.Errorf("Clock put a flow in bucket %d (open %t), should be 104", bucket, open)
+	}
+	if current, completed := clock.Current(), clock.Completed(); current != 104 || completed != 101 {
+		t.Errorf("Clock is at bucket %d with %d completed, should be 104 and 101", current, completed)
+	}
+	// a flow within the lateness
+	if bucket, open := clock.Bucket(&pb.EnrichedFlow{TimeFlowEnd: 1015}); bucket != 101 || !open {
+		t.Errorf("Clock put a flow in bucket %d (open %t), should be 101", bucket, open)
+	}
+	// a flow beyond the lateness
+	if bucket, open := clock.Bucket(&pb.EnrichedFlow{TimeFlowEnd: 1009}); bucket != 100 || open {
+		t.Errorf("Clock put a late flow in bucket %d (open %t), should be closed bucket 100", bucket, open)
+	}
+	if current := clock.Current(); current != 104 {
+		t.Errorf("Clock moved back to bucket %d", current)
+	}
+}
+
+func TestClock_processingTime(t *testing.T) {
+	clock := NewClock(ProcessingTime, time.Second, time.Minute)
+	before := time.Now().Unix()
+	bucket, open := clock.Bucket(&pb.EnrichedFlow{TimeFlowEnd: 1})
+	if bucket < before || bucket > time.Now().Unix() || !open {
+		t.Errorf("Clock put a flow in bucket %d (open %t), should be the current second", bucket, open)
+	}
+	if open := clock.Open(); open != 1 {
+		t.Errorf("Clock has %d open buckets, should be 1", open)
+	}
+}
+
+func collect(ring *Ring[int], from int64, to int64) []int {
+	var values []int
+	for value := range ring.Range(from, to) {
+		values = append(values, *value)
+	}
+	return values
+}
+
+func TestRing(t *testing.T) {
+	ring := NewRing[int](3)
+	if values := collect(ring, 0, 100); values != nil {
+		t.Errorf("Ring returned %v before being used", values)
+	}
+	*ring.At(10) = 1
+	*ring.At(11) = 2
+	*ring.At(10) += 1
+	if values := collect(ring, 10, 12); !slices.Equal(values, []int{2, 2}) {
+		t.Errorf("Ring returned %v, should be [2 2]", values)
+	}
+
+	// skipping bucket 12 resets it, bucket 10 is dropped
+	*ring.At(13) = 4
+	if ring.At(10) != nil {
+		t.Error("Ring returned a bucket which is too old")
+	}
+	if values := collect(ring, 0, 100); !slices.Equal(values, []int{2, 0, 4}) {
+		t.Errorf("Ring returned %v, should be [2 0 4]", values)
+	}
+	if values := collect(ring, 12, 13); !slices.Equal(values, []int{0}) {
+		t.Errorf("Ring returned %v, should be [0]", values)
+	}
+
+	// skipping more buckets than kept resets all of them
+	*ring.At(100) = 5
+	var values []int
+	for value := range ring.All() {
+		values = append(values, *value)
+	}
+	if !slices.Equal(values, []int{0, 0, 5}) {
+		t.Errorf("Ring returned %v, should be [0 0 5]", values)
+	}
+}
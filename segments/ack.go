@@ -0,0 +1,179 @@
+// This package is home to all pipeline segment implementations. Generally,
+// every segment lives in its own package, implements the Segment interface,
+// embeds the BaseSegment to take care of the I/O side of things, and has an
+// additional init() function to register itself using RegisterSegment.
+package segments
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/BelWue/flowpipeline/pb"
+)
+
+// The acknowledgement shared by a tracked flow and its copies.
+type acknowledgement struct {
+	mutex    sync.Mutex
+	pending  int
+	finished bool
+	flows    []*pb.EnrichedFlow
+	done     func()
+	absorbed []*acknowledgement // released once this one is finished, see Absorb
+}
+
+var (
+	acknowledgements sync.Map     // the acknowledgement of every tracked flow
+	tracked          atomic.Int64 // the number of entries in acknowledgements
+)
+
+// Tracks a flow, calling done once it and all of its copies have been
+// acknowledged. This allows input segments to find out when a flow they
+// emitted has been handled completely, e.g. to commit its Kafka offset only
+// then.
+//
+// A flow is handled once it has been acknowledged using Ack as often as it
+// has been tracked, copied or held. The pipeline package acknowledges flows
+// leaving a pipeline: flows drained from its output, flows dropped by filter
+// segments and flows discarded from full buffers. Segments copying flows use
+// Copy, segments emitting new flows in place of the ones they received use
+// Replace, and segments merging flows into others use Absorb. Output segments
+// writing flows after handing them on use Hold to delay the acknowledgement
+// until the flows have been written. Untracked
+// flows are ignored by all of these functions, which are cheap as long as no
+// flows are tracked at all.
+func Track(msg *pb.EnrichedFlow, done func()) {
+	tracked.Add(1)
+	acknowledgements.Store(msg, &acknowledgement{pending: 1, flows: []*pb.EnrichedFlow{msg}, done: done})
+}
+
+// Tracks a copy of a flow along with the original, requiring it to be
+// acknowledged as well.
+func Copy(msg *pb.EnrichedFlow, clone *pb.EnrichedFlow) {
+	ack := lookupAcknowledgement(msg)
+	if ack == nil {
+		return
+	}
+	ack.mutex.Lock()
+	defer ack.mutex.Unlock()
+	if ack.finished {
+		return
+	}
+	ack.pending += 1
+	ack.flows = append(ack.flows, clone)
+	tracked.Add(1)
+	acknowledgements.Store(clone, ack)
+}
+
+// Requires a flow to be acknowledged once more, for segments which take
+// care of flows they already handed on, such as outputs writing batches.
+func Hold(msgs ...*pb.EnrichedFlow) {
+	for _, msg := range msgs {
+		if ack := lookupAcknowledgement(msg); ack != nil {
+			ack.mutex.Lock()
+			ack.pending += 1
+			ack.mutex.Unlock()
+		}
+	}
+}
+
+// Hands the acknowledgement of a flow over to the flows replacing it, such
+// as a new message holding only some of its fields, or the slices it has
+// been split into. The replacements may include the flow itself.
+func Replace(msg *pb.EnrichedFlow, replacements ...*pb.EnrichedFlow) {
+	if lookupAcknowledgement(msg) == nil {
+		return
+	}
+	replaced := true
+	for _, replacement := range replacements {
+		if replacement == msg {
+			replaced = false
+			continue
+		}
+		Copy(msg, replacement)
+	}
+	if replaced {
+		Ack(msg)
+	}
+}
+
+// Ties the acknowledgement of flows merged into another one, such as flows
+// aggregated into a new flow, to the acknowledgement of that flow. The merged
+// flows are acknowledged once the flow they have been merged into has been,
+// and need not be acknowledged by the caller. Flows merged into an untracked
+// flow make it tracked, so it must be handed on or acknowledged eventually.
+func Absorb(into *pb.EnrichedFlow, msgs ...*pb.EnrichedFlow) {
+	for _, msg := range msgs {
+		absorbed := lookupAcknowledgement(msg)
+		if absorbed == nil {
+			continue
+		}
+		absorbed.mutex.Lock()
+		if absorbed.finished {
+			absorbed.mutex.Unlock()
+			continue
+		}
+		// the merged flow itself is not referenced anymore
+		acknowledgements.Delete(msg)
+		absorbed.flows = slices.DeleteFunc(absorbed.flows, func(flow *pb.EnrichedFlow) bool { return flow == msg })
+		tracked.Add(-1)
+		absorbed.mutex.Unlock()
+
+		ack := lookupAcknowledgement(into)
+		if ack == nil {
+			Track(into, func() {})
+			ack = lookupAcknowledgement(into)
+		}
+		ack.mutex.Lock()
+		if ack.finished {
+			ack.mutex.Unlock()
+			absorbed.release()
+			continue
+		}
+		ack.absorbed = append(ack.absorbed, absorbed)
+		ack.mutex.Unlock()
+	}
+}
+
+// Acknowledges flows, see Track.
+func Ack(msgs ...*pb.EnrichedFlow) {
+	for _, msg := range msgs {
+		if ack := lookupAcknowledgement(msg); ack != nil {
+			ack.release()
+		}
+	}
+}
+
+// Releases one of the pending acknowledgements, finishing it if it was the
+// last one. Finishing it releases the acknowledgements absorbed by it.
+func (ack *acknowledgement) release() {
+	ack.mutex.Lock()
+	ack.pending -= 1
+	if ack.pending > 0 || ack.finished {
+		ack.mutex.Unlock()
+		return
+	}
+	ack.finished = true
+	for _, flow := range ack.flows {
+		acknowledgements.Delete(flow)
+	}
+	tracked.Add(-int64(len(ack.flows)))
+	absorbed := ack.absorbed
+	ack.absorbed = nil
+	ack.mutex.Unlock()
+	ack.done()
+	for _, merged := range absorbed {
+		merged.release()
+	}
+}
+
+func lookupAcknowledgement(msg *pb.EnrichedFlow) *acknowledgement {
+	if tracked.Load() == 0 {
+		return nil
+	}
+	ack, ok := acknowledgements.Load(msg)
+	if !ok {
+		return nil
+	}
+	return ack.(*acknowledgement)
+}
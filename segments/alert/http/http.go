@@ -6,6 +6,8 @@ package http
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/url"
 	"sync"
@@ -18,6 +20,7 @@ import (
 
 type Http struct {
 	segments.BaseSegment
+	segments.BaseDeadLetterSegment
 	Url string
 	// TODO: add async parameter
 	// TODO: add timeout options
@@ -28,16 +31,23 @@ type Http struct {
 }
 
 func (segment Http) New(config map[string]string) segments.Segment {
-	requestUrl, err := url.Parse(config["url"])
+	newSegment, err := segment.NewWithError(config)
 	if err != nil {
-		log.Error().Err(err).Msgf("Http: error parsing url parameter")
+		log.Error().Err(err).Msg("Http: ")
 		return nil
 	}
+	return newSegment
+}
+
+func (segment Http) NewWithError(config map[string]string) (segments.Segment, error) {
+	requestUrl, err := url.Parse(config["url"])
+	if err != nil {
+		return nil, fmt.Errorf("error parsing url parameter: %w", err)
+	}
 	if !(requestUrl.Scheme == "http" || requestUrl.Scheme == "https") {
-		log.Error().Msgf("Http: error parsing url parameter, scheme must be 'http://' or 'https://'")
-		return nil
+		return nil, errors.New("error parsing url parameter, scheme must be 'http://' or 'https://'")
 	}
-	return &Http{Url: config["url"]}
+	return &Http{Url: config["url"]}, nil
 }
 
 func (segment *Http) Run(wg *sync.WaitGroup) {
@@ -62,10 +72,16 @@ func (segment *Http) Run(wg *sync.WaitGroup) {
 			log.Error().Msgf("Http: Server endpoint error, skipping at least one flow. Code %s.", resp.Status)
 			log.Error().Msg("Http: Above message will not repeat for every flow and is effective until resolved.")
 			limitLog = true
+			err = fmt.Errorf("server endpoint responded with %s", resp.Status)
 		} else if limitLog {
 			log.Info().Msg("Http: Previous error is resolved, flows are being posted to configured url successfully again.")
 			limitLog = false
 		}
+		if err != nil {
+			kept := segment.Keep(msg) // msg itself is handed on below
+			segment.DeadLetter(err, kept)
+			segments.Ack(kept)
+		}
 		segment.Out <- msg
 	}
 }
@@ -5,20 +5,27 @@ import (
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/BelWue/flowpipeline/pb"
+	"github.com/BelWue/flowpipeline/pipeline/window"
 )
 
 type Record struct {
-	FwdBytes       []uint64
-	FwdPackets     []uint64
-	DropBytes      []uint64
-	DropPackets    []uint64
+	buckets        *window.Ring[counters]
 	capacity       int
-	pointer        int
 	aboveThreshold atomic.Bool
 	Address        string
 	sync.RWMutex
 }
 
+// The traffic of an address within a single bucket.
+type counters struct {
+	fwdBytes    uint64
+	fwdPackets  uint64
+	dropBytes   uint64
+	dropPackets uint64
+}
+
 type Database struct {
 	database           *map[string]*Record
 	TrafficType        string
@@ -30,6 +37,7 @@ type Database struct {
 	thresholdBuckets   int
 	cleanupCounter     int
 	cleanupWindowSizes int
+	clock              *window.Clock
 	promExporter       *PrometheusExporter
 	stopCleanupC       chan struct{}
 	stopClockC         chan struct{}
@@ -44,6 +52,7 @@ func NewDatabase(params PrometheusMetricsParams, promExporter *PrometheusExporte
 		thresholdBuckets:   params.ThresholdBuckets,
 		cleanupWindowSizes: params.CleanupWindowSizes,
 		cleanupCounter:     params.Buckets * params.CleanupWindowSizes, // cleanup every N windows
+		clock:              window.NewClock(params.Time, time.Duration(params.BucketDuration)*time.Second, params.Lateness),
 		promExporter:       promExporter,
 		buckets:            params.Buckets,
 		ReportBuckets:      params.ReportBuckets,
@@ -64,49 +73,72 @@ func (db *Database) GetTypedRecord(typeLabel string, address string) *Record {
 	defer db.Unlock()
 	record, found := (*db.database)[key]
 	if !found || record == nil {
-		record = NewRecord(db.ReportBuckets, address)
+		// keep the complete buckets needed for reports and thresholds
+		// along with the ones which are still receiving flows
+		record = NewRecord(max(db.ReportBuckets, db.thresholdBuckets)+db.clock.Open(), address)
 		(*db.database)[key] = record
 	}
 	return record
 }
 
+// Returns the bucket a flow is accounted in, and whether it is still open.
+// Flows of closed buckets arrived too late and should not be appended.
+func (db *Database) Bucket(msg *pb.EnrichedFlow) (int64, bool) {
+	bucket, open := db.clock.Bucket(msg)
+	if !open {
+		db.promExporter.LateFlowCount.Inc()
+	}
+	return bucket, open
+}
+
+// Advances the watermark of this database using a flow which is not accounted
+// in it.
+func (db *Database) Advance(msg *pb.EnrichedFlow) {
+	db.clock.Advance(msg)
+}
+
 func NewRecord(windowSize int, address string) *Record {
 	record := &Record{
-		FwdBytes:    make([]uint64, windowSize),
-		FwdPackets:  make([]uint64, windowSize),
-		DropBytes:   make([]uint64, windowSize),
-		DropPackets: make([]uint64, windowSize),
-		capacity:    windowSize,
-		pointer:     0,
-		Address:     address,
+		buckets:  window.NewRing[counters](windowSize),
+		capacity: windowSize,
+		Address:  address,
 	}
 	return record
 }
 
-func (record *Record) Append(bytes uint64, packets uint64, statusFwd bool) {
+func (record *Record) Append(bucket int64, bytes uint64, packets uint64, statusFwd bool) {
 	record.Lock()
 	defer record.Unlock()
+	counters := record.buckets.At(bucket)
+	if counters == nil {
+		return
+	}
 	if statusFwd {
-		record.FwdBytes[record.pointer] += bytes
-		record.FwdPackets[record.pointer] += packets
+		counters.fwdBytes += bytes
+		counters.fwdPackets += packets
 	} else {
-		record.DropBytes[record.pointer] += bytes
-		record.DropPackets[record.pointer] += packets
+		counters.dropBytes += bytes
+		counters.dropPackets += packets
 	}
 }
 
-func (record *Record) isEmpty() bool {
+// Checks whether a record saw no traffic within the buckets up to the
+// provided current one which still count. Older buckets are only reset once
+// the record receives another flow, so they are skipped.
+func (record *Record) isEmpty(current int64) bool {
 	record.RLock()
 	defer record.RUnlock()
-	for i := 0; i < record.capacity; i++ {
-		if record.FwdPackets[i] > 0 || record.DropPackets[i] > 0 {
+	for counters := range record.buckets.Range(current-int64(record.capacity)+1, current+1) {
+		if counters.fwdPackets > 0 || counters.dropPackets > 0 {
 			return false
 		}
 	}
 	return true
 }
 
-func (record *Record) GetMetrics(buckets int, bucketDuration int) (float64, float64, float64, float64, string) {
+// Returns the average rates over the buckets right before the provided one,
+// which is the first bucket that is not complete yet.
+func (record *Record) GetMetrics(completed int64, buckets int, bucketDuration int) (float64, float64, float64, float64, string) {
 	// buckets == 0 means "look at the whole window"
 	if buckets == 0 {
 		buckets = record.capacity
@@ -117,17 +149,11 @@ func (record *Record) GetMetrics(buckets int, bucketDuration int) (float64, floa
 	sumDropPackets := uint64(0)
 	record.RLock()
 	defer record.RUnlock()
-	pos := record.pointer
-	for i := 0; i < buckets; i++ {
-		if pos <= 0 {
-			pos = record.capacity - 1
-		} else {
-			pos--
-		}
-		sumFwdBytes += record.FwdBytes[pos]
-		sumFwdPackets += record.FwdPackets[pos]
-		sumDropBytes += record.DropBytes[pos]
-		sumDropPackets += record.DropPackets[pos]
+	for counters := range record.buckets.Range(completed-int64(buckets), completed) {
+		sumFwdBytes += counters.fwdBytes
+		sumFwdPackets += counters.fwdPackets
+		sumDropBytes += counters.dropBytes
+		sumDropPackets += counters.dropPackets
 	}
 	sumFwdBps := float64(sumFwdBytes*8) / float64(buckets*bucketDuration)
 	sumFwdPps := float64(sumFwdPackets) / float64(buckets*bucketDuration)
@@ -136,14 +162,9 @@ func (record *Record) GetMetrics(buckets int, bucketDuration int) (float64, floa
 	return sumFwdBps, sumFwdPps, sumDropBps, sumDropPps, record.Address
 }
 
-func (record *Record) tick(thresholdBuckets int, bucketDuration int, thresholdBps uint64, thresholdPps uint64) {
+func (record *Record) tick(completed int64, thresholdBuckets int, bucketDuration int, thresholdBps uint64, thresholdPps uint64) {
 	record.Lock()
 	defer record.Unlock()
-	// advance pointer to the next position
-	record.pointer++
-	if record.pointer >= record.capacity {
-		record.pointer = 0
-	}
 	// calculate averages and check thresholds
 	if thresholdBuckets == 0 {
 		// thresholdBuckets == 0 means "look at the whole window"
@@ -151,15 +172,9 @@ func (record *Record) tick(thresholdBuckets int, bucketDuration int, thresholdBp
 	}
 	var sumBytes uint64
 	var sumPackets uint64
-	pos := record.pointer
-	for i := 0; i < thresholdBuckets; i++ {
-		if pos <= 0 {
-			pos = record.capacity - 1
-		} else {
-			pos--
-		}
-		sumBytes = sumBytes + record.FwdBytes[pos] + record.DropBytes[pos]
-		sumPackets = sumPackets + record.FwdPackets[pos] + record.DropPackets[pos]
+	for counters := range record.buckets.Range(completed-int64(thresholdBuckets), completed) {
+		sumBytes = sumBytes + counters.fwdBytes + counters.dropBytes
+		sumPackets = sumPackets + counters.fwdPackets + counters.dropPackets
 	}
 	bps := uint64(float64(sumBytes*8) / float64(bucketDuration*thresholdBuckets))
 	pps := uint64(float64(sumPackets) / float64(bucketDuration*thresholdBuckets))
@@ -168,11 +183,6 @@ func (record *Record) tick(thresholdBuckets int, bucketDuration int, thresholdBp
 	} else {
 		record.aboveThreshold.Store(false)
 	}
-	// clear the current bucket
-	record.FwdBytes[record.pointer] = 0
-	record.FwdPackets[record.pointer] = 0
-	record.DropBytes[record.pointer] = 0
-	record.DropPackets[record.pointer] = 0
 }
 
 func (db *Database) Clock() {
@@ -182,8 +192,9 @@ func (db *Database) Clock() {
 		select {
 		case <-ticker.C:
 			db.Lock()
+			completed := db.clock.Completed()
 			for _, record := range *db.database {
-				record.tick(db.thresholdBuckets, db.BucketDuration, db.thresholdBps, db.thresholdPps)
+				record.tick(completed, db.thresholdBuckets, db.BucketDuration, db.thresholdBps, db.thresholdPps)
 			}
 			db.Unlock()
 		case <-db.stopClockC:
@@ -202,8 +213,9 @@ func (db *Database) Cleanup() {
 			db.cleanupCounter--
 			if db.cleanupCounter <= 0 {
 				db.cleanupCounter = db.buckets * db.cleanupWindowSizes
+				current := db.clock.Current()
 				for key, record := range *db.database {
-					if record.isEmpty() {
+					if record.isEmpty(current) {
 						delete(*db.database, key)
 					}
 				}
@@ -0,0 +1,17 @@
+package toptalkers_metrics
+
+import "testing"
+
+func TestRecordIsEmpty(t *testing.T) {
+	record := NewRecord(3, "192.0.2.1")
+	if !record.isEmpty(10) {
+		t.Error("([error] New record is not empty.")
+	}
+	record.Append(10, 100, 1, true)
+	if record.isEmpty(10) || record.isEmpty(12) {
+		t.Error("([error] Record with traffic in its window is empty.")
+	}
+	if !record.isEmpty(13) {
+		t.Error("([error] Record without traffic in its window is not empty.")
+	}
+}
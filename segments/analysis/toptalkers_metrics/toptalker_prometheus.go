@@ -2,11 +2,14 @@ package toptalkers_metrics
 
 import (
 	"errors"
+	"fmt"
 	"math"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/BelWue/flowpipeline/pipeline/config"
+	"github.com/BelWue/flowpipeline/pipeline/window"
 	"github.com/rs/zerolog/log"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -28,6 +31,8 @@ type PrometheusParams struct {
 type PrometheusMetricsParams struct {
 	config.PrometheusMetricsParamsDefinition
 	CleanupWindowSizes int
+	Time               window.Mode   // optional, default is processing time, whether flows are accounted at their arrival or at their own timestamps
+	Lateness           time.Duration // optional, default is 2m, the time flows are waited for in event time
 }
 
 func NewPrometheusCollector(databases []*Database) *PrometheusCollector {
@@ -72,6 +77,9 @@ func (params *PrometheusMetricsParams) InitDefaultPrometheusMetricParams() {
 	if params.CleanupWindowSizes == 0 {
 		params.CleanupWindowSizes = 5
 	}
+	if params.Lateness == 0 {
+		params.Lateness = 2 * time.Minute
+	}
 }
 
 func (prometheusParams *PrometheusMetricsParams) ParsePrometheusConfig(config map[string]string) error {
@@ -162,6 +170,28 @@ func (prometheusParams *PrometheusMetricsParams) ParsePrometheusConfig(config ma
 	default:
 		log.Error().Msg("ToptalkersMetrics: Could not parse 'relevantaddress', using default value 'destination'.")
 	}
+
+	mode, err := window.ParseMode(config["time"])
+	if err != nil {
+		return fmt.Errorf("ToptalkersMetrics: %w", err)
+	}
+	prometheusParams.Time = mode
+	if config["time"] == "" {
+		log.Info().Msg("ToptalkersMetrics: 'time' set to default 'processing'.")
+	}
+
+	if config["lateness"] != "" {
+		parsedLateness, err := time.ParseDuration(config["lateness"])
+		if err != nil {
+			return fmt.Errorf("ToptalkersMetrics: Could not parse 'lateness' parameter: %w", err)
+		}
+		if parsedLateness < 0 {
+			return errors.New("ToptalkersMetrics: Lateness has to be >=0")
+		}
+		prometheusParams.Lateness = parsedLateness
+	} else if mode == window.EventTime {
+		log.Info().Msg("ToptalkersMetrics: 'lateness' set to default 2m.")
+	}
 	return nil
 }
 
@@ -177,7 +207,7 @@ func (collector *PrometheusCollector) Collect(ch chan<- prometheus.Metric) {
 			buckets := db.ReportBuckets
 			bucketDuration := db.BucketDuration
 			if record.aboveThreshold.Load() {
-				sumFwdBps, sumFwdPps, sumDropBps, sumDropPps, address := record.GetMetrics(buckets, bucketDuration)
+				sumFwdBps, sumFwdPps, sumDropBps, sumDropPps, address := record.GetMetrics(db.clock.Completed(), buckets, bucketDuration)
 				ch <- prometheus.MustNewConstMetric(
 					collector.trafficBpsDesc,
 					prometheus.GaugeValue,
@@ -213,6 +243,7 @@ type PrometheusExporter struct {
 	FlowReg *prometheus.Registry
 
 	KafkaMessageCount prometheus.Counter
+	LateFlowCount     prometheus.Counter
 	dbSize            prometheus.Gauge
 }
 
@@ -223,6 +254,11 @@ func (e *PrometheusExporter) Initialize() {
 			Name: "kafka_messages_total",
 			Help: "Number of Kafka messages",
 		})
+	e.LateFlowCount = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "toptalkers_late_flows_total",
+			Help: "Number of flows which arrived after their bucket was complete",
+		})
 	e.dbSize = prometheus.NewGauge(
 		prometheus.GaugeOpts{
 			Name: "toptalkers_db_size",
@@ -231,6 +267,7 @@ func (e *PrometheusExporter) Initialize() {
 	e.MetaReg = prometheus.NewRegistry()
 	e.FlowReg = prometheus.NewRegistry()
 	e.MetaReg.MustRegister(e.KafkaMessageCount)
+	e.MetaReg.MustRegister(e.LateFlowCount)
 	e.MetaReg.MustRegister(e.dbSize)
 }
 
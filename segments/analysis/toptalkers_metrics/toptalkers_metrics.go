@@ -20,6 +20,14 @@
 // window size for the exported metrics calculation and for the threshold check
 // can be configured differently.
 //
+// By default, flows are accounted in the bucket of the time they arrive at this
+// segment. Setting `time` to `event` accounts them in the bucket of their end
+// time instead, which yields correct rates for exporters with a delay or for
+// flows replayed from a file. In this case, a bucket is complete once flows
+// `lateness` (default 2m) past its end have been seen, and only complete
+// buckets are used for metrics and thresholds. Flows arriving even later are
+// not accounted, but counted in `toptalkers_late_flows_total`.
+//
 // The parameter "traffictype" is passed as OpenMetrics label, so this segment
 // can be used multiple times in one pipeline without metrics getting mixed up.
 package toptalkers_metrics
@@ -94,10 +102,13 @@ func (segment *ToptalkersMetrics) Run(wg *sync.WaitGroup) {
 		case "both":
 			keys = []string{msg.SrcAddrObj().String(), msg.DstAddrObj().String()}
 		}
+		bucket, open := database.Bucket(msg)
 		forward := false
 		for _, key := range keys {
 			record := database.GetRecord(key)
-			record.Append(msg.Bytes, msg.Packets, msg.IsForwarded())
+			if open {
+				record.Append(bucket, msg.Bytes, msg.Packets, msg.IsForwarded())
+			}
 			if record.aboveThreshold.Load() {
 				forward = true
 			}
@@ -3,17 +3,24 @@
 // allow for a more efficient filtering.
 //
 // Filters with a specified `traffictyp` will be exported if they reach the configured thresholds.
+//
+// Just like for `toptalkers_metrics`, setting `time` to `event` accounts flows
+// at their end time instead of their arrival, waiting `lateness` (default 2m)
+// for delayed flows. Both parameters apply to all filters.
 package traffic_specific_toptalkers
 
 import (
+	"errors"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/rs/zerolog/log"
 
 	"github.com/BelWue/flowfilter/parser"
 	"github.com/BelWue/flowpipeline/pb"
 	"github.com/BelWue/flowpipeline/pipeline/config"
+	"github.com/BelWue/flowpipeline/pipeline/window"
 	"github.com/BelWue/flowpipeline/segments"
 	"github.com/BelWue/flowpipeline/segments/analysis/toptalkers_metrics"
 	"github.com/BelWue/flowpipeline/segments/filter/flowfilter"
@@ -23,7 +30,9 @@ type TrafficSpecificToptalkers struct {
 	segments.BaseSegment
 	toptalkers_metrics.PrometheusParams
 	ThresholdMetricDefinition []*ThresholdMetric
-	RelevantAddress           string // optional, default is "destination", options are "destination", "source", "both", "connection"
+	RelevantAddress           string        // optional, default is "destination", options are "destination", "source", "both", "connection"
+	Time                      window.Mode   // optional, default is processing time, whether flows are accounted at their arrival or at their own timestamps
+	Lateness                  time.Duration // optional, default is 2m, the time flows are waited for in event time
 }
 
 type ThresholdMetric struct {
@@ -60,17 +69,33 @@ func (segment TrafficSpecificToptalkers) New(config map[string]string) segments.
 		newSegment.RelevantAddress = ""
 	}
 
+	mode, err := window.ParseMode(config["time"])
+	if err != nil {
+		log.Error().Err(err).Msg("ThresholdToptalkersMetrics: Could not parse 'time' parameter")
+		return nil
+	}
+	newSegment.Time = mode
+	if config["lateness"] != "" {
+		if newSegment.Lateness, err = time.ParseDuration(config["lateness"]); err != nil || newSegment.Lateness < 0 {
+			log.Error().Msg("ThresholdToptalkersMetrics: Could not parse 'lateness' parameter, has to be a duration >=0")
+			return nil
+		}
+	}
+
 	return newSegment
 }
 
-func (segment *TrafficSpecificToptalkers) AddCustomConfig(segmentReprs config.SegmentRepr) {
-	for _, definition := range segmentReprs.Config.ThresholdMetricDefinition {
+func (segment *TrafficSpecificToptalkers) AddCustomConfig(segmentReprs config.SegmentRepr) error {
+	var errs []error
+	for i, definition := range segmentReprs.Config.ThresholdMetricDefinition {
 		metric, err := segment.metricFromDefinition(definition)
 		if err != nil {
-			log.Error().Err(err).Msg("ThresholdToptalkersMetrics: Failed to add custom config")
+			errs = append(errs, fmt.Errorf("traffic_specific_toptalkers[%d]: %w", i, err))
+			continue
 		}
 		segment.ThresholdMetricDefinition = append(segment.ThresholdMetricDefinition, metric)
 	}
+	return errors.Join(errs...)
 }
 
 func (segment *TrafficSpecificToptalkers) metricFromDefinition(definition *config.ThresholdMetricDefinition) (*ThresholdMetric, error) {
@@ -78,6 +103,8 @@ func (segment *TrafficSpecificToptalkers) metricFromDefinition(definition *confi
 	metric := ThresholdMetric{}
 	metric.PrometheusMetricsParamsDefinition = definition.PrometheusMetricsParamsDefinition
 	metric.FilterDefinition = definition.FilterDefinition
+	metric.Time = segment.Time
+	metric.Lateness = segment.Lateness
 	metric.InitDefaultPrometheusMetricParams()
 
 	if segment.RelevantAddress != "" {
@@ -127,6 +154,10 @@ func (segment *TrafficSpecificToptalkers) Run(wg *sync.WaitGroup) {
 	log.Info().Msgf("Threshold Metric Report runing on %s", segment.Endpoint)
 	for msg := range segment.In {
 		promExporter.KafkaMessageCount.Inc()
+		// all flows move time forward, not just the ones matching a filter
+		for _, db := range *allDatabases {
+			db.Advance(msg)
+		}
 		for _, filterDef := range segment.ThresholdMetricDefinition {
 			addMessageToMatchingToptalkers(msg, filterDef, filter)
 		}
@@ -175,9 +206,11 @@ func addMessageToMatchingToptalkers(msg *pb.EnrichedFlow, definition *ThresholdM
 			case "connection":
 				keys = []string{fmt.Sprintf("%s -> %s", msg.SrcAddrObj().String(), msg.DstAddrObj().String())}
 			}
-			for _, key := range keys {
-				record := definition.Database.GetTypedRecord(definition.PrometheusMetricsParams.TrafficType, key)
-				record.Append(msg.Bytes, msg.Packets, msg.IsForwarded())
+			if bucket, open := definition.Database.Bucket(msg); open {
+				for _, key := range keys {
+					record := definition.Database.GetTypedRecord(definition.PrometheusMetricsParams.TrafficType, key)
+					record.Append(bucket, msg.Bytes, msg.Packets, msg.IsForwarded())
+				}
 			}
 		}
 
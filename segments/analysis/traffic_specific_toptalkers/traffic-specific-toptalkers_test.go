@@ -15,7 +15,7 @@ func TestSegment_Branch_passthrough(t *testing.T) {
 	msg := &pb.EnrichedFlow{SrcAddr: []byte{192, 168, 88, 142}, DstAddr: []byte{192, 168, 88, 123}, DstPort: 123, Packets: 1000, Bytes: 230000, Proto: 17} //Ntp (udp)
 	msg2 := &pb.EnrichedFlow{SrcAddr: []byte{192, 168, 88, 142}, DstAddr: []byte{192, 168, 88, 123}, DstPort: 443, Packets: 1, Bytes: 100, Proto: 6}
 
-	segment := segments.LookupSegment("traffic_specific_toptalkers")
+	segment, _ := segments.LookupSegment("traffic_specific_toptalkers")
 	//normally done via config
 	segment.AddCustomConfig(config.SegmentRepr{
 		Config: config.Config{
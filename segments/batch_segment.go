@@ -0,0 +1,21 @@
+// This package is home to all pipeline segment implementations. Generally,
+// every segment lives in its own package, implements the Segment interface,
+// embeds the BaseSegment to take care of the I/O side of things, and has an
+// additional init() function to register itself using RegisterSegment.
+package segments
+
+import (
+	"sync"
+
+	"github.com/BelWue/flowpipeline/pb"
+)
+
+// Segments which can process flows in batches. In pipelines using the batched
+// transport, RunBatches is used instead of Run. It reads batches from in until
+// it is closed and writes the resulting batches to out, which it closes when
+// done. Batches are handed over entirely, so they can be modified in place.
+// Segments not implementing this interface are adapted automatically.
+type BatchSegment interface {
+	Segment
+	RunBatches(in <-chan []*pb.EnrichedFlow, out chan<- []*pb.EnrichedFlow, wg *sync.WaitGroup)
+}
@@ -48,6 +48,9 @@
 package branch
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"strconv"
 	"sync"
 
@@ -67,6 +70,11 @@ type Pipeline interface {
 	GetInput() chan *pb.EnrichedFlow
 	GetOutput() <-chan *pb.EnrichedFlow
 	GetDrop() <-chan *pb.EnrichedFlow
+	SetShutdownCoordinator(coordinator *segments.ShutdownCoordinator)
+	Discard()
+	Status() []pipeline.SegmentStatus
+	Health(ctx context.Context) error
+	Attach(tap *pipeline.Tap) int
 }
 
 type Branch struct {
@@ -78,22 +86,96 @@ type Branch struct {
 }
 
 func (segment Branch) New(config map[string]string) segments.Segment {
+	newSegment, err := segment.NewWithError(config)
+	if err != nil {
+		log.Error().Err(err).Msg("Branch: ")
+		return nil
+	}
+	return newSegment
+}
+
+func (segment Branch) NewWithError(config map[string]string) (segments.Segment, error) {
 	bypassMessages := false
 	if config["bypass-messages"] != "" {
 		b, err := strconv.ParseBool(config["bypass-messages"])
 		if err != nil {
-			log.Fatal().Err(err).Msg("Branch: Failed to parse bypass-messages config option")
+			return nil, fmt.Errorf("failed to parse bypass-messages config option: %w", err)
 		}
 		bypassMessages = b
 	}
-	return &Branch{bypassMessages: bypassMessages}
+	return &Branch{bypassMessages: bypassMessages}, nil
+}
+
+func (segment *Branch) AddCustomConfig(segmentReprs config.SegmentRepr) error {
+	var err, errs error
+	segment.condition, err = newSubpipeline(segmentReprs.If, segmentReprs.Path+".if")
+	errs = errors.Join(errs, err)
+	segment.then_branch, err = newSubpipeline(segmentReprs.Then, segmentReprs.Path+".then")
+	errs = errors.Join(errs, err)
+	segment.else_branch, err = newSubpipeline(segmentReprs.Else, segmentReprs.Path+".else")
+	return errors.Join(errs, err)
+}
+
+// Builds one of the embedded pipelines, reporting errors of the segments
+// therein using their full path.
+func newSubpipeline(segmentReprs []config.SegmentRepr, path string) (Pipeline, error) {
+	subpipeline, err := pipeline.NewFromRepr(segmentReprs, path)
+	if err != nil {
+		return nil, err
+	}
+	return subpipeline, nil
 }
 
-func (segment *Branch) AddCustomConfig(segmentReprs config.SegmentRepr) {
-	segment.condition = pipeline.New(pipeline.SegmentsFromRepr(segmentReprs.If)...)
-	segment.then_branch = pipeline.New(pipeline.SegmentsFromRepr(segmentReprs.Then)...)
-	segment.else_branch = pipeline.New(pipeline.SegmentsFromRepr(segmentReprs.Else)...)
+// Sets the ShutdownCoordinator of this segment and all embedded pipelines.
+func (segment *Branch) SetShutdownCoordinator(coordinator *segments.ShutdownCoordinator) {
+	segment.BaseFilterSegment.SetShutdownCoordinator(coordinator)
+	for _, subpipeline := range []Pipeline{segment.condition, segment.then_branch, segment.else_branch} {
+		if subpipeline != nil {
+			subpipeline.SetShutdownCoordinator(coordinator)
+		}
+	}
+}
 
+// Discards all embedded pipelines, see segments.DiscardableSegment.
+func (segment *Branch) Discard() {
+	for _, subpipeline := range []Pipeline{segment.condition, segment.then_branch, segment.else_branch} {
+		if subpipeline != nil {
+			subpipeline.Discard()
+		}
+	}
+}
+
+// Returns the status of the segments of all embedded pipelines.
+func (segment *Branch) NestedStatus() []pipeline.SegmentStatus {
+	var status []pipeline.SegmentStatus
+	for _, subpipeline := range []Pipeline{segment.condition, segment.then_branch, segment.else_branch} {
+		if subpipeline != nil {
+			status = append(status, subpipeline.Status()...)
+		}
+	}
+	return status
+}
+
+// Returns the health of the segments of all embedded pipelines.
+func (segment *Branch) NestedHealth(ctx context.Context) error {
+	var errs []error
+	for _, subpipeline := range []Pipeline{segment.condition, segment.then_branch, segment.else_branch} {
+		if subpipeline != nil {
+			errs = append(errs, subpipeline.Health(ctx))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Attaches the tap to all embedded pipelines.
+func (segment *Branch) NestedAttach(tap *pipeline.Tap) int {
+	attached := 0
+	for _, subpipeline := range []Pipeline{segment.condition, segment.then_branch, segment.else_branch} {
+		if subpipeline != nil {
+			attached += subpipeline.Attach(tap)
+		}
+	}
+	return attached
 }
 
 func (segment *Branch) Run(wg *sync.WaitGroup) {
@@ -101,10 +183,16 @@ func (segment *Branch) Run(wg *sync.WaitGroup) {
 		log.Error().Msg("Branch: Uninitialized branches. This is expected during standalone testing of this package. The actual test is done as part of the pipeline package, as this segment embeds further pipelines.")
 		return
 	}
+	routed := make(chan struct{})
+	drained := make(chan struct{})
 	defer func() {
+		// close the subpipelines in the order flows pass them, so none of
+		// them is lost on shutdown
 		segment.condition.Close()
+		<-routed
 		segment.then_branch.Close()
 		segment.else_branch.Close()
+		<-drained
 		close(segment.Out)
 		if segment.Drops != nil {
 			close(segment.Drops)
@@ -116,8 +204,14 @@ func (segment *Branch) Run(wg *sync.WaitGroup) {
 	go segment.then_branch.Start()
 	go segment.else_branch.Start()
 
-	go drainOutput(segment)
-	go forwardBasedOnCondition(segment)
+	go func() {
+		defer close(drained)
+		drainOutput(segment)
+	}()
+	go func() {
+		defer close(routed)
+		forwardBasedOnCondition(segment)
+	}()
 
 	for msg := range segment.In { // connect our own input to conditional
 		segment.condition.GetInput() <- msg
@@ -177,6 +271,8 @@ func drainOutput(segment *Branch) {
 					segment.Out <- msg
 				} else if segment.Drops != nil {
 					segment.Drops <- msg
+				} else {
+					segments.Ack(msg)
 				}
 			}
 
@@ -188,10 +284,12 @@ func drainOutput(segment *Branch) {
 					segment.Out <- msg
 				} else if segment.Drops != nil {
 					segment.Drops <- msg
+				} else {
+					segments.Ack(msg)
 				}
 			}
 		}
-		if from_then == nil || from_else == nil || from_then_drop == nil || from_else_drop == nil {
+		if from_then == nil && from_else == nil && from_then_drop == nil && from_else_drop == nil {
 			return
 		}
 	}
@@ -1,19 +1,23 @@
 package branch
 
 import (
+	"strings"
+	"sync/atomic"
 	"testing"
 
 	"github.com/BelWue/flowpipeline/pb"
 	"github.com/BelWue/flowpipeline/pipeline"
+	"github.com/BelWue/flowpipeline/segments"
 
 	_ "github.com/BelWue/flowpipeline/segments/filter/drop"
 	_ "github.com/BelWue/flowpipeline/segments/filter/flowfilter"
 	_ "github.com/BelWue/flowpipeline/segments/modify/dropfields"
+	_ "github.com/BelWue/flowpipeline/segments/pass"
 	_ "github.com/BelWue/flowpipeline/segments/testing/generator"
 )
 
 func Test_Branch_passthrough(t *testing.T) {
-	pipeline := pipeline.NewFromConfig([]byte(`---
+	pipeline, err := pipeline.NewFromConfig([]byte(`---
 - segment: branch
   if:
   - segment: flowfilter
@@ -30,6 +34,9 @@ func Test_Branch_passthrough(t *testing.T) {
       policy: drop
       fields: OutIf
 `))
+	if err != nil {
+		t.Fatal(err)
+	}
 	pipeline.Start()
 	pipeline.In <- &pb.EnrichedFlow{Proto: 6, InIf: 1, OutIf: 1}
 	fmsg := <-pipeline.Out
@@ -44,7 +51,7 @@ func Test_Branch_passthrough(t *testing.T) {
 }
 
 func Test_Branch_DeadlockFreeGeneration_If(t *testing.T) {
-	pipeline := pipeline.NewFromConfig([]byte(`---
+	pipeline, err := pipeline.NewFromConfig([]byte(`---
 - segment: branch
   if:
   - segment: generator
@@ -57,6 +64,9 @@ func Test_Branch_DeadlockFreeGeneration_If(t *testing.T) {
       policy: drop
       fields: Bytes
 `))
+	if err != nil {
+		t.Fatal(err)
+	}
 	pipeline.Start()
 	pipeline.In <- &pb.EnrichedFlow{Proto: 42, Bytes: 42}
 	for i := 0; i < 5; i++ {
@@ -70,11 +80,14 @@ func Test_Branch_DeadlockFreeGeneration_If(t *testing.T) {
 }
 
 func Test_Branch_DeadlockFreeGeneration_Then(t *testing.T) {
-	pipeline := pipeline.NewFromConfig([]byte(`---
+	pipeline, err := pipeline.NewFromConfig([]byte(`---
 - segment: branch
   then:
   - segment: generator
 `))
+	if err != nil {
+		t.Fatal(err)
+	}
 	pipeline.Start()
 	pipeline.In <- &pb.EnrichedFlow{Proto: 42, Bytes: 42}
 	for i := 0; i < 5; i++ {
@@ -84,11 +97,14 @@ func Test_Branch_DeadlockFreeGeneration_Then(t *testing.T) {
 }
 
 func Test_Branch_DeadlockFreeGeneration_Else(t *testing.T) {
-	pipeline := pipeline.NewFromConfig([]byte(`---
+	pipeline, err := pipeline.NewFromConfig([]byte(`---
 - segment: branch
   else:
   - segment: generator
 `))
+	if err != nil {
+		t.Fatal(err)
+	}
 	pipeline.Start()
 	pipeline.In <- &pb.EnrichedFlow{Proto: 42, Bytes: 42}
 	for i := 0; i < 5; i++ {
@@ -96,3 +112,72 @@ func Test_Branch_DeadlockFreeGeneration_Else(t *testing.T) {
 		<-pipeline.Out
 	}
 }
+
+func Test_Branch_NestedErrors(t *testing.T) {
+	_, err := pipeline.NewFromConfig([]byte(`---
+- segment: pass
+- segment: branch
+  if:
+  - segment: flowfilter
+    config:
+      filter: proto tcp
+  then:
+  - segment: dropfields
+    config:
+      policy: drop
+      fields: InIf
+  - segment: flowfilter
+    config:
+      filter: "proto ("
+  else:
+  - segment: doesnotexist
+`))
+	if err == nil {
+		t.Fatal("[error] Branch segment did not report errors of nested segments.")
+	}
+	for _, path := range []string{"segments[1].then[1] (flowfilter)", "segments[1].else[0] (doesnotexist)"} {
+		if !strings.Contains(err.Error(), path) {
+			t.Errorf("[error] Branch segment did not report error at %s, got: %s", path, err)
+		}
+	}
+}
+
+func Test_Branch_ack(t *testing.T) {
+	pipeline, err := pipeline.NewFromConfig([]byte(`---
+- segment: branch
+  if:
+  - segment: flowfilter
+    config:
+      filter: proto tcp
+  then:
+  - segment: flowfilter
+    jobs: 2
+    config:
+      filter: port 80
+  else:
+  - segment: pass
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	flows := []*pb.EnrichedFlow{{Proto: 6, DstPort: 80}, {Proto: 6, DstPort: 443}, {Proto: 17, DstPort: 53}}
+	done := make([]atomic.Int32, len(flows))
+	for i, msg := range flows {
+		segments.Track(msg, func() { done[i].Add(1) })
+	}
+	pipeline.Start()
+	for _, msg := range flows {
+		pipeline.In <- msg
+	}
+	passed := []*pb.EnrichedFlow{<-pipeline.Out, <-pipeline.Out}
+	if done[0].Load() != 0 || done[2].Load() != 0 {
+		t.Error("[error] Branch segment acknowledged flows before they left the pipeline.")
+	}
+	segments.Ack(passed...)
+	pipeline.Close()
+	for i := range done {
+		if done := done[i].Load(); done != 1 {
+			t.Errorf("[error] Flow %d was done %d times, should be once.", i, done)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+// The `bus_publish` and `bus_subscribe` segments connect pipelines running in
+// the same flowpipeline process, such as the named pipelines of a single
+// configuration. Flows are exchanged using topics, which are identified by an
+// arbitrary name given in the `topic` parameter of both segments.
+//
+// The `bus_publish` segment hands a copy of each flow it receives to every
+// subscription of its topic and forwards the original flow to the next
+// segment. Flows published to a topic without any subscriptions are only
+// forwarded.
+//
+// The `bus_subscribe` segment emits all flows published to its topic in
+// addition to the flows it receives from the previous segment. The instances
+// of a `bus_subscribe` segment at the same position, i.e. in concurrent
+// pipelines started using `-n` or `concurrency`, share a single subscription,
+// among which the flows are distributed. A subscription exists from the
+// construction of its segment until it stops running, flows published before
+// are not delivered to it. The flows left in its buffer by then are emitted
+// before the last of its segments closes its output. Using
+// the `buffer` and `overflow` parameters, which behave just like the options
+// of the same name available to every segment, a subscription can buffer
+// flows for a slow pipeline and discard them if its buffer is full, without
+// slowing down the publishing pipeline and the other subscriptions. The
+// number of discarded flows is exported as the
+// `flowpipeline_bus_flows_overflowed_total` metric.
+//
+// The following example runs a collector pipeline publishing all flows, and
+// two consumer pipelines, of which the prometheus exporter may miss flows if
+// it can not keep up:
+//
+// ```yaml
+// pipelines:
+// - name: collector
+//   segments:
+//   - segment: goflow
+//   - segment: bus_publish
+//     config:
+//       topic: flows
+// - name: archive
+//   concurrency: 4
+//   segments:
+//   - segment: bus_subscribe
+//     config:
+//       topic: flows
+//   - segment: clickhouse
+//     config:
+//       dsn: ${file:/run/secrets/clickhouse_dsn}
+// - name: metrics
+//   segments:
+//   - segment: bus_subscribe
+//     config:
+//       topic: flows
+//       buffer: 10000
+//       overflow: drop-newest
+//   - segment: prometheus
+// ```
+package bus
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/BelWue/flowpipeline/pb"
+	"github.com/BelWue/flowpipeline/pipeline/config"
+	"github.com/BelWue/flowpipeline/segments"
+)
+
+var flowsOverflowed = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "flowpipeline_bus_flows_overflowed_total",
+	Help: "Number of flows discarded because a bus subscription's buffer was full.",
+}, []string{"topic", "subscription"})
+
+func init() {
+	segments.MetricsRegistry.MustRegister(flowsOverflowed)
+}
+
+var (
+	topics      = make(map[string]*topic)
+	topicsMutex sync.Mutex
+)
+
+// The subscriptions of a single topic by the position of the subscribing
+// segment.
+type topic struct {
+	mutex         sync.RWMutex
+	subscriptions map[string]*subscription
+}
+
+// A subscription shared by all bus_subscribe segments at the same position.
+type subscription struct {
+	ch         chan *pb.EnrichedFlow
+	done       chan struct{} // closed once the last subscriber has left
+	overflow   string
+	overflowed prometheus.Counter
+	members    int
+	sending    sync.RWMutex // held by publishers handing over a flow, see unsubscribe
+	removed    bool         // set once no publisher is handing over a flow anymore
+}
+
+func getTopic(name string) *topic {
+	topicsMutex.Lock()
+	defer topicsMutex.Unlock()
+	t, ok := topics[name]
+	if !ok {
+		t = &topic{subscriptions: make(map[string]*subscription)}
+		topics[name] = t
+	}
+	return t
+}
+
+// Joins the subscription of the named topic for the provided position,
+// creating it using the provided buffering options if there is none yet.
+func subscribe(name string, position string, buffer int, overflow string) *subscription {
+	t := getTopic(name)
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	s, ok := t.subscriptions[position]
+	if !ok {
+		s = &subscription{
+			ch:         make(chan *pb.EnrichedFlow, buffer),
+			done:       make(chan struct{}),
+			overflow:   overflow,
+			overflowed: flowsOverflowed.WithLabelValues(name, position),
+		}
+		t.subscriptions[position] = s
+	}
+	s.members += 1
+	return s
+}
+
+// Leaves the subscription of the named topic for the provided position. The
+// last subscriber to leave removes the subscription and is returned true once
+// no more flows are added to its buffer, the remaining ones of which it has
+// to take care of.
+func unsubscribe(name string, position string) bool {
+	t := getTopic(name)
+	t.mutex.Lock()
+	s := t.subscriptions[position]
+	s.members -= 1
+	removed := s.members == 0
+	if removed {
+		close(s.done) // release publishers blocked on this subscription
+		delete(t.subscriptions, position)
+	}
+	t.mutex.Unlock()
+	if removed {
+		// wait for publishers which found the subscription before it was
+		// removed, later ones will not add flows anymore
+		s.sending.Lock()
+		s.removed = true
+		s.sending.Unlock()
+	}
+	return removed
+}
+
+// Returns the current subscriptions of a topic.
+func (t *topic) current() []*subscription {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	subscriptions := make([]*subscription, 0, len(t.subscriptions))
+	for _, s := range t.subscriptions {
+		subscriptions = append(subscriptions, s)
+	}
+	return subscriptions
+}
+
+// Hands a flow to the subscription according to its overflow policy.
+// Discarded flows are acknowledged, as are flows sent to a subscription which
+// has been removed in the meantime.
+func (s *subscription) send(msg *pb.EnrichedFlow) {
+	s.sending.RLock()
+	defer s.sending.RUnlock()
+	if s.removed {
+		segments.Ack(msg)
+		return
+	}
+	select {
+	case s.ch <- msg:
+		return
+	case <-s.done:
+		segments.Ack(msg)
+		return
+	default:
+	}
+	switch s.overflow {
+	case config.OverflowDropNewest:
+		s.overflowed.Inc()
+		segments.Ack(msg)
+		return
+	case config.OverflowDropOldest:
+		for {
+			select {
+			case oldest := <-s.ch:
+				s.overflowed.Inc()
+				segments.Ack(oldest)
+			default: // drained by a subscriber in the meantime
+			}
+			select {
+			case s.ch <- msg:
+				return
+			default: // refilled by another publisher in the meantime
+			}
+		}
+	}
+	select {
+	case s.ch <- msg:
+	case <-s.done:
+		segments.Ack(msg)
+	}
+}
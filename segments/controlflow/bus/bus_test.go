@@ -0,0 +1,178 @@
+package bus
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/BelWue/flowpipeline/pb"
+	"github.com/BelWue/flowpipeline/pipeline"
+	"github.com/BelWue/flowpipeline/pipeline/config"
+
+	_ "github.com/BelWue/flowpipeline/segments/pass"
+)
+
+func newBusPipeline(t *testing.T, path string, segmentReprs ...config.SegmentRepr) *pipeline.Pipeline {
+	p, err := pipeline.NewFromRepr(segmentReprs, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Start()
+	return p
+}
+
+// Waits until the topic has the expected number of subscriptions, as these
+// are only removed once the subscribing segments have stopped running.
+func awaitSubscriptions(t *testing.T, name string, expected int) {
+	for range 100 {
+		if len(getTopic(name).current()) == expected {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("[error] Topic '%s' did not reach %d subscriptions.", name, expected)
+}
+
+func Test_Bus_fanout(t *testing.T) {
+	publish := config.SegmentRepr{Name: "bus_publish", Config: config.Config{Config: map[string]string{"topic": "fanout"}}}
+	subscribe := config.SegmentRepr{Name: "bus_subscribe", Config: config.Config{Config: map[string]string{"topic": "fanout"}}}
+	publisher := newBusPipeline(t, "publisher", publish)
+	shared := []*pipeline.Pipeline{ // concurrent instances of the same pipeline
+		newBusPipeline(t, "shared", subscribe),
+		newBusPipeline(t, "shared", subscribe),
+	}
+	single := newBusPipeline(t, "single", subscribe)
+	awaitSubscriptions(t, "fanout", 2)
+
+	for i := range 10 {
+		publisher.In <- &pb.EnrichedFlow{Bytes: uint64(i)}
+		if fmsg := <-publisher.Out; fmsg.Bytes != uint64(i) {
+			t.Errorf("[error] Publishing segment did not forward the flow, got Bytes %d.", fmsg.Bytes)
+		}
+		fmsg := <-single.Out
+		if fmsg.Bytes != uint64(i) {
+			t.Errorf("[error] Subscribing segment did not receive the flow, got Bytes %d.", fmsg.Bytes)
+		}
+		fmsg.Bytes = 42 // must not be visible to other subscriptions
+		select {
+		case fmsg = <-shared[0].Out:
+		case fmsg = <-shared[1].Out:
+		}
+		if fmsg.Bytes != uint64(i) {
+			t.Errorf("[error] Shared subscription did not receive an unmodified copy, got Bytes %d.", fmsg.Bytes)
+		}
+	}
+	select {
+	case <-shared[0].Out:
+		t.Error("[error] Shared subscription received a flow more than once.")
+	case <-shared[1].Out:
+		t.Error("[error] Shared subscription received a flow more than once.")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	single.Close()
+	shared[0].Close()
+	awaitSubscriptions(t, "fanout", 1)
+	shared[1].Close()
+	awaitSubscriptions(t, "fanout", 0)
+	publisher.In <- &pb.EnrichedFlow{}
+	<-publisher.Out
+	publisher.Close()
+}
+
+func Test_Bus_overflow(t *testing.T) {
+	overflowed := flowsOverflowed.WithLabelValues("overflow", "slow[0]")
+	overflowedBefore := testutil.ToFloat64(overflowed)
+
+	publish := config.SegmentRepr{Name: "bus_publish", Config: config.Config{Config: map[string]string{"topic": "overflow"}}}
+	subscribe := config.SegmentRepr{Name: "bus_subscribe", Config: config.Config{Config: map[string]string{"topic": "overflow", "buffer": "2", "overflow": "drop-oldest"}}}
+	publisher := newBusPipeline(t, "publisher", publish)
+	publisher.AutoDrain()
+	slow := newBusPipeline(t, "slow", subscribe)
+	awaitSubscriptions(t, "overflow", 1)
+
+	// the first flows are held by the blocked subscribing segment and its
+	// relay, the following ones fill up the buffer
+	for i := range 5 {
+		publisher.In <- &pb.EnrichedFlow{Bytes: uint64(i)}
+		if i < 2 {
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	var received []uint64
+	for range 4 {
+		received = append(received, (<-slow.Out).Bytes)
+	}
+	if received[0] != 0 || received[1] != 1 || received[2] != 3 || received[3] != 4 {
+		t.Errorf("[error] Subscription did not drop the oldest flows, received %v, should be [0 1 3 4].", received)
+	}
+	if delta := testutil.ToFloat64(overflowed) - overflowedBefore; delta != 1 {
+		t.Errorf("[error] Subscription counted %f overflowed flows, should be 1.", delta)
+	}
+	slow.Close()
+	publisher.Close()
+}
+
+func Test_Bus_lifecycle(t *testing.T) {
+	publish := config.SegmentRepr{Name: "bus_publish", Config: config.Config{Config: map[string]string{"topic": "lifecycle"}}}
+	subscribe := config.SegmentRepr{Name: "bus_subscribe", Config: config.Config{Config: map[string]string{"topic": "lifecycle", "buffer": "2"}}}
+	publisher := newBusPipeline(t, "publisher", publish)
+	publisher.AutoDrain()
+
+	// a pipeline failing to be built leaves its subscription right away
+	if _, err := pipeline.NewFromRepr([]config.SegmentRepr{subscribe, {Name: "nonexistent"}}, "failed"); err == nil {
+		t.Fatal("[error] Pipeline with an unknown segment was built.")
+	}
+	if subscriptions := len(getTopic("lifecycle").current()); subscriptions != 0 {
+		t.Fatalf("[error] Topic has %d subscriptions after a failed build, should be 0.", subscriptions)
+	}
+
+	// flows are received from construction on and emitted until shutdown
+	subscriber, err := pipeline.NewFromRepr([]config.SegmentRepr{subscribe}, "subscriber")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 2 {
+		publisher.In <- &pb.EnrichedFlow{Bytes: uint64(i)}
+	}
+	subscriber.Start()
+	closed := make(chan struct{})
+	go func() {
+		subscriber.Close()
+		close(closed)
+	}()
+	var received int
+	for range subscriber.Out {
+		received += 1
+	}
+	<-closed
+	if received != 2 {
+		t.Errorf("[error] Subscription emitted %d flows published before its shutdown, should be 2.", received)
+	}
+	awaitSubscriptions(t, "lifecycle", 0)
+	publisher.Close()
+}
+
+func Test_Bus_configErrors(t *testing.T) {
+	_, err := pipeline.NewFromConfig([]byte(`---
+- segment: bus_publish
+- segment: bus_subscribe
+  config:
+    topic: flows
+    overflow: drop-newest
+`))
+	if err == nil {
+		t.Fatal("[error] Bus segments with invalid config did not fail.")
+	}
+	for _, expected := range []string{
+		"segments[0] (bus_publish): parameter 'topic' is required",
+		"segments[1] (bus_subscribe): overflow policy 'drop-newest' requires a buffer",
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("[error] Bus segment error '%s' was not reported: %s", expected, err)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package bus
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/BelWue/flowpipeline/pb"
+	"github.com/BelWue/flowpipeline/segments"
+)
+
+type Publish struct {
+	segments.BaseOutputSegment
+	Topic string // required
+}
+
+// Options of the bus_publish segment for use with the builder package.
+type PublishOptions struct {
+	Topic string // required
+}
+
+func (options PublishOptions) SegmentName() string {
+	return "bus_publish"
+}
+
+func (options PublishOptions) SegmentConfig() map[string]string {
+	return map[string]string{"topic": options.Topic}
+}
+
+func (segment Publish) New(config map[string]string) segments.Segment {
+	newSegment, err := segment.NewWithError(config)
+	if err != nil {
+		log.Error().Err(err).Msg("BusPublish: ")
+		return nil
+	}
+	return newSegment
+}
+
+func (segment Publish) NewWithError(config map[string]string) (segments.Segment, error) {
+	if config["topic"] == "" {
+		return nil, errors.New("parameter 'topic' is required")
+	}
+	return &Publish{Topic: config["topic"]}, nil
+}
+
+func (segment *Publish) Run(wg *sync.WaitGroup) {
+	defer func() {
+		close(segment.Out)
+		wg.Done()
+	}()
+	topic := getTopic(segment.Topic)
+	for msg := range segment.In {
+		for _, subscription := range topic.current() {
+			clone := proto.Clone(msg).(*pb.EnrichedFlow)
+			segments.Copy(msg, clone)
+			subscription.send(clone)
+		}
+		segment.Out <- msg
+	}
+}
+
+func init() {
+	segment := &Publish{}
+	segments.RegisterSegment("bus_publish", segment)
+}
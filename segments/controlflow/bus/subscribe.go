@@ -0,0 +1,138 @@
+package bus
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/BelWue/flowpipeline/pipeline/config"
+	"github.com/BelWue/flowpipeline/segments"
+)
+
+type Subscribe struct {
+	segments.BaseInputSegment
+	Topic    string // required
+	Buffer   int    // optional, default is 0
+	Overflow string // optional, default is block
+
+	position     string
+	subscription *subscription
+}
+
+// Options of the bus_subscribe segment for use with the builder package.
+type SubscribeOptions struct {
+	Topic    string // required
+	Buffer   int    // optional, default is 0
+	Overflow string // optional, default is block
+}
+
+func (options SubscribeOptions) SegmentName() string {
+	return "bus_subscribe"
+}
+
+func (options SubscribeOptions) SegmentConfig() map[string]string {
+	return map[string]string{
+		"topic":    options.Topic,
+		"buffer":   strconv.Itoa(options.Buffer),
+		"overflow": options.Overflow,
+	}
+}
+
+func (segment Subscribe) New(config map[string]string) segments.Segment {
+	newSegment, err := segment.NewWithError(config)
+	if err != nil {
+		log.Error().Err(err).Msg("BusSubscribe: ")
+		return nil
+	}
+	return newSegment
+}
+
+func (segment Subscribe) NewWithError(segmentConfig map[string]string) (segments.Segment, error) {
+	if segmentConfig["topic"] == "" {
+		return nil, errors.New("parameter 'topic' is required")
+	}
+	newSegment := &Subscribe{Topic: segmentConfig["topic"], Overflow: segmentConfig["overflow"]}
+	if segmentConfig["buffer"] != "" {
+		buffer, err := strconv.Atoi(segmentConfig["buffer"])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse buffer config option: %w", err)
+		}
+		newSegment.Buffer = buffer
+	}
+	if err := config.ValidateBuffering(newSegment.Buffer, newSegment.Overflow); err != nil {
+		return nil, err
+	}
+	return newSegment, nil
+}
+
+// Subscribes to the topic right away, so that no flows are missed in between
+// building and starting the pipeline, e.g. when it replaces the previous
+// pipeline on a reload.
+func (segment *Subscribe) AddCustomConfig(segmentRepr config.SegmentRepr) error {
+	segment.position = segmentRepr.Path
+	if !segmentRepr.DryRun {
+		segment.subscription = subscribe(segment.Topic, segment.position, segment.Buffer, segment.Overflow)
+	}
+	return nil
+}
+
+// Leaves the subscription of a segment which is never run, see
+// segments.DiscardableSegment.
+func (segment *Subscribe) Discard() {
+	if segment.subscription == nil {
+		return
+	}
+	subscription := segment.subscription
+	segment.subscription = nil
+	if unsubscribe(segment.Topic, segment.position) {
+		for {
+			select {
+			case msg := <-subscription.ch:
+				segments.Ack(msg)
+			default:
+				return
+			}
+		}
+	}
+}
+
+func (segment *Subscribe) Run(wg *sync.WaitGroup) {
+	defer func() {
+		close(segment.Out)
+		wg.Done()
+	}()
+	if segment.subscription == nil { // not built by the pipeline package
+		segment.subscription = subscribe(segment.Topic, segment.position, segment.Buffer, segment.Overflow)
+	}
+	subscription := segment.subscription
+	for {
+		select {
+		case msg, ok := <-segment.In:
+			if !ok {
+				if unsubscribe(segment.Topic, segment.position) {
+					// the last subscriber hands on the flows left over
+					for {
+						select {
+						case msg := <-subscription.ch:
+							segment.Out <- msg
+						default:
+							return
+						}
+					}
+				}
+				return
+			}
+			segment.Out <- msg
+		case msg := <-subscription.ch:
+			segment.Out <- msg
+		}
+	}
+}
+
+func init() {
+	segment := &Subscribe{}
+	segments.RegisterSegment("bus_subscribe", segment)
+}
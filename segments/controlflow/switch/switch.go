@@ -0,0 +1,301 @@
+// The `switch` segment is used to route flows to one of several branches. To
+// this end, it uses additional syntax that other segments do not have access
+// to, namely the `cases` key which contains an ordered list of cases, each
+// consisting of a `filter` expression in the syntax of the `flowfilter`
+// segment and a list of `segments` constituting an embedded pipeline, and the
+// `default` key containing the list of segments receiving all flows not
+// matched by any case. Cases can be given a `name` to be used in metrics.
+//
+// By default, each flow is handed to the first case matching it. Setting the
+// `all-matches` parameter hands it to every matching case instead, each
+// receiving its own copy, such that a flow may leave the `switch` segment
+// multiple times. In both modes, flows leaving any case or the default branch
+// are forwarded to the next segment, while flows dropped within them are
+// dropped by the `switch` segment.
+//
+// If the list of segments of any case or of the default branch is empty, it
+// behaves as if it consisted of a single `pass` segment.
+//
+// The number of flows handed to each case is exported as the
+// `flowpipeline_switch_case_flows_total` metric, with the case's name or
+// position as its `case` label and `default` for the default branch.
+//
+// The following example sends the flows of two customers to separate Kafka
+// topics and discards all other flows:
+//
+// ```yaml
+// - segment: switch
+//   cases:
+//   - name: customer-a
+//     filter: cid 1
+//     segments:
+//     - segment: kafkaproducer
+//       config:
+//         server: kafka.local:9092
+//         topic: customer-a
+//   - name: customer-b
+//     filter: cid 2 or cid 3
+//     segments:
+//     - segment: kafkaproducer
+//       config:
+//         server: kafka.local:9092
+//         topic: customer-b
+//   default:
+//   - segment: drop
+// ```
+package switchsegment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/BelWue/flowfilter/parser"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/BelWue/flowpipeline/pb"
+	"github.com/BelWue/flowpipeline/pipeline"
+	"github.com/BelWue/flowpipeline/pipeline/config"
+	"github.com/BelWue/flowpipeline/segments"
+	"github.com/BelWue/flowpipeline/segments/filter/flowfilter"
+)
+
+var caseFlows = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "flowpipeline_switch_case_flows_total",
+	Help: "Number of flows handed to a case of a switch segment.",
+}, []string{"position", "case"})
+
+// This mirrors the proper implementation in the pipeline package. This
+// duplication is to avoid the import cycle.
+type Pipeline interface {
+	Start()
+	Close()
+	GetInput() chan *pb.EnrichedFlow
+	GetOutput() <-chan *pb.EnrichedFlow
+	GetDrop() <-chan *pb.EnrichedFlow
+	SetShutdownCoordinator(coordinator *segments.ShutdownCoordinator)
+	Discard()
+	Status() []pipeline.SegmentStatus
+	Health(ctx context.Context) error
+	Attach(tap *pipeline.Tap) int
+}
+
+type Switch struct {
+	segments.BaseFilterSegment
+	cases       []*switchCase
+	defaultCase *switchCase
+	allMatches  bool // optional, default is false, hand flows to all matching cases instead of the first one
+}
+
+type switchCase struct {
+	expression *parser.Expression // nil for the default branch
+	pipeline   Pipeline
+	flows      prometheus.Counter
+}
+
+func (segment Switch) New(config map[string]string) segments.Segment {
+	newSegment, err := segment.NewWithError(config)
+	if err != nil {
+		log.Error().Err(err).Msg("Switch: ")
+		return nil
+	}
+	return newSegment
+}
+
+func (segment Switch) NewWithError(config map[string]string) (segments.Segment, error) {
+	allMatches := false
+	if config["all-matches"] != "" {
+		b, err := strconv.ParseBool(config["all-matches"])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse all-matches config option: %w", err)
+		}
+		allMatches = b
+	}
+	return &Switch{allMatches: allMatches}, nil
+}
+
+func (segment *Switch) AddCustomConfig(segmentRepr config.SegmentRepr) error {
+	if len(segmentRepr.Cases) == 0 {
+		return errors.New("no cases configured")
+	}
+	var errs error
+	filter := &flowfilter.Filter{}
+	for i, caseRepr := range segmentRepr.Cases {
+		path := fmt.Sprintf("%s.cases[%d]", segmentRepr.Path, i)
+		label := caseRepr.Name
+		if label == "" {
+			label = strconv.Itoa(i)
+		}
+		switchCase := &switchCase{flows: caseFlows.WithLabelValues(segmentRepr.Path, label)}
+		expression, err := parser.Parse(caseRepr.Filter)
+		if err != nil {
+			errs = errors.Join(errs, &pipeline.SegmentError{Path: path, Name: segmentRepr.Name, Err: fmt.Errorf("syntax error in filter expression: %w", err)})
+		} else if _, err := filter.CheckFlow(expression, &pb.EnrichedFlow{}); err != nil {
+			errs = errors.Join(errs, &pipeline.SegmentError{Path: path, Name: segmentRepr.Name, Err: fmt.Errorf("semantic error in filter expression: %w", err)})
+		}
+		switchCase.expression = expression
+		switchCase.pipeline, err = newSubpipeline(caseRepr.Segments, path+".segments")
+		errs = errors.Join(errs, err)
+		segment.cases = append(segment.cases, switchCase)
+	}
+	defaultPipeline, err := newSubpipeline(segmentRepr.Default, segmentRepr.Path+".default")
+	segment.defaultCase = &switchCase{pipeline: defaultPipeline, flows: caseFlows.WithLabelValues(segmentRepr.Path, "default")}
+	return errors.Join(errs, err)
+}
+
+// Builds one of the embedded pipelines, reporting errors of the segments
+// therein using their full path.
+func newSubpipeline(segmentReprs []config.SegmentRepr, path string) (Pipeline, error) {
+	subpipeline, err := pipeline.NewFromRepr(segmentReprs, path)
+	if err != nil {
+		return nil, err
+	}
+	return subpipeline, nil
+}
+
+// Sets the ShutdownCoordinator of this segment and all cases.
+func (segment *Switch) SetShutdownCoordinator(coordinator *segments.ShutdownCoordinator) {
+	segment.BaseFilterSegment.SetShutdownCoordinator(coordinator)
+	for _, switchCase := range segment.cases {
+		if switchCase.pipeline != nil {
+			switchCase.pipeline.SetShutdownCoordinator(coordinator)
+		}
+	}
+	if segment.defaultCase != nil && segment.defaultCase.pipeline != nil {
+		segment.defaultCase.pipeline.SetShutdownCoordinator(coordinator)
+	}
+}
+
+// Discards the pipelines of all cases, see segments.DiscardableSegment.
+func (segment *Switch) Discard() {
+	for _, switchCase := range segment.cases {
+		if switchCase.pipeline != nil {
+			switchCase.pipeline.Discard()
+		}
+	}
+	if segment.defaultCase != nil && segment.defaultCase.pipeline != nil {
+		segment.defaultCase.pipeline.Discard()
+	}
+}
+
+// Returns the status of the segments of all cases.
+func (segment *Switch) NestedStatus() []pipeline.SegmentStatus {
+	var status []pipeline.SegmentStatus
+	for _, switchCase := range segment.cases {
+		if switchCase.pipeline != nil {
+			status = append(status, switchCase.pipeline.Status()...)
+		}
+	}
+	if segment.defaultCase != nil && segment.defaultCase.pipeline != nil {
+		status = append(status, segment.defaultCase.pipeline.Status()...)
+	}
+	return status
+}
+
+// Returns the health of the segments of all cases.
+func (segment *Switch) NestedHealth(ctx context.Context) error {
+	var errs []error
+	for _, switchCase := range segment.cases {
+		if switchCase.pipeline != nil {
+			errs = append(errs, switchCase.pipeline.Health(ctx))
+		}
+	}
+	if segment.defaultCase != nil && segment.defaultCase.pipeline != nil {
+		errs = append(errs, segment.defaultCase.pipeline.Health(ctx))
+	}
+	return errors.Join(errs...)
+}
+
+// Attaches the tap to all cases.
+func (segment *Switch) NestedAttach(tap *pipeline.Tap) int {
+	attached := 0
+	for _, switchCase := range segment.cases {
+		if switchCase.pipeline != nil {
+			attached += switchCase.pipeline.Attach(tap)
+		}
+	}
+	if segment.defaultCase != nil && segment.defaultCase.pipeline != nil {
+		attached += segment.defaultCase.pipeline.Attach(tap)
+	}
+	return attached
+}
+
+func (segment *Switch) Run(wg *sync.WaitGroup) {
+	if len(segment.cases) == 0 || segment.defaultCase == nil {
+		log.Error().Msg("Switch: Uninitialized cases. This is expected during standalone testing of this package. The actual test is done as part of the pipeline package, as this segment embeds further pipelines.")
+		return
+	}
+	allCases := append([]*switchCase{segment.defaultCase}, segment.cases...)
+	forwarded := &sync.WaitGroup{}
+	defer func() {
+		for _, switchCase := range allCases {
+			switchCase.pipeline.Close()
+		}
+		forwarded.Wait()
+		close(segment.Out)
+		if segment.Drops != nil {
+			close(segment.Drops)
+		}
+		wg.Done()
+	}()
+
+	for _, switchCase := range allCases {
+		output := switchCase.pipeline.GetOutput()
+		drops := switchCase.pipeline.GetDrop()
+		switchCase.pipeline.Start()
+		forwarded.Add(2)
+		go func() {
+			defer forwarded.Done()
+			for msg := range output {
+				segment.Out <- msg
+			}
+		}()
+		go func() {
+			defer forwarded.Done()
+			for msg := range drops {
+				if segment.Drops != nil {
+					segment.Drops <- msg
+				} else {
+					segments.Ack(msg)
+				}
+			}
+		}()
+	}
+
+	filter := &flowfilter.Filter{}
+	var matches []*switchCase
+	for msg := range segment.In {
+		matches = matches[:0]
+		for _, switchCase := range segment.cases {
+			if match, _ := filter.CheckFlow(switchCase.expression, msg); match {
+				matches = append(matches, switchCase)
+				if !segment.allMatches {
+					break
+				}
+			}
+		}
+		if len(matches) == 0 {
+			matches = append(matches, segment.defaultCase)
+		}
+		copies := make([]*pb.EnrichedFlow, len(matches))
+		copies[0] = msg
+		for i := 1; i < len(matches); i++ { // copy before handing on the original
+			copies[i] = proto.Clone(msg).(*pb.EnrichedFlow)
+			segments.Copy(msg, copies[i])
+		}
+		for i, switchCase := range matches {
+			switchCase.flows.Inc()
+			switchCase.pipeline.GetInput() <- copies[i]
+		}
+	}
+}
+
+func init() {
+	segment := &Switch{}
+	segments.RegisterSegment("switch", segment)
+	segments.MetricsRegistry.MustRegister(caseFlows)
+}
@@ -0,0 +1,130 @@
+package switchsegment
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/BelWue/flowpipeline/pb"
+	"github.com/BelWue/flowpipeline/pipeline"
+
+	_ "github.com/BelWue/flowpipeline/segments/filter/drop"
+	_ "github.com/BelWue/flowpipeline/segments/modify/dropfields"
+	_ "github.com/BelWue/flowpipeline/segments/pass"
+)
+
+func Test_Switch_firstMatch(t *testing.T) {
+	tcpFlows := caseFlows.WithLabelValues("segments[0]", "tcp")
+	defaultFlows := caseFlows.WithLabelValues("segments[0]", "default")
+	tcpBefore, defaultBefore := testutil.ToFloat64(tcpFlows), testutil.ToFloat64(defaultFlows)
+
+	pipeline, err := pipeline.NewFromConfig([]byte(`---
+- segment: switch
+  cases:
+  - name: tcp
+    filter: proto tcp
+    segments:
+    - segment: dropfields
+      config:
+        policy: drop
+        fields: InIf
+  - filter: port 80
+    segments:
+    - segment: dropfields
+      config:
+        policy: drop
+        fields: OutIf
+  default:
+  - segment: drop
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline.Start()
+	pipeline.In <- &pb.EnrichedFlow{Proto: 6, DstPort: 80, InIf: 1, OutIf: 1}
+	fmsg := <-pipeline.Out
+	if fmsg.InIf != 0 || fmsg.OutIf != 1 {
+		t.Errorf("[error] Switch segment did not use the first matching case, state is InIf %d, OutIf %d, should be (0, 1).", fmsg.InIf, fmsg.OutIf)
+	}
+	pipeline.In <- &pb.EnrichedFlow{Proto: 17, DstPort: 80, InIf: 1, OutIf: 1}
+	fmsg = <-pipeline.Out
+	if fmsg.InIf != 1 || fmsg.OutIf != 0 {
+		t.Errorf("[error] Switch segment did not use the second case, state is InIf %d, OutIf %d, should be (1, 0).", fmsg.InIf, fmsg.OutIf)
+	}
+	pipeline.In <- &pb.EnrichedFlow{Proto: 17, DstPort: 53}
+	pipeline.In <- &pb.EnrichedFlow{Proto: 6, DstPort: 443, InIf: 1}
+	fmsg = <-pipeline.Out
+	if fmsg.Proto != 6 {
+		t.Errorf("[error] Switch segment did not drop the unmatched flow in the default branch, got proto %d.", fmsg.Proto)
+	}
+	pipeline.Close()
+
+	if delta := testutil.ToFloat64(tcpFlows) - tcpBefore; delta != 2 {
+		t.Errorf("[error] Switch segment counted %f flows for case 'tcp', should be 2.", delta)
+	}
+	if delta := testutil.ToFloat64(defaultFlows) - defaultBefore; delta != 1 {
+		t.Errorf("[error] Switch segment counted %f flows for the default branch, should be 1.", delta)
+	}
+}
+
+func Test_Switch_allMatches(t *testing.T) {
+	pipeline, err := pipeline.NewFromConfig([]byte(`---
+- segment: switch
+  config:
+    all-matches: true
+  cases:
+  - filter: proto tcp
+    segments:
+    - segment: dropfields
+      config:
+        policy: drop
+        fields: InIf
+  - filter: port 80
+    segments:
+    - segment: dropfields
+      config:
+        policy: drop
+        fields: OutIf
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline.Start()
+	pipeline.In <- &pb.EnrichedFlow{Proto: 6, DstPort: 80, InIf: 1, OutIf: 1}
+	first, second := <-pipeline.Out, <-pipeline.Out
+	if first == second || first.InIf+second.InIf != 1 || first.OutIf+second.OutIf != 1 {
+		t.Errorf("[error] Switch segment did not hand copies to all matching cases, got %v and %v.", first, second)
+	}
+	pipeline.In <- &pb.EnrichedFlow{Proto: 17, DstPort: 53, InIf: 1, OutIf: 1}
+	fmsg := <-pipeline.Out
+	if fmsg.InIf != 1 || fmsg.OutIf != 1 {
+		t.Errorf("[error] Switch segment did not pass the unmatched flow through the empty default branch, state is InIf %d, OutIf %d.", fmsg.InIf, fmsg.OutIf)
+	}
+	pipeline.Close()
+}
+
+func Test_Switch_configErrors(t *testing.T) {
+	_, err := pipeline.NewFromConfig([]byte(`---
+- segment: switch
+  cases:
+  - filter: proto tcp )
+  - filter: proto tcp
+    segments:
+    - segment: flowfliter
+  default:
+  - segment: flowfliter
+`))
+	if err == nil {
+		t.Fatal("[error] Switch segment with invalid cases did not fail.")
+	}
+	for _, expected := range []string{
+		"segments[0].cases[0] (switch): syntax error in filter expression",
+		"segments[0].cases[1].segments[0] (flowfliter): could not find a segment named 'flowfliter'",
+		"segments[0].default[0] (flowfliter): could not find a segment named 'flowfliter'",
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("[error] Switch segment error '%s' was not reported: %s", expected, err)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+// The `tee` segment is used to send the same flows to multiple destinations,
+// each of which may process them differently. To this end, it uses additional
+// syntax that other segments do not have access to, namely the `branches` key
+// which contains a list of named branches, each consisting of a list of
+// segments that constitute an embedded pipeline.
+//
+// Every branch receives its own copy of each flow entering the `tee` segment,
+// so that modifications made within one branch are neither visible to other
+// branches nor to the segments following the `tee` segment, which receive the
+// original flows unchanged. All branches run concurrently. Flows leaving or
+// being dropped within a branch are discarded.
+//
+// By default, a slow branch slows down the `tee` segment and thus the whole
+// pipeline. Using the `buffer` and `overflow` keys of a branch, which behave
+// just like the options of the same name available to every segment, flows can
+// be buffered for a branch or be discarded for it if its buffer is full,
+// without affecting any other branch. They are applied to the first segment
+// of the branch, replacing any options configured there.
+//
+// If the list of segments of a branch is empty, the branch behaves as if it
+// consisted of a single `pass` segment.
+//
+// The following example sends all flows to clickhouse unchanged, to Kafka
+// without their addresses, and to a prometheus exporter, which may miss flows
+// if it can not keep up:
+//
+// ```yaml
+// - segment: tee
+//   branches:
+//   - name: clickhouse
+//     segments:
+//     - segment: clickhouse
+//       config:
+//         dsn: ${file:/run/secrets/clickhouse_dsn}
+//   - name: kafka
+//     segments:
+//     - segment: dropfields
+//       config:
+//         policy: drop
+//         fields: SrcAddr,DstAddr
+//     - segment: kafkaproducer
+//       config:
+//         server: kafka.local:9092
+//         topic: flows
+//   - name: prometheus
+//     buffer: 10000
+//     overflow: drop-newest
+//     segments:
+//     - segment: prometheus
+// ```
+package tee
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/BelWue/flowpipeline/pb"
+	"github.com/BelWue/flowpipeline/pipeline"
+	"github.com/BelWue/flowpipeline/pipeline/config"
+	"github.com/BelWue/flowpipeline/segments"
+)
+
+// This mirrors the proper implementation in the pipeline package. This
+// duplication is to avoid the import cycle.
+type Pipeline interface {
+	Start()
+	Close()
+	GetInput() chan *pb.EnrichedFlow
+	GetOutput() <-chan *pb.EnrichedFlow
+	SetShutdownCoordinator(coordinator *segments.ShutdownCoordinator)
+	Discard()
+	Status() []pipeline.SegmentStatus
+	Health(ctx context.Context) error
+	Attach(tap *pipeline.Tap) int
+}
+
+type Tee struct {
+	segments.BaseSegment
+	branches []Pipeline
+}
+
+func (segment Tee) New(config map[string]string) segments.Segment {
+	return &Tee{}
+}
+
+func (segment *Tee) AddCustomConfig(segmentRepr config.SegmentRepr) error {
+	if len(segmentRepr.Branches) == 0 {
+		return errors.New("no branches configured")
+	}
+	var errs error
+	var names []string
+	for i, branch := range segmentRepr.Branches {
+		path := fmt.Sprintf("%s.branches[%d]", segmentRepr.Path, i)
+		if branch.Name == "" {
+			errs = errors.Join(errs, &pipeline.SegmentError{Path: path, Name: segmentRepr.Name, Err: errors.New("branch has no name")})
+		} else if slices.Contains(names, branch.Name) {
+			errs = errors.Join(errs, &pipeline.SegmentError{Path: path, Name: segmentRepr.Name, Err: fmt.Errorf("branch name '%s' is used more than once", branch.Name)})
+		}
+		names = append(names, branch.Name)
+		if err := branch.ValidateBuffering(); err != nil {
+			errs = errors.Join(errs, &pipeline.SegmentError{Path: path, Name: segmentRepr.Name, Err: err})
+			continue
+		}
+		subpipeline, err := newSubpipeline(branch, path+".segments")
+		errs = errors.Join(errs, err)
+		segment.branches = append(segment.branches, subpipeline)
+	}
+	return errs
+}
+
+// Builds the embedded pipeline of a branch, reporting errors of the segments
+// therein using their full path. The branch's buffering options are applied
+// to its first segment.
+func newSubpipeline(branch config.TeeBranch, path string) (Pipeline, error) {
+	segmentReprs := slices.Clone(branch.Segments)
+	if len(segmentReprs) == 0 {
+		segmentReprs = []config.SegmentRepr{{Name: "pass"}}
+	}
+	if branch.Buffer != 0 || branch.Overflow != "" {
+		segmentReprs[0].Buffer = branch.Buffer
+		segmentReprs[0].Overflow = branch.Overflow
+	}
+	subpipeline, err := pipeline.NewFromRepr(segmentReprs, path)
+	if err != nil {
+		return nil, err
+	}
+	return subpipeline, nil
+}
+
+// Discards the pipelines of all branches, see segments.DiscardableSegment.
+func (segment *Tee) Discard() {
+	for _, branch := range segment.branches {
+		if branch != nil {
+			branch.Discard()
+		}
+	}
+}
+
+// Returns the status of the segments of all branches.
+func (segment *Tee) NestedStatus() []pipeline.SegmentStatus {
+	var status []pipeline.SegmentStatus
+	for _, branch := range segment.branches {
+		if branch != nil {
+			status = append(status, branch.Status()...)
+		}
+	}
+	return status
+}
+
+// Returns the health of the segments of all branches.
+func (segment *Tee) NestedHealth(ctx context.Context) error {
+	var errs []error
+	for _, branch := range segment.branches {
+		if branch != nil {
+			errs = append(errs, branch.Health(ctx))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Attaches the tap to all branches.
+func (segment *Tee) NestedAttach(tap *pipeline.Tap) int {
+	attached := 0
+	for _, branch := range segment.branches {
+		if branch != nil {
+			attached += branch.Attach(tap)
+		}
+	}
+	return attached
+}
+
+// Sets the ShutdownCoordinator of this segment and all branches.
+func (segment *Tee) SetShutdownCoordinator(coordinator *segments.ShutdownCoordinator) {
+	segment.BaseSegment.SetShutdownCoordinator(coordinator)
+	for _, branch := range segment.branches {
+		if branch != nil {
+			branch.SetShutdownCoordinator(coordinator)
+		}
+	}
+}
+
+func (segment *Tee) Run(wg *sync.WaitGroup) {
+	if len(segment.branches) == 0 || slices.Contains(segment.branches, nil) {
+		log.Error().Msg("Tee: Uninitialized branches. This is expected during standalone testing of this package. The actual test is done as part of the pipeline package, as this segment embeds further pipelines.")
+		return
+	}
+	drained := &sync.WaitGroup{}
+	defer func() {
+		for _, branch := range segment.branches {
+			branch.Close()
+		}
+		drained.Wait()
+		close(segment.Out)
+		wg.Done()
+	}()
+
+	for _, branch := range segment.branches {
+		branch.Start()
+		drained.Add(1)
+		go func() {
+			defer drained.Done()
+			for msg := range branch.GetOutput() {
+				segments.Ack(msg)
+			}
+		}()
+	}
+
+	for msg := range segment.In {
+		for _, branch := range segment.branches {
+			clone := proto.Clone(msg).(*pb.EnrichedFlow)
+			segments.Copy(msg, clone)
+			branch.GetInput() <- clone
+		}
+		segment.Out <- msg
+	}
+}
+
+func init() {
+	segment := &Tee{}
+	segments.RegisterSegment("tee", segment)
+}
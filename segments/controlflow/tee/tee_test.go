@@ -0,0 +1,158 @@
+package tee
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/BelWue/flowpipeline/pb"
+	"github.com/BelWue/flowpipeline/pipeline"
+	"github.com/BelWue/flowpipeline/segments"
+
+	_ "github.com/BelWue/flowpipeline/segments/filter/flowfilter"
+	_ "github.com/BelWue/flowpipeline/segments/modify/dropfields"
+	_ "github.com/BelWue/flowpipeline/segments/output/json"
+	_ "github.com/BelWue/flowpipeline/segments/pass"
+)
+
+func Test_Tee_copies(t *testing.T) {
+	dir := t.TempDir()
+	pipeline, err := pipeline.NewFromConfig([]byte(`---
+- segment: tee
+  branches:
+  - name: anonymized
+    segments:
+    - segment: dropfields
+      config:
+        policy: drop
+        fields: InIf
+    - segment: json
+      config:
+        filename: ` + filepath.Join(dir, "anonymized.json") + `
+  - name: tcp
+    buffer: 10
+    overflow: drop-newest
+    segments:
+    - segment: flowfilter
+      config:
+        filter: proto tcp
+    - segment: json
+      config:
+        filename: ` + filepath.Join(dir, "tcp.json") + `
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline.Start()
+	pipeline.In <- &pb.EnrichedFlow{Proto: 6, InIf: 1}
+	pipeline.In <- &pb.EnrichedFlow{Proto: 17, InIf: 1}
+	for range 2 {
+		fmsg := <-pipeline.Out
+		if fmsg.InIf != 1 {
+			t.Errorf("[error] Tee segment did not forward the original flow, InIf is %d, should be 1.", fmsg.InIf)
+		}
+	}
+	pipeline.Close()
+
+	anonymized, _ := os.ReadFile(filepath.Join(dir, "anonymized.json"))
+	if lines := strings.Count(string(anonymized), "\n"); lines != 2 || strings.Contains(string(anonymized), "inIf") {
+		t.Errorf("[error] Tee branch did not receive both flows modified, got %d lines: %s", lines, anonymized)
+	}
+	tcp, _ := os.ReadFile(filepath.Join(dir, "tcp.json"))
+	if lines := strings.Count(string(tcp), "\n"); lines != 1 || !strings.Contains(string(tcp), "inIf") {
+		t.Errorf("[error] Tee branch did not receive the unmodified tcp flow only, got %d lines: %s", lines, tcp)
+	}
+}
+
+func Test_Tee_ack(t *testing.T) {
+	pipeline, err := pipeline.NewFromConfig([]byte(`---
+- segment: tee
+  branches:
+  - name: tcp
+    segments:
+    - segment: flowfilter
+      config:
+        filter: proto tcp
+  - name: all
+    buffer: 10
+    overflow: drop-newest
+    segments:
+    - segment: pass
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	flows := []*pb.EnrichedFlow{{Proto: 6}, {Proto: 17}}
+	done := make([]atomic.Int32, len(flows))
+	for i, msg := range flows {
+		segments.Track(msg, func() { done[i].Add(1) })
+	}
+	pipeline.Start()
+	for _, msg := range flows {
+		pipeline.In <- msg
+		segments.Ack(<-pipeline.Out)
+	}
+	pipeline.Close()
+	for i := range done {
+		if done := done[i].Load(); done != 1 {
+			t.Errorf("[error] Flow %d was done %d times, should be once.", i, done)
+		}
+	}
+}
+
+func Test_Tee_configErrors(t *testing.T) {
+	_, err := pipeline.NewFromConfig([]byte(`---
+- segment: tee
+  branches:
+  - name: a
+  - name: a
+    segments:
+    - segment: flowfliter
+  - overflow: drop-oldest
+`))
+	if err == nil {
+		t.Fatal("[error] Tee segment with invalid branches did not fail.")
+	}
+	for _, expected := range []string{
+		"segments[0].branches[1] (tee): branch name 'a' is used more than once",
+		"segments[0].branches[1].segments[0] (flowfliter): could not find a segment named 'flowfliter'",
+		"segments[0].branches[2] (tee): branch has no name",
+		"segments[0].branches[2] (tee): overflow policy 'drop-oldest' requires a buffer",
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("[error] Tee segment error '%s' was not reported: %s", expected, err)
+		}
+	}
+
+	_, err = pipeline.NewFromConfig([]byte(`---
+- segment: tee
+`))
+	if err == nil || !strings.Contains(err.Error(), "no branches configured") {
+		t.Errorf("[error] Tee segment without branches was not reported: %v", err)
+	}
+}
+
+func Test_Tee_status(t *testing.T) {
+	pipeline, err := pipeline.NewFromConfig([]byte(`---
+- segment: tee
+  branches:
+  - name: tcp
+    segments:
+    - segment: flowfilter
+      config:
+        filter: proto tcp
+    - segment: pass
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := pipeline.Status()
+	if len(status) != 1 || len(status[0].Nested) != 2 {
+		t.Fatalf("[error] Tee segment did not report the status of its branches: %+v", status)
+	}
+	if nested := status[0].Nested[0]; nested.Segment != "flowfilter" || nested.Position != "segments[0].branches[0].segments[0]" {
+		t.Errorf("[error] Tee segment reported segment '%s' at '%s' for its branch.", nested.Segment, nested.Position)
+	}
+}
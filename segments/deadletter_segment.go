@@ -0,0 +1,73 @@
+// This package is home to all pipeline segment implementations. Generally,
+// every segment lives in its own package, implements the Segment interface,
+// embeds the BaseSegment to take care of the I/O side of things, and has an
+// additional init() function to register itself using RegisterSegment.
+package segments
+
+import (
+	"google.golang.org/protobuf/proto"
+
+	"github.com/BelWue/flowpipeline/pb"
+)
+
+// Segments delivering flows to external destinations can implement this
+// interface to hand over the flows they ultimately failed to deliver, e.g.
+// once a write to their database failed. Only these segments accept the
+// `deadletter` key, whose pipeline receives these flows along with the
+// reason in their Note field.
+type DeadLetterSegment interface {
+	Segment
+	SubscribeDeadLetters(deadLetters chan<- *DeadLetter)
+}
+
+// A flow a segment failed to deliver, and the reason why.
+type DeadLetter struct {
+	Flow *pb.EnrichedFlow
+	Err  error
+}
+
+// An extension for Segment implementations which may fail to deliver flows.
+// Embedding it next to BaseSegment or one of its extensions implements the
+// DeadLetterSegment interface.
+type BaseDeadLetterSegment struct {
+	deadLetters chan<- *DeadLetter
+}
+
+// Sets a return channel for flows which could not be delivered. This method
+// is called by the pipeline package for segments configured with a dead
+// letter pipeline only. The channel is closed once the segment's Run method
+// has returned.
+func (segment *BaseDeadLetterSegment) SubscribeDeadLetters(deadLetters chan<- *DeadLetter) {
+	segment.deadLetters = deadLetters
+}
+
+// Hands flows which could not be delivered to the dead letter pipeline, if
+// one is configured, and does nothing otherwise. Blocks until the dead letter
+// pipeline accepted them, and must not be called after Run has returned. The
+// flows are handed over as they are, so they must not be handed on by the
+// segment, see Keep.
+func (segment *BaseDeadLetterSegment) DeadLetter(err error, flows ...*pb.EnrichedFlow) {
+	if segment.deadLetters == nil {
+		return
+	}
+	for _, msg := range flows {
+		if msg != nil {
+			segment.deadLetters <- &DeadLetter{Flow: msg, Err: err}
+		}
+	}
+}
+
+// Holds a flow the segment is about to hand on, see Hold, and returns the flow
+// to write and to pass to DeadLetter later on. If a dead letter pipeline is
+// configured, this is a copy tracked along with the original, as the following
+// segments may have modified the original by the time it failed to deliver.
+// Otherwise, it is the flow itself.
+func (segment *BaseDeadLetterSegment) Keep(msg *pb.EnrichedFlow) *pb.EnrichedFlow {
+	if segment.deadLetters == nil || msg == nil {
+		Hold(msg)
+		return msg
+	}
+	kept := proto.Clone(msg).(*pb.EnrichedFlow)
+	Copy(msg, kept)
+	return kept
+}
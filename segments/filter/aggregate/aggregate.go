@@ -1,39 +1,149 @@
+// The `aggregate` segment merges flows with equal values in a set of key fields
+// into a single flow, for instance to reduce the rate of high-rate sampled flows
+// before storing them. The keys default to the 5-tuple along with `IpTos` and
+// `InIf`, but can be set to any list of flow fields using the `keys` parameter.
+//
+// An aggregated flow is emitted once no flows were merged into it for the
+// `inactivetimeout` (default 15s) or once it has been aggregating flows for the
+// `activetimeout` (default 30m), whichever comes first. Both timeouts refer to
+// the time flows arrive at this segment. All remaining flows are emitted when
+// the pipeline is shut down.
+//
+// The aggregated flow spans from the earliest start to the latest end of its
+// flows, its `Bytes` and `Packets` are summed and its `TcpFlags` are combined.
+// If flows with different sampling rates are aggregated, the counters are
+// normalized just like the `normalize` segment does. All other fields are taken
+// from the first flow aggregated.
 package aggregate
 
 import (
+	"errors"
+	"fmt"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/rs/zerolog/log"
+
+	"github.com/BelWue/flowpipeline/pb"
+	"github.com/BelWue/flowpipeline/pipeline/flowkey"
 	"github.com/BelWue/flowpipeline/segments"
 )
 
 type Aggregate struct {
 	segments.BaseSegment
+	Keys            []string      // optional, default is SrcAddr,DstAddr,SrcPort,DstPort,Proto,IpTos,InIf, the fields determining which flows are aggregated
+	ActiveTimeout   time.Duration // optional, default is 30m, the maximum time flows are aggregated into the same flow
+	InactiveTimeout time.Duration // optional, default is 15s, the time after which an aggregated flow is emitted if no more flows were merged into it
+
+	keyFields *flowkey.Fields
+	cache     map[string]*record
+}
 
-	cache FlowExporter
+// A flow being aggregated.
+type record struct {
+	flow    *pb.EnrichedFlow
+	created time.Time
+	updated time.Time
 }
 
 func (segment Aggregate) New(config map[string]string) segments.Segment {
-	return &Aggregate{cache: FlowExporter{}}
+	newSegment, err := segment.NewWithError(config)
+	if err != nil {
+		log.Error().Err(err).Msg("Aggregate: ")
+		return nil
+	}
+	return newSegment
+}
+
+func (segment Aggregate) NewWithError(config map[string]string) (segments.Segment, error) {
+	keys := DefaultKeys
+	if config["keys"] != "" {
+		keys = strings.FieldsFunc(config["keys"], func(r rune) bool {
+			return r == ',' || r == ' '
+		})
+	} else {
+		log.Info().Msgf("Aggregate: 'keys' set to default '%s'.", strings.Join(DefaultKeys, ","))
+	}
+	keyFields, err := flowkey.NewFields(keys)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse 'keys' parameter: %w", err)
+	}
+
+	activeTimeout := 30 * time.Minute
+	if config["activetimeout"] != "" {
+		if activeTimeout, err = time.ParseDuration(config["activetimeout"]); err != nil {
+			return nil, fmt.Errorf("could not parse 'activetimeout' parameter: %w", err)
+		}
+		if activeTimeout <= 0 {
+			return nil, errors.New("activetimeout has to be >0")
+		}
+	} else {
+		log.Info().Msg("Aggregate: 'activetimeout' set to default 30m.")
+	}
+
+	inactiveTimeout := 15 * time.Second
+	if config["inactivetimeout"] != "" {
+		if inactiveTimeout, err = time.ParseDuration(config["inactivetimeout"]); err != nil {
+			return nil, fmt.Errorf("could not parse 'inactivetimeout' parameter: %w", err)
+		}
+		if inactiveTimeout <= 0 {
+			return nil, errors.New("inactivetimeout has to be >0")
+		}
+	} else {
+		log.Info().Msg("Aggregate: 'inactivetimeout' set to default 15s.")
+	}
+
+	return &Aggregate{
+		Keys:            keys,
+		ActiveTimeout:   activeTimeout,
+		InactiveTimeout: inactiveTimeout,
+		keyFields:       keyFields,
+	}, nil
 }
 
 func (segment *Aggregate) Run(wg *sync.WaitGroup) {
 	defer func() {
+		segment.export(func(*record) bool { return true })
 		close(segment.Out)
 		wg.Done()
 	}()
 
+	segment.cache = make(map[string]*record)
+	ticker := time.NewTicker(min(segment.ActiveTimeout, segment.InactiveTimeout))
+	defer ticker.Stop()
 	for {
 		select {
 		case msg, ok := <-segment.In:
 			if !ok {
 				return
 			}
-			segment.cache.InsertFlow(msg)
-		case msg, ok := <-segment.cache.Flows:
-			if !ok {
-				return
-			}
-			segment.Out <- msg
+			segment.insert(msg, time.Now())
+		case now := <-ticker.C:
+			segment.export(func(r *record) bool {
+				return now.Sub(r.updated) >= segment.InactiveTimeout || now.Sub(r.created) >= segment.ActiveTimeout
+			})
+		}
+	}
+}
+
+func (segment *Aggregate) insert(msg *pb.EnrichedFlow, now time.Time) {
+	key := segment.keyFields.Key(msg)
+	if r, ok := segment.cache[key]; ok {
+		merge(r.flow, msg)
+		segments.Absorb(r.flow, msg) // acknowledged along with the aggregated flow
+		r.updated = now
+		return
+	}
+	segment.cache[key] = &record{flow: msg, created: now, updated: now}
+}
+
+// Emits and removes all aggregated flows matching the provided condition.
+func (segment *Aggregate) export(expired func(*record) bool) {
+	for key, r := range segment.cache {
+		if expired(r) {
+			delete(segment.cache, key)
+			segment.Out <- r.flow
 		}
 	}
 }
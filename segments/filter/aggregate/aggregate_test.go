@@ -0,0 +1,128 @@
+package aggregate
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BelWue/flowpipeline/pb"
+	"github.com/BelWue/flowpipeline/segments"
+)
+
+func startAggregate(t *testing.T, config map[string]string) (chan *pb.EnrichedFlow, chan *pb.EnrichedFlow, *sync.WaitGroup) {
+	t.Helper()
+	template, _ := segments.LookupSegment("aggregate")
+	segment, err := segments.NewSegment(template, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in, out := make(chan *pb.EnrichedFlow), make(chan *pb.EnrichedFlow)
+	segment.Rewire(in, out)
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go segment.Run(wg)
+	return in, out, wg
+}
+
+// Aggregate Segment test, merging flows and flushing them on shutdown
+func TestSegment_Aggregate_merge(t *testing.T) {
+	in, out, wg := startAggregate(t, map[string]string{"keys": "SrcPort,DstPort"})
+	in <- &pb.EnrichedFlow{SrcPort: 1, DstPort: 2, TimeFlowStart: 20, TimeFlowEnd: 30, Bytes: 10, Packets: 1, SamplingRate: 32, TcpFlags: 0b000010}
+	in <- &pb.EnrichedFlow{SrcPort: 3, DstPort: 2, TimeFlowStart: 10, TimeFlowEnd: 40, Bytes: 5, Packets: 1}
+	in <- &pb.EnrichedFlow{SrcPort: 1, DstPort: 2, TimeFlowStart: 10, TimeFlowEnd: 25, Bytes: 20, Packets: 2, SamplingRate: 32, TcpFlags: 0b010000}
+	close(in)
+
+	results := make(map[uint32]*pb.EnrichedFlow)
+	for msg := range out {
+		results[msg.SrcPort] = msg
+	}
+	wg.Wait()
+
+	if len(results) != 2 {
+		t.Fatalf("([error] Segment Aggregate emitted %d flows, should be 2.", len(results))
+	}
+	result := results[1]
+	if result.TimeFlowStart != 10 || result.TimeFlowEnd != 30 {
+		t.Errorf("([error] Segment Aggregate merged times to %d-%d, should be 10-30.", result.TimeFlowStart, result.TimeFlowEnd)
+	}
+	if result.Bytes != 30 || result.Packets != 3 || result.SamplingRate != 32 || result.Normalized != pb.EnrichedFlow_No {
+		t.Errorf("([error] Segment Aggregate merged counters incorrectly: %d bytes, %d packets.", result.Bytes, result.Packets)
+	}
+	if result.TcpFlags != 0b010010 {
+		t.Errorf("([error] Segment Aggregate merged TCP flags to %b, should be 10010.", result.TcpFlags)
+	}
+	if results[3].Bytes != 5 {
+		t.Errorf("([error] Segment Aggregate modified a flow aggregated alone.")
+	}
+}
+
+// Aggregate Segment test, normalizing flows sampled at different rates
+func TestSegment_Aggregate_samplingRate(t *testing.T) {
+	aggregated := &pb.EnrichedFlow{Bytes: 10, Packets: 1, SamplingRate: 32}
+	merge(aggregated, &pb.EnrichedFlow{Bytes: 10, Packets: 1, SamplingRate: 64})
+	merge(aggregated, &pb.EnrichedFlow{Bytes: 10, Packets: 1, SamplingRate: 0})
+	merge(aggregated, &pb.EnrichedFlow{Bytes: 100, Packets: 10, SamplingRate: 16, Normalized: pb.EnrichedFlow_Yes})
+	if aggregated.Bytes != 1070 || aggregated.Packets != 107 || aggregated.Normalized != pb.EnrichedFlow_Yes {
+		t.Errorf("([error] Segment Aggregate normalized counters incorrectly: %d bytes, %d packets.", aggregated.Bytes, aggregated.Packets)
+	}
+}
+
+// Aggregate Segment test, emitting flows after the inactive timeout
+func TestSegment_Aggregate_inactiveTimeout(t *testing.T) {
+	in, out, wg := startAggregate(t, map[string]string{"inactivetimeout": "10ms"})
+	in <- &pb.EnrichedFlow{Bytes: 1}
+	in <- &pb.EnrichedFlow{Bytes: 2}
+	select {
+	case msg := <-out:
+		if msg.Bytes != 3 {
+			t.Errorf("([error] Segment Aggregate emitted %d bytes, should be 3.", msg.Bytes)
+		}
+	case <-time.After(time.Second):
+		t.Error("([error] Segment Aggregate did not emit a flow after its inactive timeout.")
+	}
+	close(in)
+	for range out {
+		t.Error("([error] Segment Aggregate emitted a flow twice.")
+	}
+	wg.Wait()
+}
+
+// Aggregate Segment test, acknowledging merged flows along with the
+// aggregated flow
+func TestSegment_Aggregate_ack(t *testing.T) {
+	var done [2]bool
+	flows := []*pb.EnrichedFlow{{Bytes: 1}, {Bytes: 2}}
+	for i, msg := range flows {
+		segments.Track(msg, func() { done[i] = true })
+	}
+	in, out, wg := startAggregate(t, map[string]string{})
+	for _, msg := range flows {
+		in <- msg
+	}
+	close(in)
+	aggregated := <-out
+	wg.Wait()
+
+	if done[0] || done[1] {
+		t.Fatal("([error] Segment Aggregate acknowledged flows before the aggregated flow.")
+	}
+	segments.Ack(aggregated)
+	if !done[0] || !done[1] {
+		t.Error("([error] Segment Aggregate did not acknowledge flows along with the aggregated flow.")
+	}
+}
+
+// Aggregate Segment test, rejecting invalid configurations
+func TestSegment_Aggregate_invalidConfig(t *testing.T) {
+	for _, config := range []map[string]string{
+		{"keys": "SrcAddr,Foo"},
+		{"keys": "BgpCommunities"},
+		{"activetimeout": "-1s"},
+		{"inactivetimeout": "soon"},
+	} {
+		template, _ := segments.LookupSegment("aggregate")
+		if _, err := segments.NewSegment(template, config); err == nil {
+			t.Errorf("([error] Segment Aggregate accepted invalid config %v.", config)
+		}
+	}
+}
@@ -12,7 +12,6 @@ import (
 	"github.com/BelWue/flowpipeline/pb"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"google.golang.org/protobuf/proto"
 )
 
 type FlowKey struct {
@@ -25,18 +24,6 @@ type FlowKey struct {
 	InIface uint32
 }
 
-func NewFlowKeyFromFlow(flow *pb.EnrichedFlow) FlowKey {
-	return FlowKey{
-		SrcAddr: flow.SrcAddrObj().String(),
-		DstAddr: flow.DstAddrObj().String(),
-		SrcPort: uint16(flow.SrcPort),
-		DstPort: uint16(flow.DstPort),
-		Proto:   flow.Proto,
-		IPTos:   uint8(flow.IpTos),
-		InIface: flow.InIf,
-	}
-}
-
 func NewFlowKey(packet gopacket.Packet) FlowKey {
 	fkey := FlowKey{}
 	fkey.InIface = uint32(packet.Metadata().InterfaceIndex)
@@ -73,7 +60,6 @@ type FlowRecord struct {
 	SamplerAddress  net.IP
 	HardwareAddress net.HardwareAddr
 	Packets         []gopacket.Packet
-	Flows           []*pb.EnrichedFlow
 }
 
 func BuildFlow(f *FlowRecord) *pb.EnrichedFlow {
@@ -155,16 +141,6 @@ func BuildFlow(f *FlowRecord) *pb.EnrichedFlow {
 		msg.Bytes += uint64(pkt.Metadata().Length)
 		msg.Packets += 1
 	}
-	for _, flow := range f.Flows {
-		proto.Merge(msg, flow)
-		// TODO: how to do this without custom behaviour for each field?
-		// TimeFlowStart: use earlier
-		// TimeFlowEnd: use later
-		// TimeReceived: use earlier
-		// Bytes: add, considering sampling rate
-		// Packets: add, considering sampling rate
-		// copy the rest?
-	}
 	return msg
 }
 
@@ -283,23 +259,6 @@ func (f *FlowExporter) Insert(pkt gopacket.Packet) {
 	f.mutex.Unlock()
 }
 
-func (f *FlowExporter) InsertFlow(flow *pb.EnrichedFlow) {
-	key := NewFlowKeyFromFlow(flow)
-
-	var record *FlowRecord
-	var exists bool
-
-	f.mutex.Lock()
-	if record, exists = f.cache[key]; !exists {
-		f.cache[key] = new(FlowRecord)
-		f.cache[key].TimeReceived = time.Unix(int64(flow.TimeFlowStart), 0)
-		record = f.cache[key]
-	}
-	record.LastUpdated = time.Unix(int64(flow.TimeFlowEnd), 0)
-	record.SamplerAddress = f.samplerAddress
-	record.Flows = append(record.Flows, flow)
-}
-
 func (f *FlowExporter) ConsumeFrom(pkts chan gopacket.Packet) {
 	for {
 		select {
@@ -0,0 +1,26 @@
+package aggregate
+
+import (
+	"github.com/BelWue/flowpipeline/pb"
+	"github.com/BelWue/flowpipeline/segments/internal/flowmerge"
+)
+
+// The fields flows are aggregated by if no keys are configured.
+var DefaultKeys = []string{"SrcAddr", "DstAddr", "SrcPort", "DstPort", "Proto", "IpTos", "InIf"}
+
+// Merges a flow into an aggregated flow. The aggregated flow covers the time
+// from the earliest start to the latest end of both, its counters are summed
+// and its TCP flags are combined. All other fields are kept as they were in
+// the first flow aggregated. Counters of flows sampled at different rates are
+// normalized, see flowmerge.AlignCounters.
+func merge(aggregated *pb.EnrichedFlow, flow *pb.EnrichedFlow) {
+	aggregated.TimeReceived = flowmerge.Earliest(aggregated.TimeReceived, flow.TimeReceived)
+	aggregated.TimeReceivedNs = flowmerge.Earliest(aggregated.TimeReceivedNs, flow.TimeReceivedNs)
+	flowmerge.ExtendTimes(aggregated, flow)
+
+	samplingRate := flowmerge.AlignCounters(aggregated, flow)
+	aggregated.Bytes += flow.Bytes * samplingRate
+	aggregated.Packets += flow.Packets * samplingRate
+
+	aggregated.TcpFlags |= flow.TcpFlags
+}
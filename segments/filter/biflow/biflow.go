@@ -0,0 +1,222 @@
+// The `biflow` segment stitches the flows of both directions of a connection
+// into a single bidirectional flow. Flows are matched with a flow in the
+// opposite direction by their addresses, ports, protocol and `SamplerAddress`,
+// and additionally by their VRFs if `vrf` is set. Flows not matched within the
+// `window` (default 30s) are emitted unchanged as unidirectional flows, as are
+// all pending flows when the pipeline is shut down.
+//
+// A biflow is based on the flow sent by the initiator of the connection, which
+// is marked by setting `BiFlowDirection` to 1. The counters of the responder's
+// flow are stored in `ReverseBytes` and `ReversePackets`, and the biflow spans
+// from the earliest start to the latest end of both flows. The initiator is
+// the side sending the only flow with a SYN flag, if any, or the side using
+// the higher port otherwise, as ephemeral ports are above service ports.
+// Failing both, the earlier flow is considered the initiator's.
+package biflow
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/BelWue/flowpipeline/pb"
+	"github.com/BelWue/flowpipeline/segments"
+	"github.com/BelWue/flowpipeline/segments/internal/flowmerge"
+)
+
+// The BiFlowDirection of biflows, as defined by IPFIX.
+const biflowDirectionInitiator = 1
+
+const tcpFlagSYN = 0b000010
+
+type Biflow struct {
+	segments.BaseSegment
+	Window time.Duration // optional, default is 30s, the time to wait for the flow in the opposite direction
+	Vrf    bool          // optional, default is false, whether to match flows by their VRFs as well
+
+	pending map[flowKey][]*pendingFlow
+}
+
+// Identifies the flows of both directions of a connection. The endpoints are
+// ordered, such that the key of a flow and its reverse flow are equal.
+type flowKey struct {
+	samplerAddress string
+	lowAddr        string
+	highAddr       string
+	lowPort        uint32
+	highPort       uint32
+	lowVrf         uint32 // the VRF of the endpoint with the lower address
+	highVrf        uint32
+	proto          uint32
+}
+
+// A flow waiting for its reverse flow.
+type pendingFlow struct {
+	flow    *pb.EnrichedFlow
+	fromLow bool // whether the flow was sent by the endpoint with the lower address
+	arrival time.Time
+}
+
+func (segment Biflow) New(config map[string]string) segments.Segment {
+	newSegment, err := segment.NewWithError(config)
+	if err != nil {
+		log.Error().Err(err).Msg("Biflow: ")
+		return nil
+	}
+	return newSegment
+}
+
+func (segment Biflow) NewWithError(config map[string]string) (segments.Segment, error) {
+	window := 30 * time.Second
+	if config["window"] != "" {
+		var err error
+		if window, err = time.ParseDuration(config["window"]); err != nil {
+			return nil, fmt.Errorf("could not parse 'window' parameter: %w", err)
+		}
+		if window <= 0 {
+			return nil, errors.New("window has to be >0")
+		}
+	} else {
+		log.Info().Msg("Biflow: 'window' set to default 30s.")
+	}
+
+	var vrf bool
+	if config["vrf"] != "" {
+		var err error
+		if vrf, err = strconv.ParseBool(config["vrf"]); err != nil {
+			return nil, fmt.Errorf("could not parse 'vrf' parameter: %w", err)
+		}
+	}
+
+	return &Biflow{
+		Window: window,
+		Vrf:    vrf,
+	}, nil
+}
+
+func (segment *Biflow) Run(wg *sync.WaitGroup) {
+	defer func() {
+		segment.expire(func(*pendingFlow) bool { return true })
+		close(segment.Out)
+		wg.Done()
+	}()
+
+	segment.pending = make(map[flowKey][]*pendingFlow)
+	ticker := time.NewTicker(segment.Window)
+	defer ticker.Stop()
+	for {
+		select {
+		case msg, ok := <-segment.In:
+			if !ok {
+				return
+			}
+			segment.match(msg, time.Now())
+		case now := <-ticker.C:
+			segment.expire(func(p *pendingFlow) bool {
+				return now.Sub(p.arrival) >= segment.Window
+			})
+		}
+	}
+}
+
+// Returns the key of a flow, and whether it was sent by the endpoint with the
+// lower address.
+func (segment *Biflow) key(msg *pb.EnrichedFlow) (flowKey, bool) {
+	key := flowKey{samplerAddress: string(msg.SamplerAddress), proto: msg.Proto}
+	fromLow := true
+	if order := bytes.Compare(msg.SrcAddr, msg.DstAddr); order > 0 || order == 0 && msg.SrcPort > msg.DstPort {
+		fromLow = false
+	}
+	srcVrf, dstVrf := uint32(0), uint32(0)
+	if segment.Vrf {
+		srcVrf, dstVrf = msg.IngressVrfId, msg.EgressVrfId
+	}
+	if fromLow {
+		key.lowAddr, key.lowPort, key.lowVrf = string(msg.SrcAddr), msg.SrcPort, srcVrf
+		key.highAddr, key.highPort, key.highVrf = string(msg.DstAddr), msg.DstPort, dstVrf
+	} else {
+		key.lowAddr, key.lowPort, key.lowVrf = string(msg.DstAddr), msg.DstPort, dstVrf
+		key.highAddr, key.highPort, key.highVrf = string(msg.SrcAddr), msg.SrcPort, srcVrf
+	}
+	return key, fromLow
+}
+
+// Emits a biflow if a flow in the opposite direction is pending, or adds the
+// flow to the pending flows otherwise.
+func (segment *Biflow) match(msg *pb.EnrichedFlow, now time.Time) {
+	key, fromLow := segment.key(msg)
+	queue := segment.pending[key]
+	for i, p := range queue {
+		if p.fromLow == fromLow {
+			continue
+		}
+		if len(queue) == 1 {
+			delete(segment.pending, key)
+		} else {
+			segment.pending[key] = append(queue[:i:i], queue[i+1:]...)
+		}
+		segment.Out <- stitch(p.flow, msg)
+		return
+	}
+	segment.pending[key] = append(queue, &pendingFlow{flow: msg, fromLow: fromLow, arrival: now})
+}
+
+// Emits and removes all pending flows matching the provided condition as
+// unidirectional flows.
+func (segment *Biflow) expire(expired func(*pendingFlow) bool) {
+	for key, queue := range segment.pending {
+		var remaining []*pendingFlow
+		for _, p := range queue {
+			if expired(p) {
+				segment.Out <- p.flow
+			} else {
+				remaining = append(remaining, p)
+			}
+		}
+		if len(remaining) == 0 {
+			delete(segment.pending, key)
+		} else {
+			segment.pending[key] = remaining
+		}
+	}
+}
+
+// Merges two flows of opposite directions into a biflow based on the flow
+// of the initiator. The other flow is acknowledged along with the biflow.
+func stitch(earlier *pb.EnrichedFlow, later *pb.EnrichedFlow) *pb.EnrichedFlow {
+	forward, reverse := earlier, later
+	if isInitiator(later, earlier) {
+		forward, reverse = later, earlier
+	}
+
+	samplingRate := flowmerge.AlignCounters(forward, reverse)
+	forward.ReverseBytes = reverse.Bytes * samplingRate
+	forward.ReversePackets = reverse.Packets * samplingRate
+	flowmerge.ExtendTimes(forward, reverse)
+	forward.BiFlowDirection = biflowDirectionInitiator
+
+	segments.Absorb(forward, reverse) // its counters live on in the biflow
+	return forward
+}
+
+// Reports whether a flow, rather than its reverse flow, was sent by the
+// initiator of the connection.
+func isInitiator(flow *pb.EnrichedFlow, reverse *pb.EnrichedFlow) bool {
+	if flow.Proto == 6 {
+		syn, reverseSyn := flow.TcpFlags&tcpFlagSYN != 0, reverse.TcpFlags&tcpFlagSYN != 0
+		if syn != reverseSyn {
+			return syn
+		}
+	}
+	return flow.SrcPort > flow.DstPort
+}
+
+func init() {
+	segment := &Biflow{}
+	segments.RegisterSegment("biflow", segment)
+}
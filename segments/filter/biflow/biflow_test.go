@@ -0,0 +1,122 @@
+package biflow
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BelWue/flowpipeline/pb"
+	"github.com/BelWue/flowpipeline/segments"
+)
+
+var (
+	client = net.ParseIP("192.0.2.10").To4()
+	server = net.ParseIP("192.0.2.1").To4()
+)
+
+func startBiflow(t *testing.T, config map[string]string) (chan *pb.EnrichedFlow, chan *pb.EnrichedFlow, *sync.WaitGroup) {
+	t.Helper()
+	template, _ := segments.LookupSegment("biflow")
+	segment, err := segments.NewSegment(template, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in, out := make(chan *pb.EnrichedFlow), make(chan *pb.EnrichedFlow)
+	segment.Rewire(in, out)
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go segment.Run(wg)
+	return in, out, wg
+}
+
+// Biflow Segment test, stitching a response with its earlier request
+func TestSegment_Biflow_stitch(t *testing.T) {
+	in, out, wg := startBiflow(t, map[string]string{})
+	in <- &pb.EnrichedFlow{SrcAddr: server, DstAddr: client, SrcPort: 443, DstPort: 51234, Proto: 6, TcpFlags: 0b010010, Bytes: 5000, Packets: 5, TimeFlowStart: 11, TimeFlowEnd: 20}
+	in <- &pb.EnrichedFlow{SrcAddr: client, DstAddr: server, SrcPort: 51234, DstPort: 443, Proto: 6, TcpFlags: 0b010010, Bytes: 400, Packets: 4, TimeFlowStart: 10, TimeFlowEnd: 19}
+	result := <-out
+	close(in)
+	for range out {
+		t.Error("([error] Segment Biflow emitted a stitched flow separately.")
+	}
+	wg.Wait()
+
+	if !result.SrcAddrObj().Equal(client) || result.SrcPort != 51234 || result.BiFlowDirection != 1 {
+		t.Errorf("([error] Segment Biflow did not mark the client as initiator: %s:%d.", result.SrcAddrObj(), result.SrcPort)
+	}
+	if result.Bytes != 400 || result.Packets != 4 || result.ReverseBytes != 5000 || result.ReversePackets != 5 {
+		t.Errorf("([error] Segment Biflow stitched counters incorrectly.")
+	}
+	if result.TimeFlowStart != 10 || result.TimeFlowEnd != 20 {
+		t.Errorf("([error] Segment Biflow stitched times to %d-%d, should be 10-20.", result.TimeFlowStart, result.TimeFlowEnd)
+	}
+}
+
+// Biflow Segment test, acknowledging the reverse flow along with the biflow
+func TestSegment_Biflow_ack(t *testing.T) {
+	var done [2]bool
+	flows := []*pb.EnrichedFlow{
+		{SrcAddr: client, DstAddr: server, SrcPort: 51234, DstPort: 443, Proto: 6},
+		{SrcAddr: server, DstAddr: client, SrcPort: 443, DstPort: 51234, Proto: 6},
+	}
+	for i, msg := range flows {
+		segments.Track(msg, func() { done[i] = true })
+	}
+	in, out, wg := startBiflow(t, map[string]string{})
+	for _, msg := range flows {
+		in <- msg
+	}
+	result := <-out
+	close(in)
+	for range out {
+	}
+	wg.Wait()
+
+	if done[0] || done[1] {
+		t.Fatal("([error] Segment Biflow acknowledged flows before the biflow.")
+	}
+	segments.Ack(result)
+	if !done[0] || !done[1] {
+		t.Error("([error] Segment Biflow did not acknowledge both flows along with the biflow.")
+	}
+}
+
+// Biflow Segment test, preferring the SYN flag over ports
+func TestSegment_Biflow_syn(t *testing.T) {
+	request := &pb.EnrichedFlow{SrcAddr: client, DstAddr: server, SrcPort: 22, DstPort: 8080, Proto: 6, TcpFlags: 0b000010}
+	response := &pb.EnrichedFlow{SrcAddr: server, DstAddr: client, SrcPort: 8080, DstPort: 22, Proto: 6, TcpFlags: 0b010000}
+	if result := stitch(response, request); result != request {
+		t.Error("([error] Segment Biflow did not consider the SYN flag.")
+	}
+}
+
+// Biflow Segment test, not matching flows from different samplers or VRFs
+func TestSegment_Biflow_unmatched(t *testing.T) {
+	in, out, wg := startBiflow(t, map[string]string{"window": "10ms", "vrf": "true"})
+	in <- &pb.EnrichedFlow{SrcAddr: client, DstAddr: server, SrcPort: 51234, DstPort: 443, Proto: 6, IngressVrfId: 1}
+	in <- &pb.EnrichedFlow{SrcAddr: server, DstAddr: client, SrcPort: 443, DstPort: 51234, Proto: 6, EgressVrfId: 2}
+	in <- &pb.EnrichedFlow{SrcAddr: server, DstAddr: client, SrcPort: 443, DstPort: 51234, Proto: 6, SamplerAddress: server, EgressVrfId: 1}
+	for range 3 {
+		select {
+		case msg := <-out:
+			if msg.BiFlowDirection != 0 || msg.ReverseBytes != 0 {
+				t.Error("([error] Segment Biflow stitched unrelated flows.")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("([error] Segment Biflow did not emit unmatched flows after its window.")
+		}
+	}
+	close(in)
+	wg.Wait()
+}
+
+// Biflow Segment test, normalizing flows sampled at different rates
+func TestSegment_Biflow_samplingRate(t *testing.T) {
+	request := &pb.EnrichedFlow{SrcPort: 51234, DstPort: 443, Bytes: 10, Packets: 1, SamplingRate: 32}
+	response := &pb.EnrichedFlow{SrcPort: 443, DstPort: 51234, Bytes: 20, Packets: 2, SamplingRate: 64}
+	result := stitch(request, response)
+	if result.Bytes != 320 || result.Packets != 32 || result.ReverseBytes != 1280 || result.ReversePackets != 128 || result.Normalized != pb.EnrichedFlow_Yes {
+		t.Errorf("([error] Segment Biflow normalized counters incorrectly.")
+	}
+}
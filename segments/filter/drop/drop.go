@@ -12,6 +12,17 @@ type Drop struct {
 	segments.BaseFilterSegment
 }
 
+// Options of the drop segment for use with the builder package.
+type Options struct{}
+
+func (options Options) SegmentName() string {
+	return "drop"
+}
+
+func (options Options) SegmentConfig() map[string]string {
+	return map[string]string{}
+}
+
 func (segment Drop) New(config map[string]string) segments.Segment {
 	return &Drop{}
 }
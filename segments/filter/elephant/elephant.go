@@ -8,15 +8,25 @@
 // it can be useful to adjust the window size (in seconds).
 // The ramp up time defults to 0 (disabled), but can be configured to wait for analyzing
 // flows. All flows within this Timerange are dropped after the start of the pipeline.
+//
+// By default, the window is made up of the flows which arrived at this segment
+// in the last seconds. Setting `time` to `event` uses the flows which ended in
+// the window before the latest flow end seen instead, which is more accurate
+// for exporters with a delay or for flows replayed from a file. Flows ending
+// more than `lateness` (default 2m) before that are not added to the window,
+// but are still compared to it.
 package elephant
 
 import (
+	"errors"
+	"fmt"
 	"math"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/BelWue/flowpipeline/pipeline/window"
 	"github.com/BelWue/flowpipeline/segments"
 	"github.com/rs/zerolog/log"
 
@@ -28,18 +38,29 @@ type Elephant struct {
 	Aspect     string  // optional, one of "bytes", "bps", "packets", or "pps", default is "bytes", determines which aspect qualifies a flow as an elephant
 	Percentile float64 // optional, default is 99.00, determines the cutoff percentile for flows being dropped by this segment, i.e. 95.00 corresponds to outputting the top 5% only
 	// TODO: add option to get bottom percent?
-	Exact      bool // optional, default is false, determines whether to use percentiles that are exact or generated using the P-square estimation algorithm
-	Window     int  // optional, default is 300, sets the number of seconds used as a sliding window size
-	RampupTime int  // optional, default is 0, sets the time to wait for analyzing flows. All flows within this Timerange are dropped.
+	Exact      bool          // optional, default is false, determines whether to use percentiles that are exact or generated using the P-square estimation algorithm
+	Window     int           // optional, default is 300, sets the number of seconds used as a sliding window size
+	RampupTime int           // optional, default is 0, sets the time to wait for analyzing flows. All flows within this Timerange are dropped.
+	Time       window.Mode   // optional, default is processing time, whether flows are added to the window at their arrival or at their own timestamps
+	Lateness   time.Duration // optional, default is 2m, the time flows are added to the window after their end in event time
 }
 
 func (segment Elephant) New(config map[string]string) segments.Segment {
+	newSegment, err := segment.NewWithError(config)
+	if err != nil {
+		log.Error().Err(err).Msg("Elephant: ")
+		return nil
+	}
+	return newSegment
+}
+
+func (segment Elephant) NewWithError(config map[string]string) (segments.Segment, error) {
 	var aspect = "bytes"
 	if config["aspect"] != "" {
 		if strings.ToLower(config["aspect"]) == "bytes" || strings.ToLower(config["aspect"]) == "packets" || strings.ToLower(config["aspect"]) == "bps" || strings.ToLower(config["aspect"]) == "pps" {
 			aspect = strings.ToLower(config["aspect"])
 		} else {
-			log.Error().Msg("Elephant: Could not parse 'aspect' parameter, using default 'bytes'.")
+			return nil, fmt.Errorf("could not parse 'aspect' parameter '%s', use one of 'bytes', 'bps', 'packets' or 'pps'", config["aspect"])
 		}
 	} else {
 		log.Info().Msg("Elephant: 'aspect' set to default 'bytes'.")
@@ -50,11 +71,10 @@ func (segment Elephant) New(config map[string]string) segments.Segment {
 		if parsedPercentile, err := strconv.ParseFloat(config["percentile"], 64); err == nil {
 			percentile = parsedPercentile
 			if percentile == 0 {
-				log.Error().Msg("Elephant: Using 0-Percentile corresponds to no-op. Remove this segment or use a higher value.")
-				return nil
+				return nil, errors.New("using 0-Percentile corresponds to no-op, remove this segment or use a higher value")
 			}
 		} else {
-			log.Error().Msg("Elephant: Could not parse 'percentile' parameter, using default 99.00.")
+			return nil, fmt.Errorf("could not parse 'percentile' parameter: %w", err)
 		}
 	} else {
 		log.Info().Msg("Elephant: 'percentile' set to default 99.00.")
@@ -65,26 +85,24 @@ func (segment Elephant) New(config map[string]string) segments.Segment {
 		if parsedExact, err := strconv.ParseBool(config["exact"]); err == nil {
 			exact = parsedExact
 		} else {
-			log.Error().Msg("Elephant: Could not parse 'exact' parameter, using default false.")
+			return nil, fmt.Errorf("could not parse 'exact' parameter: %w", err)
 		}
 	} else {
 		log.Info().Msg("Elephant: 'exact' set to default false.")
 	}
 
-	var window = 300
+	var windowSize = 300
 	if config["window"] != "" {
 		if parsedWindow, err := strconv.ParseInt(config["window"], 10, 64); err == nil {
 			if parsedWindow <= 0 {
-				log.Error().Msg("Elephant: Window has to be >0.")
-				return nil
+				return nil, errors.New("window has to be >0")
 			}
 			if parsedWindow > math.MaxInt {
-				log.Error().Msg("Elephant: Window out of range.")
-				return nil
+				return nil, errors.New("window out of range")
 			}
-			window = int(parsedWindow)
+			windowSize = int(parsedWindow)
 		} else {
-			log.Error().Msg("Elephant: Could not parse 'window' parameter, using default 300.")
+			return nil, fmt.Errorf("could not parse 'window' parameter: %w", err)
 		}
 	} else {
 		log.Info().Msg("Elephant: 'window' set to default 300.")
@@ -94,28 +112,48 @@ func (segment Elephant) New(config map[string]string) segments.Segment {
 	if config["rampuptime"] != "" {
 		if ramptime, err := strconv.ParseInt(config["rampuptime"], 10, 64); err == nil {
 			if ramptime < 0 {
-				log.Error().Msg("Elephant: Rampuptime has to be >= 0.")
-				return nil
+				return nil, errors.New("rampuptime has to be >= 0")
 			}
 			if ramptime > math.MaxInt {
-				log.Error().Msg("Elephant: Rampuptime out of range.")
-				return nil
+				return nil, errors.New("rampuptime out of range")
 			}
 			rampuptime = int(ramptime)
 		} else {
-			log.Error().Msg("Elephant: Could not parse 'rampuptime' parameter, using default 0.")
+			return nil, fmt.Errorf("could not parse 'rampuptime' parameter: %w", err)
 		}
 	} else {
 		log.Info().Msg("Elephant: 'rampuptime' set to default 0.")
 	}
 
+	mode, err := window.ParseMode(config["time"])
+	if err != nil {
+		return nil, fmt.Errorf("could not parse 'time' parameter: %w", err)
+	}
+	if config["time"] == "" {
+		log.Info().Msg("Elephant: 'time' set to default 'processing'.")
+	}
+
+	var lateness = 2 * time.Minute
+	if config["lateness"] != "" {
+		if lateness, err = time.ParseDuration(config["lateness"]); err != nil {
+			return nil, fmt.Errorf("could not parse 'lateness' parameter: %w", err)
+		}
+		if lateness < 0 {
+			return nil, errors.New("lateness has to be >=0")
+		}
+	} else if mode == window.EventTime {
+		log.Info().Msg("Elephant: 'lateness' set to default 2m.")
+	}
+
 	return &Elephant{
 		Aspect:     aspect,
 		Percentile: percentile,
 		Exact:      exact,
-		Window:     window,
+		Window:     windowSize,
 		RampupTime: rampuptime,
-	}
+		Time:       mode,
+		Lateness:   lateness,
+	}, nil
 }
 
 func (segment *Elephant) Run(wg *sync.WaitGroup) {
@@ -130,7 +168,9 @@ func (segment *Elephant) Run(wg *sync.WaitGroup) {
 		inRampup = true
 		rampupEnd = time.Now().Add(time.Duration(segment.RampupTime) * time.Second)
 	}
-	var window = rolling.NewTimePolicy(rolling.NewWindow(segment.Window), time.Second)
+	clock := window.NewClock(segment.Time, time.Second, segment.Lateness)
+	buckets := window.NewRing[[]float64](segment.Window + clock.Open())
+	values := rolling.NewWindow(segment.Window)
 	for msg := range segment.In {
 		// always determine a flow's aspect to append to the window
 		var aspect float64
@@ -152,7 +192,11 @@ func (segment *Elephant) Run(wg *sync.WaitGroup) {
 		case "packets":
 			aspect = float64(msg.Packets)
 		}
-		window.Append(aspect)
+		if bucket, open := clock.Bucket(msg); open {
+			if bucketValues := buckets.At(bucket); bucketValues != nil {
+				*bucketValues = append(*bucketValues, aspect)
+			}
+		}
 
 		// Check if ramp up phase is over. Shortcircuiting avoids
 		// permanent checks against time.Now().
@@ -166,11 +210,16 @@ func (segment *Elephant) Run(wg *sync.WaitGroup) {
 		// else with the previous if to ensure the first flow after
 		// rampupEnd is considered.
 		if !inRampup {
+			current := clock.Current()
+			values = values[:0]
+			for bucket := range buckets.Range(current-int64(segment.Window)+1, current+1) {
+				values = append(values, *bucket)
+			}
 			var threshold float64
 			if segment.Exact {
-				threshold = window.Reduce(rolling.Percentile(segment.Percentile))
+				threshold = rolling.Percentile(segment.Percentile)(values)
 			} else {
-				threshold = window.Reduce(rolling.FastPercentile(segment.Percentile))
+				threshold = rolling.FastPercentile(segment.Percentile)(values)
 			}
 			if aspect >= threshold {
 				log.Debug().Msgf("Elephant: Found elephant with size %d (>=%f)", msg.Bytes, threshold)
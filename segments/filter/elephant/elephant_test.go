@@ -14,9 +14,10 @@ import (
 
 // Elephant Segment test, passthrough test
 func TestSegment_Elephant_passthrough(t *testing.T) {
-	segment := segments.LookupSegment("elephant").New(map[string]string{})
-	if segment == nil {
-		log.Fatal().Msg("Configured segment 'elephant' could not be initialized properly, see previous messages.")
+	template, _ := segments.LookupSegment("elephant")
+	segment, err := segments.NewSegment(template, map[string]string{})
+	if err != nil {
+		log.Fatal().Err(err).Msg("Configured segment 'elephant' could not be initialized properly: ")
 	}
 
 	in, out := make(chan *pb.EnrichedFlow), make(chan *pb.EnrichedFlow)
@@ -38,6 +39,34 @@ func TestSegment_Elephant_passthrough(t *testing.T) {
 	wg.Wait()
 }
 
+// Elephant Segment test, windowing flows by their own timestamps
+func TestSegment_Elephant_eventTime(t *testing.T) {
+	template, _ := segments.LookupSegment("elephant")
+	segment, err := segments.NewSegment(template, map[string]string{"window": "10", "percentile": "99.9", "exact": "true", "time": "event"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in, out := make(chan *pb.EnrichedFlow), make(chan *pb.EnrichedFlow)
+	segment.Rewire(in, out)
+
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go segment.Run(wg)
+
+	in <- &pb.EnrichedFlow{Bytes: 100, TimeFlowEnd: 1000}
+	<-out
+	in <- &pb.EnrichedFlow{Bytes: 50, TimeFlowEnd: 1005}
+	// the first flow has left the window by now
+	in <- &pb.EnrichedFlow{Bytes: 60, TimeFlowEnd: 1020}
+	result := <-out
+	if result.Bytes != 60 {
+		t.Error("([error] Segment Elephant did not window flows by their timestamps.")
+	}
+	close(in)
+	wg.Wait()
+}
+
 // Elephant Segment benchmark passthrough
 func BenchmarkElephant(b *testing.B) {
 	zerolog.SetGlobalLevel(zerolog.Disabled)
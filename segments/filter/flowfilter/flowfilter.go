@@ -4,6 +4,7 @@
 package flowfilter
 
 import (
+	"fmt"
 	"sync"
 
 	"github.com/rs/zerolog/log"
@@ -20,7 +21,29 @@ type FlowFilter struct {
 	expression *parser.Expression
 }
 
+// Options of the flowfilter segment for use with the builder package.
+type Options struct {
+	Filter string // optional, default is empty
+}
+
+func (options Options) SegmentName() string {
+	return "flowfilter"
+}
+
+func (options Options) SegmentConfig() map[string]string {
+	return map[string]string{"filter": options.Filter}
+}
+
 func (segment FlowFilter) New(config map[string]string) segments.Segment {
+	newSegment, err := segment.NewWithError(config)
+	if err != nil {
+		log.Error().Err(err).Msg("FlowFilter: ")
+		return nil
+	}
+	return newSegment
+}
+
+func (segment FlowFilter) NewWithError(config map[string]string) (segments.Segment, error) {
 	var err error
 
 	newSegment := &FlowFilter{
@@ -29,15 +52,13 @@ func (segment FlowFilter) New(config map[string]string) segments.Segment {
 
 	newSegment.expression, err = parser.Parse(config["filter"])
 	if err != nil {
-		log.Error().Err(err).Msg("FlowFilter: Syntax error in filter expression: ")
-		return nil
+		return nil, fmt.Errorf("syntax error in filter expression: %w", err)
 	}
 	filter := &Filter{}
 	if _, err := filter.CheckFlow(newSegment.expression, &pb.EnrichedFlow{}); err != nil {
-		log.Error().Err(err).Msg("FlowFilter: Semantic error in filter expression: ")
-		return nil
+		return nil, fmt.Errorf("semantic error in filter expression: %w", err)
 	}
-	return newSegment
+	return newSegment, nil
 }
 
 func (segment *FlowFilter) Run(wg *sync.WaitGroup) {
@@ -58,6 +79,30 @@ func (segment *FlowFilter) Run(wg *sync.WaitGroup) {
 	}
 }
 
+func (segment *FlowFilter) RunBatches(in <-chan []*pb.EnrichedFlow, out chan<- []*pb.EnrichedFlow, wg *sync.WaitGroup) {
+	defer func() {
+		close(out)
+		wg.Done()
+	}()
+
+	log.Info().Msgf("FlowFilter: Using filter expression: %s", segment.Filter)
+
+	filter := &Filter{}
+	for batch := range in {
+		kept := batch[:0] // filter in place
+		for _, msg := range batch {
+			if match, _ := filter.CheckFlow(segment.expression, msg); match {
+				kept = append(kept, msg)
+			} else if segment.Drops != nil {
+				segment.Drops <- msg
+			}
+		}
+		if len(kept) > 0 {
+			out <- kept
+		}
+	}
+}
+
 func init() {
 	segment := &FlowFilter{}
 	segments.RegisterSegment("flowfilter", segment)
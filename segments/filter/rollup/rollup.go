@@ -0,0 +1,243 @@
+// The `rollup` segment summarizes flows in tumbling time windows, similar to
+// `nfdump -A`, for instance to store traffic statistics instead of raw flows.
+// Flows are grouped by the start of their time window, which is aligned to the
+// `window` length (default 1m), and by the flow fields listed in `keys`, such
+// as `SrcAs,DstAs,Proto,DstPort,NetId`.
+//
+// For each key and window, a single summary flow is emitted. It contains the
+// key fields, the summed `Bytes` and `Packets`, the number of flows summarized
+// in `FlowCount` and the earliest start, latest end and earliest reception of
+// these flows. The counters are normalized just like the `normalize` segment
+// does and marked as `Normalized`, as flows with different sampling rates may
+// be summarized together. All other fields are empty.
+//
+// A window is emitted once flows `lateness` (default 1m) past its end have
+// been seen, or at the latest after the window length and the lateness have
+// passed since its first flow arrived. Flows arriving even later are summarized
+// separately and emitted with the next check, so the summaries of a window
+// still add up correctly. To cap memory usage, the oldest window is emitted
+// early if more than `maxentries` (default 100000) summaries are kept. All
+// remaining summaries are emitted when the pipeline is shut down.
+package rollup
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/BelWue/flowpipeline/pb"
+	"github.com/BelWue/flowpipeline/pipeline/flowkey"
+	"github.com/BelWue/flowpipeline/segments"
+	"github.com/BelWue/flowpipeline/segments/internal/flowmerge"
+)
+
+type Rollup struct {
+	segments.BaseSegment
+	Keys       []string      // required, the fields to group flows by
+	Window     time.Duration // optional, default is 1m, the length of the time windows
+	Lateness   time.Duration // optional, default is 1m, the time flows are waited for after the end of their window
+	MaxEntries int           // optional, default is 100000, the number of summaries after which the oldest window is emitted early
+
+	keyFields *flowkey.Fields
+	windows   map[int64]*window // by their start in nanoseconds
+	entries   int               // the number of summaries in all windows
+	watermark int64             // the latest flow time seen in nanoseconds
+}
+
+// The summaries of a time window.
+type window struct {
+	start     int64     // in nanoseconds
+	opened    time.Time // when the first flow arrived
+	summaries map[string]*pb.EnrichedFlow
+}
+
+func (segment Rollup) New(config map[string]string) segments.Segment {
+	newSegment, err := segment.NewWithError(config)
+	if err != nil {
+		log.Error().Err(err).Msg("Rollup: ")
+		return nil
+	}
+	return newSegment
+}
+
+func (segment Rollup) NewWithError(config map[string]string) (segments.Segment, error) {
+	keys := strings.FieldsFunc(config["keys"], func(r rune) bool {
+		return r == ',' || r == ' '
+	})
+	keyFields, err := flowkey.NewFields(keys)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse 'keys' parameter: %w", err)
+	}
+
+	windowLength := time.Minute
+	if config["window"] != "" {
+		if windowLength, err = time.ParseDuration(config["window"]); err != nil {
+			return nil, fmt.Errorf("could not parse 'window' parameter: %w", err)
+		}
+		if windowLength <= 0 {
+			return nil, errors.New("window has to be >0")
+		}
+	} else {
+		log.Info().Msg("Rollup: 'window' set to default 1m.")
+	}
+
+	lateness := time.Minute
+	if config["lateness"] != "" {
+		if lateness, err = time.ParseDuration(config["lateness"]); err != nil {
+			return nil, fmt.Errorf("could not parse 'lateness' parameter: %w", err)
+		}
+		if lateness < 0 {
+			return nil, errors.New("lateness has to be >=0")
+		}
+	} else {
+		log.Info().Msg("Rollup: 'lateness' set to default 1m.")
+	}
+
+	maxEntries := 100000
+	if config["maxentries"] != "" {
+		if maxEntries, err = strconv.Atoi(config["maxentries"]); err != nil {
+			return nil, fmt.Errorf("could not parse 'maxentries' parameter: %w", err)
+		}
+		if maxEntries <= 0 {
+			return nil, errors.New("maxentries has to be >0")
+		}
+	} else {
+		log.Info().Msg("Rollup: 'maxentries' set to default 100000.")
+	}
+
+	return &Rollup{
+		Keys:       keys,
+		Window:     windowLength,
+		Lateness:   lateness,
+		MaxEntries: maxEntries,
+		keyFields:  keyFields,
+	}, nil
+}
+
+func (segment *Rollup) Run(wg *sync.WaitGroup) {
+	defer func() {
+		segment.emit(func(*window) bool { return true })
+		close(segment.Out)
+		wg.Done()
+	}()
+
+	segment.windows = make(map[int64]*window)
+	ticker := time.NewTicker(min(segment.Window, time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case msg, ok := <-segment.In:
+			if !ok {
+				return
+			}
+			segment.insert(msg, time.Now())
+		case now := <-ticker.C:
+			segment.emit(func(w *window) bool {
+				return w.start+int64(segment.Window+segment.Lateness) <= segment.watermark ||
+					now.Sub(w.opened) >= segment.Window+segment.Lateness
+			})
+		}
+	}
+}
+
+func (segment *Rollup) insert(msg *pb.EnrichedFlow, now time.Time) {
+	flowTime := startTime(msg, now)
+	segment.watermark = max(segment.watermark, flowTime)
+	start := flowTime - flowTime%int64(segment.Window)
+	w := segment.window(start, now)
+
+	key := segment.keyFields.Key(msg)
+	summary, ok := w.summaries[key]
+	if !ok {
+		if segment.entries >= segment.MaxEntries {
+			log.Warn().Msgf("Rollup: Reached %d summaries, emitting the oldest window early.", segment.MaxEntries)
+			segment.emitOldest()
+			w = segment.window(start, now) // in case the oldest window was this one
+		}
+		summary = &pb.EnrichedFlow{Normalized: pb.EnrichedFlow_Yes}
+		segment.keyFields.Copy(summary, msg)
+		w.summaries[key] = summary
+		segment.entries += 1
+	}
+
+	samplingRate := flowmerge.NormalizationFactor(msg)
+	summary.Bytes += msg.Bytes * samplingRate
+	summary.Packets += msg.Packets * samplingRate
+	summary.FlowCount += 1
+	segments.Absorb(summary, msg) // acknowledged along with the summary
+	summary.TimeReceived = flowmerge.Earliest(summary.TimeReceived, msg.TimeReceived)
+	summary.TimeReceivedNs = flowmerge.Earliest(summary.TimeReceivedNs, msg.TimeReceivedNs)
+	flowmerge.ExtendTimes(summary, msg)
+}
+
+// Returns the window starting at the provided time, opening it if needed.
+func (segment *Rollup) window(start int64, now time.Time) *window {
+	w, ok := segment.windows[start]
+	if !ok {
+		w = &window{start: start, opened: now, summaries: make(map[string]*pb.EnrichedFlow)}
+		segment.windows[start] = w
+	}
+	return w
+}
+
+// Returns the start time of a flow in nanoseconds, falling back to the time
+// it was received or arrived at this segment.
+func startTime(msg *pb.EnrichedFlow, now time.Time) int64 {
+	switch {
+	case msg.TimeFlowStartNs != 0:
+		return int64(msg.TimeFlowStartNs)
+	case msg.TimeFlowStartMs != 0:
+		return int64(msg.TimeFlowStartMs) * int64(time.Millisecond)
+	case msg.TimeFlowStart != 0:
+		return int64(msg.TimeFlowStart) * int64(time.Second)
+	case msg.TimeReceivedNs != 0:
+		return int64(msg.TimeReceivedNs)
+	case msg.TimeReceived != 0:
+		return int64(msg.TimeReceived) * int64(time.Second)
+	}
+	return now.UnixNano()
+}
+
+// Emits and removes the summaries of all windows matching the provided
+// condition, in the order of the windows.
+func (segment *Rollup) emit(due func(*window) bool) {
+	starts := make([]int64, 0, len(segment.windows))
+	for start, w := range segment.windows {
+		if due(w) {
+			starts = append(starts, start)
+		}
+	}
+	slices.Sort(starts)
+	for _, start := range starts {
+		segment.emitWindow(segment.windows[start])
+	}
+}
+
+func (segment *Rollup) emitOldest() {
+	var oldest *window
+	for _, w := range segment.windows {
+		if oldest == nil || w.start < oldest.start {
+			oldest = w
+		}
+	}
+	segment.emitWindow(oldest)
+}
+
+func (segment *Rollup) emitWindow(w *window) {
+	delete(segment.windows, w.start)
+	segment.entries -= len(w.summaries)
+	for _, summary := range w.summaries {
+		segment.Out <- summary
+	}
+}
+
+func init() {
+	segment := &Rollup{}
+	segments.RegisterSegment("rollup", segment)
+}
@@ -0,0 +1,165 @@
+package rollup
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BelWue/flowpipeline/pb"
+	"github.com/BelWue/flowpipeline/segments"
+)
+
+func startRollup(t *testing.T, config map[string]string) (chan *pb.EnrichedFlow, chan *pb.EnrichedFlow, *sync.WaitGroup) {
+	t.Helper()
+	template, _ := segments.LookupSegment("rollup")
+	segment, err := segments.NewSegment(template, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in, out := make(chan *pb.EnrichedFlow), make(chan *pb.EnrichedFlow)
+	segment.Rewire(in, out)
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go segment.Run(wg)
+	return in, out, wg
+}
+
+// Rollup Segment test, summarizing flows by key and window
+func TestSegment_Rollup_summarize(t *testing.T) {
+	in, out, wg := startRollup(t, map[string]string{"keys": "Proto,DstPort", "window": "1m"})
+	go func() {
+		in <- &pb.EnrichedFlow{Proto: 6, DstPort: 443, SrcPort: 1, TimeFlowStart: 60, TimeFlowEnd: 70, Bytes: 10, Packets: 1, SamplingRate: 10}
+		in <- &pb.EnrichedFlow{Proto: 6, DstPort: 443, SrcPort: 2, TimeFlowStart: 100, TimeFlowEnd: 130, Bytes: 20, Packets: 2, SamplingRate: 10}
+		in <- &pb.EnrichedFlow{Proto: 6, DstPort: 443, SrcPort: 3, TimeFlowStart: 120, TimeFlowEnd: 125, Bytes: 30, Packets: 3, SamplingRate: 10}
+		in <- &pb.EnrichedFlow{Proto: 17, DstPort: 53, SrcPort: 4, TimeFlowStart: 61, TimeFlowEnd: 61, Bytes: 40, Packets: 4, Normalized: pb.EnrichedFlow_Yes}
+		close(in)
+	}()
+
+	var results []*pb.EnrichedFlow
+	for msg := range out {
+		results = append(results, msg)
+	}
+	wg.Wait()
+
+	if len(results) != 3 {
+		t.Fatalf("([error] Segment Rollup emitted %d summaries, should be 3.", len(results))
+	}
+	for _, result := range results {
+		if result.SrcPort != 0 {
+			t.Error("([error] Segment Rollup did not clear fields other than the keys.")
+		}
+		switch {
+		case result.Proto == 6 && result.TimeFlowStart == 60:
+			if result.DstPort != 443 || result.FlowCount != 2 || result.Bytes != 300 || result.Packets != 30 || result.TimeFlowEnd != 130 {
+				t.Errorf("([error] Segment Rollup summarized incorrectly: %v", result)
+			}
+		case result.Proto == 6 && result.TimeFlowStart == 120:
+			if result.FlowCount != 1 || result.Bytes != 300 {
+				t.Errorf("([error] Segment Rollup summarized incorrectly: %v", result)
+			}
+		case result.Proto == 17:
+			if result.DstPort != 53 || result.FlowCount != 1 || result.Bytes != 40 {
+				t.Errorf("([error] Segment Rollup summarized incorrectly: %v", result)
+			}
+		default:
+			t.Errorf("([error] Segment Rollup emitted an unexpected summary: %v", result)
+		}
+	}
+}
+
+// Rollup Segment test, emitting windows once later flows have been seen
+func TestSegment_Rollup_watermark(t *testing.T) {
+	in, out, wg := startRollup(t, map[string]string{"keys": "Proto", "window": "10ms", "lateness": "10ms"})
+	in <- &pb.EnrichedFlow{Proto: 6, TimeFlowStartMs: 1000}
+	in <- &pb.EnrichedFlow{Proto: 6, TimeFlowStartMs: 1025}
+	select {
+	case msg := <-out:
+		if msg.TimeFlowStartMs != 1000 {
+			t.Errorf("([error] Segment Rollup emitted the window starting at %d first.", msg.TimeFlowStartMs)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("([error] Segment Rollup did not emit a window after its lateness.")
+	}
+
+	// a late flow is summarized separately
+	in <- &pb.EnrichedFlow{Proto: 6, TimeFlowStartMs: 1005}
+	select {
+	case msg := <-out:
+		if msg.TimeFlowStartMs != 1005 && msg.TimeFlowStartMs != 1025 {
+			t.Errorf("([error] Segment Rollup emitted an unexpected summary: %v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("([error] Segment Rollup did not emit a late flow.")
+	}
+	close(in)
+	for range out {
+	}
+	wg.Wait()
+}
+
+// Rollup Segment test, emitting the oldest window early
+func TestSegment_Rollup_maxEntries(t *testing.T) {
+	in, out, wg := startRollup(t, map[string]string{"keys": "DstPort", "window": "1h", "maxentries": "2"})
+	in <- &pb.EnrichedFlow{DstPort: 1, TimeFlowStart: 3600}
+	in <- &pb.EnrichedFlow{DstPort: 2, TimeFlowStart: 7200}
+	go func() {
+		in <- &pb.EnrichedFlow{DstPort: 3, TimeFlowStart: 7200}
+	}()
+	select {
+	case msg := <-out:
+		if msg.DstPort != 1 {
+			t.Errorf("([error] Segment Rollup emitted the summary of port %d early, should be 1.", msg.DstPort)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("([error] Segment Rollup did not emit a window early.")
+	}
+	close(in)
+	count := 0
+	for range out {
+		count += 1
+	}
+	wg.Wait()
+	if count != 2 {
+		t.Errorf("([error] Segment Rollup emitted %d summaries on shutdown, should be 2.", count)
+	}
+}
+
+// Rollup Segment test, acknowledging flows along with their summary
+func TestSegment_Rollup_ack(t *testing.T) {
+	var done [2]bool
+	flows := []*pb.EnrichedFlow{{Proto: 6, Bytes: 1}, {Proto: 6, Bytes: 2}}
+	for i, msg := range flows {
+		segments.Track(msg, func() { done[i] = true })
+	}
+	in, out, wg := startRollup(t, map[string]string{"keys": "Proto"})
+	for _, msg := range flows {
+		in <- msg
+	}
+	close(in)
+	summary := <-out
+	wg.Wait()
+
+	if done[0] || done[1] {
+		t.Fatal("([error] Segment Rollup acknowledged flows before their summary.")
+	}
+	segments.Ack(summary)
+	if !done[0] || !done[1] {
+		t.Error("([error] Segment Rollup did not acknowledge flows along with their summary.")
+	}
+}
+
+// Rollup Segment test, rejecting invalid configurations
+func TestSegment_Rollup_invalidConfig(t *testing.T) {
+	for _, config := range []map[string]string{
+		{},
+		{"keys": "Foo"},
+		{"keys": "Proto", "window": "0s"},
+		{"keys": "Proto", "lateness": "-1m"},
+		{"keys": "Proto", "maxentries": "many"},
+	} {
+		template, _ := segments.LookupSegment("rollup")
+		if _, err := segments.NewSegment(template, config); err == nil {
+			t.Errorf("([error] Segment Rollup accepted invalid config %v.", config)
+		}
+	}
+}
@@ -22,8 +22,9 @@ type BaseFilterSegment struct {
 
 // Set a return channel for dropped flow messages. Segments need to be wary of
 // this channel closing when producing messages to this channel. This method is
-// only called by the flowpipeline tool from the controlflow/branch segment to
-// implement the then/else branches, otherwise this functionality is unused.
+// called by the pipeline package for every filter segment to count drops, and
+// the dropped flows are used by the controlflow/branch segment to implement the
+// then/else branches.
 func (segment *BaseFilterSegment) SubscribeDrops(drops chan<- *pb.EnrichedFlow) {
 	segment.Drops = drops
 }
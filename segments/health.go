@@ -0,0 +1,10 @@
+package segments
+
+import "context"
+
+// Segments can implement this interface to contribute to the readiness of
+// flowpipeline, e.g. by reporting whether they are connected to Kafka or can
+// reach their database. Segments should not block for longer than ctx allows.
+type HealthReporter interface {
+	Health(ctx context.Context) error // nil if the segment is ready to handle flows
+}
@@ -29,7 +29,7 @@ import (
 )
 
 type Bpf struct {
-	segments.BaseSegment
+	segments.BaseInputSegment
 
 	dumper   PacketDumper
 	exporter *FlowExporter
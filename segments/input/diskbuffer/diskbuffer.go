@@ -60,6 +60,16 @@ func DoDebugPrintf(format string, v ...any) {
 }
 
 func (segment *DiskBuffer) New(config map[string]string) segments.Segment {
+	newSegment, err := segment.NewWithError(config)
+	if err != nil {
+		log.Error().Err(err).Msg("Diskbuffer: ")
+		return nil
+	}
+	return newSegment
+}
+
+func (segment *DiskBuffer) NewWithError(config map[string]string) (segments.Segment, error) {
+	segment = &DiskBuffer{} // do not modify the registered instance
 	var (
 		err    error
 		buflen int
@@ -69,26 +79,26 @@ func (segment *DiskBuffer) New(config map[string]string) segments.Segment {
 	if segment.BufferDir != "" {
 		fi, err := os.Stat(segment.BufferDir)
 		if err != nil {
-			log.Fatal().Msgf("Diskbuffer: Could not obtain file info for file %s", segment.BufferDir)
+			return nil, fmt.Errorf("could not obtain file info for file %s", segment.BufferDir)
 		}
 		if !fi.IsDir() {
-			log.Fatal().Msgf("Diskbuffer: bufferdir %s must be a directory", segment.BufferDir)
+			return nil, fmt.Errorf("bufferdir %s must be a directory", segment.BufferDir)
 		}
 		if unix.Access(segment.BufferDir, unix.W_OK) != nil {
-			log.Fatal().Msg("Diskbuffer: bufferdir must be writeable")
+			return nil, errors.New("bufferdir must be writeable")
 		}
 	} else {
-		log.Fatal().Msg("Diskbuffer: bufferdir must exist")
+		return nil, errors.New("bufferdir must exist")
 	}
 	// parse HighMemoryMark option
 	segment.HighMemoryMark = defaultHighMemoryMark
 	if config["highmemorymark"] != "" {
 		segment.HighMemoryMark, err = strconv.Atoi(config["highmemorymark"])
 		if err != nil {
-			log.Fatal().Err(err).Msg("Diskbuffer: Failed to parse highmemorymark config option: ")
+			return nil, fmt.Errorf("failed to parse highmemorymark config option: %w", err)
 		}
 		if segment.HighMemoryMark < 10 || segment.HighMemoryMark > 95 {
-			log.Fatal().Msg("Diskbuffer: HighMemoryMark must be between 10 and 95")
+			return nil, errors.New("HighMemoryMark must be between 10 and 95")
 		}
 	}
 
@@ -96,10 +106,10 @@ func (segment *DiskBuffer) New(config map[string]string) segments.Segment {
 	if config["readingmemorymark"] != "" {
 		segment.ReadingMemoryMark, err = strconv.Atoi(config["highmemorymark"])
 		if err != nil {
-			log.Fatal().Err(err).Msg("Diskbuffer: Failed to parse readingmemorymark config option: ")
+			return nil, fmt.Errorf("failed to parse readingmemorymark config option: %w", err)
 		}
 		if segment.ReadingMemoryMark < 1 || segment.ReadingMemoryMark > 50 {
-			log.Fatal().Msg("Diskbuffer: HighMemoryMark must be between 1 and 50")
+			return nil, errors.New("HighMemoryMark must be between 1 and 50")
 		}
 
 	}
@@ -109,26 +119,26 @@ func (segment *DiskBuffer) New(config map[string]string) segments.Segment {
 	if config["lowmemorymark"] != "" {
 		segment.LowMemoryMark, err = strconv.Atoi(config["lowmemorymark"])
 		if err != nil {
-			log.Fatal().Err(err).Msg("Diskbuffer: Failed to parse lowmemorymark config option: ")
+			return nil, fmt.Errorf("failed to parse lowmemorymark config option: %w", err)
 		}
 		if segment.LowMemoryMark < 5 || segment.LowMemoryMark > 70 {
-			log.Fatal().Msg("Diskbuffer: HighMemoryMark must be between 5 and 70")
+			return nil, errors.New("HighMemoryMark must be between 5 and 70")
 		}
 	}
 
 	//sanity check: lowmemorymark < highmemorymark
 	if segment.LowMemoryMark > segment.HighMemoryMark {
-		log.Fatal().Msg("Diskbuffer: HighMemoryMark must be greater than LowMemoryMark")
+		return nil, errors.New("HighMemoryMark must be greater than LowMemoryMark")
 	}
 	if segment.ReadingMemoryMark > segment.LowMemoryMark {
-		log.Fatal().Msg("Diskbuffer: LowMemoryMark must be greater than ReadingMemoryMark")
+		return nil, errors.New("LowMemoryMark must be greater than ReadingMemoryMark")
 	}
 
 	segment.MaxCacheSize = defaultMaxCacheSize
 	if config["maxcachesize"] != "" {
 		segment.FileSize, err = humanize.ParseBytes(config["maxcachesize"])
 		if err != nil {
-			log.Fatal().Err(err).Msg("Diskbuffer: Failed to parse maxcachesize config option: ")
+			return nil, fmt.Errorf("failed to parse maxcachesize config option: %w", err)
 		}
 	}
 
@@ -137,7 +147,7 @@ func (segment *DiskBuffer) New(config map[string]string) segments.Segment {
 	if config["filesize"] != "" {
 		segment.FileSize, err = humanize.ParseBytes(config["filesize"])
 		if err != nil {
-			log.Fatal().Err(err).Msg("Diskbuffer: Failed to parse filesize config option: ")
+			return nil, fmt.Errorf("failed to parse filesize config option: %w", err)
 		}
 	}
 
@@ -146,7 +156,7 @@ func (segment *DiskBuffer) New(config map[string]string) segments.Segment {
 	if config["batchsize"] != "" {
 		segment.BatchSize, err = strconv.Atoi(config["batchsize"])
 		if err != nil {
-			log.Fatal().Err(err).Msg("Diskbuffer: Failed to parse batchsize config option: ")
+			return nil, fmt.Errorf("failed to parse batchsize config option: %w", err)
 		}
 	}
 	if segment.BatchSize < 0 {
@@ -156,7 +166,7 @@ func (segment *DiskBuffer) New(config map[string]string) segments.Segment {
 	if config["batchdebug"] != "" {
 		batchDebug, err := strconv.ParseBool(config["batchdebug"])
 		if err != nil {
-			log.Fatal().Err(err).Msg("Diskbuffer: Failed to parse batchdebug config option: ")
+			return nil, fmt.Errorf("failed to parse batchdebug config option: %w", err)
 		}
 		// set proper BatchDebugPrintf function
 		if batchDebug {
@@ -171,7 +181,7 @@ func (segment *DiskBuffer) New(config map[string]string) segments.Segment {
 	if config["queuestatusinterval"] != "" {
 		segment.QueueStatusInterval, err = time.ParseDuration(config["queuestatusinterval"])
 		if err != nil {
-			log.Fatal().Err(err).Msg("Diskbuffer: Failed to parse queuestatussnterval config option: ")
+			return nil, fmt.Errorf("failed to parse queuestatussnterval config option: %w", err)
 		}
 	}
 
@@ -179,7 +189,7 @@ func (segment *DiskBuffer) New(config map[string]string) segments.Segment {
 	if config["queuesize"] != "" {
 		buflen, err = strconv.Atoi(config["queuesize"])
 		if err != nil {
-			log.Fatal().Err(err).Msg("Diskbuffer: Failed to parse queuesize config option: ")
+			return nil, fmt.Errorf("failed to parse queuesize config option: %w", err)
 		}
 	} else {
 		buflen = defaultQueueSize
@@ -190,7 +200,7 @@ func (segment *DiskBuffer) New(config map[string]string) segments.Segment {
 	}
 	segment.MemoryBuffer = make(chan *pb.EnrichedFlow, buflen)
 	segment.Capacity = cap(segment.MemoryBuffer)
-	return segment
+	return segment, nil
 }
 
 func WatchCacheFiles(segment *DiskBuffer, BufferWG *sync.WaitGroup, Signal chan struct{}, CacheFiles *[]string) {
@@ -260,9 +270,25 @@ func WriteToDisk(segment *DiskBuffer, ReadWriteWG *sync.WaitGroup, Signal chan s
 	}
 	writer := bufio.NewWriterSize(encoder, 65536)
 
+	// flows are acknowledged once they have been handed to the file, as
+	// flows read back from disk are new flows
+	var written []*pb.EnrichedFlow
+	flush := func() {
+		err := writer.Flush()
+		if err == nil {
+			err = encoder.Flush()
+		}
+		if err != nil {
+			log.Warn().Err(err).Msgf("Diskbuffer: Lost %d flows, failed to write to file %s", len(written), filename)
+		} else {
+			segments.Ack(written...)
+		}
+		written = written[:0]
+	}
+
 	defer file.Close()
 	defer encoder.Close()
-	defer writer.Flush()
+	defer flush()
 
 	for {
 		select {
@@ -284,11 +310,13 @@ func WriteToDisk(segment *DiskBuffer, ReadWriteWG *sync.WaitGroup, Signal chan s
 						log.Warn().Err(err).Msgf("Diskbuffer: Skipping a flow, failed to write to file %s", filename)
 						continue
 					}
+					written = append(written, msg)
 				default:
 					// MemoryBuffer is empty -> no need to write anyhing to disk
 					return
 				}
 			}
+			flush()
 			fi, err := file.Stat()
 			if err != nil {
 				log.Warn().Msgf("Diskbuffer: Could not obtain file info for file %s", filename)
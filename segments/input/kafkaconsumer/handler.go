@@ -2,10 +2,12 @@ package kafkaconsumer
 
 import (
 	"bytes"
+	"sync"
 
 	"github.com/rs/zerolog/log"
 
 	"github.com/BelWue/flowpipeline/pb"
+	"github.com/BelWue/flowpipeline/segments"
 	"github.com/IBM/sarama"
 	"google.golang.org/protobuf/encoding/protodelim"
 	"google.golang.org/protobuf/proto"
@@ -16,6 +18,7 @@ type Handler struct {
 	ready  chan bool
 	flows  chan *pb.EnrichedFlow
 	legacy bool
+	acked  bool // mark messages once their flows have been acknowledged instead of on receipt
 }
 
 // Setup is run at the beginning of a new session, before ConsumeClaim
@@ -37,27 +40,91 @@ func (h *Handler) Cleanup(sarama.ConsumerGroupSession) error {
 // ConsumeClaim must start a consumer loop of ConsumerGroupClaim's Messages().
 
 func (h *Handler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	offsets := &offsetTracker{session: session, topic: claim.Topic(), partition: claim.Partition()}
 	for {
 		select {
 		case message := <-claim.Messages():
-			if h.legacy {
+			if !h.acked {
 				session.MarkMessage(message, "")
+			}
+			var flow *pb.EnrichedFlow
+			if h.legacy {
 				flowMsg := new(pb.LegacyEnrichedFlow)
 				if err := proto.Unmarshal(message.Value, flowMsg); err == nil {
-					h.flows <- flowMsg.ConvertToEnrichedFlow()
+					flow = flowMsg.ConvertToEnrichedFlow()
 				} else {
 					log.Warn().Err(err).Msg("KafkaConsumer: Error decoding flow, this might be due to the use of Goflow custom fields. Original error:\n  ")
 				}
 			} else {
 				msg := new(pb.ProtoProducerMessage)
-				if err := protodelim.UnmarshalFrom(bytes.NewReader(message.Value), msg); err != nil {
+				if err := protodelim.UnmarshalFrom(bytes.NewReader(message.Value), msg); err == nil {
+					flow = &msg.EnrichedFlow
+				} else {
 					log.Error().Err(err).Msg("KafkaConsumer: Failed unmarshalling message")
-					continue
 				}
-				h.flows <- &msg.EnrichedFlow
 			}
+			if !h.acked {
+				if flow != nil {
+					h.flows <- flow
+				}
+				continue
+			}
+			done := offsets.add(message.Offset)
+			if flow == nil {
+				done() // nothing to wait for
+				continue
+			}
+			segments.Track(flow, done)
+			h.flows <- flow
 		case <-session.Context().Done():
 			return nil
 		}
 	}
 }
+
+// Keeps track of the offsets of a claim whose flows have not been
+// acknowledged yet. Offsets are marked in order, i.e. an offset is marked
+// only once the flows of all previous offsets have been acknowledged as well.
+// Acknowledgements arriving after the session ended are ignored by sarama, the
+// corresponding messages will be consumed again by the next session.
+type offsetTracker struct {
+	session   sarama.ConsumerGroupSession
+	topic     string
+	partition int32
+
+	mutex   sync.Mutex
+	pending []*pendingOffset // in the order the messages were received
+}
+
+type pendingOffset struct {
+	offset int64
+	acked  bool
+}
+
+// Adds a received offset, returning the function to call once its flow has
+// been acknowledged.
+func (t *offsetTracker) add(offset int64) func() {
+	entry := &pendingOffset{offset: offset}
+	t.mutex.Lock()
+	t.pending = append(t.pending, entry)
+	t.mutex.Unlock()
+	return func() {
+		t.ack(entry)
+	}
+}
+
+func (t *offsetTracker) ack(entry *pendingOffset) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	entry.acked = true
+	marked := -1
+	for marked+1 < len(t.pending) && t.pending[marked+1].acked {
+		marked += 1
+	}
+	if marked < 0 {
+		return
+	}
+	// the committed offset is the one of the next message to consume
+	t.session.MarkOffset(t.topic, t.partition, t.pending[marked].offset+1, "")
+	t.pending = t.pending[marked+1:]
+}
@@ -13,16 +13,27 @@
 // The supported group partion assignor balancing strategies can be set using a comma
 // separated list for `strategy`. Supported values are `sticky`, `roundrobin` and
 // `range`. Default is `sticky`.
+//
+// The commit configuration sets when consumed messages count as done, i.e.
+// when their offsets may be committed to Kafka. By default, this is the case
+// as soon as they have been `received`. Setting it to `acked` delays this until
+// their flows have been handled by the whole pipeline, for instance written by
+// an output segment such as `clickhouse`, or dropped by a filter. Offsets are
+// committed in order for each partition, so after a crash or rebalance, only
+// flows which were not done yet are consumed again. This makes processing
+// at-least-once, at the expense of some memory for the flows not done yet.
 package kafkaconsumer
 
 import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rs/zerolog/log"
@@ -34,7 +45,7 @@ import (
 
 // FIXME: clean up those todos
 type KafkaConsumer struct {
-	segments.BaseSegment
+	segments.BaseInputSegment
 	Server       string        // required
 	Topic        string        // required
 	Group        string        // required
@@ -43,6 +54,7 @@ type KafkaConsumer struct {
 	Tls          bool          // optional, default is true
 	Auth         bool          // optional, default is true
 	StartAt      string        // optional, one of "oldest" or "newest", default is "newest"
+	Commit       string        // optional, one of "received" or "acked", default is "received"
 	Timeout      time.Duration // optional, default is 15s, any parsable duration
 	Legacy       bool          //optional, default is false
 	KafkaVersion string        //optional, default is 3.8.0
@@ -50,11 +62,12 @@ type KafkaConsumer struct {
 	startingOffset int64
 	saramaConfig   *sarama.Config
 	shutdown       chan bool //required for gracefull shutdown
+	connected      *atomic.Bool
 }
 
 func (segment KafkaConsumer) New(config map[string]string) segments.Segment {
 	var err error
-	newsegment := &KafkaConsumer{}
+	newsegment := &KafkaConsumer{connected: &atomic.Bool{}}
 	newsegment.saramaConfig = sarama.NewConfig()
 	newsegment.saramaConfig.ClientID, err = os.Hostname()
 	if err != nil {
@@ -195,6 +208,18 @@ func (segment KafkaConsumer) New(config map[string]string) segments.Segment {
 	newsegment.saramaConfig.Consumer.Offsets.Initial = startingOffset
 	newsegment.StartAt = startAt
 
+	newsegment.Commit = "received"
+	switch strings.ToLower(config["commit"]) {
+	case "":
+		log.Info().Msg("KafkaConsumer: 'commit' set to default 'received'.")
+	case "received":
+	case "acked":
+		newsegment.Commit = "acked"
+		log.Info().Msg("KafkaConsumer: Committing offsets of acknowledged flows only.")
+	default:
+		log.Error().Msg("KafkaConsumer: Could not parse 'commit' parameter, using default 'received'.")
+	}
+
 	newsegment.Timeout = 15 * time.Second
 	if timeout, err := time.ParseDuration(config["timeout"]); err == nil {
 		newsegment.Timeout = timeout
@@ -216,6 +241,15 @@ func (segment *KafkaConsumer) Close() {
 	close(segment.shutdown)
 }
 
+// Reports whether a consumer session is established, see
+// segments.HealthReporter.
+func (segment *KafkaConsumer) Health(ctx context.Context) error {
+	if segment.connected == nil || !segment.connected.Load() {
+		return errors.New("not connected to Kafka")
+	}
+	return nil
+}
+
 func (segment *KafkaConsumer) Run(wg *sync.WaitGroup) {
 	defer func() {
 		close(segment.Out)
@@ -238,6 +272,7 @@ func (segment *KafkaConsumer) Run(wg *sync.WaitGroup) {
 		ready:  make(chan bool),
 		flows:  make(chan *pb.EnrichedFlow),
 		legacy: segment.Legacy,
+		acked:  segment.Commit == "acked",
 	}
 	handlerWg := sync.WaitGroup{}
 	handlerWg.Add(1)
@@ -298,6 +333,8 @@ func (segment *KafkaConsumer) Run(wg *sync.WaitGroup) {
 		return
 	}
 	log.Info().Msg("KafkaConsumer: Connected and operational.")
+	segment.connected.Store(true)
+	defer segment.connected.Store(false)
 
 	// receive flows in a loop
 	for {
@@ -321,6 +358,7 @@ func (segment *KafkaConsumer) Run(wg *sync.WaitGroup) {
 			log.Info().Msg("KafkaConsumer: Connection Closed")
 			return
 		case handlerReady = <-handler.ready:
+			segment.connected.Store(handlerReady)
 			if !handlerReady {
 				log.Error().Msg("KafkaConsumer: Failed to establish connection.")
 				handlerCancel()
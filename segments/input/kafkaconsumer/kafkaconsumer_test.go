@@ -1,7 +1,15 @@
 package kafkaconsumer
 
 import (
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+
+	"github.com/BelWue/flowpipeline/pb"
+	"github.com/BelWue/flowpipeline/pipeline"
+	"github.com/BelWue/flowpipeline/segments"
 )
 
 func TestSegment_KafkaConsumer_instanciation(t *testing.T) {
@@ -26,3 +34,125 @@ func TestSegment_KafkaConsumer_instanciation(t *testing.T) {
 		t.Error("([error] Segment KafkaConsumer did not initiate successfully.")
 	}
 }
+
+// An output segment which writes flows only once the test acknowledges them.
+type heldOutput struct {
+	segments.BaseSegment
+	written chan *pb.EnrichedFlow
+}
+
+func (segment *heldOutput) New(config map[string]string) segments.Segment {
+	return &heldOutput{written: make(chan *pb.EnrichedFlow, 10)}
+}
+
+func (segment *heldOutput) Run(wg *sync.WaitGroup) {
+	defer func() {
+		close(segment.Out)
+		wg.Done()
+	}()
+	for msg := range segment.In {
+		segments.Hold(msg)
+		segment.Out <- msg
+		segment.written <- msg
+	}
+}
+
+// Returns the highest offset of partition 0 committed to the mock broker, or
+// -1 if there is none.
+func committedOffset(broker *sarama.MockBroker, topic string) int64 {
+	committed := int64(-1)
+	for _, requestResponse := range broker.History() {
+		if request, ok := requestResponse.Request.(*sarama.OffsetCommitRequest); ok {
+			if offset, _, err := request.Offset(topic, 0); err == nil && offset > committed {
+				committed = offset
+			}
+		}
+	}
+	return committed
+}
+
+func TestSegment_KafkaConsumer_commitAcked(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 0)
+	defer broker.Close()
+	fetchResponse := sarama.NewMockFetchResponse(t, 10)
+	for i := range 4 {
+		msg := &pb.ProtoProducerMessage{EnrichedFlow: pb.EnrichedFlow{SequenceNum: uint32(i)}}
+		value, err := msg.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fetchResponse.SetMessage("flows", 0, int64(i), sarama.ByteEncoder(value))
+	}
+	fetchResponse.SetHighWaterMark("flows", 0, 4)
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("flows", 0, broker.BrokerID()),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetOffset("flows", 0, sarama.OffsetOldest, 0).
+			SetOffset("flows", 0, sarama.OffsetNewest, 4),
+		"FindCoordinatorRequest": sarama.NewMockFindCoordinatorResponse(t).
+			SetCoordinator(sarama.CoordinatorGroup, "flowpipeline", broker),
+		"HeartbeatRequest": sarama.NewMockHeartbeatResponse(t),
+		"JoinGroupRequest": sarama.NewMockJoinGroupResponse(t).
+			SetGroupProtocol(sarama.StickyBalanceStrategyName),
+		"SyncGroupRequest": sarama.NewMockSyncGroupResponse(t).
+			SetMemberAssignment(&sarama.ConsumerGroupMemberAssignment{
+				Topics: map[string][]int32{"flows": {0}},
+			}),
+		"OffsetFetchRequest": sarama.NewMockOffsetFetchResponse(t).
+			SetOffset("flowpipeline", "flows", 0, -1, "", sarama.ErrNoError).
+			SetError(sarama.ErrNoError),
+		"FetchRequest":        fetchResponse,
+		"OffsetCommitRequest": sarama.NewMockOffsetCommitResponse(t),
+		"LeaveGroupRequest":   sarama.NewMockLeaveGroupResponse(t),
+	})
+
+	consumer := (&KafkaConsumer{}).New(map[string]string{
+		"server":        broker.Addr(),
+		"topic":         "flows",
+		"group":         "flowpipeline",
+		"tls":           "false",
+		"auth":          "false",
+		"startat":       "oldest",
+		"kafka-version": "2.0.0",
+		"commit":        "acked",
+	}).(*KafkaConsumer)
+	consumer.saramaConfig.Consumer.Offsets.AutoCommit.Interval = 10 * time.Millisecond
+	output := (&heldOutput{}).New(nil).(*heldOutput)
+	pipeline := pipeline.New(consumer, output)
+	pipeline.Start()
+	pipeline.AutoDrain()
+	defer pipeline.Close()
+
+	written := make([]*pb.EnrichedFlow, 4)
+	for range 4 {
+		select {
+		case msg := <-output.written:
+			written[msg.SequenceNum] = msg
+		case <-time.After(5 * time.Second):
+			t.Fatal("([error] Segment KafkaConsumer did not consume all messages.")
+		}
+	}
+
+	// the first message is not done yet, so nothing may be committed
+	segments.Ack(written[1], written[2])
+	time.Sleep(100 * time.Millisecond)
+	if committed := committedOffset(broker, "flows"); committed != -1 {
+		t.Errorf("([error] Segment KafkaConsumer committed offset %d before the first flow was acknowledged.", committed)
+	}
+
+	for _, ack := range []struct {
+		flow      *pb.EnrichedFlow
+		committed int64
+	}{{written[0], 3}, {written[3], 4}} {
+		segments.Ack(ack.flow)
+		deadline := time.Now().Add(5 * time.Second)
+		for committedOffset(broker, "flows") != ack.committed && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if committed := committedOffset(broker, "flows"); committed != ack.committed {
+			t.Errorf("([error] Segment KafkaConsumer committed offset %d, should be %d.", committed, ack.committed)
+		}
+	}
+}
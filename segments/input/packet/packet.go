@@ -40,7 +40,7 @@ import (
 )
 
 type Packet struct {
-	segments.BaseSegment
+	segments.BaseInputSegment
 
 	exporter *aggregate.FlowExporter
 
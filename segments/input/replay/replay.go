@@ -22,7 +22,7 @@ import (
 )
 
 type Replay struct {
-	segments.BaseSegment
+	segments.BaseInputSegment
 	db *sql.DB
 
 	FileName      string
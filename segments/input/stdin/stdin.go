@@ -3,10 +3,13 @@
 // segment, which allows flowpipelines to be piped into each other. This segment can
 // also read files created with the `json` segment. The `eofcloses` parameter can
 // therefore be used to gracefully terminate the pipeline after reading the file.
+// Other pipelines running in the same process are not affected, flowpipeline
+// exits once all of them have terminated.
 package stdin
 
 import (
 	"bufio"
+	"fmt"
 	"strconv"
 
 	"github.com/rs/zerolog/log"
@@ -20,14 +23,40 @@ import (
 )
 
 type StdIn struct {
-	segments.BaseSegment
+	segments.BaseInputSegment
 	scanner *bufio.Scanner
 
 	FileName  string // optional, default is empty which means read from stdin
 	EofCloses bool   // optional, default is false. Closes Pipeleine gracefully after input file was read
 }
 
+// Options of the stdin segment for use with the builder package.
+type Options struct {
+	Filename  string // optional, default is empty which means read from stdin
+	EofCloses bool   // optional, default is false, closes the pipeline after the file was read
+}
+
+func (options Options) SegmentName() string {
+	return "stdin"
+}
+
+func (options Options) SegmentConfig() map[string]string {
+	return map[string]string{
+		"filename":  options.Filename,
+		"eofcloses": strconv.FormatBool(options.EofCloses),
+	}
+}
+
 func (segment StdIn) New(config map[string]string) segments.Segment {
+	newSegment, err := segment.NewWithError(config)
+	if err != nil {
+		log.Error().Err(err).Msg("StdIn: ")
+		return nil
+	}
+	return newSegment
+}
+
+func (segment StdIn) NewWithError(config map[string]string) (segments.Segment, error) {
 	newsegment := &StdIn{}
 
 	var filename string = "stdout"
@@ -37,8 +66,7 @@ func (segment StdIn) New(config map[string]string) segments.Segment {
 	if config["filename"] != "" {
 		file, err = os.Open(config["filename"])
 		if err != nil {
-			log.Error().Err(err).Msg("StdIn: File specified in 'filename' is not accessible: ")
-			return nil
+			return nil, fmt.Errorf("file specified in 'filename' is not accessible: %w", err)
 		}
 		filename = config["filename"]
 		if config["eofcloses"] != "" {
@@ -59,7 +87,7 @@ func (segment StdIn) New(config map[string]string) segments.Segment {
 	newsegment.FileName = filename
 	newsegment.EofCloses = eofCloses
 
-	return newsegment
+	return newsegment, nil
 }
 
 func (segment *StdIn) Run(wg *sync.WaitGroup) {
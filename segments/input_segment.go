@@ -0,0 +1,32 @@
+// This package is home to all pipeline segment implementations. Generally,
+// every segment lives in its own package, implements the Segment interface,
+// embeds the BaseSegment to take care of the I/O side of things, and has an
+// additional init() function to register itself using RegisterSegment.
+package segments
+
+// Input segments introduce flows into a pipeline from external sources, such
+// as network listeners or message queues. They are kept running when the
+// remainder of a pipeline is replaced during a configuration reload.
+type InputSegment interface {
+	Segment
+	IsInput() bool // marks segments introducing flows from external sources
+}
+
+// An extended basis for Segment implementations in the input group. Apart
+// from marking the segment as an InputSegment, it is identical to the
+// BaseSegment.
+type BaseInputSegment struct {
+	BaseSegment
+}
+
+// Input segments are always inputs, this is used to detect the input section
+// of a pipeline.
+func (segment *BaseInputSegment) IsInput() bool {
+	return true
+}
+
+// Checks whether a Segment introduces flows from external sources.
+func IsInputSegment(segment Segment) bool {
+	value, ok := segment.(InputSegment)
+	return ok && value.IsInput()
+}
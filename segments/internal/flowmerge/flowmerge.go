@@ -0,0 +1,56 @@
+// This package holds the helpers shared by segments merging multiple flows
+// into a single one, such as aggregate, biflow and rollup.
+package flowmerge
+
+import (
+	"github.com/BelWue/flowpipeline/pb"
+)
+
+// Extends the time a flow spans from its start to its end to cover the time
+// spanned by another flow.
+func ExtendTimes(flow *pb.EnrichedFlow, other *pb.EnrichedFlow) {
+	flow.TimeFlowStart = Earliest(flow.TimeFlowStart, other.TimeFlowStart)
+	flow.TimeFlowStartMs = Earliest(flow.TimeFlowStartMs, other.TimeFlowStartMs)
+	flow.TimeFlowStartNs = Earliest(flow.TimeFlowStartNs, other.TimeFlowStartNs)
+	flow.TimeFlowEnd = max(flow.TimeFlowEnd, other.TimeFlowEnd)
+	flow.TimeFlowEndMs = max(flow.TimeFlowEndMs, other.TimeFlowEndMs)
+	flow.TimeFlowEndNs = max(flow.TimeFlowEndNs, other.TimeFlowEndNs)
+}
+
+// Prepares a flow for adding the counters of another flow to it, and returns
+// the factor the other flow's counters need to be multiplied with before.
+//
+// Counters of flows sampled at different rates can not be summed as they are.
+// In this case, the counters of the flow are normalized like the normalize
+// segment does, i.e. multiplied by the sampling rate and marked as Normalized,
+// and the other flow's counters need to be normalized as well.
+func AlignCounters(flow *pb.EnrichedFlow, other *pb.EnrichedFlow) uint64 {
+	if flow.SamplingRate == other.SamplingRate && flow.Normalized == other.Normalized {
+		return 1
+	}
+	samplingRate := NormalizationFactor(flow)
+	flow.Bytes *= samplingRate
+	flow.Packets *= samplingRate
+	flow.Normalized = pb.EnrichedFlow_Yes
+	return NormalizationFactor(other)
+}
+
+// Returns the earlier of two timestamps, ignoring unset ones.
+func Earliest(a uint64, b uint64) uint64 {
+	if a == 0 {
+		return b
+	}
+	if b == 0 {
+		return a
+	}
+	return min(a, b)
+}
+
+// Returns the factor the counters of a flow need to be multiplied with to
+// normalize them, i.e. its sampling rate unless it has been normalized.
+func NormalizationFactor(flow *pb.EnrichedFlow) uint64 {
+	if flow.Normalized == pb.EnrichedFlow_Yes || flow.SamplingRate == 0 {
+		return 1
+	}
+	return flow.SamplingRate
+}
@@ -0,0 +1,15 @@
+// This package is home to all pipeline segment implementations. Generally,
+// every segment lives in its own package, implements the Segment interface,
+// embeds the BaseSegment to take care of the I/O side of things, and has an
+// additional init() function to register itself using RegisterSegment.
+package segments
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The Prometheus registry shared by the whole flowpipeline process. The
+// pipeline package registers its per-segment metrics here, and segments may
+// add their own. It is served by the flowpipeline tool on a single endpoint
+// if enabled using the `-metrics` flag.
+var MetricsRegistry = prometheus.NewRegistry()
@@ -8,6 +8,7 @@ import (
 	"strconv"
 	"sync"
 
+	"github.com/BelWue/flowpipeline/pb"
 	"github.com/BelWue/flowpipeline/segments"
 	"github.com/bwNetFlow/ip_prefix_trie"
 	"github.com/rs/zerolog/log"
@@ -85,99 +86,123 @@ func (segment *AddNetId) Run(wg *sync.WaitGroup) {
 
 	segment.readPrefixList()
 	for msg := range segment.In {
-		var laddress net.IP
-		if !segment.MatchBoth {
-			switch {
-			case msg.RemoteAddr == 1: // 1 indicates SrcAddr is the RemoteAddr
-				laddress = msg.DstAddr // we want the LocalAddr tho
-			case msg.RemoteAddr == 2: // 2 indicates DstAddr is the RemoteAddr
-				laddress = msg.SrcAddr // we want the LocalAddr tho
-			default:
-				if !segment.DropUnmatched {
-					segment.Out <- msg
-				}
-				continue
+		if segment.addNetId(msg) {
+			segment.Out <- msg
+		}
+	}
+}
+
+func (segment *AddNetId) RunBatches(in <-chan []*pb.EnrichedFlow, out chan<- []*pb.EnrichedFlow, wg *sync.WaitGroup) {
+	defer func() {
+		close(out)
+		wg.Done()
+	}()
+
+	segment.readPrefixList()
+	for batch := range in {
+		kept := batch[:0] // filter in place
+		for _, msg := range batch {
+			if segment.addNetId(msg) {
+				kept = append(kept, msg)
 			}
+		}
+		if len(kept) > 0 {
+			out <- kept
+		}
+	}
+}
 
-			// prepare matching the address into a prefix and its associated CID
-			if laddress.To4() == nil {
-				if segment.UseIntIds {
-					retId, _ := segment.trieV6.Lookup(laddress).(int64)
-					msg.NetId = uint32(retId)
-				} else {
-					retId, _ := segment.trieV6.Lookup(laddress).(string)
-					msg.NetIdString = retId
-				}
+// Adds the network IDs to a flow. Returns whether the flow should be kept.
+func (segment *AddNetId) addNetId(msg *pb.EnrichedFlow) bool {
+	var laddress net.IP
+	if !segment.MatchBoth {
+		switch {
+		case msg.RemoteAddr == 1: // 1 indicates SrcAddr is the RemoteAddr
+			laddress = msg.DstAddr // we want the LocalAddr tho
+		case msg.RemoteAddr == 2: // 2 indicates DstAddr is the RemoteAddr
+			laddress = msg.SrcAddr // we want the LocalAddr tho
+		default:
+			return !segment.DropUnmatched
+		}
 
+		// prepare matching the address into a prefix and its associated CID
+		if laddress.To4() == nil {
+			if segment.UseIntIds {
+				retId, _ := segment.trieV6.Lookup(laddress).(int64)
+				msg.NetId = uint32(retId)
 			} else {
-				if segment.UseIntIds {
-					retId, _ := segment.trieV4.Lookup(laddress).(int64)
-					msg.NetId = uint32(retId)
-				} else {
-					retId, _ := segment.trieV4.Lookup(laddress).(string)
-					msg.NetIdString = retId
-				}
+				retId, _ := segment.trieV6.Lookup(laddress).(string)
+				msg.NetIdString = retId
 			}
-			if segment.DropUnmatched && msg.Cid == 0 {
-				continue
+
+		} else {
+			if segment.UseIntIds {
+				retId, _ := segment.trieV4.Lookup(laddress).(int64)
+				msg.NetId = uint32(retId)
+			} else {
+				retId, _ := segment.trieV4.Lookup(laddress).(string)
+				msg.NetIdString = retId
+			}
+		}
+		if segment.DropUnmatched && msg.Cid == 0 {
+			return false
+		}
+	} else {
+		if net.IP(msg.SrcAddr).To4() == nil {
+			if segment.UseIntIds {
+				retId, _ := segment.trieV6.Lookup(msg.SrcAddr).(int64)
+				msg.SrcId = uint32(retId)
+			} else {
+				retId, _ := segment.trieV6.Lookup(msg.SrcAddr).(string)
+				msg.SrcIdString = retId
 			}
 		} else {
-			if net.IP(msg.SrcAddr).To4() == nil {
-				if segment.UseIntIds {
-					retId, _ := segment.trieV6.Lookup(msg.SrcAddr).(int64)
-					msg.SrcId = uint32(retId)
-				} else {
-					retId, _ := segment.trieV6.Lookup(msg.SrcAddr).(string)
-					msg.SrcIdString = retId
-				}
+			if segment.UseIntIds {
+				retId, _ := segment.trieV4.Lookup(msg.SrcAddr).(int64)
+				msg.SrcId = uint32(retId)
 			} else {
-				if segment.UseIntIds {
-					retId, _ := segment.trieV4.Lookup(msg.SrcAddr).(int64)
-					msg.SrcId = uint32(retId)
-				} else {
-					retId, _ := segment.trieV4.Lookup(msg.SrcAddr).(string)
-					msg.SrcIdString = retId
-				}
+				retId, _ := segment.trieV4.Lookup(msg.SrcAddr).(string)
+				msg.SrcIdString = retId
 			}
-			if net.IP(msg.DstAddr).To4() == nil {
-				if segment.UseIntIds {
-					retId, _ := segment.trieV6.Lookup(msg.DstAddr).(int64)
-					msg.DstId = uint32(retId)
-				} else {
-					retId, _ := segment.trieV6.Lookup(msg.DstAddr).(string)
-					msg.DstIdString = retId
-				}
+		}
+		if net.IP(msg.DstAddr).To4() == nil {
+			if segment.UseIntIds {
+				retId, _ := segment.trieV6.Lookup(msg.DstAddr).(int64)
+				msg.DstId = uint32(retId)
 			} else {
-				if segment.UseIntIds {
-					retId, _ := segment.trieV4.Lookup(msg.DstAddr).(int64)
-					msg.DstId = uint32(retId)
-				} else {
-					retId, _ := segment.trieV4.Lookup(msg.DstAddr).(string)
-					msg.DstIdString = retId
-				}
+				retId, _ := segment.trieV6.Lookup(msg.DstAddr).(string)
+				msg.DstIdString = retId
 			}
+		} else {
 			if segment.UseIntIds {
-				if msg.SrcId == 0 && msg.DstId != 0 {
-					msg.NetId = msg.DstId
-				} else if msg.DstId == 0 && msg.SrcId != 0 {
-					msg.NetId = msg.SrcId
-				} else if msg.DstId == 0 && msg.SrcId == 0 {
-					if segment.DropUnmatched {
-						continue
-					}
-				}
+				retId, _ := segment.trieV4.Lookup(msg.DstAddr).(int64)
+				msg.DstId = uint32(retId)
 			} else {
-				if msg.SrcIdString == "" && msg.DstIdString != "" {
-					msg.NetIdString = msg.DstIdString
-				} else if msg.DstIdString == "" && msg.SrcIdString != "" {
-					msg.NetIdString = msg.SrcIdString
-				} else if msg.DstIdString == "" && msg.SrcIdString == "" {
-					continue
+				retId, _ := segment.trieV4.Lookup(msg.DstAddr).(string)
+				msg.DstIdString = retId
+			}
+		}
+		if segment.UseIntIds {
+			if msg.SrcId == 0 && msg.DstId != 0 {
+				msg.NetId = msg.DstId
+			} else if msg.DstId == 0 && msg.SrcId != 0 {
+				msg.NetId = msg.SrcId
+			} else if msg.DstId == 0 && msg.SrcId == 0 {
+				if segment.DropUnmatched {
+					return false
 				}
 			}
+		} else {
+			if msg.SrcIdString == "" && msg.DstIdString != "" {
+				msg.NetIdString = msg.DstIdString
+			} else if msg.DstIdString == "" && msg.SrcIdString != "" {
+				msg.NetIdString = msg.SrcIdString
+			} else if msg.DstIdString == "" && msg.SrcIdString == "" {
+				return false
+			}
 		}
-		segment.Out <- msg
 	}
+	return true
 }
 
 func (segment *AddNetId) readPrefixList() {
@@ -6,6 +6,8 @@
 package dropfields
 
 import (
+	"errors"
+	"fmt"
 	"reflect"
 	"regexp"
 	"strings"
@@ -34,7 +36,37 @@ type DropFields struct {
 	Fields []string // required, determines which fields are kept/dropped
 }
 
+// Options of the dropfields segment for use with the builder package.
+type Options struct {
+	Policy Policy   // required, determines whether to keep or drop fields
+	Fields []string // required, determines which fields are kept/dropped
+}
+
+func (options Options) SegmentName() string {
+	return "dropfields"
+}
+
+func (options Options) SegmentConfig() map[string]string {
+	config := map[string]string{"fields": strings.Join(options.Fields, ",")}
+	switch options.Policy {
+	case PolicyKeep:
+		config["policy"] = "keep"
+	case PolicyDrop:
+		config["policy"] = "drop"
+	}
+	return config
+}
+
 func (segment *DropFields) New(config map[string]string) segments.Segment {
+	newSegment, err := segment.NewWithError(config)
+	if err != nil {
+		log.Error().Err(err).Msg("DropFields: ")
+		return nil
+	}
+	return newSegment
+}
+
+func (segment *DropFields) NewWithError(config map[string]string) (segments.Segment, error) {
 	var (
 		policy Policy
 		fields []string
@@ -47,19 +79,28 @@ func (segment *DropFields) New(config map[string]string) segments.Segment {
 	case "drop":
 		policy = PolicyDrop
 	default:
-		log.Fatal().Msg("DropFields: The 'policy' parameter is required to be either 'keep' or 'drop'.")
+		return nil, errors.New("the 'policy' parameter is required to be either 'keep' or 'drop'")
 	}
 
-	// parse fields
-	fields = FieldSplitRegex.Split(strings.TrimSpace(config["fields"]), -1)
+	// parse fields, ignoring empty ones from leading or trailing separators
+	flowType := reflect.TypeOf(pb.EnrichedFlow{})
+	for _, fieldName := range FieldSplitRegex.Split(strings.TrimSpace(config["fields"]), -1) {
+		if fieldName == "" {
+			continue
+		}
+		if field, ok := flowType.FieldByName(fieldName); !ok || !field.IsExported() {
+			return nil, fmt.Errorf("field '%s' is not valid or can not be set", fieldName)
+		}
+		fields = append(fields, fieldName)
+	}
 	if len(fields) == 0 {
-		log.Warn().Msg("DropFields: The 'fields' parameter can not be empty.")
+		return nil, errors.New("the 'fields' parameter must not be empty")
 	}
 
 	return &DropFields{
 		Policy: policy,
 		Fields: fields,
-	}
+	}, nil
 }
 
 func (segment *DropFields) Run(wg *sync.WaitGroup) {
@@ -68,30 +109,46 @@ func (segment *DropFields) Run(wg *sync.WaitGroup) {
 		wg.Done()
 	}()
 	for original := range segment.In {
-		// get reflected value of original flow
-		reflectedOriginal := reflect.ValueOf(original).Elem()
-		switch segment.Policy {
-		case PolicyKeep:
-			resultFlow := &pb.EnrichedFlow{}
-			for _, fieldName := range segment.Fields {
-				originalField := reflectedOriginal.FieldByName(fieldName)
-				resultFlowDestinationField := reflect.ValueOf(resultFlow).Elem().FieldByName(fieldName)
-				if originalField.IsValid() && resultFlowDestinationField.CanSet() {
-					resultFlowDestinationField.Set(originalField)
-				} else {
-					log.Fatal().Msgf("DropFields: Field '%s' is not valid or can not be set.", fieldName)
-				}
-			}
-			segment.Out <- resultFlow
-		case PolicyDrop:
-			for _, fieldName := range segment.Fields {
-				originalField := reflect.Indirect(reflectedOriginal).FieldByName(fieldName)
-				if originalField.IsValid() && originalField.CanSet() {
-					originalField.SetZero()
-				}
+		segment.Out <- segment.dropFields(original)
+	}
+}
+
+func (segment *DropFields) RunBatches(in <-chan []*pb.EnrichedFlow, out chan<- []*pb.EnrichedFlow, wg *sync.WaitGroup) {
+	defer func() {
+		close(out)
+		wg.Done()
+	}()
+	for batch := range in {
+		for i, original := range batch {
+			batch[i] = segment.dropFields(original)
+		}
+		out <- batch
+	}
+}
+
+// Returns the flow with the configured fields dropped, which is a new flow
+// when using the keep policy.
+func (segment *DropFields) dropFields(original *pb.EnrichedFlow) *pb.EnrichedFlow {
+	// get reflected value of original flow
+	reflectedOriginal := reflect.ValueOf(original).Elem()
+	switch segment.Policy {
+	case PolicyKeep:
+		resultFlow := &pb.EnrichedFlow{}
+		for _, fieldName := range segment.Fields {
+			// all fields have been validated in NewWithError
+			originalField := reflectedOriginal.FieldByName(fieldName)
+			reflect.ValueOf(resultFlow).Elem().FieldByName(fieldName).Set(originalField)
+		}
+		segment.Replace(original, resultFlow)
+		return resultFlow
+	default: // PolicyDrop
+		for _, fieldName := range segment.Fields {
+			originalField := reflect.Indirect(reflectedOriginal).FieldByName(fieldName)
+			if originalField.IsValid() && originalField.CanSet() {
+				originalField.SetZero()
 			}
-			segment.Out <- original
 		}
+		return original
 	}
 }
 
@@ -66,7 +66,7 @@ var (
 			},
 		},
 		"keep two fields": {
-			config: map[string]string{"policy": "keep", "fields": " SrcAddr , SrcPort"},
+			config: map[string]string{"policy": "keep", "fields": " SrcAddr , SrcPort,"},
 			input:  testPacketTwo,
 			expected: &pb.EnrichedFlow{
 				SrcAddr: []byte{0x2a, 0x00, 0x13, 0x98, 0x00, 0x05, 0x8d, 0x01, 0x00, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x01},
@@ -88,6 +88,19 @@ func TestSegment_DropFields(t *testing.T) {
 	}
 }
 
+func TestSegment_DropFields_configErrors(t *testing.T) {
+	for _, config := range []map[string]string{
+		{"policy": "keep"},
+		{"policy": "keep", "fields": " , "},
+		{"policy": "keep", "fields": "SrcAddr,Foo"},
+		{"fields": "SrcAddr"},
+	} {
+		if _, err := (&DropFields{}).NewWithError(config); err == nil {
+			t.Errorf("[error] Segment DropFields accepted the invalid config %v.", config)
+		}
+	}
+}
+
 // DropFields Segment benchmark passthrough
 func BenchmarkDropFields(b *testing.B) {
 	zerolog.SetGlobalLevel(zerolog.Disabled)
@@ -15,6 +15,7 @@ import (
 
 	"github.com/rs/zerolog/log"
 
+	"github.com/BelWue/flowpipeline/pb"
 	"github.com/BelWue/flowpipeline/segments"
 )
 
@@ -47,20 +48,37 @@ func (segment *Normalize) Run(wg *sync.WaitGroup) {
 		wg.Done()
 	}()
 	for msg := range segment.In {
-		if msg.SamplingRate > 0 {
-			msg.Bytes *= msg.SamplingRate
-			msg.Packets *= msg.SamplingRate
-			msg.Normalized = 1
-		} else if segment.Fallback != 0 {
-			msg.Bytes *= segment.Fallback
-			msg.Packets *= segment.Fallback
-			msg.SamplingRate = segment.Fallback
-			msg.Normalized = 1
-		}
+		segment.normalize(msg)
 		segment.Out <- msg
 	}
 }
 
+func (segment *Normalize) RunBatches(in <-chan []*pb.EnrichedFlow, out chan<- []*pb.EnrichedFlow, wg *sync.WaitGroup) {
+	defer func() {
+		close(out)
+		wg.Done()
+	}()
+	for batch := range in {
+		for _, msg := range batch {
+			segment.normalize(msg)
+		}
+		out <- batch
+	}
+}
+
+func (segment *Normalize) normalize(msg *pb.EnrichedFlow) {
+	if msg.SamplingRate > 0 {
+		msg.Bytes *= msg.SamplingRate
+		msg.Packets *= msg.SamplingRate
+		msg.Normalized = 1
+	} else if segment.Fallback != 0 {
+		msg.Bytes *= segment.Fallback
+		msg.Packets *= segment.Fallback
+		msg.SamplingRate = segment.Fallback
+		msg.Normalized = 1
+	}
+}
+
 func init() {
 	segment := &Normalize{}
 	segments.RegisterSegment("normalize", segment)
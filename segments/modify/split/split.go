@@ -0,0 +1,220 @@
+// The `split` segment splits long flows into slices aligned to time buckets of
+// the `bucket` length (default 1m), so that segments calculating rates such as
+// `prometheus` or `toptalkers_metrics` do not attribute the traffic of a long
+// flow to the single point in time it was exported at. This works best if
+// these segments account flows by their own timestamps, i.e. with `time` set
+// to `event`.
+//
+// Each slice spans the part of the original flow within its bucket and gets a
+// share of the `Bytes` and `Packets`, as well as the `ReverseBytes` and
+// `ReversePackets` of biflows, proportional to its duration. The shares are
+// rounded such that they add up to the original counters exactly, which may
+// leave slices with bytes but without packets. All other fields are copied.
+// Slices are numbered in `SplitIndex`, starting at 0, and `SplitCount` holds
+// their number, so split flows can be recognized by a `SplitCount` above 0.
+//
+// Flows which lie within a single bucket or lack a start or end time are
+// passed on unchanged. To protect against bogus timestamps, flows which would
+// be split into more than `maxslices` (default 1000) slices are passed on
+// unchanged as well.
+package split
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/BelWue/flowpipeline/pb"
+	"github.com/BelWue/flowpipeline/segments"
+)
+
+type Split struct {
+	segments.BaseSegment
+	Bucket    time.Duration // optional, default is 1m, the length of the time buckets flows are split at
+	MaxSlices int           // optional, default is 1000, the maximum number of slices a flow is split into, longer flows are passed on unchanged
+}
+
+func (segment Split) New(config map[string]string) segments.Segment {
+	newSegment, err := segment.NewWithError(config)
+	if err != nil {
+		log.Error().Err(err).Msg("Split: ")
+		return nil
+	}
+	return newSegment
+}
+
+func (segment Split) NewWithError(config map[string]string) (segments.Segment, error) {
+	var err error
+	bucket := time.Minute
+	if config["bucket"] != "" {
+		if bucket, err = time.ParseDuration(config["bucket"]); err != nil {
+			return nil, fmt.Errorf("could not parse 'bucket' parameter: %w", err)
+		}
+		if bucket <= 0 {
+			return nil, errors.New("bucket has to be >0")
+		}
+	} else {
+		log.Info().Msg("Split: 'bucket' set to default 1m.")
+	}
+
+	maxSlices := 1000
+	if config["maxslices"] != "" {
+		if maxSlices, err = strconv.Atoi(config["maxslices"]); err != nil {
+			return nil, fmt.Errorf("could not parse 'maxslices' parameter: %w", err)
+		}
+		if maxSlices <= 1 {
+			return nil, errors.New("maxslices has to be >1")
+		}
+	} else {
+		log.Info().Msg("Split: 'maxslices' set to default 1000.")
+	}
+
+	return &Split{
+		Bucket:    bucket,
+		MaxSlices: maxSlices,
+	}, nil
+}
+
+func (segment *Split) Run(wg *sync.WaitGroup) {
+	defer func() {
+		close(segment.Out)
+		wg.Done()
+	}()
+	for msg := range segment.In {
+		for _, slice := range segment.split(msg) {
+			segment.Out <- slice
+		}
+	}
+}
+
+// Returns the slices of a flow, or the flow itself if it is not split. The
+// original flow is reused as the last slice.
+func (segment *Split) split(msg *pb.EnrichedFlow) []*pb.EnrichedFlow {
+	start, end, ok := flowTimes(msg)
+	if !ok || end <= start {
+		return []*pb.EnrichedFlow{msg}
+	}
+	bucket := int64(segment.Bucket)
+	first := start - start%bucket
+	count := (end - first + bucket - 1) / bucket
+	if count <= 1 {
+		return []*pb.EnrichedFlow{msg}
+	}
+	if count > int64(segment.MaxSlices) {
+		log.Debug().Msgf("Split: Not splitting flow into %d slices, more than the maximum of %d.", count, segment.MaxSlices)
+		return []*pb.EnrichedFlow{msg}
+	}
+
+	duration := uint64(end - start)
+	bytes := newShares(msg.Bytes, duration)
+	packets := newShares(msg.Packets, duration)
+	reverseBytes := newShares(msg.ReverseBytes, duration)
+	reversePackets := newShares(msg.ReversePackets, duration)
+
+	slices := make([]*pb.EnrichedFlow, count)
+	for i := range slices {
+		slice := msg
+		if i < len(slices)-1 {
+			slice = proto.Clone(msg).(*pb.EnrichedFlow)
+		}
+		sliceStart := max(start, first+int64(i)*bucket)
+		sliceEnd := min(end, first+int64(i+1)*bucket)
+		elapsed := uint64(sliceEnd - start)
+
+		setTimes(slice, msg, sliceStart, sliceEnd)
+		slice.Bytes = bytes.next(elapsed)
+		slice.Packets = packets.next(elapsed)
+		slice.ReverseBytes = reverseBytes.next(elapsed)
+		slice.ReversePackets = reversePackets.next(elapsed)
+		slice.SplitIndex = uint32(i)
+		slice.SplitCount = uint32(count)
+		slices[i] = slice
+	}
+	segment.Replace(msg, slices...)
+	return slices
+}
+
+// Returns the start and end of a flow in nanoseconds, using the most precise
+// timestamps available.
+func flowTimes(msg *pb.EnrichedFlow) (int64, int64, bool) {
+	var start, end int64
+	switch {
+	case msg.TimeFlowStartNs != 0:
+		start = int64(msg.TimeFlowStartNs)
+	case msg.TimeFlowStartMs != 0:
+		start = int64(msg.TimeFlowStartMs) * int64(time.Millisecond)
+	case msg.TimeFlowStart != 0:
+		start = int64(msg.TimeFlowStart) * int64(time.Second)
+	default:
+		return 0, 0, false
+	}
+	switch {
+	case msg.TimeFlowEndNs != 0:
+		end = int64(msg.TimeFlowEndNs)
+	case msg.TimeFlowEndMs != 0:
+		end = int64(msg.TimeFlowEndMs) * int64(time.Millisecond)
+	case msg.TimeFlowEnd != 0:
+		end = int64(msg.TimeFlowEnd) * int64(time.Second)
+	default:
+		return 0, 0, false
+	}
+	return start, end, true
+}
+
+// Sets the timestamps of a slice to its span in nanoseconds, in all of the
+// resolutions present in the original flow.
+func setTimes(slice *pb.EnrichedFlow, original *pb.EnrichedFlow, start int64, end int64) {
+	if original.TimeFlowStartNs != 0 {
+		slice.TimeFlowStartNs = uint64(start)
+	}
+	if original.TimeFlowStartMs != 0 {
+		slice.TimeFlowStartMs = uint64(start / int64(time.Millisecond))
+	}
+	if original.TimeFlowStart != 0 {
+		slice.TimeFlowStart = uint64(start / int64(time.Second))
+	}
+	if original.TimeFlowEndNs != 0 {
+		slice.TimeFlowEndNs = uint64(end)
+	}
+	if original.TimeFlowEndMs != 0 {
+		slice.TimeFlowEndMs = uint64(end / int64(time.Millisecond))
+	}
+	if original.TimeFlowEnd != 0 {
+		slice.TimeFlowEnd = uint64(end / int64(time.Second))
+	}
+}
+
+// Distributes a counter proportionally over the duration of a flow. Each
+// slice gets the rounded down share of the time elapsed at its end minus the
+// shares handed out before, so the shares add up to the total exactly.
+type shares struct {
+	total    uint64
+	duration uint64
+	assigned uint64
+}
+
+func newShares(total uint64, duration uint64) *shares {
+	return &shares{total: total, duration: duration}
+}
+
+// Returns the share of the next slice, ending after the provided time has
+// elapsed since the start of the flow.
+func (s *shares) next(elapsed uint64) uint64 {
+	// elapsed <= duration, so the quotient fits and Div64 does not panic
+	hi, lo := bits.Mul64(s.total, elapsed)
+	cumulative, _ := bits.Div64(hi, lo, s.duration)
+	share := cumulative - s.assigned
+	s.assigned = cumulative
+	return share
+}
+
+func init() {
+	segment := &Split{}
+	segments.RegisterSegment("split", segment)
+}
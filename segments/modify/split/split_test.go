@@ -0,0 +1,121 @@
+package split
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/BelWue/flowpipeline/pb"
+	"github.com/BelWue/flowpipeline/segments"
+)
+
+func runSplit(t *testing.T, config map[string]string, msg *pb.EnrichedFlow) []*pb.EnrichedFlow {
+	t.Helper()
+	template, _ := segments.LookupSegment("split")
+	segment, err := segments.NewSegment(template, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in, out := make(chan *pb.EnrichedFlow), make(chan *pb.EnrichedFlow)
+	segment.Rewire(in, out)
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go segment.Run(wg)
+	go func() {
+		in <- msg
+		close(in)
+	}()
+	var results []*pb.EnrichedFlow
+	for result := range out {
+		results = append(results, result)
+	}
+	wg.Wait()
+	return results
+}
+
+// Split Segment test, splitting a flow proportionally
+func TestSegment_Split_proportional(t *testing.T) {
+	results := runSplit(t, map[string]string{"bucket": "1m"},
+		&pb.EnrichedFlow{TimeFlowStart: 90, TimeFlowEnd: 240, Bytes: 1000, Packets: 10, Proto: 6})
+	if len(results) != 3 {
+		t.Fatalf("([error] Segment Split returned %d slices, should be 3.", len(results))
+	}
+	expected := []struct{ start, end, bytes, packets uint64 }{
+		{90, 120, 200, 2},
+		{120, 180, 400, 4},
+		{180, 240, 400, 4},
+	}
+	for i, slice := range results {
+		if slice.TimeFlowStart != expected[i].start || slice.TimeFlowEnd != expected[i].end {
+			t.Errorf("([error] Segment Split returned slice %d spanning %d-%d.", i, slice.TimeFlowStart, slice.TimeFlowEnd)
+		}
+		if slice.Bytes != expected[i].bytes || slice.Packets != expected[i].packets {
+			t.Errorf("([error] Segment Split returned slice %d with %d bytes and %d packets.", i, slice.Bytes, slice.Packets)
+		}
+		if slice.SplitIndex != uint32(i) || slice.SplitCount != 3 || slice.Proto != 6 {
+			t.Errorf("([error] Segment Split did not mark slice %d correctly.", i)
+		}
+	}
+}
+
+// Split Segment test, keeping totals exact when rounding
+func TestSegment_Split_rounding(t *testing.T) {
+	results := runSplit(t, map[string]string{"bucket": "1s"},
+		&pb.EnrichedFlow{TimeFlowStartMs: 100, TimeFlowEndMs: 7000, Bytes: 1001, Packets: 3, ReverseBytes: 17})
+	var bytes, packets, reverseBytes uint64
+	for _, slice := range results {
+		bytes += slice.Bytes
+		packets += slice.Packets
+		reverseBytes += slice.ReverseBytes
+	}
+	if len(results) != 7 || bytes != 1001 || packets != 3 || reverseBytes != 17 {
+		t.Errorf("([error] Segment Split returned %d slices summing up to %d bytes, %d packets and %d reverse bytes.", len(results), bytes, packets, reverseBytes)
+	}
+	if results[0].TimeFlowStartMs != 100 || results[0].TimeFlowEndMs != 1000 || results[6].TimeFlowEndMs != 7000 {
+		t.Error("([error] Segment Split did not align slices to buckets.")
+	}
+}
+
+// Split Segment test, passing on flows which are not split
+func TestSegment_Split_unchanged(t *testing.T) {
+	for _, msg := range []*pb.EnrichedFlow{
+		{TimeFlowStart: 61, TimeFlowEnd: 119, Bytes: 100},
+		{TimeFlowEnd: 1000, Bytes: 100},
+		{TimeFlowStart: 1, TimeFlowEnd: 100000000, Bytes: 100},
+	} {
+		results := runSplit(t, map[string]string{"bucket": "1m"}, msg)
+		if len(results) != 1 || results[0] != msg || msg.Bytes != 100 || msg.SplitCount != 0 {
+			t.Errorf("([error] Segment Split modified flow %v.", msg)
+		}
+	}
+}
+
+// Split Segment test, acknowledging a flow once all slices have been
+func TestSegment_Split_ack(t *testing.T) {
+	msg := &pb.EnrichedFlow{TimeFlowStart: 30, TimeFlowEnd: 150, Bytes: 100}
+	done := false
+	segments.Track(msg, func() { done = true })
+	results := runSplit(t, map[string]string{"bucket": "1m"}, msg)
+	for i, slice := range results {
+		if done {
+			t.Fatalf("([error] Segment Split acknowledged the flow after %d of %d slices.", i, len(results))
+		}
+		segments.Ack(slice)
+	}
+	if !done {
+		t.Error("([error] Segment Split did not acknowledge the flow after all slices.")
+	}
+}
+
+// Split Segment test, rejecting invalid configurations
+func TestSegment_Split_invalidConfig(t *testing.T) {
+	for _, config := range []map[string]string{
+		{"bucket": "0s"},
+		{"bucket": "often"},
+		{"maxslices": "1"},
+	} {
+		template, _ := segments.LookupSegment("split")
+		if _, err := segments.NewSegment(template, config); err == nil {
+			t.Errorf("([error] Segment Split accepted invalid config %v.", config)
+		}
+	}
+}
@@ -6,7 +6,10 @@
 package clickhouse_segment
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"fmt"
 	"math"
 	"net"
 	"strconv"
@@ -23,8 +26,10 @@ import (
 )
 
 type Clickhouse struct {
-	segments.BaseSegment
+	segments.BaseOutputSegment
+	segments.BaseDeadLetterSegment
 	db              *sql.DB
+	connected       chan struct{} // closed once db is set up
 	createStatement string
 	insertStatement string
 
@@ -32,13 +37,13 @@ type Clickhouse struct {
 	Preset    string // optional, what schema to use, currently only the option and default is "flowhouse"
 	BatchSize int    // optional how many flows to hold in memory between INSERTs, default is 1000
 
-	bulkInsert func(unsavedFlows []*pb.EnrichedFlow) error
+	bulkInsert func(ctx context.Context, unsavedFlows []*pb.EnrichedFlow) error
 }
 
 // Every Segment must implement a New method, even if there isn't any config
 // it is interested in.
 func (segment Clickhouse) New(config map[string]string) segments.Segment {
-	newsegment := &Clickhouse{}
+	newsegment := &Clickhouse{connected: make(chan struct{})}
 
 	if config["dsn"] == "" {
 		log.Error().Msg("Clickhouse: Parameter 'dsn' is required.")
@@ -132,13 +137,52 @@ func (segment *Clickhouse) Run(wg *sync.WaitGroup) {
 		close(segment.Out)
 		wg.Done()
 	}()
+	segment.connect()
+	defer segment.db.Close()
+
+	var unsaved []*pb.EnrichedFlow
+
+	for msg := range segment.In {
+		unsaved = append(unsaved, segment.Keep(msg)) // until the batch has been written
+		if len(unsaved) >= segment.BatchSize {
+			segment.insert(context.Background(), unsaved)
+			unsaved = []*pb.EnrichedFlow{}
+		}
+		segment.Out <- msg
+	}
+	segment.insertFinal(unsaved)
+}
 
+func (segment *Clickhouse) RunBatches(in <-chan []*pb.EnrichedFlow, out chan<- []*pb.EnrichedFlow, wg *sync.WaitGroup) {
+	defer func() {
+		close(out)
+		wg.Done()
+	}()
+	segment.connect()
+	defer segment.db.Close()
+
+	var unsaved []*pb.EnrichedFlow
+
+	for batch := range in {
+		for _, msg := range batch {
+			unsaved = append(unsaved, segment.Keep(msg)) // until the batch has been written
+			if len(unsaved) >= segment.BatchSize {
+				segment.insert(context.Background(), unsaved)
+				unsaved = []*pb.EnrichedFlow{}
+			}
+		}
+		out <- batch
+	}
+	segment.insertFinal(unsaved)
+}
+
+// Opens the database and creates the table if necessary.
+func (segment *Clickhouse) connect() {
 	var err error
 	segment.db, err = sql.Open("clickhouse", segment.DSN)
 	if err != nil {
 		log.Panic().Err(err).Msg("Clickhouse: Could not open database with error")
 	}
-	defer segment.db.Close()
 
 	tx, err := segment.db.Begin()
 	if err != nil {
@@ -149,31 +193,53 @@ func (segment *Clickhouse) Run(wg *sync.WaitGroup) {
 		log.Panic().Err(err).Msg("Clickhouse: Could not create database, check field configuration")
 	}
 	tx.Commit()
+	close(segment.connected)
+}
 
-	var unsaved []*pb.EnrichedFlow
+// Writes a batch of flows and acknowledges them, handing them to the dead
+// letter pipeline if this failed.
+func (segment *Clickhouse) insert(ctx context.Context, unsaved []*pb.EnrichedFlow) error {
+	err := segment.bulkInsert(ctx, unsaved)
+	if err != nil {
+		log.Error().Err(err).Msg("Clickhouse: Bulk insert failed")
+		segment.DeadLetter(err, unsaved...)
+	}
+	segments.Ack(unsaved...)
+	return err
+}
 
-	for msg := range segment.In {
-		unsaved = append(unsaved, msg)
-		if len(unsaved) >= segment.BatchSize {
-			err := segment.bulkInsert(unsaved)
-			if err != nil {
-				log.Error().Err(err).Msg("Clickhouse: Bulk insert failed")
-			}
-			unsaved = []*pb.EnrichedFlow{}
-		}
-		segment.Out <- msg
+// Writes the last batch on shutdown, which is bounded by the pipeline's flush
+// deadline.
+func (segment *Clickhouse) insertFinal(unsaved []*pb.EnrichedFlow) {
+	if err := segment.insert(segment.Context(), unsaved); err != nil {
+		segment.FlushFailed(fmt.Errorf("Clickhouse: Final bulk insert of %d flows failed: %w", len(unsaved), err))
+	}
+}
+
+// Reports whether the database is reachable, see segments.HealthReporter.
+func (segment *Clickhouse) Health(ctx context.Context) error {
+	select {
+	case <-segment.connected:
+		return segment.db.PingContext(ctx)
+	default:
+		return errors.New("not connected to the database yet")
 	}
-	segment.bulkInsert(unsaved)
 }
 
-func (segment Clickhouse) bulkInsertFlowhouse(unsavedFlows []*pb.EnrichedFlow) error {
+// Inserts a batch of flows in a single transaction. If the transaction fails,
+// the error is returned and none of the flows have been inserted. Otherwise,
+// flows which could not be inserted on their own are handed to the dead
+// letter pipeline.
+func (segment *Clickhouse) bulkInsertFlowhouse(ctx context.Context, unsavedFlows []*pb.EnrichedFlow) error {
 	if len(unsavedFlows) == 0 {
 		return nil
 	}
-	tx, err := segment.db.Begin()
+	tx, err := segment.db.BeginTx(ctx, nil)
 	if err != nil {
 		log.Error().Err(err).Msgf("Clickhouse: Error starting transaction for current batch of %d flows", len(unsavedFlows))
+		return err
 	}
+	var failed []segments.DeadLetter
 	for _, msg := range unsavedFlows {
 		var srcPfx, dstPfx net.IP
 		if msg.IsIPv6() {
@@ -205,12 +271,18 @@ func (segment Clickhouse) bulkInsertFlowhouse(unsavedFlows []*pb.EnrichedFlow) e
 			msg.Packets,
 			msg.SamplingRate,
 		}
-		_, err := tx.Exec(segment.insertStatement, valueArgs...)
+		_, err := tx.ExecContext(ctx, segment.insertStatement, valueArgs...)
 		if err != nil {
 			log.Error().Err(err).Msg("Clickhouse: Error inserting flow into transaction")
+			failed = append(failed, segments.DeadLetter{Flow: msg, Err: err})
 		}
 	}
-	tx.Commit()
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for _, deadLetter := range failed {
+		segment.DeadLetter(deadLetter.Err, deadLetter.Flow)
+	}
 	return nil
 }
 
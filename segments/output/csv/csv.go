@@ -81,30 +81,50 @@ func (segment *Csv) Run(wg *sync.WaitGroup) {
 		wg.Done()
 	}()
 	for msg := range segment.In {
-		var record []string
-		values := reflect.ValueOf(msg).Elem()
-		for _, fieldname := range segment.fieldNames {
-			value := values.FieldByName(fieldname).Interface()
-			switch value := value.(type) {
-			case []uint8: // this is necessary for proper formatting
-				ipstring := net.IP(value).String()
-				if ipstring == "<nil>" {
-					ipstring = ""
-				}
-				record = append(record, ipstring)
-			case uint32: // this is because FormatUint is much faster than Sprint
-				record = append(record, strconv.FormatUint(uint64(value), 10))
-			case uint64: // this is because FormatUint is much faster than Sprint
-				record = append(record, strconv.FormatUint(uint64(value), 10))
-			case string: // this is because doing nothing is also much faster than Sprint
-				record = append(record, value)
-			default:
-				record = append(record, fmt.Sprint(value))
+		segment.writer.Write(segment.record(msg))
+		segment.Out <- msg
+	}
+}
+
+func (segment *Csv) RunBatches(in <-chan []*pb.EnrichedFlow, out chan<- []*pb.EnrichedFlow, wg *sync.WaitGroup) {
+	defer func() {
+		segment.writer.Flush()
+		segment.File.Close()
+		close(out)
+		wg.Done()
+	}()
+	for batch := range in {
+		for _, msg := range batch {
+			segment.writer.Write(segment.record(msg))
+		}
+		out <- batch
+	}
+}
+
+// Formats the configured fields of a flow as a CSV record.
+func (segment *Csv) record(msg *pb.EnrichedFlow) []string {
+	var record []string
+	values := reflect.ValueOf(msg).Elem()
+	for _, fieldname := range segment.fieldNames {
+		value := values.FieldByName(fieldname).Interface()
+		switch value := value.(type) {
+		case []uint8: // this is necessary for proper formatting
+			ipstring := net.IP(value).String()
+			if ipstring == "<nil>" {
+				ipstring = ""
 			}
+			record = append(record, ipstring)
+		case uint32: // this is because FormatUint is much faster than Sprint
+			record = append(record, strconv.FormatUint(uint64(value), 10))
+		case uint64: // this is because FormatUint is much faster than Sprint
+			record = append(record, strconv.FormatUint(uint64(value), 10))
+		case string: // this is because doing nothing is also much faster than Sprint
+			record = append(record, value)
+		default:
+			record = append(record, fmt.Sprint(value))
 		}
-		segment.writer.Write(record)
-		segment.Out <- msg
 	}
+	return record
 }
 
 func init() {
@@ -3,25 +3,38 @@
 // field available in the [protobuf definition](https://github.com/BelWue/flowpipeline/blob/master/pb/flow.proto).
 // The `fields` works in the exact same way, except that these protobuf fields won't be indexed by InfluxDB.
 //
+// Points are written in the background in batches of 5000, or once per second.
+// Batches which can not be written are not retried, their flows are handed to
+// the `deadletter` pipeline if configured.
+//
 // Note that some of the above fields might not be present depending on the method
 // of flow export, the input segment used in this pipeline, or the modify segments
 // in front of this export segment.
 package influx
 
 import (
+	"context"
+	"fmt"
 	"net/url"
 	"reflect"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
 	"github.com/rs/zerolog/log"
 
 	"github.com/BelWue/flowpipeline/pb"
 	"github.com/BelWue/flowpipeline/segments"
 )
 
+// The maximum time points are held back before being written.
+const flushInterval = time.Second
+
 type Influx struct {
-	segments.BaseSegment
+	segments.BaseOutputSegment
+	segments.BaseDeadLetterSegment
 	Address string   // optional, URL for influxdb endpoint, default is http://127.0.0.1:8086
 	Org     string   // required, Influx org name
 	Bucket  string   // required, Influx bucket
@@ -117,25 +130,81 @@ func (segment *Influx) Run(wg *sync.WaitGroup) {
 
 	// initialize Influx endpoint
 	connector.Initialize()
-	writeAPI := connector.influxClient.WriteAPI(connector.Org, connector.Bucket)
+	writeAPI := connector.influxClient.WriteAPIBlocking(connector.Org, connector.Bucket)
 	defer func() {
 		close(segment.Out)
-		// Force all unwritten data to be sent
-		writeAPI.Flush()
 		connector.influxClient.Close()
 		wg.Done()
 	}()
 
-	for msg := range segment.In {
-		segment.Out <- msg
-		datapoint := connector.CreatePoint(msg)
-		if datapoint == nil {
-			// just ignore raised warnings if flow cannot be converted or unmarshalled
-			continue
+	// points are written in batches on a separate goroutine, so flows are
+	// not held back while a batch is being written
+	batches := make(chan batch)
+	written := make(chan error)
+	go func() {
+		// the last batch is written on shutdown, which is bounded by the
+		// pipeline's flush deadline
+		written <- segment.write(segment.Context(), writeAPI, batches)
+	}()
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	var unsaved batch
+	for {
+		select {
+		case msg, ok := <-segment.In:
+			if !ok {
+				if len(unsaved.datapoints) > 0 {
+					batches <- unsaved
+				}
+				close(batches)
+				if err := <-written; err != nil {
+					segment.FlushFailed(fmt.Errorf("Influx: Final write failed: %w", err))
+				}
+				return
+			}
+			datapoint := connector.CreatePoint(msg)
+			if datapoint == nil {
+				// just ignore raised warnings if flow cannot be converted or unmarshalled
+				segment.Out <- msg
+				continue
+			}
+			unsaved.flows = append(unsaved.flows, segment.Keep(msg)) // until its batch has been written
+			unsaved.datapoints = append(unsaved.datapoints, datapoint)
+			segment.Out <- msg
+			if len(unsaved.datapoints) >= connector.Batchsize {
+				batches <- unsaved
+				unsaved = batch{}
+			}
+		case <-ticker.C:
+			if len(unsaved.datapoints) > 0 {
+				batches <- unsaved
+				unsaved = batch{}
+			}
+		}
+	}
+}
+
+// The points written at once, along with the flows they were created from.
+type batch struct {
+	flows      []*pb.EnrichedFlow
+	datapoints []*write.Point
+}
+
+// Writes all batches until batches is closed. Returns the error of the last
+// batch, which is the one flushed on shutdown. Flows of batches which could
+// not be written are handed to the dead letter pipeline.
+func (segment *Influx) write(ctx context.Context, writeAPI api.WriteAPIBlocking, batches chan batch) error {
+	var err error
+	for unsaved := range batches {
+		err = writeAPI.WritePoint(ctx, unsaved.datapoints...)
+		if err != nil {
+			log.Error().Err(err).Msgf("Influx: Failed to write %d flows", len(unsaved.flows))
+			segment.DeadLetter(err, unsaved.flows...)
 		}
-		// async write
-		writeAPI.WritePoint(datapoint)
+		segments.Ack(unsaved.flows...)
 	}
+	return err
 }
 
 func init() {
@@ -25,6 +25,7 @@ import (
 	"github.com/klauspost/compress/zstd"
 	"github.com/rs/zerolog/log"
 
+	"github.com/BelWue/flowpipeline/pb"
 	"github.com/BelWue/flowpipeline/segments"
 	"google.golang.org/protobuf/encoding/protojson"
 )
@@ -35,12 +36,42 @@ type Json struct {
 	Pretty bool // optional, default is false
 }
 
+// Options of the json segment for use with the builder package.
+type Options struct {
+	Filename string // optional, default is empty which means stdout
+	Pretty   bool   // optional, default is false
+	Zstd     int    // optional, compresses the output using this zstd level if set
+}
+
+func (options Options) SegmentName() string {
+	return "json"
+}
+
+func (options Options) SegmentConfig() map[string]string {
+	config := map[string]string{"filename": options.Filename}
+	if options.Pretty {
+		config["pretty"] = "true"
+	}
+	if options.Zstd != 0 {
+		config["zstd"] = strconv.Itoa(options.Zstd)
+	}
+	return config
+}
+
 func (segment Json) New(config map[string]string) segments.Segment {
+	newSegment, err := segment.NewWithError(config)
+	if err != nil {
+		log.Error().Err(err).Msg("Json: ")
+		return nil
+	}
+	return newSegment
+}
+
+func (segment Json) NewWithError(config map[string]string) (segments.Segment, error) {
 	newsegment := &Json{}
 	file, err := segment.GetOutput(config)
 	if err != nil {
-		log.Error().Err(err).Msg("Json: File specified in 'filename' is not accessible: ")
-		return nil
+		return nil, fmt.Errorf("file specified in 'filename' is not accessible: %w", err)
 	}
 	log.Info().Msgf("Json: configured output to %s", file.Name())
 
@@ -56,7 +87,7 @@ func (segment Json) New(config map[string]string) segments.Segment {
 		}
 		encoder, err := zstd.NewWriter(file, zstd.WithEncoderLevel(level))
 		if err != nil {
-			log.Fatal().Err(err).Msg("Json: error creating zstd encoder: ")
+			return nil, fmt.Errorf("error creating zstd encoder: %w", err)
 		}
 		newsegment.writer = bufio.NewWriter(encoder)
 	} else {
@@ -77,7 +108,7 @@ func (segment Json) New(config map[string]string) segments.Segment {
 
 	newsegment.Pretty = pretty
 
-	return newsegment
+	return newsegment, nil
 }
 
 func (segment *Json) Run(wg *sync.WaitGroup) {
@@ -90,16 +121,7 @@ func (segment *Json) Run(wg *sync.WaitGroup) {
 
 	marshalOptions := protojson.MarshalOptions{Multiline: segment.Pretty}
 	for msg := range segment.In {
-		data, err := marshalOptions.Marshal(msg)
-		if err != nil {
-			log.Warn().Err(err).Msg("Json: Skipping a flow, failed to recode protobuf as JSON: ")
-			continue
-		}
-
-		// use Fprintln because it adds an OS specific newline
-		_, err = fmt.Fprintln(segment.writer, string(data))
-		if err != nil {
-			log.Warn().Err(err).Msgf("Json: Skipping a flow, failed to write to file %s", segment.File.Name())
+		if !segment.write(marshalOptions, msg) {
 			continue
 		}
 		// we need to flush here every time because we need full lines and can not wait
@@ -109,6 +131,47 @@ func (segment *Json) Run(wg *sync.WaitGroup) {
 	}
 }
 
+func (segment *Json) RunBatches(in <-chan []*pb.EnrichedFlow, out chan<- []*pb.EnrichedFlow, wg *sync.WaitGroup) {
+	defer func() {
+		_ = segment.writer.Flush()
+		segment.File.Close()
+		close(out)
+		wg.Done()
+	}()
+
+	marshalOptions := protojson.MarshalOptions{Multiline: segment.Pretty}
+	for batch := range in {
+		written := batch[:0] // skip flows failing to be written
+		for _, msg := range batch {
+			if segment.write(marshalOptions, msg) {
+				written = append(written, msg)
+			}
+		}
+		// flushing once per batch still results in full lines
+		_ = segment.writer.Flush()
+		if len(written) > 0 {
+			out <- written
+		}
+	}
+}
+
+// Writes a flow as a line of JSON. Returns false if the flow was skipped.
+func (segment *Json) write(marshalOptions protojson.MarshalOptions, msg *pb.EnrichedFlow) bool {
+	data, err := marshalOptions.Marshal(msg)
+	if err != nil {
+		log.Warn().Err(err).Msg("Json: Skipping a flow, failed to recode protobuf as JSON: ")
+		return false
+	}
+
+	// use Fprintln because it adds an OS specific newline
+	_, err = fmt.Fprintln(segment.writer, string(data))
+	if err != nil {
+		log.Warn().Err(err).Msgf("Json: Skipping a flow, failed to write to file %s", segment.File.Name())
+		return false
+	}
+	return true
+}
+
 func init() {
 	segment := &Json{}
 	segments.RegisterSegment("json", segment)
@@ -45,7 +45,8 @@ import (
 
 // FIXME: use sarama directly here
 type KafkaProducer struct {
-	segments.BaseSegment
+	segments.BaseOutputSegment
+	segments.BaseDeadLetterSegment
 	Server       string // required
 	Topic        string // required
 	TopicSuffix  string // optional, default is empty
@@ -88,8 +89,8 @@ func (segment KafkaProducer) New(config map[string]string) segments.Segment {
 	newsegment.saramaConfig.Producer.RequiredAcks = sarama.WaitForLocal       // Only wait for the leader to ack
 	newsegment.saramaConfig.Producer.Compression = sarama.CompressionSnappy   // Compress messages
 	newsegment.saramaConfig.Producer.Flush.Frequency = 500 * time.Millisecond // Flush batches every 500ms
-	newsegment.saramaConfig.Producer.Return.Successes = false                 // this would block until we've read the ACK, just don't
-	newsegment.saramaConfig.Producer.Return.Errors = false                    // this would block until we've read the error, but we wouldn't retry anyways
+	newsegment.saramaConfig.Producer.Return.Successes = true                  // acknowledges flows once produced
+	newsegment.saramaConfig.Producer.Return.Errors = true                     // hands flows which could not be produced to the dead letter pipeline
 
 	if config["kafka-version"] != "" {
 		newsegment.saramaConfig.Version, err = sarama.ParseKafkaVersion(config["kafka-version"])
@@ -190,59 +191,171 @@ func (segment *KafkaProducer) Run(wg *sync.WaitGroup) {
 		wg.Done()
 	}()
 
-	producer, err := sarama.NewAsyncProducer(strings.Split(segment.Server, ","), segment.saramaConfig)
+	producer, closeProducer, err := segment.startProducer()
+	if err != nil {
+		log.Error().Err(err).Msg("KafkaProducer: Could not create producer, no flows will be produced. ")
+		for msg := range segment.In {
+			kept := segment.Keep(msg)
+			segment.Out <- msg
+			segment.DeadLetter(err, kept)
+			segments.Ack(kept)
+		}
+		return
+	}
+	defer closeProducer()
 
 	for msg := range segment.In {
+		kept := segment.Keep(msg) // until it has been produced
 		segment.Out <- msg
-		var binary []byte
-		if segment.Legacy {
-			legacyFlow := msg.ConvertToLegacyEnrichedFlow()
-			if binary, err = proto.Marshal(legacyFlow); err != nil {
-				log.Error().Err(err).Msg("KafkaProducer: Error encoding protobuf. ")
-				continue
+		// the original may be modified by the following segments by now
+		if !segment.produce(producer, kept) {
+			return
+		}
+	}
+}
+
+func (segment *KafkaProducer) RunBatches(in <-chan []*pb.EnrichedFlow, out chan<- []*pb.EnrichedFlow, wg *sync.WaitGroup) {
+	defer func() {
+		close(out)
+		wg.Done()
+	}()
+
+	producer, closeProducer, err := segment.startProducer()
+	if err != nil {
+		log.Error().Err(err).Msg("KafkaProducer: Could not create producer, no flows will be produced. ")
+		for batch := range in {
+			kept := segment.keepBatch(batch)
+			out <- batch
+			segment.DeadLetter(err, kept...)
+			segments.Ack(kept...)
+		}
+		return
+	}
+	defer closeProducer()
+
+	for batch := range in {
+		kept := segment.keepBatch(batch) // until they have been produced
+		out <- batch
+		for i, msg := range kept {
+			if !segment.produce(producer, msg) {
+				segments.Ack(kept[i+1:]...)
+				return
 			}
-		} else {
-			if msg != nil {
-				protoProducerMessage := pb.ProtoProducerMessage{}
-				msg.SyncMissingTimeStamps()
-				protoProducerMessage.EnrichedFlow = *msg
-				if binary, err = protoProducerMessage.MarshalBinary(); err != nil {
-					log.Error().Err(err).Msg("KafkaProducer: Error encoding protobuf. ")
+		}
+	}
+}
+
+// Keeps all flows of a batch, see segments.BaseDeadLetterSegment.Keep.
+func (segment *KafkaProducer) keepBatch(batch []*pb.EnrichedFlow) []*pb.EnrichedFlow {
+	kept := make([]*pb.EnrichedFlow, len(batch))
+	for i, msg := range batch {
+		kept[i] = segment.Keep(msg)
+	}
+	return kept
+}
+
+// Creates the producer and starts acknowledging the flows it produced, or
+// handing them to the dead letter pipeline if this failed. The returned
+// function closes the producer and waits for all buffered flows.
+func (segment *KafkaProducer) startProducer() (sarama.AsyncProducer, func(), error) {
+	producer, err := sarama.NewAsyncProducer(strings.Split(segment.Server, ","), segment.saramaConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the results need to be read until the producer has been closed, which
+	// waits for all buffered messages
+	produced := make(chan struct{})
+	go func() {
+		defer close(produced)
+		successes, errors := producer.Successes(), producer.Errors()
+		for successes != nil || errors != nil {
+			select {
+			case producerMessage, ok := <-successes:
+				if !ok {
+					successes = nil
+					continue
+				}
+				if msg, ok := producerMessage.Metadata.(*pb.EnrichedFlow); ok {
+					segments.Ack(msg)
+				}
+			case producerError, ok := <-errors:
+				if !ok {
+					errors = nil
 					continue
 				}
-			} else {
-				log.Error().Msgf("KafkaProducer: Empty message")
-				continue
+				if msg, ok := producerError.Msg.Metadata.(*pb.EnrichedFlow); ok {
+					segment.DeadLetter(producerError.Err, msg)
+					segments.Ack(msg)
+				}
 			}
 		}
+	}()
+	return producer, func() {
+		producer.AsyncClose()
+		<-produced
+	}, nil
+}
 
-		if segment.TopicSuffix == "" {
-			producer.Input() <- &sarama.ProducerMessage{
-				Topic: segment.Topic,
-				Value: sarama.ByteEncoder(binary),
+// Hands a flow kept by the segment to the producer. Returns false if the
+// segment is unable to produce any flows and has shut down the pipeline.
+func (segment *KafkaProducer) produce(producer sarama.AsyncProducer, msg *pb.EnrichedFlow) bool {
+	var binary []byte
+	var err error
+	if segment.Legacy {
+		legacyFlow := msg.ConvertToLegacyEnrichedFlow()
+		if binary, err = proto.Marshal(legacyFlow); err != nil {
+			log.Error().Err(err).Msg("KafkaProducer: Error encoding protobuf. ")
+			segment.DeadLetter(err, msg)
+			segments.Ack(msg)
+			return true
+		}
+	} else {
+		if msg != nil {
+			protoProducerMessage := pb.ProtoProducerMessage{}
+			msg.SyncMissingTimeStamps()
+			protoProducerMessage.EnrichedFlow = *msg
+			if binary, err = protoProducerMessage.MarshalBinary(); err != nil {
+				log.Error().Err(err).Msg("KafkaProducer: Error encoding protobuf. ")
+				segment.DeadLetter(err, msg)
+				segments.Ack(msg)
+				return true
 			}
 		} else {
-			fmsg := reflect.ValueOf(msg).Elem()
-			field := fmsg.FieldByName(segment.TopicSuffix)
-			var suffix string
-			switch field.Type().String() {
-			case "uint32": // this is because FormatUint is much faster than Sprint
-				suffix = strconv.FormatUint(uint64(field.Interface().(uint32)), 10)
-			case "uint64": // this is because FormatUint is much faster than Sprint
-				suffix = strconv.FormatUint(uint64(field.Interface().(uint64)), 10)
-			case "string": // this is because doing nothing is also much faster than Sprint
-				suffix = field.Interface().(string)
-			default:
-				log.Error().Msg("KafkaProducer: TopicSuffix must be of type uint or string.")
-				segment.ShutdownParentPipeline()
-				return
-			}
-			producer.Input() <- &sarama.ProducerMessage{
-				Topic: segment.Topic + "-" + suffix,
-				Value: sarama.ByteEncoder(binary),
-			}
+			log.Error().Msgf("KafkaProducer: Empty message")
+			return true
+		}
+	}
+
+	if segment.TopicSuffix == "" {
+		producer.Input() <- &sarama.ProducerMessage{
+			Topic:    segment.Topic,
+			Value:    sarama.ByteEncoder(binary),
+			Metadata: msg,
+		}
+	} else {
+		fmsg := reflect.ValueOf(msg).Elem()
+		field := fmsg.FieldByName(segment.TopicSuffix)
+		var suffix string
+		switch field.Type().String() {
+		case "uint32": // this is because FormatUint is much faster than Sprint
+			suffix = strconv.FormatUint(uint64(field.Interface().(uint32)), 10)
+		case "uint64": // this is because FormatUint is much faster than Sprint
+			suffix = strconv.FormatUint(uint64(field.Interface().(uint64)), 10)
+		case "string": // this is because doing nothing is also much faster than Sprint
+			suffix = field.Interface().(string)
+		default:
+			log.Error().Msg("KafkaProducer: TopicSuffix must be of type uint or string.")
+			segments.Ack(msg)
+			segment.ShutdownParentPipeline()
+			return false
+		}
+		producer.Input() <- &sarama.ProducerMessage{
+			Topic:    segment.Topic + "-" + suffix,
+			Value:    sarama.ByteEncoder(binary),
+			Metadata: msg,
 		}
 	}
+	return true
 }
 
 func init() {
@@ -1,7 +1,11 @@
 package kafkaproducer
 
 import (
+	"sync"
 	"testing"
+
+	"github.com/BelWue/flowpipeline/pb"
+	"github.com/BelWue/flowpipeline/segments"
 )
 
 func TestSegment_KafkaProducer_instanciation(t *testing.T) {
@@ -36,3 +40,53 @@ func TestSegment_KafkaProducer_instanciation(t *testing.T) {
 		t.Error("([error] Segment KafkaProducer did not initiate successfully.")
 	}
 }
+
+// KafkaProducer Segment test, dead letters are not modified by the following segments
+func TestSegment_KafkaProducer_deadLetter(t *testing.T) {
+	segment := (&KafkaProducer{}).New(map[string]string{"server": "127.0.0.1:1", "topic": "duh", "tls": "0", "auth": "0"}).(*KafkaProducer)
+	segment.saramaConfig.Metadata.Retry.Max = 0
+	deadLetters := make(chan *segments.DeadLetter)
+	segment.SubscribeDeadLetters(deadLetters)
+
+	in, out := make(chan *pb.EnrichedFlow), make(chan *pb.EnrichedFlow)
+	segment.Rewire(in, out)
+
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go segment.Run(wg)
+
+	in <- &pb.EnrichedFlow{Proto: 6}
+	msg := <-out
+	msg.Proto = 17
+	deadLetter := <-deadLetters
+	if deadLetter.Flow == msg || deadLetter.Flow.Proto != 6 {
+		t.Error("([error] Segment KafkaProducer handed a flow to the dead letter pipeline after handing it on.")
+	}
+	close(in)
+	wg.Wait()
+}
+
+// KafkaProducer Segment test, all flows of a batch are dead lettered without a producer
+func TestSegment_KafkaProducer_deadLetterBatches(t *testing.T) {
+	segment := (&KafkaProducer{}).New(map[string]string{"server": "127.0.0.1:1", "topic": "duh", "tls": "0", "auth": "0"}).(*KafkaProducer)
+	segment.saramaConfig.Metadata.Retry.Max = 0
+	deadLetters := make(chan *segments.DeadLetter)
+	segment.SubscribeDeadLetters(deadLetters)
+
+	in, out := make(chan []*pb.EnrichedFlow), make(chan []*pb.EnrichedFlow)
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go segment.RunBatches(in, out, wg)
+
+	in <- []*pb.EnrichedFlow{{Proto: 6}, {Proto: 17}}
+	batch := <-out
+	batch[0].Proto, batch[1].Proto = 1, 1
+	for _, proto := range []uint32{6, 17} {
+		if deadLetter := <-deadLetters; deadLetter.Flow.Proto != proto {
+			t.Error("([error] Segment KafkaProducer did not dead letter the flows of a batch as they were.")
+		}
+	}
+	close(in)
+	<-out
+	wg.Wait()
+}
@@ -33,7 +33,8 @@
 // to both observe and tune this segment's performance.
 //
 // Upon connection error or loss, the segment will try to reconnect indefinitely with a pause of
-// `reconnectwait` between attempts.
+// `reconnectwait` between attempts. The final batches which can not be sent on shutdown
+// are handed to the `deadletter` pipeline if configured.
 //
 // * `queuesize` (integer) sets the number of flows that are buffered between the segment and the output go routines.
 // * `batchsize` (integer) sets the number of flows that each output go routine buffers before sending.
@@ -158,11 +159,18 @@ func (c *resilientClient) Send(events []interface{}) {
 
 // SendNoRetry will try to send the given events to the server. If the connection fails, it will not retry.
 func (c *resilientClient) SendNoRetry(events []interface{}) (int, error) {
+	// connect on first send when no client exists
+	if c.sc == nil {
+		c.connect()
+	}
 	return c.sc.Send(events)
 }
 
 // Close will close the connection to the server.
 func (c *resilientClient) Close() {
+	if c.sc == nil {
+		return
+	}
 	err := c.sc.Close()
 	if err != nil {
 		log.Error().Err(err).Msgf("Lumberjack: Error closing connection to server %s", c.ServerName)
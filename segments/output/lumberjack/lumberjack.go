@@ -2,6 +2,9 @@
 package lumberjack
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net/url"
 	"runtime"
 	"strconv"
@@ -32,7 +35,8 @@ type ServerOptions struct {
 }
 
 type Lumberjack struct {
-	segments.BaseSegment
+	segments.BaseOutputSegment
+	segments.BaseDeadLetterSegment
 	Servers             map[string]ServerOptions
 	BatchSize           int
 	BatchTimeout        time.Duration
@@ -48,6 +52,16 @@ func DoDebugPrintf(format string, v ...any) {
 }
 
 func (segment *Lumberjack) New(config map[string]string) segments.Segment {
+	newSegment, err := segment.NewWithError(config)
+	if err != nil {
+		log.Error().Err(err).Msg("Lumberjack: ")
+		return nil
+	}
+	return newSegment
+}
+
+func (segment *Lumberjack) NewWithError(config map[string]string) (segments.Segment, error) {
+	segment = &Lumberjack{} // do not modify the registered instance
 	var (
 		err                error
 		buflen             int
@@ -61,10 +75,10 @@ func (segment *Lumberjack) New(config map[string]string) segments.Segment {
 	} else {
 		defaultCompression, err = strconv.Atoi(defaultCompressionString)
 		if err != nil {
-			log.Fatal().Err(err).Msgf("Lumberjack: Failed to parse default compression level %s", defaultCompressionString)
+			return nil, fmt.Errorf("failed to parse default compression level %s: %w", defaultCompressionString, err)
 		}
 		if defaultCompression < 0 || defaultCompression > 9 {
-			log.Fatal().Msgf("Lumberjack: Default compression level %d is out of range", defaultCompression)
+			return nil, fmt.Errorf("default compression level %d is out of range", defaultCompression)
 		}
 	}
 
@@ -74,13 +88,13 @@ func (segment *Lumberjack) New(config map[string]string) segments.Segment {
 		rawServerStrings[idx] = strings.TrimSpace(serverName)
 	}
 	if len(rawServerStrings) == 0 {
-		log.Fatal().Msg("Lumberjack: No servers specified in 'servers' config option.")
+		return nil, errors.New("no servers specified in 'servers' config option")
 	} else {
 		segment.Servers = make(map[string]ServerOptions)
 		for _, rawServerString := range rawServerStrings {
 			serverURL, err := url.Parse(rawServerString)
 			if err != nil {
-				log.Fatal().Err(err).Msgf("Lumberjack: Failed to parse server URL %s", rawServerString)
+				return nil, fmt.Errorf("failed to parse server URL %s: %w", rawServerString, err)
 			}
 			urlQueryParams := serverURL.Query()
 
@@ -97,7 +111,7 @@ func (segment *Lumberjack) New(config map[string]string) segments.Segment {
 				useTLS = true
 				verifyTLS = false
 			default:
-				log.Fatal().Msgf("Lumberjack: Unknown scheme %s in server URL %s", serverURL.Scheme, rawServerString)
+				return nil, fmt.Errorf("unknown scheme %s in server URL %s", serverURL.Scheme, rawServerString)
 			}
 
 			// parse compression level
@@ -110,10 +124,10 @@ func (segment *Lumberjack) New(config map[string]string) segments.Segment {
 			} else {
 				compressionLevel, err = strconv.Atoi(compressionString)
 				if err != nil {
-					log.Fatal().Err(err).Msgf("Lumberjack: Failed to parse compression level %s for host %s", compressionString, serverURL.Host)
+					return nil, fmt.Errorf("failed to parse compression level %s for host %s: %w", compressionString, serverURL.Host, err)
 				}
 				if compressionLevel < 0 || compressionLevel > 9 {
-					log.Fatal().Msgf("Lumberjack: Compression level %d out of range for host %s", compressionLevel, serverURL.Host)
+					return nil, fmt.Errorf("compression level %d out of range for host %s", compressionLevel, serverURL.Host)
 				}
 			}
 
@@ -126,7 +140,7 @@ func (segment *Lumberjack) New(config map[string]string) segments.Segment {
 				numRoutines, err = strconv.Atoi(numRoutinesString)
 				switch {
 				case err != nil:
-					log.Fatal().Err(err).Msgf("Lumberjack: Failed to parse count %s for host %s", numRoutinesString, serverURL.Host)
+					return nil, fmt.Errorf("failed to parse count %s for host %s: %w", numRoutinesString, serverURL.Host, err)
 				case numRoutines < 1:
 					log.Warn().Msgf("Lumberjack: count is smaller than 1, setting to 1")
 					numRoutines = 1
@@ -149,7 +163,7 @@ func (segment *Lumberjack) New(config map[string]string) segments.Segment {
 	if config["batchsize"] != "" {
 		segment.BatchSize, err = strconv.Atoi(strings.ReplaceAll(config["batchsize"], "_", ""))
 		if err != nil {
-			log.Fatal().Err(err).Msg("Lumberjack: Failed to parse batchsize config option: ")
+			return nil, fmt.Errorf("failed to parse batchsize config option: %w", err)
 		}
 	}
 	if segment.BatchSize < 0 {
@@ -160,7 +174,7 @@ func (segment *Lumberjack) New(config map[string]string) segments.Segment {
 	if config["batchtimeout"] != "" {
 		segment.BatchTimeout, err = time.ParseDuration(config["batchtimeout"])
 		if err != nil {
-			log.Fatal().Err(err).Msg("Lumberjack: Failed to parse timeout config option: ")
+			return nil, fmt.Errorf("failed to parse timeout config option: %w", err)
 		}
 	}
 
@@ -176,7 +190,7 @@ func (segment *Lumberjack) New(config map[string]string) segments.Segment {
 	if config["batchdebug"] != "" {
 		batchDebug, err := strconv.ParseBool(config["batchdebug"])
 		if err != nil {
-			log.Fatal().Err(err).Msg("Lumberjack: Failed to parse batchdebug config option: ")
+			return nil, fmt.Errorf("failed to parse batchdebug config option: %w", err)
 		}
 		// set proper BatchDebugPrintf function
 		if batchDebug {
@@ -191,7 +205,7 @@ func (segment *Lumberjack) New(config map[string]string) segments.Segment {
 	if config["reconnectwait"] != "" {
 		segment.ReconnectWait, err = time.ParseDuration(config["reconnectwait"])
 		if err != nil {
-			log.Fatal().Err(err).Msg("Lumberjack: Failed to parse reconnectwait config option: ")
+			return nil, fmt.Errorf("failed to parse reconnectwait config option: %w", err)
 		}
 	}
 
@@ -200,7 +214,7 @@ func (segment *Lumberjack) New(config map[string]string) segments.Segment {
 	if config["queuestatusinterval"] != "" {
 		segment.QueueStatusInterval, err = time.ParseDuration(config["queuestatusinterval"])
 		if err != nil {
-			log.Fatal().Err(err).Msg("Lumberjack: Failed to parse queuestatussnterval config option: ")
+			return nil, fmt.Errorf("failed to parse queuestatussnterval config option: %w", err)
 		}
 	}
 
@@ -208,7 +222,7 @@ func (segment *Lumberjack) New(config map[string]string) segments.Segment {
 	if config["queuesize"] != "" {
 		buflen, err = strconv.Atoi(strings.ReplaceAll(config["queuesize"], "_", ""))
 		if err != nil {
-			log.Fatal().Err(err).Msg("Lumberjack: Failed to parse queuesize config option: ")
+			return nil, fmt.Errorf("failed to parse queuesize config option: %w", err)
 		}
 	} else {
 		buflen = defaultQueueSize
@@ -219,17 +233,36 @@ func (segment *Lumberjack) New(config map[string]string) segments.Segment {
 	}
 	segment.LumberjackOut = make(chan *pb.EnrichedFlow, buflen)
 
-	return segment
+	return segment, nil
 }
 
 func (segment *Lumberjack) Run(wg *sync.WaitGroup) {
-	var writerWG sync.WaitGroup
+	var (
+		writerWG    sync.WaitGroup
+		unsentMutex sync.Mutex
+		unsent      []segments.DeadLetter // final batches the writers failed to send
+	)
 
 	defer func() {
+		// the writers send their final batches on shutdown, which is
+		// bounded by the pipeline's flush deadline
+		stopped := make(chan struct{})
+		go func() {
+			writerWG.Wait()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+			log.Info().Msg("Lumberjack: All writer functions have stopped, exiting…")
+			for _, deadLetter := range unsent {
+				segment.DeadLetter(deadLetter.Err, deadLetter.Flow)
+				segments.Ack(deadLetter.Flow)
+			}
+		case <-segment.Context().Done():
+			segment.FlushFailed(fmt.Errorf("Lumberjack: Writer functions did not send their final batches in time: %w", context.Cause(segment.Context())))
+		}
 		close(segment.Out)
-		writerWG.Wait()
 		wg.Done()
-		log.Info().Msg("Lumberjack: All writer functions have stopped, exiting…")
 	}()
 
 	// print queue status information
@@ -246,9 +279,9 @@ func (segment *Lumberjack) Run(wg *sync.WaitGroup) {
 
 	// run goroutine for each lumberjack server
 	for server, options := range segment.Servers {
-		writerWG.Add(1)
 		options := options
 		for i := 0; i < options.Parallism; i++ {
+			writerWG.Add(1)
 			go func(server string, numServer int) {
 				defer writerWG.Done()
 				// connect to lumberjack server
@@ -271,13 +304,23 @@ func (segment *Lumberjack) Run(wg *sync.WaitGroup) {
 						// exit on closed channel
 						if !isOpen {
 							// send local buffer
+							if idx == 0 {
+								return
+							}
 							count, err := client.SendNoRetry(flowInterface[:idx])
 							if err != nil {
-								log.Error().Err(err).Msgf("Lumberjack: Failed to send final flow batch upon exit to %s", server)
+								segment.FlushFailed(fmt.Errorf("Lumberjack: Failed to send final flow batch upon exit to %s: %w", server, err))
+								// handed to the dead letter pipeline once
+								// all writers have stopped
+								unsentMutex.Lock()
+								for _, flow := range flowInterface[:idx] {
+									unsent = append(unsent, segments.DeadLetter{Flow: flow.(*pb.EnrichedFlow), Err: err})
+								}
+								unsentMutex.Unlock()
 							} else {
 								segment.BatchDebugPrintf("Lumberjack: %s Sent final batch (%d)", server, count)
+								ackBatch(flowInterface[:idx])
 							}
-							wg.Done()
 							return
 						}
 
@@ -298,6 +341,7 @@ func (segment *Lumberjack) Run(wg *sync.WaitGroup) {
 							}
 
 							client.Send(flowInterface)
+							ackBatch(flowInterface)
 							segment.BatchDebugPrintf("Lumberjack: %s Sent full batch (%d)", server, segment.BatchSize)
 
 							// reset idx
@@ -314,6 +358,7 @@ func (segment *Lumberjack) Run(wg *sync.WaitGroup) {
 						if idx > 0 {
 							segment.BatchDebugPrintf("Lumberjack: %s Sending incomplete batch (%d/%d)", server, idx, segment.BatchSize)
 							client.Send(flowInterface[:idx])
+							ackBatch(flowInterface[:idx])
 							idx = 0
 						} else {
 							segment.BatchDebugPrintf("Lumberjack: %s Timer expired with empty batch", server)
@@ -329,12 +374,19 @@ func (segment *Lumberjack) Run(wg *sync.WaitGroup) {
 
 	// forward flows to lumberjack servers and to the next segment
 	for msg := range segment.In {
-		segment.LumberjackOut <- msg
+		segment.LumberjackOut <- segment.Keep(msg) // until its batch has been sent
 		segment.Out <- msg
 	}
 	close(segment.LumberjackOut)
 }
 
+// Acknowledges the flows of a batch which has been sent, see segments.Ack.
+func ackBatch(batch []interface{}) {
+	for _, flow := range batch {
+		segments.Ack(flow.(*pb.EnrichedFlow))
+	}
+}
+
 // register segment
 func init() {
 	segment := &Lumberjack{}
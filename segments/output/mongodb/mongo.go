@@ -39,7 +39,8 @@ import (
 )
 
 type Mongodb struct {
-	segments.BaseSegment
+	segments.BaseOutputSegment
+	segments.BaseDeadLetterSegment
 	mongodbUri     string
 	dbCollection   *mongo.Collection
 	fieldTypes     []string
@@ -63,6 +64,10 @@ func (segment Mongodb) New(configx map[string]string) segments.Segment {
 		return nil
 	}
 
+	if segments.IsDryRun(configx) {
+		return newsegment
+	}
+
 	ctx := context.Background()
 
 	//Test if db connection works
@@ -96,15 +101,24 @@ func (segment *Mongodb) Run(wg *sync.WaitGroup) {
 	db := client.Database(segment.databaseName)
 	segment.dbCollection = db.Collection(segment.collectionName)
 
-	defer client.Disconnect(ctx)
-	unsavedJson := make(chan []interface{})
+	unsavedJson := make(chan batch)
 	messagesToSave := make(chan *pb.EnrichedFlow)
-	go segment.bulkInsert(ctx, unsavedJson)
+	inserted := make(chan error)
+	go func() {
+		// the last batch is written on shutdown, which is bounded by the
+		// pipeline's flush deadline
+		inserted <- segment.bulkInsert(segment.Context(), unsavedJson)
+	}()
 	go segment.prepareDataForBulkInsert(messagesToSave, unsavedJson)
 	for msg := range segment.In {
-		messagesToSave <- msg
+		messagesToSave <- segment.Keep(msg) // until its batch has been written
 		segment.Out <- msg
 	}
+	close(messagesToSave)
+	if err := <-inserted; err != nil {
+		segment.FlushFailed(fmt.Errorf("MongoDB: Final insert failed: %w", err))
+	}
+	client.Disconnect(segment.Context())
 }
 
 func fillSegmentWithConfig(newsegment *Mongodb, config map[string]string) (*Mongodb, error) {
@@ -188,31 +202,57 @@ func fillSegmentWithConfig(newsegment *Mongodb, config map[string]string) (*Mong
 	return newsegment, nil
 }
 
-func (segment Mongodb) prepareDataForBulkInsert(msgChan chan *pb.EnrichedFlow, unsavedJsonFlows chan []interface{}) {
-	unsavedFlowData := make([]interface{}, segment.BatchSize)
-	nrOfFlows := 0
+// The formatted flows inserted at once, along with the flows themselves.
+type batch struct {
+	flows     []*pb.EnrichedFlow
+	documents []interface{}
+}
+
+// Batches the formatted flows for bulkInsert. Any remaining flows are handed
+// over as a final batch once msgChan is closed.
+func (segment Mongodb) prepareDataForBulkInsert(msgChan chan *pb.EnrichedFlow, unsavedJsonFlows chan batch) {
+	defer close(unsavedJsonFlows)
+	var unsaved batch
 	for msg := range msgChan {
-		flowData := formatFlowToMongoDbJson(msg, segment)
-		unsavedFlowData[nrOfFlows] = flowData
-		nrOfFlows += 1
-		if nrOfFlows >= segment.BatchSize {
-			unsavedJsonFlows <- unsavedFlowData
-			nrOfFlows = 0
+		unsaved.flows = append(unsaved.flows, msg)
+		unsaved.documents = append(unsaved.documents, formatFlowToMongoDbJson(msg, segment))
+		if len(unsaved.documents) >= segment.BatchSize {
+			unsavedJsonFlows <- unsaved
+			unsaved = batch{}
 		}
 	}
-
+	if len(unsaved.documents) > 0 {
+		unsavedJsonFlows <- unsaved
+	}
 }
 
-func (segment Mongodb) bulkInsert(ctx context.Context, unsavedJsonFlows chan []interface{}) {
+// Inserts all batches until unsavedJsonFlows is closed. Returns the error of
+// the last batch, which is the one flushed on shutdown. Flows which could not
+// be inserted are handed to the dead letter pipeline.
+func (segment Mongodb) bulkInsert(ctx context.Context, unsavedJsonFlows chan batch) error {
 	// not using transactions due to limitations of capped collectiction
 	// ("You cannot write to capped collections in transactions."
 	// https://www.mongodb.com/docs/manual/core/capped-collections/)
-	for unsavedFlows := range unsavedJsonFlows {
-		_, err := segment.dbCollection.InsertMany(ctx, unsavedFlows)
+	var err error
+	for unsaved := range unsavedJsonFlows {
+		_, err = segment.dbCollection.InsertMany(ctx, unsaved.documents)
 		if err != nil {
 			log.Error().Err(err).Msg("MongoDB: Failed to insert to mongo db")
+			segment.DeadLetter(err, unsaved.flows[insertedUntil(err):]...)
 		}
+		segments.Ack(unsaved.flows...)
+	}
+	return err
+}
+
+// Returns the number of documents inserted by an ordered InsertMany failing
+// with the provided error, which stops at the first document failing.
+func insertedUntil(err error) int {
+	var bulkWriteException mongo.BulkWriteException
+	if errors.As(err, &bulkWriteException) && len(bulkWriteException.WriteErrors) > 0 {
+		return bulkWriteException.WriteErrors[0].Index
 	}
+	return 0
 }
 
 func formatFlowToMongoDbJson(msg *pb.EnrichedFlow, segment Mongodb) bson.M {
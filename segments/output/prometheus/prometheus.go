@@ -25,7 +25,7 @@ import (
 )
 
 type Prometheus struct {
-	segments.BaseSegment
+	segments.BaseOutputSegment
 	Endpoint          string         // optional, default value is ":8080"
 	MetricsPath       string         // optional, default is "/metrics"
 	FlowdataPath      string         // optional, default is "/flowdata"
@@ -14,9 +14,13 @@
 // this should be an okay value for processing at least 1000 flows per second on
 // most szenarios, i.e. flushing to disk once per second. Mind the expected flow
 // throughput when setting this parameter.
+//
+// Batches which can not be written are not retried, their flows are handed to
+// the `deadletter` pipeline if configured.
 package sqlite
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"math"
@@ -35,7 +39,8 @@ import (
 )
 
 type Sqlite struct {
-	segments.BaseSegment
+	segments.BaseOutputSegment
+	segments.BaseDeadLetterSegment
 	db              *sql.DB
 	fieldTypes      []string
 	fieldNames      []string
@@ -45,6 +50,8 @@ type Sqlite struct {
 	FileName  string // required
 	Fields    string // optional comma-separated list of fields to export, default is "", meaning all fields
 	BatchSize int    // optional how many flows to hold in memory between INSERTs, default is 1000
+
+	bulkInsert func(ctx context.Context, unsavedFlows []*pb.EnrichedFlow) error
 }
 
 // Every Segment must implement a New method, even if there isn't any config
@@ -128,6 +135,7 @@ func (segment Sqlite) New(config map[string]string) segments.Segment {
 	valueStrings := make([]string, 0, len(newsegment.fieldNames))
 	valueStrings = append(valueStrings, fmt.Sprintf("(%s)", strings.Join(qmList, ",")))
 	newsegment.insertStatement = fmt.Sprintf("INSERT INTO flows (%s) VALUES %s", strings.Join(newsegment.fieldNames, ","), strings.Join(valueStrings, ","))
+	newsegment.bulkInsert = newsegment.bulkInsertFlows
 
 	return newsegment
 }
@@ -137,13 +145,52 @@ func (segment *Sqlite) Run(wg *sync.WaitGroup) {
 		close(segment.Out)
 		wg.Done()
 	}()
+	segment.open()
+	defer segment.db.Close()
 
+	var unsaved []*pb.EnrichedFlow
+
+	for msg := range segment.In {
+		unsaved = append(unsaved, segment.Keep(msg)) // until the batch has been written
+		if len(unsaved) >= segment.BatchSize {
+			segment.insert(context.Background(), unsaved)
+			unsaved = []*pb.EnrichedFlow{}
+		}
+		segment.Out <- msg
+	}
+	segment.insertFinal(unsaved)
+}
+
+func (segment *Sqlite) RunBatches(in <-chan []*pb.EnrichedFlow, out chan<- []*pb.EnrichedFlow, wg *sync.WaitGroup) {
+	defer func() {
+		close(out)
+		wg.Done()
+	}()
+	segment.open()
+	defer segment.db.Close()
+
+	var unsaved []*pb.EnrichedFlow
+
+	for batch := range in {
+		for _, msg := range batch {
+			unsaved = append(unsaved, segment.Keep(msg)) // until the batch has been written
+			if len(unsaved) >= segment.BatchSize {
+				segment.insert(context.Background(), unsaved)
+				unsaved = []*pb.EnrichedFlow{}
+			}
+		}
+		out <- batch
+	}
+	segment.insertFinal(unsaved)
+}
+
+// Opens the database and creates the table if necessary.
+func (segment *Sqlite) open() {
 	var err error
 	segment.db, err = sql.Open("sqlite3", segment.FileName)
 	if err != nil {
 		log.Panic().Err(err).Msgf("Sqlite: Failed opening DB \"%s\"", segment.FileName) // this has already been checked in New
 	}
-	defer segment.db.Close()
 
 	tx, err := segment.db.Begin()
 	if err != nil {
@@ -154,31 +201,42 @@ func (segment *Sqlite) Run(wg *sync.WaitGroup) {
 		log.Panic().Err(err).Msgf("Sqlite: Could not create database, check field configuration")
 	}
 	tx.Commit()
+}
 
-	var unsaved []*pb.EnrichedFlow
+// Writes a batch of flows and acknowledges them, handing them to the dead
+// letter pipeline if this failed.
+func (segment *Sqlite) insert(ctx context.Context, unsaved []*pb.EnrichedFlow) error {
+	err := segment.bulkInsert(ctx, unsaved)
+	if err != nil {
+		log.Error().Err(err).Msg("Sqlite: Failed bulk insert")
+		segment.DeadLetter(err, unsaved...)
+	}
+	segments.Ack(unsaved...)
+	return err
+}
 
-	for msg := range segment.In {
-		unsaved = append(unsaved, msg)
-		if len(unsaved) >= segment.BatchSize {
-			err := segment.bulkInsert(unsaved)
-			if err != nil {
-				log.Error().Err(err).Msg("Sqlite: Failed bluk insert")
-			}
-			unsaved = []*pb.EnrichedFlow{}
-		}
-		segment.Out <- msg
+// Writes the last batch on shutdown, which is bounded by the pipeline's flush
+// deadline.
+func (segment *Sqlite) insertFinal(unsaved []*pb.EnrichedFlow) {
+	if err := segment.insert(segment.Context(), unsaved); err != nil {
+		segment.FlushFailed(fmt.Errorf("Sqlite: Final bulk insert of %d flows failed: %w", len(unsaved), err))
 	}
-	segment.bulkInsert(unsaved)
 }
 
-func (segment Sqlite) bulkInsert(unsavedFlows []*pb.EnrichedFlow) error {
+// Inserts a batch of flows in a single transaction. If the transaction fails,
+// the error is returned and none of the flows have been inserted. Otherwise,
+// flows which could not be inserted on their own are handed to the dead
+// letter pipeline.
+func (segment *Sqlite) bulkInsertFlows(ctx context.Context, unsavedFlows []*pb.EnrichedFlow) error {
 	if len(unsavedFlows) == 0 {
 		return nil
 	}
-	tx, err := segment.db.Begin()
+	tx, err := segment.db.BeginTx(ctx, nil)
 	if err != nil {
 		log.Error().Err(err).Msgf("Sqlite: Error starting transaction for current batch of %d flows", len(unsavedFlows))
+		return err
 	}
+	var failed []segments.DeadLetter
 	for _, msg := range unsavedFlows {
 		valueArgs := make([]interface{}, 0, len(segment.fieldNames))
 		values := reflect.ValueOf(msg).Elem()
@@ -197,12 +255,18 @@ func (segment Sqlite) bulkInsert(unsavedFlows []*pb.EnrichedFlow) error {
 				valueArgs = append(valueArgs, fmt.Sprint(protofield))
 			}
 		}
-		_, err := tx.Exec(segment.insertStatement, valueArgs...)
+		_, err := tx.ExecContext(ctx, segment.insertStatement, valueArgs...)
 		if err != nil {
 			log.Error().Err(err).Msgf("Sqlite: Error inserting flow into transaction")
+			failed = append(failed, segments.DeadLetter{Flow: msg, Err: err})
 		}
 	}
-	tx.Commit()
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for _, deadLetter := range failed {
+		segment.DeadLetter(deadLetter.Err, deadLetter.Flow)
+	}
 	return nil
 }
 
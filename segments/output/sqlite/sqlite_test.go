@@ -4,13 +4,16 @@
 package sqlite
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"os"
 	"sync"
 	"testing"
 
 	"github.com/BelWue/flowpipeline/pb"
+	"github.com/BelWue/flowpipeline/segments"
 	"github.com/rs/zerolog"
-	// "github.com/BelWue/flowpipeline/segments"
 )
 
 // Sqlite Segment test, passthrough test only
@@ -36,6 +39,69 @@ func TestSegment_Sqlite_passthrough(t *testing.T) {
 	wg.Wait()
 }
 
+// Sqlite Segment test, flows are acknowledged once their failed batch has been dead lettered
+func TestSegment_Sqlite_deadLetter(t *testing.T) {
+	segment := Sqlite{}.New(map[string]string{"filename": t.TempDir() + "/test.sqlite", "batchsize": "1"}).(*Sqlite)
+	segment.bulkInsert = func(ctx context.Context, unsavedFlows []*pb.EnrichedFlow) error {
+		return errors.New("disk full")
+	}
+	deadLetters := make(chan *segments.DeadLetter)
+	segment.SubscribeDeadLetters(deadLetters)
+
+	in, out := make(chan *pb.EnrichedFlow), make(chan *pb.EnrichedFlow)
+	segment.Rewire(in, out)
+
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go segment.Run(wg)
+
+	acked := make(chan struct{})
+	msg := &pb.EnrichedFlow{Proto: 6}
+	segments.Track(msg, func() { close(acked) })
+	in <- msg
+	deadLetter := <-deadLetters
+	select {
+	case <-acked:
+		t.Error("([error] Segment Sqlite acknowledged a flow before it was dead lettered.")
+	default:
+	}
+	if deadLetter.Flow.Proto != 6 || deadLetter.Err == nil {
+		t.Error("([error] Segment Sqlite did not dead letter the flow of a failed batch.")
+	}
+	segments.Ack(<-out)
+	<-acked
+	close(in)
+	wg.Wait()
+}
+
+// Sqlite Segment test, batches are written and passed through
+func TestSegment_Sqlite_batches(t *testing.T) {
+	filename := t.TempDir() + "/test.sqlite"
+	segment := Sqlite{}.New(map[string]string{"filename": filename, "batchsize": "2"}).(*Sqlite)
+
+	in, out := make(chan []*pb.EnrichedFlow), make(chan []*pb.EnrichedFlow)
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go segment.RunBatches(in, out, wg)
+	in <- []*pb.EnrichedFlow{{Proto: 1}, {Proto: 2}, {Proto: 3}}
+	if batch := <-out; len(batch) != 3 {
+		t.Errorf("([error] Segment Sqlite did not pass through the batch, got %d flows.", len(batch))
+	}
+	close(in)
+	<-out
+	wg.Wait()
+
+	db, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM flows").Scan(&count); err != nil || count != 3 {
+		t.Errorf("([error] Segment Sqlite did not write all flows of the batch, got %d (%v).", count, err)
+	}
+}
+
 // Sqlite Segment benchmark with 1000 samples stored in memory
 func BenchmarkSqlite_1000(b *testing.B) {
 	zerolog.SetGlobalLevel(zerolog.Disabled)
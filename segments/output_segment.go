@@ -0,0 +1,32 @@
+// This package is home to all pipeline segment implementations. Generally,
+// every segment lives in its own package, implements the Segment interface,
+// embeds the BaseSegment to take care of the I/O side of things, and has an
+// additional init() function to register itself using RegisterSegment.
+package segments
+
+// Output segments hand flows to external destinations, such as files,
+// databases or message queues. When running concurrent pipelines in order,
+// trailing output segments are run once behind the concurrent section.
+type OutputSegment interface {
+	Segment
+	IsOutput() bool // marks segments handing flows to external destinations
+}
+
+// An extended basis for Segment implementations in the output group. Apart
+// from marking the segment as an OutputSegment, it is identical to the
+// BaseSegment.
+type BaseOutputSegment struct {
+	BaseSegment
+}
+
+// Output segments are always outputs, this is used to detect the output
+// section of a pipeline.
+func (segment *BaseOutputSegment) IsOutput() bool {
+	return true
+}
+
+// Checks whether a Segment hands flows to external destinations.
+func IsOutputSegment(segment Segment) bool {
+	value, ok := segment.(OutputSegment)
+	return ok && value.IsOutput()
+}
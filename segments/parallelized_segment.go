@@ -14,6 +14,7 @@ import (
 type ParallelizedSegment struct {
 	BaseFilterSegment
 	segments []Segment
+	outs     []chan *pb.EnrichedFlow
 }
 
 func (segment *ParallelizedSegment) New(config map[string]string) Segment {
@@ -27,7 +28,7 @@ func (segment *ParallelizedSegment) Close() {
 	}
 }
 
-func (segment *ParallelizedSegment) SubscribeDrops(drop chan *pb.EnrichedFlow) {
+func (segment *ParallelizedSegment) SubscribeDrops(drop chan<- *pb.EnrichedFlow) {
 	for _, nestedSegment := range segment.segments {
 		filterSegment, ok := nestedSegment.(FilterSegment)
 		if ok {
@@ -37,18 +38,32 @@ func (segment *ParallelizedSegment) SubscribeDrops(drop chan *pb.EnrichedFlow) {
 }
 
 func (segment *ParallelizedSegment) Run(wg *sync.WaitGroup) {
-	defer wg.Done()
+	defer func() {
+		close(segment.Out)
+		wg.Done()
+	}()
 	segmentWg := sync.WaitGroup{}
-	for _, segment := range segment.segments {
-		segmentWg.Add(1)
-		go segment.Run(&segmentWg)
+	for i, nestedSegment := range segment.segments {
+		segmentWg.Add(2)
+		go nestedSegment.Run(&segmentWg)
+		go func(out <-chan *pb.EnrichedFlow) { // merge all outputs, each one is closed by its segment
+			defer segmentWg.Done()
+			for msg := range out {
+				segment.Out <- msg
+			}
+		}(segment.outs[i])
 	}
 	segmentWg.Wait()
 }
 
+// Wires all contained segments to the same input, their outputs are merged
+// into the provided out channel during Run.
 func (segment *ParallelizedSegment) Rewire(in chan *pb.EnrichedFlow, out chan *pb.EnrichedFlow) {
-	for _, segment := range segment.segments {
-		segment.Rewire(in, out)
+	segment.BaseFilterSegment.Rewire(in, out)
+	segment.outs = make([]chan *pb.EnrichedFlow, len(segment.segments))
+	for i, nestedSegment := range segment.segments {
+		segment.outs[i] = make(chan *pb.EnrichedFlow)
+		nestedSegment.Rewire(in, segment.outs[i])
 	}
 }
 
@@ -56,9 +71,35 @@ func (segment *ParallelizedSegment) AddSegment(nestedSegment Segment) {
 	segment.segments = append(segment.segments, nestedSegment)
 }
 
-// ShutdownParentPipeline implements Segment.
-func (segment *ParallelizedSegment) ShutdownParentPipeline() {
-	for _, segment := range segment.segments {
-		segment.ShutdownParentPipeline()
+// Returns the contained segment instances, i.e. the jobs running in parallel.
+func (segment *ParallelizedSegment) Jobs() []Segment {
+	return segment.segments
+}
+
+// Subscribes to the replacements of all contained segments.
+func (segment *ParallelizedSegment) SubscribeReplacements(replaced func(msg *pb.EnrichedFlow, replacements []*pb.EnrichedFlow)) {
+	for _, nestedSegment := range segment.segments {
+		if replacing, ok := nestedSegment.(ReplacingSegment); ok {
+			replacing.SubscribeReplacements(replaced)
+		}
+	}
+}
+
+// Discards all contained segments, see DiscardableSegment.
+func (segment *ParallelizedSegment) Discard() {
+	for _, nestedSegment := range segment.segments {
+		if discardable, ok := nestedSegment.(DiscardableSegment); ok {
+			discardable.Discard()
+		}
+	}
+}
+
+// Sets the ShutdownCoordinator of this wrapper and all contained segments.
+func (segment *ParallelizedSegment) SetShutdownCoordinator(coordinator *ShutdownCoordinator) {
+	segment.BaseFilterSegment.SetShutdownCoordinator(coordinator)
+	for _, nestedSegment := range segment.segments {
+		if coordinated, ok := nestedSegment.(CoordinatedSegment); ok {
+			coordinated.SetShutdownCoordinator(coordinator)
+		}
 	}
 }
@@ -17,6 +17,20 @@ type Pass struct {
 	// add any additional fields here
 }
 
+// Every segment package should provide typed options for use with the builder
+// package, which are converted to the config read by the New method.
+type Options struct {
+	// add any parameters here
+}
+
+func (options Options) SegmentName() string {
+	return "pass"
+}
+
+func (options Options) SegmentConfig() map[string]string {
+	return map[string]string{}
+}
+
 // Every Segment must implement a New method, even if there isn't any config
 // it is interested in.
 func (segment Pass) New(config map[string]string) segments.Segment {
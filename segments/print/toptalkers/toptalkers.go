@@ -15,6 +15,13 @@
 // writing to the same file. The thresholds serve to only log when the largest top
 // talkers are of note: the output is suppressed when either bytes or packets per
 // second are under their thresholds.
+//
+// By default, flows are accounted at the time they arrive at this segment.
+// Setting `time` to `event` accounts them at their end time instead, which
+// yields correct rates for exporters with a delay or for flows replayed from a
+// file. In this case, each report covers the window before the latest flow
+// time seen minus the `lateness` (default 2m), and flows arriving even later
+// are not accounted.
 package toptalkers
 
 import (
@@ -28,27 +35,34 @@ import (
 
 	"github.com/rs/zerolog/log"
 
+	"github.com/BelWue/flowpipeline/pipeline/window"
 	"github.com/BelWue/flowpipeline/segments"
-	"github.com/asecurityteam/rolling"
 	"github.com/dustin/go-humanize"
 )
 
 type Record struct {
 	DstIp   string
-	Bytes   *rolling.TimePolicy
-	Packets *rolling.TimePolicy
+	buckets *window.Ring[traffic]
+}
+
+// The traffic of an address within a second.
+type traffic struct {
+	bytes   uint64
+	packets uint64
 }
 
 type TopTalkers struct {
 	segments.BaseTextOutputSegment
 	writer *bufio.Writer
 
-	Window         int    // optional, default is 60, sets the number of seconds used as a sliding window size
-	ReportInterval int    // optional, default is 10, sets the number of seconds between report printing
-	LogPrefix      string // optional, default is "", a prefix for each log line, useful in case multiple segments log to the same file
-	ThresholdBps   uint64 // optional, default is 0, only log talkers with an average bits per second rate higher than this value
-	ThresholdPps   uint64 // optional, default is 0, only log talkers with an average packets per second rate higher than this value
-	TopN           uint64 // optional, default is 10, sets the number of top talkers per report
+	Window         int           // optional, default is 60, sets the number of seconds used as a sliding window size
+	ReportInterval int           // optional, default is 10, sets the number of seconds between report printing
+	LogPrefix      string        // optional, default is "", a prefix for each log line, useful in case multiple segments log to the same file
+	ThresholdBps   uint64        // optional, default is 0, only log talkers with an average bits per second rate higher than this value
+	ThresholdPps   uint64        // optional, default is 0, only log talkers with an average packets per second rate higher than this value
+	TopN           uint64        // optional, default is 10, sets the number of top talkers per report
+	Time           window.Mode   // optional, default is processing time, whether flows are accounted at their arrival or at their own timestamps
+	Lateness       time.Duration // optional, default is 2m, the time flows are waited for in event time
 }
 
 func (segment TopTalkers) New(config map[string]string) segments.Segment {
@@ -57,6 +71,7 @@ func (segment TopTalkers) New(config map[string]string) segments.Segment {
 		ReportInterval: 10,
 		LogPrefix:      config["logprefix"],
 		TopN:           10,
+		Lateness:       2 * time.Minute,
 	}
 
 	if config["window"] != "" {
@@ -137,6 +152,30 @@ func (segment TopTalkers) New(config map[string]string) segments.Segment {
 		log.Info().Msg("TopTalkers: 'topn' set to default 10.")
 	}
 
+	mode, err := window.ParseMode(config["time"])
+	if err != nil {
+		log.Error().Err(err).Msg("TopTalkers: Could not parse 'time' parameter")
+		return nil
+	}
+	newsegment.Time = mode
+	if config["time"] == "" {
+		log.Info().Msg("TopTalkers: 'time' set to default 'processing'.")
+	}
+
+	if config["lateness"] != "" {
+		if parsedLateness, err := time.ParseDuration(config["lateness"]); err == nil {
+			if parsedLateness < 0 {
+				log.Error().Msg("TopTalkers: Lateness has to be >=0.")
+				return nil
+			}
+			newsegment.Lateness = parsedLateness
+		} else {
+			log.Error().Msg("TopTalkers: Could not parse 'lateness' parameter, using default 2m.")
+		}
+	} else if mode == window.EventTime {
+		log.Info().Msg("TopTalkers: 'lateness' set to default 2m.")
+	}
+
 	return newsegment
 }
 
@@ -147,38 +186,49 @@ func (segment *TopTalkers) Run(wg *sync.WaitGroup) {
 		wg.Done()
 	}()
 	database := map[string]*Record{}
+	clock := window.NewClock(segment.Time, time.Second, segment.Lateness)
 
 	ticker := time.NewTicker(time.Duration(segment.ReportInterval) * time.Second)
 
 	for {
 		select {
 		case <-ticker.C:
-			databaseEntries := []*Record{}
-			for _, entry := range database {
-				databaseEntries = append(databaseEntries, entry)
+			completed := clock.Completed()
+			type entry struct {
+				dstIp   string
+				bytes   uint64
+				packets uint64
 			}
-			sort.Slice(databaseEntries, func(i, j int) bool {
-				iBytes := databaseEntries[i].Bytes.Reduce(rolling.Sum)
-				if iBytes == 0 {
-					delete(database, databaseEntries[i].DstIp)
+			databaseEntries := []entry{}
+			for dstIp, record := range database {
+				var sum, pending traffic
+				for bucket := range record.buckets.Range(completed-int64(segment.Window), completed) {
+					sum.bytes += bucket.bytes
+					sum.packets += bucket.packets
+				}
+				for bucket := range record.buckets.Range(completed, clock.Current()+1) {
+					pending.bytes += bucket.bytes
 				}
-				jBytes := databaseEntries[j].Bytes.Reduce(rolling.Sum)
-				if jBytes == 0 {
-					delete(database, databaseEntries[j].DstIp)
+				if sum.bytes == 0 && pending.bytes == 0 {
+					delete(database, dstIp)
+					continue
 				}
-				return iBytes > jBytes
+				databaseEntries = append(databaseEntries, entry{dstIp, sum.bytes, sum.packets})
+			}
+			sort.Slice(databaseEntries, func(i, j int) bool {
+				return databaseEntries[i].bytes > databaseEntries[j].bytes
 			})
 			var printedRecords uint64 = 0
 			fmt.Fprintln(segment.writer, segment.LogPrefix+"===================================================================")
 			for _, record := range databaseEntries {
-				bps := record.Bytes.Reduce(rolling.Sum) * 8 / float64(segment.Window)
-				pps := record.Packets.Reduce(rolling.Sum) * 8 / float64(segment.Window)
+				bps := float64(record.bytes) * 8 / float64(segment.Window)
+				pps := float64(record.packets) / float64(segment.Window)
 				if bps < float64(segment.ThresholdBps) || pps < float64(segment.ThresholdPps) {
 					break
 				}
 				fmt.Fprintf(segment.writer, "%s%s: %s, %s\n",
 					segment.LogPrefix,
-					record.DstIp,
+					record.dstIp,
 					humanize.SI(bps, "bps"),
 					humanize.SI(pps, "pps"),
 				)
@@ -192,17 +242,19 @@ func (segment *TopTalkers) Run(wg *sync.WaitGroup) {
 			if !ok {
 				return
 			}
-			record := database[msg.DstAddrObj().String()]
-			if record == nil {
-				record = &Record{
-					DstIp:   msg.DstAddrObj().String(),
-					Bytes:   rolling.NewTimePolicy(rolling.NewWindow(segment.Window), time.Second),
-					Packets: rolling.NewTimePolicy(rolling.NewWindow(segment.Window), time.Second),
+			if bucket, open := clock.Bucket(msg); open {
+				record := database[msg.DstAddrObj().String()]
+				if record == nil {
+					record = &Record{
+						DstIp:   msg.DstAddrObj().String(),
+						buckets: window.NewRing[traffic](segment.Window + clock.Open()),
+					}
+					database[msg.DstAddrObj().String()] = record
 				}
+				counters := record.buckets.At(bucket)
+				counters.bytes += msg.Bytes
+				counters.packets += msg.Packets
 			}
-			record.Bytes.Append(float64(msg.Bytes))
-			record.Packets.Append(float64(msg.Packets))
-			database[msg.DstAddrObj().String()] = record
 
 			segment.Out <- msg
 		}
@@ -5,9 +5,11 @@
 package segments
 
 import (
+	"context"
+	"fmt"
+	"reflect"
 	"strings"
 	"sync"
-	"syscall"
 
 	"github.com/BelWue/flowpipeline/pb"
 	"github.com/BelWue/flowpipeline/pipeline/config"
@@ -20,6 +22,13 @@ var (
 	ContainerVolumePrefix = ""
 )
 
+// Reports whether a segment is built only to check a configuration, given the
+// config passed to its New method, see config.SegmentRepr.DryRun. Segments
+// must not create files or connect to remote services in New if it is.
+func IsDryRun(segmentConfig map[string]string) bool {
+	return segmentConfig[config.DryRunParameter] == "true"
+}
+
 // Used by Segments to register themselves in their init() functions. Errors
 // and exits immediately on conflicts.
 func RegisterSegment(name string, s Segment) {
@@ -35,22 +44,57 @@ func RegisterSegment(name string, s Segment) {
 
 // Used by the pipeline package to convert segment names in configuration to
 // actual Segment objects.
-func LookupSegment(name string) Segment {
+func LookupSegment(name string) (Segment, error) {
 	name = strings.ToLower(name)
 	lock.RLock()
 	segment, ok := registeredSegments[name]
 	lock.RUnlock()
 	if !ok {
-		log.Fatal().Msgf("Segments: Could not find a segment named '%s'.", name)
+		return nil, fmt.Errorf("could not find a segment named '%s'", name)
+	}
+	return segment, nil
+}
+
+// Returns the name a Segment's type has been registered with. Segments which
+// have not been registered are identified by their type name.
+func SegmentName(segment Segment) string {
+	segmentType := reflect.TypeOf(segment)
+	lock.RLock()
+	defer lock.RUnlock()
+	for name, registered := range registeredSegments {
+		if reflect.TypeOf(registered) == segmentType {
+			return name
+		}
+	}
+	if segmentType.Kind() == reflect.Pointer {
+		segmentType = segmentType.Elem()
+	}
+	return strings.ToLower(segmentType.Name())
+}
+
+// Instantiates a new Segment from a registered one using the provided config.
+// Segments implementing ErrorReportingSegment are asked for their error
+// directly, for all others a generic error is returned if New returns nil.
+func NewSegment(template Segment, config map[string]string) (Segment, error) {
+	if value, ok := template.(ErrorReportingSegment); ok {
+		return value.NewWithError(config)
+	}
+	segment := template.New(config)
+	if segment == nil {
+		return nil, fmt.Errorf("segment could not be initialized properly, see previous messages")
 	}
-	return segment
+	return segment, nil
 }
 
 // Used by the tests to run single flow messages through a segment.
 func TestSegment(name string, config map[string]string, msg *pb.EnrichedFlow) *pb.EnrichedFlow {
-	segment := LookupSegment(name).New(config)
-	if segment == nil {
-		log.Fatal().Msgf("Configured segment '%s' could not be initialized properly, see previous messages.", name)
+	template, err := LookupSegment(name)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Segments: ")
+	}
+	segment, err := NewSegment(template, config)
+	if err != nil {
+		log.Fatal().Err(err).Msgf("Configured segment '%s' could not be initialized properly: ", name)
 	}
 
 	in, out := make(chan *pb.EnrichedFlow), make(chan *pb.EnrichedFlow)
@@ -75,17 +119,57 @@ type Segment interface {
 	New(config map[string]string) Segment                       // for reading the provided config
 	Run(wg *sync.WaitGroup)                                     // goroutine, must close(segment.Out) when segment.In is closed
 	Rewire(in chan *pb.EnrichedFlow, out chan *pb.EnrichedFlow) // embed this using BaseSegment
-	ShutdownParentPipeline()                                    // shut down Parent Pipeline gracefully
-	AddCustomConfig(segmentReprs config.SegmentRepr)            //Add segment specific sturctured config parameters
+	ShutdownParentPipeline()                                    // request the parent pipeline to shut down gracefully
+	AddCustomConfig(segmentReprs config.SegmentRepr) error      //Add segment specific sturctured config parameters
 	Close()
 }
 
+// Segments can implement this interface in addition to Segment to report
+// configuration errors to the caller instead of logging them and returning nil
+// from New, or exiting altogether. Their New method should simply wrap
+// NewWithError.
+type ErrorReportingSegment interface {
+	Segment
+	NewWithError(config map[string]string) (Segment, error) // for reading the provided config, returns any problems found
+}
+
+// Segments implementing this interface report the flows they replace by new
+// messages, such as dropfields keeping only some fields. This is implemented by
+// the BaseSegment, and segments replacing flows use its Replace method. The
+// pipeline package uses this to keep track of flows across replacements, e.g.
+// to restore their order after parallel jobs.
+type ReplacingSegment interface {
+	Segment
+	SubscribeReplacements(replaced func(msg *pb.EnrichedFlow, replacements []*pb.EnrichedFlow))
+}
+
+// Segments holding on to something from their construction on, rather than
+// only while running, can implement this interface to let go of it if they
+// are never run, e.g. because another segment of their pipeline could not be
+// built. Segments embedding further pipelines pass the call on to these.
+type DiscardableSegment interface {
+	Segment
+	Discard()
+}
+
+// Typed options of a segment, used to configure segments from Go code, see
+// the builder package. Segment packages provide them as a struct named
+// Options. They are converted to the parameters a segment reads from its
+// configuration file, so that both ways of configuring a segment share the
+// same validation in New or NewWithError.
+type Options interface {
+	SegmentName() string              // the name the segment is registered with
+	SegmentConfig() map[string]string // the parameters as found in the `config` key of a configuration file
+}
+
 // Serves as a basis for any Segment implementations. Segments embedding this
 // type only need the New and the Run methods to be compliant to the Segment
 // interface.
 type BaseSegment struct {
-	In  <-chan *pb.EnrichedFlow
-	Out chan<- *pb.EnrichedFlow
+	In          <-chan *pb.EnrichedFlow
+	Out         chan<- *pb.EnrichedFlow
+	coordinator *ShutdownCoordinator
+	replaced    []func(msg *pb.EnrichedFlow, replacements []*pb.EnrichedFlow)
 }
 
 // This function rewires this Segment with the provided channels. This is
@@ -99,16 +183,65 @@ func (segment *BaseSegment) Rewire(in chan *pb.EnrichedFlow, out chan *pb.Enrich
 	segment.Out = out
 }
 
-// This functions shutdown Parent Pipeline segments on the given syscall.
-// It is used for intended termination within pipeline function, e.g. end pipeline on read from file.
+// Sets the ShutdownCoordinator of the pipeline this segment is running in.
+// This is typically called only by the pipeline package.
+func (segment *BaseSegment) SetShutdownCoordinator(coordinator *ShutdownCoordinator) {
+	segment.coordinator = coordinator
+}
+
+// Requests the pipeline this segment is running in to shut down gracefully.
+// It is used for intended termination within a pipeline, e.g. ending the
+// pipeline after reading a file. Other pipelines in the same process keep
+// running. Segments not running in a pipeline can not request a shutdown.
 func (segment *BaseSegment) ShutdownParentPipeline() {
-	syscall.Kill(syscall.Getpid(), syscall.SIGINT)
+	if segment.coordinator == nil {
+		log.Warn().Msg("Segments: Shutdown requested by a segment not running in a pipeline, ignoring.")
+		return
+	}
+	segment.coordinator.RequestShutdown()
+}
+
+// Returns a context which is canceled once the deadline for shutting down
+// the parent pipeline has passed, see ShutdownCoordinator.Context. Segments
+// not running in a pipeline get a context which is never canceled.
+func (segment *BaseSegment) Context() context.Context {
+	if segment.coordinator == nil {
+		return context.Background()
+	}
+	return segment.coordinator.Context()
+}
+
+// Reports an error which prevented flows from being flushed on shutdown, and
+// thus makes the shutdown of the parent pipeline fail.
+func (segment *BaseSegment) FlushFailed(err error) {
+	log.Error().Err(err).Msg("Segments: Failed to flush flows: ")
+	if segment.coordinator != nil {
+		segment.coordinator.ReportFlushError(err)
+	}
+}
+
+// Adds a function to be called for every flow this segment replaces, see
+// Replace. This is typically called only by the pipeline package.
+func (segment *BaseSegment) SubscribeReplacements(replaced func(msg *pb.EnrichedFlow, replacements []*pb.EnrichedFlow)) {
+	segment.replaced = append(segment.replaced, replaced)
+}
+
+// Reports that a flow is replaced by new messages, which must happen before
+// any of them is handed on. The replacements take over the acknowledgement
+// of the flow and its place in the pipeline's order. They may include the
+// flow itself, e.g. if it is reused as one of multiple slices.
+func (segment *BaseSegment) Replace(msg *pb.EnrichedFlow, replacements ...*pb.EnrichedFlow) {
+	Replace(msg, replacements...)
+	for _, replaced := range segment.replaced {
+		replaced(msg, replacements)
+	}
 }
 
 func (segment *BaseSegment) Close() {
 	//placeholder since most segments dont need to do anything
 }
 
-func (segment *BaseSegment) AddCustomConfig(config.SegmentRepr) {
+func (segment *BaseSegment) AddCustomConfig(config.SegmentRepr) error {
 	//placeholder since most segments dont have a custom sturctured config
+	return nil
 }
@@ -0,0 +1,80 @@
+// This package is home to all pipeline segment implementations. Generally,
+// every segment lives in its own package, implements the Segment interface,
+// embeds the BaseSegment to take care of the I/O side of things, and has an
+// additional init() function to register itself using RegisterSegment.
+package segments
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// The cause of a ShutdownCoordinator's context being canceled because its
+// pipeline took too long to shut down.
+var ErrFlushDeadline = errors.New("flush deadline exceeded")
+
+// Segments can implement this interface to take part in the shutdown of the
+// pipeline they are running in. Any segment embedding BaseSegment does.
+// Segments embedding further pipelines pass the coordinator on to these, so
+// that a whole tree of pipelines is shut down together.
+type CoordinatedSegment interface {
+	SetShutdownCoordinator(coordinator *ShutdownCoordinator)
+}
+
+// Coordinates the shutdown of a single pipeline, which is shared by all of
+// its segments. Segments can request their pipeline to be closed, use its
+// context to bound the time spent flushing buffered flows, and report flows
+// they failed to flush.
+type ShutdownCoordinator struct {
+	ctx     context.Context
+	cancel  context.CancelCauseFunc
+	request func()
+	once    sync.Once
+	mutex   sync.Mutex
+	errs    []error
+}
+
+// Creates a ShutdownCoordinator which calls request once the first shutdown
+// is requested. The request is handled asynchronously, so that segments may
+// block until their pipeline closes their input.
+func NewShutdownCoordinator(request func()) *ShutdownCoordinator {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	return &ShutdownCoordinator{ctx: ctx, cancel: cancel, request: request}
+}
+
+// Returns a context which is canceled once the deadline for shutting down
+// the pipeline has passed. Segments should use it for all operations flushing
+// flows on shutdown, such as writing their last batch to a database.
+func (coordinator *ShutdownCoordinator) Context() context.Context {
+	return coordinator.ctx
+}
+
+// Requests the pipeline to be closed gracefully. Further requests are
+// ignored.
+func (coordinator *ShutdownCoordinator) RequestShutdown() {
+	coordinator.once.Do(func() {
+		go coordinator.request()
+	})
+}
+
+// Cancels the context of this coordinator, signaling to all segments that
+// they should give up flushing.
+func (coordinator *ShutdownCoordinator) Expire() {
+	coordinator.cancel(ErrFlushDeadline)
+}
+
+// Records an error which prevented flows from being flushed.
+func (coordinator *ShutdownCoordinator) ReportFlushError(err error) {
+	coordinator.mutex.Lock()
+	defer coordinator.mutex.Unlock()
+	coordinator.errs = append(coordinator.errs, err)
+}
+
+// Returns all errors reported using ReportFlushError, as well as
+// ErrFlushDeadline if the deadline has passed.
+func (coordinator *ShutdownCoordinator) Err() error {
+	coordinator.mutex.Lock()
+	defer coordinator.mutex.Unlock()
+	return errors.Join(append(coordinator.errs, context.Cause(coordinator.ctx))...)
+}
@@ -6,6 +6,7 @@ package segments
 
 import (
 	"os"
+	"path/filepath"
 )
 
 type TextOutputSegment interface {
@@ -16,13 +17,19 @@ type TextOutputSegment interface {
 // An extended basis for Segment implementations in the filter group. It
 // contains the necessities to process filtered (dropped) flows.
 type BaseTextOutputSegment struct {
-	BaseSegment
+	BaseOutputSegment
 	File *os.File // optional, default is empty which means stdout
 }
 
 func (s *BaseTextOutputSegment) GetOutput(config map[string]string) (*os.File, error) {
 	var err error
-	if config["filename"] != "" {
+	if config["filename"] != "" && IsDryRun(config) {
+		// do not truncate existing files when checking the configuration
+		if _, err = os.Stat(filepath.Dir(config["filename"])); err != nil {
+			return nil, err
+		}
+		s.File = os.Stdout
+	} else if config["filename"] != "" {
 		s.File, err = os.Create(config["filename"])
 		if err != nil {
 			return nil, err